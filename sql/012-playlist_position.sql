@@ -0,0 +1,10 @@
+ALTER TABLE playlist
+ADD COLUMN position DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+UPDATE playlist SET position = numbered.row_number * 1024
+FROM (
+    SELECT id, ROW_NUMBER() OVER (ORDER BY added_at, id) AS row_number FROM playlist
+) numbered
+WHERE playlist.id = numbered.id;
+
+CREATE INDEX playlist_position_index ON playlist (position);
@@ -0,0 +1,8 @@
+CREATE TABLE schedules (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT    NOT NULL,
+    start_at   BIGINT    NOT NULL,
+    created_at BIGINT    NOT NULL,
+    entry      TEXT      NOT NULL,
+    playlist   TEXT      NOT NULL
+);
@@ -0,0 +1,9 @@
+CREATE TABLE uploads (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT    NOT NULL,
+    path       TEXT      NOT NULL,
+    size       BIGINT    NOT NULL,
+    created_at BIGINT    NOT NULL
+);
+
+CREATE INDEX uploads_user_id_index ON uploads (user_id);
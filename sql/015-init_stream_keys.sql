@@ -0,0 +1,5 @@
+CREATE TABLE stream_keys (
+    user_id    BIGINT       PRIMARY KEY,
+    stream_key VARCHAR(255) NOT NULL UNIQUE,
+    created_at BIGINT       NOT NULL
+);
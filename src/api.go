@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"path"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -92,60 +94,269 @@ func (server *Server) apiLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) apiUploadMedia(w http.ResponseWriter, r *http.Request, userId uint64) {
+	budget := server.uploadBudget(userId)
+	if budget == 0 {
+		respondTooLarge(w, "Upload quota of user id:%v or the media storage quota is exhausted", userId)
+		return
+	}
+
+	// The whole form is received before the category of the file is known, so it's bounded by the largest limit first.
+	bodyLimit := server.uploadBodyLimit(budget)
+	if bodyLimit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, bodyLimit+UPLOAD_FORM_OVERHEAD)
+	}
+
 	inputFile, headers, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondTooLarge(w, "Uploaded file exceeds the limit of %vMB", formatMegabytes(bodyLimit, 2))
+		return
+	}
 	if err != nil {
 		respondBadRequest(w, "Failed to read formdata from the request: %v", err)
 		return
 	}
+	defer inputFile.Close()
 
 	filename := SanitizeUrlFileName(headers.Filename)
-	// TODO(kihau): Actually check file format by doing http.DetectContentType().
 	extension := path.Ext(filename)
 	directory := getMediaType(extension)
 
-	outputPath, isSafe := safeJoin(CONTENT_MEDIA, directory, filename)
-	if !isSafe {
-		respondBadRequest(w, "Filename of the uploaded file is not allowed")
+	limit := server.uploadCategoryLimit(directory)
+	if budget > 0 && (limit == 0 || budget < limit) {
+		limit = budget
+	}
+
+	if limit > 0 && headers.Size > limit {
+		respondTooLarge(w, "Uploaded file %v of size %vMB exceeds the limit of %vMB", filename, formatMegabytes(headers.Size, 2), formatMegabytes(limit, 2))
 		return
 	}
+
+	head := make([]byte, SNIFF_LENGTH)
+	headLength, err := io.ReadFull(inputFile, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		respondBadRequest(w, "Failed to read the uploaded file: %v", err)
+		return
+	}
+	head = head[:headLength]
+
+	if err := validateUploadContent(head, directory); err != nil {
+		respondBadRequest(w, "%v", err)
+		return
+	}
+
 	os.MkdirAll(CONTENT_MEDIA+directory, os.ModePerm)
 
-	outputFile, err := os.Create(outputPath)
+	outputFile, filename, err := createUniqueFile(CONTENT_MEDIA+directory, filename)
 	if err != nil {
-		respondInternalError(w, "Server side file creation for file %v failed with: %v", outputPath, err)
+		respondInternalError(w, "Server side file creation for file %v failed with: %v", headers.Filename, err)
 		return
 	}
 	defer outputFile.Close()
 
+	outputPath := outputFile.Name()
 	LogInfo("Saving uploaded media file to: %v.", outputPath)
 
-	_, err = io.Copy(outputFile, inputFile)
+	input := io.MultiReader(bytes.NewReader(head), inputFile)
+	written, err := copyWithLimit(outputFile, input, Conditional(limit > 0, limit, -1))
 	if err != nil {
-		respondInternalError(w, "Server side file copy for file %v failed with: %v", outputPath, err)
+		outputFile.Close()
+		os.Remove(outputPath)
+
+		if errors.Is(err, errUploadTooLarge) {
+			respondTooLarge(w, "Uploaded file %v exceeds the limit of %vMB", filename, formatMegabytes(limit, 2))
+		} else {
+			respondInternalError(w, "Server side file copy for file %v failed with: %v", outputPath, err)
+		}
+		return
+	}
+
+	server.recordUpload(userId, outputPath, written)
+
+	response := server.createUploadResponse(outputPath, filename, directory)
+	jsonData, _ := json.Marshal(response)
+	w.Write(jsonData)
+}
+
+func (server *Server) apiUploadInit(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data UploadInitRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
 		return
 	}
 
-	networkPath, isSafe := safeJoin(CONTENT_MEDIA, directory, filename)
-	if !isSafe {
-		respondBadRequest(w, "Filename of the uploaded file is not allowed")
+	upload, err := server.uploadInit(data, userId)
+	if errors.Is(err, errUploadTooLarge) {
+		respondTooLarge(w, "%v", err)
 		return
 	}
 
-	trimmed := strings.TrimSuffix(filename, extension)
-	name := cleanupResourceName(trimmed)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
+		return
+	}
 
-	response := MediaUploadResponse{
-		Url:      networkPath,
-		Name:     name,
-		Filename: filename,
-		Format:   extension,
-		Category: directory,
+	response := UploadStatusResponse{
+		UploadId:     upload.id,
+		Offset:       0,
+		Size:         upload.size,
+		MaxChunkSize: MAX_CHUNK_SIZE,
 	}
 
 	jsonData, _ := json.Marshal(response)
 	w.Write(jsonData)
 }
 
+func (server *Server) apiUploadChunk(w http.ResponseWriter, r *http.Request, userId uint64) {
+	upload := server.findResumableUpload(w, r.PathValue("id"), userId)
+	if upload == nil {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondBadRequest(w, "Missing or invalid Upload-Offset header: %v", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_CHUNK_SIZE)
+
+	newOffset, err := upload.writeChunk(r.Body, offset)
+	if errors.Is(err, errUploadOffsetMismatch) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		LogWarn("Upload %v chunk offset %v does not match the current offset %v", upload.id, offset, newOffset)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		respondBadRequest(w, "Failed to write chunk of upload %v: %v", upload.id, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	response := upload.status()
+	jsonData, _ := json.Marshal(response)
+	w.Write(jsonData)
+}
+
+func (server *Server) apiUploadOffset(w http.ResponseWriter, r *http.Request, userId uint64) {
+	upload := server.findResumableUpload(w, r.PathValue("id"), userId)
+	if upload == nil {
+		return
+	}
+
+	response := upload.status()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(response.Offset, 10))
+	jsonData, _ := json.Marshal(response)
+	w.Write(jsonData)
+}
+
+func (server *Server) apiUploadFinalize(w http.ResponseWriter, r *http.Request, userId uint64) {
+	upload := server.findResumableUpload(w, r.PathValue("id"), userId)
+	if upload == nil {
+		return
+	}
+
+	response, err := server.uploadFinalize(upload)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
+		return
+	}
+
+	jsonData, _ := json.Marshal(response)
+	w.Write(jsonData)
+}
+
+func (server *Server) apiUploadAbort(w http.ResponseWriter, r *http.Request, userId uint64) {
+	upload := server.findResumableUpload(w, r.PathValue("id"), userId)
+	if upload == nil {
+		return
+	}
+
+	server.removeResumableUpload(upload)
+	LogInfo("Upload %v was aborted by user id:%v.", upload.id, userId)
+}
+
+func (server *Server) apiMediaList(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data LibraryListRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	response := server.mediaList(data, userId)
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		respondInternalError(w, "Serialization of the media list failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiMediaDelete(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data MediaDeleteRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	if err := server.mediaDelete(data, userId); err != nil {
+		respondBadRequest(w, "%v", err)
+	}
+}
+
+func (server *Server) apiMediaRename(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data MediaRenameRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	newPath, err := server.mediaRename(data, userId)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
+		return
+	}
+
+	jsonData, _ := json.Marshal(newPath)
+	w.Write(jsonData)
+}
+
+func (server *Server) apiLibraryList(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data LibraryListRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	response := server.library.list(data)
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		respondInternalError(w, "Serialization of the library list failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiLibrarySearch(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data LibrarySearchRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	response := server.library.search(data)
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		respondInternalError(w, "Serialization of the library search failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiLibraryRescan(w http.ResponseWriter, r *http.Request, userId uint64) {
+	LogInfo("User id:%v requested a library rescan.", userId)
+	go server.libraryRescan()
+}
+
 func (server *Server) apiInviteCreate(w http.ResponseWriter, r *http.Request, userId uint64) {
 	invite := server.createNewInvite(userId)
 	jsonData, _ := json.Marshal(invite)
@@ -362,46 +573,24 @@ func (server *Server) apiUserUpdateAvatar(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var fileContents [512]byte
-	n, err := formfile.Read(fileContents[:])
-	if err != nil && err != io.EOF {
-		respondInternalError(w, "Error reading from disk")
+	data, err := io.ReadAll(formfile)
+	if err != nil {
+		respondBadRequest(w, "Failed to read the user avatar: %v", err)
 		return
 	}
 
-	contentType := http.DetectContentType(fileContents[:n])
-	var ext string
-	switch contentType {
-	case "image/png":
-		ext = "png"
-	case "image/jpeg":
-		ext = "jpg"
-	case "image/gif":
-		ext = "gif"
-	case "image/webp":
-		ext = "webp"
-	default:
-		respondBadRequest(w, "Invalid image type, detected: %v", contentType)
+	encoded, err := processAvatar(data)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
 		return
 	}
 
-	os.MkdirAll(CONTENT_USERS, os.ModePerm)
-	avatarUrl := fmt.Sprintf(CONTENT_USERS+"avatar%v", user.Id)
-
-	os.Remove(avatarUrl)
-	file, err := os.Create(avatarUrl)
+	// Avatar files are versioned with a Unix timestamp because of HTML DOM URL caching.
+	avatarUrl, err := saveAvatar(user.Id, time.Now().UnixMilli(), encoded)
 	if err != nil {
-		respondInternalError(w, "File creation for the user avatar file failed with: %v", err)
+		respondInternalError(w, "Saving the user avatar failed with: %v", err)
 		return
 	}
-	defer file.Close()
-
-	file.Write(fileContents[:n])
-	io.Copy(file, formfile)
-
-	// Unix timestamp is added because of HTML DOM URL caching.
-	now := time.Now()
-	avatarUrl = fmt.Sprintf(CONTENT_USERS+"avatar%v?ext=%v&%v", user.Id, ext, now.UnixMilli())
 
 	server.users.mutex.Lock()
 	server.users.slice[userIndex].Avatar = avatarUrl
@@ -493,6 +682,22 @@ func (server *Server) apiPlayerLooping(w http.ResponseWriter, r *http.Request, u
 	server.playerLooping(looping, userId)
 }
 
+func (server *Server) apiPlayerRecord(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var record bool
+	if !server.readJsonDataFromRequest(w, r, &record) {
+		return
+	}
+
+	if !record {
+		server.stopLiveRecording(userId)
+		return
+	}
+
+	if err := server.startLiveRecording(userId); err != nil {
+		respondBadRequest(w, "%v", err)
+	}
+}
+
 func (server *Server) apiPlayerUpdateTitle(w http.ResponseWriter, r *http.Request, userId uint64) {
 	var title string
 	if !server.readJsonDataFromRequest(w, r, &title) {
@@ -782,7 +987,7 @@ func (server *Server) apiPlaylistAdd(w http.ResponseWriter, r *http.Request, use
 }
 
 func (server *Server) apiPlaylistClear(w http.ResponseWriter, r *http.Request, userId uint64) {
-	server.playlistClear()
+	server.playlistClear(userId)
 }
 
 func (server *Server) apiPlaylistDelete(w http.ResponseWriter, r *http.Request, userId uint64) {
@@ -797,7 +1002,7 @@ func (server *Server) apiPlaylistDelete(w http.ResponseWriter, r *http.Request,
 }
 
 func (server *Server) apiPlaylistShuffle(w http.ResponseWriter, r *http.Request, userId uint64) {
-	server.playlistShuffle()
+	server.playlistShuffle(userId)
 }
 
 func (server *Server) apiPlaylistMove(w http.ResponseWriter, r *http.Request, userId uint64) {
@@ -811,6 +1016,12 @@ func (server *Server) apiPlaylistMove(w http.ResponseWriter, r *http.Request, us
 	}
 }
 
+func (server *Server) apiPlaylistUndo(w http.ResponseWriter, r *http.Request, userId uint64) {
+	if err := server.playlistUndo(userId); err != nil {
+		respondBadRequest(w, "%v", err)
+	}
+}
+
 func (server *Server) apiPlaylistUpdate(w http.ResponseWriter, r *http.Request, userId uint64) {
 	var entry Entry
 	if !server.readJsonDataFromRequest(w, r, &entry) {
@@ -822,6 +1033,51 @@ func (server *Server) apiPlaylistUpdate(w http.ResponseWriter, r *http.Request,
 	}
 }
 
+func (server *Server) apiScheduleList(w http.ResponseWriter, r *http.Request, userId uint64) {
+	server.state.mutex.Lock()
+	jsonData, err := json.Marshal(server.state.schedules)
+	server.state.mutex.Unlock()
+
+	if err != nil {
+		respondInternalError(w, "Serialization of the schedule list failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiScheduleAdd(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var data ScheduleAddRequest
+	if !server.readJsonDataFromRequest(w, r, &data) {
+		return
+	}
+
+	schedule, err := server.scheduleAdd(data, userId)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
+		return
+	}
+
+	jsonData, err := json.Marshal(schedule)
+	if err != nil {
+		respondInternalError(w, "Serialization of the schedule failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiScheduleCancel(w http.ResponseWriter, r *http.Request, userId uint64) {
+	var scheduleId uint64
+	if !server.readJsonDataFromRequest(w, r, &scheduleId) {
+		return
+	}
+
+	if err := server.scheduleCancel(scheduleId, userId); err != nil {
+		respondBadRequest(w, "%v", err)
+	}
+}
+
 func (server *Server) apiHistoryGet(w http.ResponseWriter, r *http.Request, userId uint64) {
 	server.state.mutex.Lock()
 	jsonData, err := json.Marshal(server.state.history)
@@ -878,13 +1134,7 @@ func (server *Server) apiChatDelete(w http.ResponseWriter, r *http.Request, user
 }
 
 func (server *Server) apiHistoryClear(w http.ResponseWriter, r *http.Request, userId uint64) {
-	server.state.mutex.Lock()
-	server.state.history = server.state.history[:0]
-	server.state.mutex.Unlock()
-
-	DatabaseHistoryClear(server.db)
-
-	server.writeEventToAllConnections("historyclear", nil, userId)
+	server.historyClear(userId)
 }
 
 func (server *Server) apiHistoryPlay(w http.ResponseWriter, r *http.Request, userId uint64) {
@@ -961,48 +1211,25 @@ func (server *Server) apiChatEdit(w http.ResponseWriter, r *http.Request, userId
 func (server *Server) apiStreamStart(w http.ResponseWriter, r *http.Request, userId uint64) {
 	LogInfo("Connection %s started stream.", getIp(r))
 
-	server.state.setupLock.Lock()
-	defer server.state.setupLock.Unlock()
-
-	_ = os.RemoveAll(CONTENT_STREAM)
-	_ = os.MkdirAll(CONTENT_STREAM, os.ModePerm)
-
 	user := server.getAuthorized(w, r)
 	if user == nil {
 		return
 	}
 
-	entryUrl := STREAM_ROUTE + "stream.m3u8"
-	m3u := M3U{
-		url:    entryUrl,
-		isLive: true,
-	}
-	m3u.addPair(KeyValue{EXT_X_VERSION, "3"})
-	m3u.addPair(KeyValue{EXT_X_TARGETDURATION, "10"})
-	m3u.addPair(KeyValue{EXT_X_MEDIA_SEQUENCE, "0"})
-
-	// Create a dummy file so clients have something to munch on
-	file, err := os.Create(CONTENT_STREAM + STREAM_M3U8)
-	if err != nil {
-		respondInternalError(w, "ERROR: %v", err)
-		return
-	}
-
-	defer file.Close()
-	m3u.serializePlaylist(file)
+	server.startHostedStream(user)
+}
 
-	server.state.liveStream = LiveStream{}
+func (server *Server) apiStreamStop(w http.ResponseWriter, r *http.Request, userId uint64) {
+	server.state.setupLock.Lock()
+	liveStream := server.state.liveStream
+	server.state.setupLock.Unlock()
 
-	entry := Entry{
-		Url:       entryUrl,
-		UserId:    user.Id,
-		Title:     user.Username + "'s stream",
-		UseProxy:  false,
-		Subtitles: []Subtitle{},
-		CreatedAt: time.Now(),
+	if liveStream == nil || liveStream.userId != userId {
+		respondBadRequest(w, "You're not streaming")
+		return
 	}
 
-	go server.setNewEntry(entry, userId)
+	server.stopHostedStream(liveStream, userId)
 }
 
 func (server *Server) apiStreamUpload(w http.ResponseWriter, r *http.Request, userId uint64) {
@@ -1010,52 +1237,178 @@ func (server *Server) apiStreamUpload(w http.ResponseWriter, r *http.Request, us
 	entryUserId := server.state.entry.UserId
 	server.state.mutex.Unlock()
 
-	if entryUserId != userId {
+	server.state.setupLock.Lock()
+	liveStream := server.state.liveStream
+	server.state.setupLock.Unlock()
+
+	if liveStream == nil {
+		respondBadRequest(w, "No stream was started")
+		return
+	}
+
+	if entryUserId != userId || liveStream.userId != userId {
 		LogWarn("User ID mismatch on stream upload from %v", getIp(r))
 		http.Error(w, "You're not the owner of this stream", http.StatusUnauthorized)
 		return
 	}
 
 	filename := r.PathValue("filename")
-	LogInfo("Receiving stream item: %v", filename)
+	LogDebug("Receiving stream item: %v", filename)
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_STREAM_CHUNK_SIZE)
+	defer r.Body.Close()
 
-	// Do more filename validation (continuity)
-	if !strings.HasPrefix(filename, "stream") {
-		respondBadRequest(w, "Invalid filename %v", filename)
+	// The playlist of the streamer is never served, it only provides durations of the uploaded segments.
+	if filename == STREAM_M3U8 {
+		m3u, err := parseM3UFrom(r.Body)
+		if err != nil {
+			respondBadRequest(w, "Failed to parse the stream playlist: %v", err)
+			return
+		}
+
+		server.receiveStreamPlaylist(liveStream, m3u)
 		return
 	}
 
-	safePath, safe := safeJoin(CONTENT_STREAM, filename)
-	if !safe {
-		respondBadRequest(w, "Path traversal attempted on %v", filename)
+	sequence, err := parseStreamFilename(filename)
+	if err != nil {
+		respondBadRequest(w, "%v", err)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_STREAM_CHUNK_SIZE)
 
-	server.state.setupLock.Lock()
-	liveStream := &server.state.liveStream
-	server.state.setupLock.Unlock()
+	duration := 0.0
+	if value := r.URL.Query().Get("duration"); value != "" {
+		duration, err = strconv.ParseFloat(value, 64)
+		if err != nil || duration <= 0 || duration > MAX_STREAM_SEGMENT_DURATION {
+			respondBadRequest(w, "Segment duration %v must be a number of seconds between 0 and %v", value, MAX_STREAM_SEGMENT_DURATION)
+			return
+		}
+	}
+
+	if err := liveStream.validateUpload(sequence); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 
-	file, err := os.Create(safePath)
+	// Clients are never served a partially uploaded segment.
+	file, err := os.CreateTemp(CONTENT_STREAM, "upload-*")
 	if err != nil {
-		LogError("Failed to create file: %v", err)
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		respondInternalError(w, "Failed to create file: %v", err)
 		return
 	}
-	defer file.Close()
 
 	written, err := io.Copy(file, r.Body)
+	file.Close()
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		os.Remove(file.Name())
+		respondTooLarge(w, "Stream segment %v exceeds %v bytes", filename, MAX_STREAM_CHUNK_SIZE)
+		return
+	}
+
 	if err != nil {
-		LogError("Failed to read bytes from body: %v", err)
-		http.Error(w, "Failed to read bytes", http.StatusInternalServerError)
+		os.Remove(file.Name())
+		respondInternalError(w, "Failed to read bytes from body: %v", err)
+		return
+	}
+
+	if written == 0 {
+		os.Remove(file.Name())
+		respondBadRequest(w, "Stream segment %v is empty", filename)
+		return
+	}
+
+	if err := liveStream.acceptUpload(file.Name(), filename, sequence, duration, written); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-	defer r.Body.Close()
-	liveStream.dataTransferred += written
 
 	w.WriteHeader(http.StatusOK)
 }
 
+func (server *Server) apiStreamKeyGet(w http.ResponseWriter, r *http.Request, userId uint64) {
+	key, err := server.streamKeyGet(userId)
+	if err != nil {
+		respondInternalError(w, "%v", err)
+		return
+	}
+
+	jsonData, err := json.Marshal(key)
+	if err != nil {
+		respondInternalError(w, "Serialization of the stream key failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+func (server *Server) apiStreamKeyReset(w http.ResponseWriter, r *http.Request, userId uint64) {
+	key, err := server.streamKeyReset(userId)
+	if err != nil {
+		respondInternalError(w, "%v", err)
+		return
+	}
+
+	jsonData, err := json.Marshal(key)
+	if err != nil {
+		respondInternalError(w, "Serialization of the stream key failed with: %v", err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// Receives a stream pushed as MPEG-TS in the body of a chunked request, for example from ffmpeg or OBS with
+// "-f mpegts -method POST <url>". The request ends once the stream ends.
+func (server *Server) apiStreamPush(w http.ResponseWriter, r *http.Request) {
+	user := server.findStreamKeyUser(r.PathValue("key"))
+	if user == nil {
+		respondUnauthorized(w, "Invalid stream key")
+		return
+	}
+
+	LogInfo("Connection %s started pushing a stream of user %v.", getIp(r), user.Id)
+
+	reader := &pushReader{body: r.Body, controller: http.NewResponseController(w)}
+	if err := server.ingestStream(reader, user); err != nil {
+		LogWarn("Pushed stream of user %v from %s ended with: %v", user.Id, getIp(r), err)
+		respondBadRequest(w, "%v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Receives a stream pushed as MPEG-TS in binary WebSocket messages.
+func (server *Server) apiStreamPushWebsocket(w http.ResponseWriter, r *http.Request) {
+	user := server.findStreamKeyUser(r.PathValue("key"))
+	if user == nil {
+		respondUnauthorized(w, "Invalid stream key")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		LogError("Failed to upgrade the stream push connection from %s: %v", getIp(r), err)
+		return
+	}
+	defer conn.Close()
+
+	LogInfo("Connection %s started pushing a stream of user %v over WebSocket.", getIp(r), user.Id)
+	conn.SetReadLimit(MAX_STREAM_CHUNK_SIZE)
+
+	err = server.ingestStream(&websocketReader{conn: conn}, user)
+	if err != nil {
+		LogWarn("Pushed stream of user %v from %s ended with: %v", user.Id, getIp(r), err)
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err != nil {
+		message = websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "Failed to ingest the stream")
+	}
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
+
 func (server *Server) apiEvents(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -1211,6 +1564,8 @@ func getEventName(eventType EventType) string {
 		return "playlist update"
 	case EVENT_PLAYLIST_SHUFFLE:
 		return "playlist shuffle"
+	case EVENT_PLAYLIST_UNDO:
+		return "playlist undo"
 
 	default:
 		return fmt.Sprintf("<unknown type:%v>", eventType)
@@ -1298,13 +1653,18 @@ func (server *Server) handleWSMessage(data []byte, userId uint64) {
 		handleWsEvent(event, userId, server.playlistMove)
 
 	case EVENT_PLAYLIST_CLEAR:
-		server.playlistClear()
+		server.playlistClear(userId)
 
 	case EVENT_PLAYLIST_DELETE:
 		handleWsEvent(event, userId, server.playlistDelete)
 
 	case EVENT_PLAYLIST_SHUFFLE:
-		server.playlistShuffle()
+		server.playlistShuffle(userId)
+
+	case EVENT_PLAYLIST_UNDO:
+		if err := server.playlistUndo(userId); err != nil {
+			LogError("Failed to handle %v event: %v", getEventName(event.Type), err)
+		}
 
 	case EVENT_PLAYLIST_UPDATE:
 		handleWsEvent(event, userId, server.playlistUpdate)
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Avatars are re-encoded at each of these sizes (in pixels). The first one is stored as the user avatar URL.
+var AVATAR_SIZES = [...]int{256, 64}
+
+// Uploads with larger dimensions are rejected before decoding, to avoid allocating huge images.
+const MAX_AVATAR_DIMENSION = 4096
+const MAX_AVATAR_PIXELS = 16 * 1024 * 1024
+
+// Limits the total number of pixels across all frames of an animated avatar.
+const MAX_AVATAR_ANIMATION_PIXELS = 256 * 1024 * 1024
+
+var errAvatarAvif = errors.New("AVIF avatars are not supported, use a PNG, JPEG, GIF or WebP image instead")
+
+type EncodedAvatar struct {
+	// File extension of the encoded avatar, without the dot.
+	extension string
+
+	// Encoded avatar for each of the AVATAR_SIZES.
+	sizes map[int][]byte
+}
+
+// Decodes and validates an uploaded avatar, crops it to a centered square and re-encodes it at every avatar size.
+// Animated GIFs keep their animation, WebP images are only validated and stored unchanged.
+func processAvatar(data []byte) (EncodedAvatar, error) {
+	// AVIF is an ISO base media file with an avif (or avis for sequences) brand, which cannot be decoded.
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" && (string(data[8:12]) == "avif" || string(data[8:12]) == "avis") {
+		return EncodedAvatar{}, errAvatarAvif
+	}
+
+	var config image.Config
+	var format string
+	var err error
+
+	if isWebp(data) {
+		config, err = decodeWebpConfig(data)
+		format = "webp"
+	} else {
+		config, format, err = image.DecodeConfig(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return EncodedAvatar{}, fmt.Errorf("Unsupported or invalid image: %v", err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return EncodedAvatar{}, fmt.Errorf("Image has invalid dimensions %vx%v", config.Width, config.Height)
+	}
+
+	if config.Width > MAX_AVATAR_DIMENSION || config.Height > MAX_AVATAR_DIMENSION || config.Width*config.Height > MAX_AVATAR_PIXELS {
+		return EncodedAvatar{}, fmt.Errorf("Image dimensions %vx%v exceed the allowed %vx%v", config.Width, config.Height, MAX_AVATAR_DIMENSION, MAX_AVATAR_DIMENSION)
+	}
+
+	switch format {
+	case "webp":
+		return storeAvatarUnchanged(data, "webp"), nil
+
+	case "gif":
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return EncodedAvatar{}, fmt.Errorf("Failed to decode gif image: %v", err)
+		}
+
+		if len(anim.Image) > 1 {
+			return processAnimatedAvatar(anim)
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return EncodedAvatar{}, fmt.Errorf("Failed to decode %v image: %v", format, err)
+	}
+
+	crop := squareCrop(img.Bounds())
+	encoded := EncodedAvatar{extension: "png", sizes: make(map[int][]byte, len(AVATAR_SIZES))}
+
+	for _, size := range AVATAR_SIZES {
+		// Images are never upscaled, small avatars are only cropped.
+		side := min(size, crop.Dx())
+		resized := scaleArea(img, crop, side)
+
+		var output bytes.Buffer
+		if err := png.Encode(&output, resized); err != nil {
+			return EncodedAvatar{}, fmt.Errorf("Failed to encode the avatar: %v", err)
+		}
+
+		encoded.sizes[size] = output.Bytes()
+	}
+
+	return encoded, nil
+}
+
+func storeAvatarUnchanged(data []byte, extension string) EncodedAvatar {
+	encoded := EncodedAvatar{extension: extension, sizes: make(map[int][]byte, len(AVATAR_SIZES))}
+	for _, size := range AVATAR_SIZES {
+		encoded.sizes[size] = data
+	}
+
+	return encoded
+}
+
+// Crops and scales every frame of an animated GIF. Frames are composed onto a canvas first, because GIF frames may
+// only cover part of the image and depend on the disposal of the previous frames.
+func processAnimatedAvatar(anim *gif.GIF) (EncodedAvatar, error) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if len(anim.Image)*bounds.Dx()*bounds.Dy() > MAX_AVATAR_ANIMATION_PIXELS {
+		return EncodedAvatar{}, fmt.Errorf("Animated image with %v frames of %vx%v is too large", len(anim.Image), bounds.Dx(), bounds.Dy())
+	}
+
+	crop := squareCrop(bounds)
+	canvas := image.NewRGBA(bounds)
+
+	resized := make(map[int]*gif.GIF, len(AVATAR_SIZES))
+	for _, size := range AVATAR_SIZES {
+		side := min(size, crop.Dx())
+		resized[size] = &gif.GIF{
+			LoopCount: anim.LoopCount,
+			Config:    image.Config{Width: side, Height: side},
+		}
+	}
+
+	for i, frame := range anim.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		palette := paletteWithTransparency(frame.Palette)
+
+		for _, size := range AVATAR_SIZES {
+			output := resized[size]
+			scaled := scaleArea(canvas, crop, output.Config.Width)
+
+			paletted := image.NewPaletted(scaled.Bounds(), palette)
+			draw.Draw(paletted, paletted.Bounds(), scaled, image.Point{}, draw.Src)
+
+			// Every output frame is a complete image, so it replaces the previous one entirely.
+			output.Image = append(output.Image, paletted)
+			output.Delay = append(output.Delay, anim.Delay[i])
+			output.Disposal = append(output.Disposal, gif.DisposalBackground)
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	encoded := EncodedAvatar{extension: "gif", sizes: make(map[int][]byte, len(AVATAR_SIZES))}
+	for _, size := range AVATAR_SIZES {
+		var output bytes.Buffer
+		if err := gif.EncodeAll(&output, resized[size]); err != nil {
+			return EncodedAvatar{}, fmt.Errorf("Failed to encode the avatar: %v", err)
+		}
+
+		encoded.sizes[size] = output.Bytes()
+	}
+
+	return encoded, nil
+}
+
+// Returns the palette with a fully transparent color, so that transparent areas of the canvas stay transparent.
+func paletteWithTransparency(palette color.Palette) color.Palette {
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return palette
+		}
+	}
+
+	if len(palette) >= 256 {
+		return palette
+	}
+
+	return append(slices.Clip(palette), color.RGBA{})
+}
+
+func isWebp(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// Reads dimensions of a WebP image from the header of its first chunk, which is either lossy (VP8), lossless (VP8L)
+// or extended (VP8X).
+func decodeWebpConfig(data []byte) (image.Config, error) {
+	if len(data) < 30 {
+		return image.Config{}, fmt.Errorf("WebP header is truncated")
+	}
+
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8 ":
+		// Frame tag (3 bytes) is followed by the 0x9d 0x01 0x2a start code and 14 bit dimensions.
+		if chunk[3] != 0x9d || chunk[4] != 0x01 || chunk[5] != 0x2a {
+			return image.Config{}, fmt.Errorf("WebP VP8 start code is missing")
+		}
+
+		width := int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+		return image.Config{Width: width, Height: height}, nil
+
+	case "VP8L":
+		// Signature byte is followed by 14 bit width and height, both stored minus one.
+		if chunk[0] != 0x2f {
+			return image.Config{}, fmt.Errorf("WebP VP8L signature is missing")
+		}
+
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		width := int(bits&0x3fff) + 1
+		height := int((bits>>14)&0x3fff) + 1
+		return image.Config{Width: width, Height: height}, nil
+
+	case "VP8X":
+		// Flags and reserved bytes are followed by 24 bit canvas width and height, both stored minus one.
+		width := int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1
+		height := int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1
+		return image.Config{Width: width, Height: height}, nil
+	}
+
+	return image.Config{}, fmt.Errorf("Unknown WebP chunk %q", data[12:16])
+}
+
+// Downscales the source rectangle into a side by side image, averaging all source pixels covered by each output pixel.
+func scaleArea(img image.Image, src image.Rectangle, side int) *image.RGBA {
+	resized := image.NewRGBA(image.Rect(0, 0, side, side))
+
+	for y := 0; y < side; y++ {
+		y0 := src.Min.Y + y*src.Dy()/side
+		y1 := max(src.Min.Y+(y+1)*src.Dy()/side, y0+1)
+
+		for x := 0; x < side; x++ {
+			x0 := src.Min.X + x*src.Dx()/side
+			x1 := max(src.Min.X+(x+1)*src.Dx()/side, x0+1)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					count++
+				}
+			}
+
+			resized.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+
+	return resized
+}
+
+// Returns the largest square centered within the bounds.
+func squareCrop(bounds image.Rectangle) image.Rectangle {
+	side := min(bounds.Dx(), bounds.Dy())
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+func avatarPath(userId uint64, version int64, size int, extension string) string {
+	return fmt.Sprintf(CONTENT_USERS+"avatar%v_%v_%v.%v", userId, version, size, extension)
+}
+
+// Writes every avatar size under a new version and removes the files of all previous versions.
+// Returns path of the largest avatar.
+func saveAvatar(userId uint64, version int64, encoded EncodedAvatar) (string, error) {
+	os.MkdirAll(CONTENT_USERS, os.ModePerm)
+
+	written := make([]string, 0, len(encoded.sizes))
+	for _, size := range AVATAR_SIZES {
+		avatar := avatarPath(userId, version, size, encoded.extension)
+		if err := os.WriteFile(avatar, encoded.sizes[size], 0644); err != nil {
+			for _, file := range written {
+				os.Remove(file)
+			}
+
+			return "", err
+		}
+
+		written = append(written, avatar)
+	}
+
+	removeStaleAvatars(userId, version)
+	return avatarPath(userId, version, AVATAR_SIZES[0], encoded.extension), nil
+}
+
+// Removes avatar files of the user other than the given version, including ones stored before avatars were processed.
+func removeStaleAvatars(userId uint64, version int64) {
+	legacy := fmt.Sprintf(CONTENT_USERS+"avatar%v", userId)
+	os.Remove(legacy)
+
+	matches, _ := filepath.Glob(legacy + "_*_*.*")
+	current := fmt.Sprintf("%v_%v_", legacy, version)
+	for _, match := range matches {
+		match = filepath.ToSlash(match)
+		if !strings.HasPrefix(match, current) {
+			os.Remove(match)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"slices"
+	"sync"
+)
+
+// HlsCache bounds the disk space used by chunks of the VOD proxies of an entry. Once the budget is exceeded, chunks
+// furthest behind the room playhead are removed and marked as not fetched, so they are fetched again on a seek back.
+type HlsCache struct {
+	mutex    sync.Mutex
+	size     int64
+	limit    int64
+	proxies  map[string]*HlsProxy
+	playhead func() float64
+	// Chunks within this many seconds ahead of the playhead are not evicted, they're about to be played.
+	keepAhead float64
+	closed    bool
+}
+
+type CachedChunk struct {
+	proxy  *HlsProxy
+	prefix string
+	id     int
+	start  float64
+	end    float64
+	size   int64
+}
+
+// Attaches a cache with the configured budget to every VOD proxy of the entry. Expects the setup lock to be held.
+func (server *Server) setupHlsCache() {
+	if server.config.HlsCacheSizeMB <= 0 {
+		return
+	}
+
+	cache := &HlsCache{
+		limit:     server.config.HlsCacheSizeMB * MB,
+		proxies:   server.state.hlsProxies,
+		playhead:  server.getCurrentTimestamp,
+		keepAhead: max(server.config.HlsPrefetchSeconds, HLS_CACHE_KEEP_BEHIND),
+	}
+
+	for _, proxy := range server.state.hlsProxies {
+		proxy.cache = cache
+	}
+}
+
+// Accounts a newly fetched chunk and evicts chunks if the cache exceeds its budget.
+func (cache *HlsCache) add(size int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.size += size
+	if cache.closed || cache.size <= cache.limit {
+		return
+	}
+
+	chunks := make([]CachedChunk, 0)
+	for prefix, proxy := range cache.proxies {
+		for id, start := range proxy.chunkStarts {
+			// Sizes are only written with the chunk lock held, chunks being fetched right now are skipped.
+			mutex := &proxy.chunkLocks[id]
+			if !mutex.TryLock() {
+				continue
+			}
+			fetched, size := proxy.fetchedChunks[id], proxy.chunkSizes[id]
+			mutex.Unlock()
+
+			if !fetched || proxy.chunkPins[id].Load() > 0 {
+				continue
+			}
+
+			end := proxy.duration
+			if id+1 < len(proxy.chunkStarts) {
+				end = proxy.chunkStarts[id+1]
+			}
+
+			chunk := CachedChunk{proxy: proxy, prefix: prefix, id: id, start: start, end: end, size: size}
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	evicted := selectChunkEvictions(chunks, cache.playhead(), cache.keepAhead, cache.size-cache.limit)
+	for _, chunk := range evicted {
+		mutex := &chunk.proxy.chunkLocks[chunk.id]
+		if !mutex.TryLock() {
+			continue
+		}
+
+		// Pins are taken before the chunk lock, so a chunk pinned since the selection is still skipped here.
+		if chunk.proxy.chunkPins[chunk.id].Load() > 0 {
+			mutex.Unlock()
+			continue
+		}
+
+		chunkPath := CONTENT_PROXY + chunk.prefix + toString(chunk.id)
+		if err := os.Remove(chunkPath); err != nil && !os.IsNotExist(err) {
+			LogWarn("Failed to evict HLS chunk %v: %v", chunkPath, err)
+			mutex.Unlock()
+			continue
+		}
+
+		chunk.proxy.fetchedChunks[chunk.id] = false
+		chunk.proxy.chunkSizes[chunk.id] = 0
+		mutex.Unlock()
+
+		cache.size -= chunk.size
+	}
+
+	if len(evicted) > 0 {
+		LogDebug("Evicted %v HLS chunks, cache size is now %vMB", len(evicted), formatMegabytes(cache.size, 2))
+	}
+}
+
+// Stops evictions once the entry is replaced, since the next entry reuses the chunk file names.
+func (cache *HlsCache) close() {
+	cache.mutex.Lock()
+	cache.closed = true
+	cache.mutex.Unlock()
+}
+
+// Returns chunks to evict so that at least excess bytes are freed. Chunks behind the playhead go first, furthest first,
+// followed by chunks furthest ahead. Chunks within HLS_CACHE_KEEP_BEHIND seconds behind or keepAhead seconds ahead of
+// the playhead are never selected, so the cache may stay above the budget.
+func selectChunkEvictions(chunks []CachedChunk, playhead, keepAhead float64, excess int64) []CachedChunk {
+	candidates := make([]CachedChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.end > playhead-HLS_CACHE_KEEP_BEHIND && chunk.start < playhead+keepAhead {
+			continue
+		}
+		candidates = append(candidates, chunk)
+	}
+
+	slices.SortStableFunc(candidates, func(a, b CachedChunk) int {
+		aBehind, bBehind := a.end <= playhead, b.end <= playhead
+		if aBehind != bBehind {
+			if aBehind {
+				return -1
+			}
+			return 1
+		}
+
+		if aBehind {
+			// Furthest behind first
+			return cmp.Compare(a.start, b.start)
+		}
+		// Furthest ahead first
+		return cmp.Compare(b.start, a.start)
+	})
+
+	evicted := make([]CachedChunk, 0)
+	freed := int64(0)
+	for _, chunk := range candidates {
+		if freed >= excess {
+			break
+		}
+		evicted = append(evicted, chunk)
+		freed += chunk.size
+	}
+
+	return evicted
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -27,24 +28,46 @@ const TOKEN_LENGTH = 32
 const BROADCAST_INTERVAL = 2 * time.Second
 const HEARTBEAT_INTERVAL = 2 * time.Second
 const BLACK_HOLE_PERIOD = 20 * time.Minute
+const SCHEDULE_CHECK_INTERVAL = time.Second
+const SCHEDULE_COUNTDOWN_PERIOD = 5 * time.Minute
+const SCHEDULE_MISSED_TOLERANCE = 5 * time.Minute
 
 const MAX_NICKNAME_LENGTH = 255
 const MAX_UNKNOWN_PATH_LENGTH = 40
 const MAX_HISTORY_SIZE = 120
+const MAX_UNDO_SIZE = 20
+const MAX_SCHEDULE_COUNT = 50
 const MAX_CHAT_LOAD = 100
 const MAX_SPEED = 2.5
 const MIN_SPEED = 0.1
-const MAX_THUMBNAIL_COUNT = 100
 const MAX_SHARE_LIFETIME_SECONDS = 365 * 24 * 60 * 60
 
 const SUBTITLE_SIZE_LIMIT = 512 * KB
+const SUBTITLE_PTS_PROBE_SIZE = 64 * KB // head of the first video chunk read to align subtitle renditions
 const AVATAR_SIZE_LIMIT = 8 * MB
 const PROXY_FILE_SIZE_LIMIT = 4 * GB
 const BODY_LIMIT = 8 * KB
 const MAX_STREAM_CHUNK_SIZE = 10 * MB
+const MAX_STREAM_SEGMENT_DURATION = 30.0 // seconds
+const STREAM_WINDOW_SEGMENTS = 6         // segments listed by the playlist of a hosted stream
+const STREAM_INITIAL_TARGET_DURATION = 2 // seconds, advertised until the first segment is published
+const STREAM_PUSH_SEGMENT_DURATION = 4.0 // seconds, segments of pushed streams are cut at the first keyframe past it
+const STREAM_PUSH_READ_TIMEOUT = 30 * time.Second
 const MAX_CHUNK_SIZE = 50 * MB
 const MAX_PRELOAD_SIZE = 20 * MB
+const HLS_PREFETCH_CONCURRENCY = 3
+const HLS_PREFETCH_MAX_BACKOFF = 32 * time.Second
+const HLS_PREFETCH_IDLE_TIMEOUT = time.Minute // renditions not requested by clients for this long are not prefetched
+const HLS_CACHE_KEEP_BEHIND = 30              // seconds behind the playhead never evicted, so short seeks back stay cached
+const LIVE_SEGMENTS_BEHIND = 3                // segments kept after leaving the origin playlist, for clients lagging behind
+const LIVE_INITIAL_PREFETCH = 3               // segments from the live edge prefetched when the stream starts
+const LIVE_IDLE_TIMEOUT = 30 * time.Second    // live playlists not requested for this long are no longer refreshed
+const LIVE_REFRESH_TIMEOUT = 10 * time.Second // longest a client waits for an idle live playlist to be refreshed
+const LIVE_MIN_REFRESH_INTERVAL = 500 * time.Millisecond
+const LIVE_MAX_REFRESH_INTERVAL = 10 * time.Second
 const MAX_THUMBNAIL_SIZE = 4 * MB
+const MAX_THUMBNAIL_CACHE_SIZE = 256 * MB
+const THUMBNAIL_CONCURRENCY = 2 // thumbnails generated at once in the background
 const HEURISTIC_BITRATE_MB_S = 1.75 * MB
 
 var SUBTITLE_EXTENSIONS = [...]string{".vtt", ".srt"}
@@ -81,20 +104,24 @@ const MEDIA_AUDIO = CONTENT_MEDIA + "audio/"
 const MEDIA_SUBS = CONTENT_MEDIA + "subs/"
 const MEDIA_IMAGE = CONTENT_MEDIA + "image/"
 const MEDIA_THUMB = CONTENT_MEDIA + "thumb/"
+const MEDIA_PARTIAL = CONTENT_MEDIA + "partial/"
+const MEDIA_RECORDINGS = MEDIA_VIDEO + "recordings/" // one directory of segments and a playlist per recording
 
-const ORIGINAL_M3U8 = "original.m3u8"
 const PROXY_M3U8 = "proxy.m3u8"
-const VIDEO_M3U8 = "video.m3u8"
-const AUDIO_M3U8 = "audio.m3u8"
+const RENDITION_M3U8 = "index.m3u8" // prefixed with the rendition chunk prefix, eg. v0-index.m3u8
 const STREAM_M3U8 = "stream.m3u8"
+const STREAM_INIT = "stream_init.mp4"
+const RECORDING_M3U8 = "index.m3u8"
 const VIDEO_PREFIX = "vi-"
-const AUDIO_PREFIX = "au-"
+const RENDITION_VIDEO_PREFIX = "v"
+const RENDITION_AUDIO_PREFIX = "a"
+const RENDITION_SUBTITLE_PREFIX = "s"
+const MAX_HLS_RENDITIONS = 8              // per rendition type, indexes are single base 36 digits
+const HLS_RENDITION_SETUP_CONCURRENCY = 4 // rendition playlists downloaded at once while setting up the proxy
+const HLS_PREFIX_LENGTH = 3               // length of every VOD chunk prefix
 const LIVE_PREFIX = "live-"
 const MIS_PREFIX = "mis-"
-const MEDIA_INIT_SECTION = "mis.key"
-const MEDIA_INIT_SECTION_AUDIO = "mis-audio.key"
-const MEDIA_DECRYPTION_KEY = "decrypt.key"
-const MEDIA_DECRYPTION_KEY_AUDIO = "decrypt-audio.key"
+const KEY_PREFIX = "key-"
 const MAX_PLAYLIST_DEPTH = 2
 const MAX_CHUNK_NAME_LENGTH = 26
 const MAX_PLAYLIST_DURATION_SECONDS = 86400 // 24hours
@@ -105,6 +132,9 @@ const MAX_MESSAGE_CHARACTERS = 1000
 const GENERIC_CHUNK_SIZE = 1_000_000
 const TRAILING_PULL_SIZE = 256 * KB
 const PRE_OFFSET = 256 * KB
+const FILE_PROXY_RANGE_SIZE = 2 * MB  // largest range claimed at once by a download worker
+const FILE_PROXY_PULL_SIZE = 256 * KB // bytes written to disk at once, workers check the playhead between pulls
+const FILE_PROXY_TARGET_SPEEDUP = 3.0 // download speed relative to the bitrate, above which extra workers are idle
 
 type EventType uint64
 
@@ -130,6 +160,7 @@ const (
 	EVENT_PLAYLIST_DELETE
 	EVENT_PLAYLIST_UPDATE
 	EVENT_PLAYLIST_SHUFFLE
+	EVENT_PLAYLIST_UNDO
 )
 
 type PlayerSyncType uint64
@@ -159,6 +190,9 @@ type Server struct {
 	// Currently open WebSocket connections.
 	conns *Connections
 
+	// Index of media files available on the server.
+	library *Library
+
 	// Connection to the PostgreSQL database. When database support is disabled, this field is set to nil.
 	db *sql.DB
 }
@@ -249,6 +283,11 @@ type Metadata struct {
 	// TODO(kihau): Make those two time.Time instead.
 	ReleaseDate string `json:"release_date"`
 	Duration    int64  `json:"duration"`
+
+	// Overall bitrate in bits per second.
+	Bitrate   int64        `json:"bitrate"`
+	Container string       `json:"container"`
+	Tracks    []MediaTrack `json:"tracks"`
 }
 
 type Entry struct {
@@ -319,6 +358,14 @@ type ServerState struct {
 	resources    map[string]SharedResource
 	resourceLock sync.RWMutex
 
+	// Media files uploaded by users
+	uploads          []UploadRecord
+	resumableUploads map[string]*ResumableUpload
+	uploadLock       sync.Mutex
+
+	// Guards creation and eviction of files in the thumbnail cache
+	thumbnailLock sync.Mutex
+
 	// Indicates whether the server is waiting for the entry to load. Loading includes both YouTube fetch and proxy setup.
 	isLoadingEntry atomic.Bool
 
@@ -332,6 +379,12 @@ type ServerState struct {
 	history  []Entry
 	messages []ChatMessage
 
+	// Bounded stack of reversible playlist and history mutations, with the most recent one at the end.
+	undoStack []UndoAction
+
+	// Pending scheduled playbacks, sorted by their start time.
+	schedules []Schedule
+
 	// Tiny array of recent actions which are displayed in "Recent Actions" section in the room tab.
 	// Should be kept relatively small (somewhere between 3 and 10 elements).
 	actions []Action
@@ -339,13 +392,22 @@ type ServerState struct {
 	// Setup lock for the proxy.
 	setupLock      sync.Mutex
 	proxy          *HlsProxy
-	audioProxy     *HlsProxy
 	isLive         bool
 	isHls          bool
 	fileProxy      FileProxy
 	audioFileProxy FileProxy
 
-	liveStream LiveStream
+	liveStream *LiveStream
+
+	// Stream keys of users, guarded by the stream key lock.
+	streamKeys    []StreamKey
+	streamKeyLock sync.Mutex
+
+	// VOD proxies keyed by their chunk prefix. Master playlists are proxied with one per rendition.
+	hlsProxies map[string]*HlsProxy
+
+	// WebVTT subtitle renditions of the proxied master playlist.
+	subtitleRenditions []SubtitleRendition
 }
 
 type GatewayHandler struct {
@@ -356,6 +418,30 @@ type GatewayHandler struct {
 	hits, perSecond     int
 }
 
+type HlsRenditions struct {
+	// Proxies of all video, audio and subtitle renditions keyed by their chunk prefix.
+	proxies map[string]*HlsProxy
+
+	// Proxy of the first video rendition that was set up.
+	video *HlsProxy
+
+	subtitles []SubtitleRendition
+}
+
+// A rendition playlist to set up a proxy for, along with the result.
+type RenditionSetup struct {
+	url    string
+	prefix string
+	proxy  *HlsProxy
+	err    error
+}
+
+type SubtitleRendition struct {
+	name     string
+	language string
+	proxy    *HlsProxy
+}
+
 type HlsProxy struct {
 	// Common
 	referer string
@@ -363,10 +449,46 @@ type HlsProxy struct {
 	chunkLocks     []sync.Mutex
 	fetchedChunks  []bool
 	originalChunks []string
-	// Live resources
-	liveUrl      string
-	liveSegments sync.Map
-	lastRefresh  time.Time
+	chunkStarts    []float64      // playlist time in seconds at which each chunk starts
+	chunkSizes     []int64        // size on disk of fetched chunks
+	chunkPins      []atomic.Int32 // number of requests serving each chunk, pinned chunks are not evicted
+	chunkRanges    []*Range       // sub-ranges of the original chunks, nil for whole resources
+	duration       float64        // total duration of the playlist in seconds
+	cache          *HlsCache      // shared by all proxies of the entry, nil when the cache is unbounded
+	// Prefetching
+	lastServed   atomic.Int64 // unix milliseconds of the last chunk served to a client
+	stopPrefetch context.CancelFunc
+	prefetchDone chan struct{}
+	// Live resources, refreshed by the live refresher which reuses the prefetching fields above
+	liveUrl       string
+	liveSegments  sync.Map
+	liveMutex     sync.Mutex    // locks livePlaylist, liveErr, liveEnded, liveRefreshed, recording, recordingClosed
+	livePlaylist  []byte        // rewritten playlist served to clients, nil until the first successful refresh
+	liveErr       error         // error of the last refresh, nil when it succeeded
+	liveEnded     bool          // the origin ended the stream, the playlist is final
+	liveRefreshed chan struct{} // closed and replaced after every refresh
+	liveWake      chan struct{} // wakes the live refresher up when clients return to an idle stream
+	liveSequence  int           // media sequence of the first segment in the last playlist, used by the refresher only
+	dvr           *DvrWindow    // used by the refresher only, nil when the DVR window is disabled
+	// Recording of the live stream, nil unless it was requested by a user
+	recording       *LiveRecording
+	recordingClosed bool // the refresher stopped, recordings can no longer be started
+	// Decryption keys, and maps of VOD playlists, each proxied under its own name
+	resourceMutex sync.Mutex              // locks resources, resourceNames and resourceCount
+	resources     map[string]*HlsResource // keyed by the name they are served under
+	resourceNames map[string]string       // served names keyed by the origin URI and range of the resource
+	resourceCount int                     // number of resources ever registered, names are never reused
+}
+
+// HlsResource is a key or map of a proxied playlist, downloaded on the first request for it.
+type HlsResource struct {
+	uri          string
+	identity     string // origin URI and range of the resource, key of resourceNames
+	byteRange    *Range // [optional] sub-range of the URI
+	obtained     bool
+	evicted      bool // removed along with the last live segment using it
+	lastSequence int  // media sequence of the last live segment using it, unused by VOD playlists
+	mutex        sync.Mutex
 }
 
 type FileProxy struct {
@@ -380,6 +502,12 @@ type FileProxy struct {
 	fileMutex     sync.RWMutex
 	diskRanges    []Range // must remain sorted
 	rangeMutex    sync.Mutex
+
+	// Estimated bytes per second of playback, used to measure consumed preload and to decide how many workers download.
+	bitrate float64
+
+	// Result of probing the proxied file, empty when probing failed.
+	probe MediaProbe
 }
 
 func (proxy *FileProxy) loadBytes(offset, count int64) bool {
@@ -389,29 +517,70 @@ func (proxy *FileProxy) loadBytes(offset, count int64) bool {
 		return false
 	}
 	defer response.Body.Close()
-	_, err = proxy.pullAndStoreBytes(response, offset, count)
+	next, err := proxy.pullAndStoreBytes(response.Body, offset, count)
 	if err != nil {
 		LogWarn("Failed to pull last %v bytes: %v", count, err)
 		return false
 	}
+	if next != offset+count {
+		LogWarn("Failed to pull last %v bytes: the response ended after %v bytes", count, next-offset)
+		return false
+	}
 	return true
 }
 
+// GenericDownloader downloads the proxied file with parallel range requests. Workers claim the first missing bytes
+// following the playhead, so the range clients read next is always downloaded first.
 type GenericDownloader struct {
-	mutex    sync.Mutex // locks download, offset
-	download *http.Response
-	offset   int64
-	preload  int64
-	speed    *SpeedTest
-	sleeper  *Sleeper
-	destroy  chan bool
-	closed   bool
+	mutex      sync.Mutex // locks offset, claimed, downloaded, speed, speedMBps
+	offset     int64      // playhead, the offset clients read at
+	claimed    []Range    // ranges being downloaded by the workers
+	workers    int
+	speed      *SpeedTest
+	speedMBps  float64 // combined speed of the workers, 0 until measured
+	downloaded int64   // bytes downloaded by every worker, measured by the speed test
+	sleeper    *Sleeper
+	ctx        context.Context
+	stop       context.CancelFunc
+	done       sync.WaitGroup
 }
 
 type LiveStream struct {
-	userId          uint64
-	dataTransferred int64
-	lastChunkId     uint64
+	userId uint64
+	title  string
+
+	mutex                 sync.Mutex     // locks every field below
+	dataTransferred       int64          // bytes of every accepted upload
+	published             float64        // seconds of every published segment
+	lastUploaded          int            // sequence number of the last uploaded segment, -1 before the first one
+	lastPublished         int            // sequence number of the last published segment, -1 before the first one
+	pending               map[int]string // uploaded segments waiting for their duration, keyed by their sequence number
+	window                []Segment      // segments listed by the playlist, oldest first
+	files                 map[int]string // files of published segments, keyed by their media sequence
+	mediaSequence         int            // media sequence of the first segment of the window
+	discontinuitySequence int
+	targetDuration        int        // longest published segment in seconds, rounded up
+	hasInit               bool       // the streamer uploaded a media initialization section
+	dvr                   *DvrWindow // nil when the DVR window is disabled
+	playlist              []byte     // playlist served to clients
+	ended                 bool
+}
+
+type StreamStats struct {
+	UserId          uint64  `json:"user_id"`
+	Title           string  `json:"title"`
+	DataTransferred int64   `json:"data_transferred"`
+	Duration        float64 `json:"duration"`
+	Bitrate         float64 `json:"bitrate"` // bits per second of the published segments
+}
+
+// Key authorizing a user to push a stream to the server, in place of the user token.
+type StreamKey struct {
+	UserId uint64 `json:"user_id"`
+	Key    string `json:"key"`
+
+	// Unix time in milliseconds.
+	CreatedAt int64 `json:"created_at"`
 }
 
 type Connection struct {
@@ -484,18 +653,21 @@ type MessageHistoryRequest struct {
 }
 
 type LiveSegment struct {
-	realUrl        string
-	realMapUri     string
-	obtainedUrl    bool
-	obtainedMapUri bool
-	mutex          sync.Mutex
-	created        time.Time
+	realUrl     string
+	realRange   *Range // [optional] sub-range of the real URL
+	mapName     string // name of the proxied map resource, empty when the segment has no map
+	obtainedUrl bool
+	evicted     bool // removed from the sliding window along with its files
+	sequence    int  // media sequence number, shared by parts of the segment
+	mutex       sync.Mutex
+	created     time.Time
 }
 
 type PlayerGetResponse struct {
-	Player  PlayerState `json:"player"`
-	Entry   Entry       `json:"entry"`
-	Actions []Action    `json:"actions"`
+	Player    PlayerState `json:"player"`
+	Entry     Entry       `json:"entry"`
+	Actions   []Action    `json:"actions"`
+	Recording bool        `json:"recording"`
 }
 
 type SyncEvent struct {
@@ -583,6 +755,58 @@ type RequestEntry struct {
 	PlaylistToTop     bool        `json:"playlist_to_top"`
 }
 
+// Entry (and optionally a list of entries queued after it) set and played at a given wall-clock time.
+type Schedule struct {
+	Id     uint64 `json:"id"`
+	UserId uint64 `json:"user_id"`
+
+	// Unix time in milliseconds.
+	StartAt   int64 `json:"start_at"`
+	CreatedAt int64 `json:"created_at"`
+
+	Entry RequestEntry `json:"entry"`
+
+	// Entries added to the top of the playlist once the scheduled entry starts playing.
+	Playlist []RequestEntry `json:"playlist"`
+}
+
+type ScheduleAddRequest struct {
+	StartAt  int64          `json:"start_at"`
+	Entry    RequestEntry   `json:"entry"`
+	Playlist []RequestEntry `json:"playlist"`
+}
+
+type ScheduleCountdownEvent struct {
+	ScheduleId  uint64 `json:"schedule_id"`
+	Title       string `json:"title"`
+	StartAt     int64  `json:"start_at"`
+	SecondsLeft int64  `json:"seconds_left"`
+}
+
+type UndoType uint64
+
+const (
+	UNDO_PLAYLIST_CLEAR UndoType = iota
+	UNDO_PLAYLIST_DELETE
+	UNDO_PLAYLIST_ORDER
+	UNDO_HISTORY_CLEAR
+)
+
+// A single reversible mutation of the playlist or the history.
+type UndoAction struct {
+	Type   UndoType
+	UserId uint64
+
+	// Entries removed by the mutation (clear and delete).
+	Entries []Entry
+
+	// Playlist index of the deleted entry.
+	Index int
+
+	// Playlist entry IDs in the order preceding a move or a shuffle.
+	Order []uint64
+}
+
 type PlaylistMoveRequest struct {
 	EntryId   uint64 `json:"entry_id"`
 	DestIndex int    `json:"dest_index"`
@@ -594,11 +818,12 @@ type PlaylistMoveEvent struct {
 }
 
 type MediaUploadResponse struct {
-	Url      string `json:"url"`
-	Name     string `json:"name"`
-	Filename string `json:"filename"`
-	Format   string `json:"format"`
-	Category string `json:"category"`
+	Url      string   `json:"url"`
+	Name     string   `json:"name"`
+	Filename string   `json:"filename"`
+	Format   string   `json:"format"`
+	Category string   `json:"category"`
+	Metadata Metadata `json:"metadata"`
 }
 
 type UserVerifyResponse struct {
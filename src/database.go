@@ -3,6 +3,7 @@ package main
 import (
 	"cmp"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -18,6 +19,9 @@ import (
 const SQL_MIGRATIONS_DIR = "sql/"
 const TABLE_USERS = "users"
 
+// Distance between positions of neighbouring playlist rows. Moves place an entry halfway between its neighbours.
+const PLAYLIST_POSITION_GAP = 1024.0
+
 // Used as an ID seeder when database disabled.
 var idSeeder atomic.Uint64
 
@@ -512,6 +516,31 @@ func databaseEntryAdd(db *sql.DB, entry *Entry) error {
 	return nil
 }
 
+// Inserts a previously deleted entry back with its original entry and subtitle IDs, so that references to them stay valid.
+func databaseEntryRestore(db *sql.DB, entry *Entry) error {
+	query := `
+		INSERT INTO entries (
+			id, url, title, user_id, use_proxy, referer_url, source_url, thumbnail, created_at, last_set_at, audio_url, split_tracks
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+
+	_, err := db.Exec(query, entry.Id, entry.Url, entry.Title, entry.UserId, entry.UseProxy, entry.RefererUrl, entry.SourceUrl, entry.Thumbnail, entry.CreatedAt, entry.LastSetAt, entry.AudioUrl, entry.SplitTracks)
+	if err != nil {
+		LogError("Failed to restore entry id:%v in the database: %v", entry.Id, err)
+		return err
+	}
+
+	for _, sub := range entry.Subtitles {
+		_, err := db.Exec("INSERT INTO subtitles (id, entry_id, name, url, shift) VALUES ($1, $2, $3, $4, $5)", sub.Id, entry.Id, sub.Name, sub.Url, sub.Shift)
+		if err != nil {
+			LogError("Failed to restore subtitle id:%v in the database: %v", sub.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func databaseEntryDelete(db *sql.DB, entryId uint64) bool {
 	_, err := db.Exec("DELETE FROM entries WHERE id = $1", entryId)
 	if err != nil {
@@ -763,7 +792,7 @@ func DatabasePlaylistGet(db *sql.DB) ([]Entry, bool) {
 		SELECT e.*, s.* FROM playlist p
 		JOIN entries e ON p.entry_id = e.id
 		LEFT JOIN subtitles s ON e.id = s.entry_id
-		ORDER BY p.added_at;
+		ORDER BY p.position, p.added_at;
 	`
 
 	rows, err := db.Query(query)
@@ -821,7 +850,7 @@ func DatabasePlaylistGet(db *sql.DB) ([]Entry, bool) {
 	return entries, true
 }
 
-func DatabasePlaylistAdd(db *sql.DB, entry *Entry) error {
+func DatabasePlaylistAdd(db *sql.DB, entry *Entry, toTop bool) error {
 	if db == nil {
 		entry.Id = idSeeder.Add(1)
 		for i := range entry.Subtitles {
@@ -835,7 +864,16 @@ func DatabasePlaylistAdd(db *sql.DB, entry *Entry) error {
 		return err
 	}
 
-	_, err := db.Exec("INSERT INTO playlist (entry_id) VALUES ($1)", entry.Id)
+	return databasePlaylistInsert(db, entry.Id, toTop)
+}
+
+func databasePlaylistInsert(db *sql.DB, entryId uint64, toTop bool) error {
+	query := "INSERT INTO playlist (entry_id, position) VALUES ($1, (SELECT COALESCE(MAX(position), 0) + $2 FROM playlist))"
+	if toTop {
+		query = "INSERT INTO playlist (entry_id, position) VALUES ($1, (SELECT COALESCE(MIN(position), 0) - $2 FROM playlist))"
+	}
+
+	_, err := db.Exec(query, entryId, PLAYLIST_POSITION_GAP)
 	if err != nil {
 		LogError("SQL query failed: %v", err)
 		return err
@@ -844,9 +882,44 @@ func DatabasePlaylistAdd(db *sql.DB, entry *Entry) error {
 	return nil
 }
 
-func DatabasePlaylistAddMany(db *sql.DB, entries []Entry) error {
+func DatabasePlaylistAddMany(db *sql.DB, entries []Entry, toTop bool) error {
+	if !toTop {
+		for i := range entries {
+			if err := DatabasePlaylistAdd(db, &entries[i], false); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Entries added to the top are inserted in reverse so that the first entry ends up first.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := DatabasePlaylistAdd(db, &entries[i], true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DatabasePlaylistRestore puts entries removed from the playlist back under their original IDs, in the provided order.
+func DatabasePlaylistRestore(db *sql.DB, entries []Entry, toTop bool) error {
+	if db == nil {
+		return nil
+	}
+
 	for i := range entries {
-		if err := DatabasePlaylistAdd(db, &entries[i]); err != nil {
+		entry := &entries[i]
+		if toTop {
+			entry = &entries[len(entries)-1-i]
+		}
+
+		if err := databaseEntryRestore(db, entry); err != nil {
+			return err
+		}
+
+		if err := databasePlaylistInsert(db, entry.Id, toTop); err != nil {
 			return err
 		}
 	}
@@ -854,6 +927,94 @@ func DatabasePlaylistAddMany(db *sql.DB, entries []Entry) error {
 	return nil
 }
 
+func databasePlaylistPosition(db *sql.DB, entryId uint64) (float64, bool) {
+	var position float64
+	err := db.QueryRow("SELECT position FROM playlist WHERE entry_id = $1", entryId).Scan(&position)
+	if err != nil {
+		LogError("Failed to get playlist position of entry id:%v: %v", entryId, err)
+		return 0, false
+	}
+
+	return position, true
+}
+
+// Renumbers the whole playlist with evenly spaced positions, preserving the current order.
+func databasePlaylistRenumber(db *sql.DB) bool {
+	query := `
+		UPDATE playlist SET position = numbered.row_number * $1
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (ORDER BY position, added_at) AS row_number FROM playlist
+		) numbered
+		WHERE playlist.id = numbered.id
+	`
+
+	_, err := db.Exec(query, PLAYLIST_POSITION_GAP)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// DatabasePlaylistMove places an entry between its new neighbours, prevId and nextId (0 when there is no neighbour on that side).
+// Only the moved row is updated, unless the gap between the neighbours was exhausted, in which case the playlist is renumbered first.
+func DatabasePlaylistMove(db *sql.DB, entryId uint64, prevId uint64, nextId uint64) bool {
+	if db == nil {
+		return true
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var prev, next float64
+		var ok bool
+
+		switch {
+		case prevId == 0 && nextId == 0:
+			return true
+
+		case prevId == 0:
+			if next, ok = databasePlaylistPosition(db, nextId); !ok {
+				return false
+			}
+			prev = next - 2*PLAYLIST_POSITION_GAP
+
+		case nextId == 0:
+			if prev, ok = databasePlaylistPosition(db, prevId); !ok {
+				return false
+			}
+			next = prev + 2*PLAYLIST_POSITION_GAP
+
+		default:
+			if prev, ok = databasePlaylistPosition(db, prevId); !ok {
+				return false
+			}
+			if next, ok = databasePlaylistPosition(db, nextId); !ok {
+				return false
+			}
+		}
+
+		position := prev + (next-prev)/2
+		if position <= prev || position >= next {
+			// Floating point precision between the neighbours is exhausted.
+			if !databasePlaylistRenumber(db) {
+				return false
+			}
+			continue
+		}
+
+		_, err := db.Exec("UPDATE playlist SET position = $1 WHERE entry_id = $2", position, entryId)
+		if err != nil {
+			LogError("SQL query failed: %v", err)
+			return false
+		}
+
+		return true
+	}
+
+	LogError("Failed to find a playlist position for entry id:%v", entryId)
+	return false
+}
+
 func DatabasePlaylistDelete(db *sql.DB, entryId uint64) bool {
 	if db == nil {
 		return true
@@ -876,6 +1037,37 @@ func DatabasePlaylistClear(db *sql.DB) bool {
 	return true
 }
 
+// DatabasePlaylistReorder assigns evenly spaced positions to all playlist entries following the order of the provided entries.
+func DatabasePlaylistReorder(db *sql.DB, entries []Entry) bool {
+	if db == nil {
+		return true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		LogError("Failed to begin playlist reorder transaction: %v", err)
+		return false
+	}
+
+	defer tx.Rollback()
+
+	for i, entry := range entries {
+		position := float64(i+1) * PLAYLIST_POSITION_GAP
+		_, err = tx.Exec("UPDATE playlist SET position = $1 WHERE entry_id = $2", position, entry.Id)
+		if err != nil {
+			LogError("SQL query failed: %v", err)
+			return false
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		LogError("Failed to commit playlist reorder transaction: %v", err)
+		return false
+	}
+
+	return true
+}
+
 func DatabasePlaylistUpdate(db *sql.DB, id uint64, title string, url string) bool {
 	if db == nil {
 		return true
@@ -890,6 +1082,34 @@ func DatabasePlaylistUpdate(db *sql.DB, id uint64, title string, url string) boo
 	return true
 }
 
+func DatabaseEntryUpdateUrl(db *sql.DB, id uint64, url string) bool {
+	if db == nil {
+		return true
+	}
+
+	_, err := db.Exec("UPDATE entries SET url = $1 WHERE id = $2", url, id)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func DatabaseEntryUpdateThumbnail(db *sql.DB, id uint64, thumbnail string) bool {
+	if db == nil {
+		return true
+	}
+
+	_, err := db.Exec("UPDATE entries SET thumbnail = $1 WHERE id = $2", thumbnail, id)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
 func DatabaseHistoryGet(db *sql.DB) ([]Entry, bool) {
 	if db == nil {
 		return []Entry{}, true
@@ -980,6 +1200,29 @@ func DatabaseHistoryAdd(db *sql.DB, entry *Entry) error {
 	return nil
 }
 
+// DatabaseHistoryRestore puts cleared history entries back under their original IDs, ahead of the current history.
+func DatabaseHistoryRestore(db *sql.DB, entries []Entry) error {
+	if db == nil {
+		return nil
+	}
+
+	// History is ordered by insertion time, so entries are inserted from the newest one, each just before the oldest row.
+	query := "INSERT INTO history (entry_id, added_at) VALUES ($1, (SELECT COALESCE(MIN(added_at), CURRENT_TIMESTAMP) - INTERVAL '1 millisecond' FROM history))"
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := databaseEntryRestore(db, &entries[i]); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(query, entries[i].Id); err != nil {
+			LogError("SQL query failed: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func DatabaseHistoryDelete(db *sql.DB, entryId uint64) bool {
 	if db == nil {
 		return true
@@ -1100,3 +1343,224 @@ func DatabaseMessageDelete(db *sql.DB, messageId uint64) bool {
 
 	return true
 }
+
+func DatabaseScheduleGet(db *sql.DB) ([]Schedule, bool) {
+	if db == nil {
+		return []Schedule{}, true
+	}
+
+	rows, err := db.Query("SELECT id, user_id, start_at, created_at, entry, playlist FROM schedules ORDER BY start_at")
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return []Schedule{}, false
+	}
+
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+
+	for rows.Next() {
+		var temp Schedule
+		var entryJson, playlistJson string
+
+		err := rows.Scan(&temp.Id, &temp.UserId, &temp.StartAt, &temp.CreatedAt, &entryJson, &playlistJson)
+		if err != nil {
+			LogError("SQL query failed: %v", err)
+			return []Schedule{}, false
+		}
+
+		if err := json.Unmarshal([]byte(entryJson), &temp.Entry); err != nil {
+			LogError("Failed to deserialize entry of schedule id:%v: %v", temp.Id, err)
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(playlistJson), &temp.Playlist); err != nil {
+			LogError("Failed to deserialize playlist of schedule id:%v: %v", temp.Id, err)
+			continue
+		}
+
+		schedules = append(schedules, temp)
+	}
+
+	if err := rows.Err(); err != nil {
+		LogError("SQL query failed: %v", err)
+		return []Schedule{}, false
+	}
+
+	return schedules, true
+}
+
+func DatabaseScheduleAdd(db *sql.DB, schedule *Schedule) error {
+	if db == nil {
+		schedule.Id = idSeeder.Add(1)
+		return nil
+	}
+
+	entryJson, err := json.Marshal(schedule.Entry)
+	if err != nil {
+		return err
+	}
+
+	playlistJson, err := json.Marshal(schedule.Playlist)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO schedules (
+			user_id, start_at, created_at, entry, playlist
+		) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	row := db.QueryRow(query, schedule.UserId, schedule.StartAt, schedule.CreatedAt, string(entryJson), string(playlistJson))
+	if err := row.Scan(&schedule.Id); err != nil {
+		LogError("Failed to save schedule for user id:%v because of: %v", schedule.UserId, err)
+		return err
+	}
+
+	return nil
+}
+
+func DatabaseScheduleDelete(db *sql.DB, scheduleId uint64) bool {
+	if db == nil {
+		return true
+	}
+
+	_, err := db.Exec("DELETE FROM schedules WHERE id = $1", scheduleId)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func DatabaseUploadGet(db *sql.DB) ([]UploadRecord, bool) {
+	if db == nil {
+		return []UploadRecord{}, true
+	}
+
+	rows, err := db.Query("SELECT id, user_id, path, size, created_at FROM uploads ORDER BY created_at")
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return []UploadRecord{}, false
+	}
+
+	defer rows.Close()
+
+	uploads := make([]UploadRecord, 0)
+
+	for rows.Next() {
+		var temp UploadRecord
+		err := rows.Scan(&temp.Id, &temp.UserId, &temp.Path, &temp.Size, &temp.CreatedAt)
+		if err != nil {
+			LogError("SQL query failed: %v", err)
+			return []UploadRecord{}, false
+		}
+
+		uploads = append(uploads, temp)
+	}
+
+	return uploads, true
+}
+
+func DatabaseUploadAdd(db *sql.DB, upload *UploadRecord) error {
+	if db == nil {
+		upload.Id = idSeeder.Add(1)
+		return nil
+	}
+
+	query := `
+		INSERT INTO uploads (
+			user_id, path, size, created_at
+		) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+
+	row := db.QueryRow(query, upload.UserId, upload.Path, upload.Size, upload.CreatedAt)
+	if err := row.Scan(&upload.Id); err != nil {
+		LogError("Failed to save upload record for user id:%v because of: %v", upload.UserId, err)
+		return err
+	}
+
+	return nil
+}
+
+func DatabaseUploadDelete(db *sql.DB, path string) bool {
+	if db == nil {
+		return true
+	}
+
+	_, err := db.Exec("DELETE FROM uploads WHERE path = $1", path)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func DatabaseUploadRename(db *sql.DB, id uint64, path string) bool {
+	if db == nil {
+		return true
+	}
+
+	_, err := db.Exec("UPDATE uploads SET path = $1 WHERE id = $2", path, id)
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func DatabaseStreamKeyGet(db *sql.DB) ([]StreamKey, bool) {
+	if db == nil {
+		return []StreamKey{}, true
+	}
+
+	rows, err := db.Query("SELECT user_id, stream_key, created_at FROM stream_keys")
+	if err != nil {
+		LogError("SQL query failed: %v", err)
+		return []StreamKey{}, false
+	}
+
+	defer rows.Close()
+
+	keys := make([]StreamKey, 0)
+
+	for rows.Next() {
+		var temp StreamKey
+		err := rows.Scan(&temp.UserId, &temp.Key, &temp.CreatedAt)
+		if err != nil {
+			LogError("SQL query failed: %v", err)
+			return []StreamKey{}, false
+		}
+
+		keys = append(keys, temp)
+	}
+
+	return keys, true
+}
+
+func DatabaseStreamKeySet(db *sql.DB, key StreamKey) bool {
+	if db == nil {
+		return true
+	}
+
+	query := `
+		INSERT INTO stream_keys (
+			user_id, stream_key, created_at
+		) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET stream_key = $2, created_at = $3
+	`
+
+	_, err := db.Exec(query, key.UserId, key.Key, key.CreatedAt)
+	if err != nil {
+		LogError("Failed to save stream key for user id:%v because of: %v", key.UserId, err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DvrWindow retains segments of a live stream after they leave the source playlist, so the room can rewind the stream
+// and the server can store it as a VOD entry once it ends. Segments are kept until the window exceeds its length.
+// Not synchronized, the owner of the window is expected to serialize calls.
+type DvrWindow struct {
+	length        float64   // seconds of segments kept, including segments listed by the source playlist
+	segments      []Segment // every segment of the window, oldest first, without parts
+	firstSequence int       // media sequence of the first segment
+	discontinuity int       // discontinuity sequence of the first segment
+}
+
+// Returns nil when the window is disabled.
+func newDvrWindow(minutes float64) *DvrWindow {
+	if minutes <= 0 {
+		return nil
+	}
+
+	return &DvrWindow{length: minutes * 60}
+}
+
+func hasDiscontinuity(segment *Segment) bool {
+	return slices.ContainsFunc(segment.attributePairs, func(pair KeyValue) bool {
+		return pair.key == EXT_X_DISCONTINUITY
+	})
+}
+
+// extend merges the source playlist into the window and prepends the retained segments which the source no longer
+// lists, adjusting the media and discontinuity sequence to match. Segment URLs must already be rewritten to the names
+// they are served under. Returns segments which fell out of the window.
+func (dvr *DvrWindow) extend(m3u *M3U) []Segment {
+	sequence, err := parseInt(m3u.getAttribute(EXT_X_MEDIA_SEQUENCE))
+	if err != nil {
+		sequence = 0
+	}
+	discontinuity, err := parseInt(m3u.getAttribute(EXT_X_DISCONTINUITY_SEQUENCE))
+	if err != nil {
+		discontinuity = 0
+	}
+
+	removed := make([]Segment, 0)
+	end := dvr.firstSequence + len(dvr.segments)
+	if len(dvr.segments) == 0 || sequence < dvr.firstSequence || sequence > end {
+		// The first playlist, a restart of the stream or a gap after the source moved past the retained segments.
+		if len(dvr.segments) > 0 {
+			LogWarn("Media sequence of the live stream jumped from %v to %v, clearing the DVR window.", end, sequence)
+		}
+		removed = dvr.clear()
+		dvr.firstSequence = sequence
+		dvr.discontinuity = discontinuity
+		end = sequence
+	}
+
+	// Segments are stored with the map and key in effect, the segment which listed them may leave the window first.
+	var mapUri string
+	var mapRange *ByteRange
+	var key Key
+	hasKey := false
+	for i, segment := range m3u.segments {
+		if segment.mapUri != "" {
+			mapUri, mapRange = segment.mapUri, segment.mapRange
+		}
+		if segment.hasKey {
+			key, hasKey = segment.key, true
+		}
+
+		if sequence+i < end {
+			continue
+		}
+
+		segment.parts = nil
+		segment.mapUri, segment.mapRange = mapUri, mapRange
+		segment.key, segment.hasKey = key, hasKey
+		dvr.segments = append(dvr.segments, segment)
+	}
+
+	removed = append(removed, dvr.trim(sequence)...)
+
+	retained := slices.Clone(dvr.segments[:sequence-dvr.firstSequence])
+	m3u.segments = append(retained, m3u.segments...)
+
+	removeRepeatedMaps(m3u.segments)
+	removeRepeatedKeys(m3u.segments)
+	m3u.setAttribute(EXT_X_MEDIA_SEQUENCE, toString(dvr.firstSequence))
+	if dvr.discontinuity > 0 {
+		m3u.setAttribute(EXT_X_DISCONTINUITY_SEQUENCE, toString(dvr.discontinuity))
+	}
+
+	// Clients have to be allowed to seek back into the window, the playlist grows only when the window is not full.
+	m3u.removeAttributes(EXT_X_PLAYLIST_TYPE)
+	return removed
+}
+
+// Maps are listed only where they change, segments which carry the map in effect have it removed.
+func removeRepeatedMaps(segments []Segment) {
+	previousUri, previousRange := "", ""
+	for i := range segments {
+		segment := &segments[i]
+		if segment.mapUri == "" {
+			continue
+		}
+
+		currentRange := ""
+		if segment.mapRange != nil {
+			currentRange = segment.mapRange.String()
+		}
+
+		if segment.mapUri == previousUri && currentRange == previousRange {
+			segment.mapUri, segment.mapRange = "", nil
+			continue
+		}
+		previousUri, previousRange = segment.mapUri, currentRange
+	}
+}
+
+// Keys are listed only where they change, segments which carry the key in effect have it removed.
+func removeRepeatedKeys(segments []Segment) {
+	var previous *Key
+	for i := range segments {
+		segment := &segments[i]
+		if !segment.hasKey {
+			continue
+		}
+
+		if previous != nil && segment.key == *previous {
+			segment.key, segment.hasKey = Key{}, false
+			continue
+		}
+		previous = &segment.key
+	}
+}
+
+// Removes every segment of the window.
+func (dvr *DvrWindow) clear() []Segment {
+	removed := dvr.segments
+	dvr.segments = nil
+	return removed
+}
+
+// Removes the oldest segments exceeding the window length, never removing segments still listed by the source.
+func (dvr *DvrWindow) trim(sourceSequence int) []Segment {
+	total := 0.0
+	for _, segment := range dvr.segments {
+		total += segment.length
+	}
+
+	count := 0
+	for count < len(dvr.segments) && dvr.firstSequence+count < sourceSequence {
+		if total-dvr.segments[count].length < dvr.length {
+			break
+		}
+
+		// Removing a discontinuity tag advances the discontinuity sequence.
+		if hasDiscontinuity(&dvr.segments[count]) {
+			dvr.discontinuity++
+		}
+		total -= dvr.segments[count].length
+		count++
+	}
+
+	removed := slices.Clone(dvr.segments[:count])
+	dvr.segments = slices.Delete(dvr.segments, 0, count)
+	dvr.firstSequence += count
+	return removed
+}
+
+// Creates the directory of a new recording of the entry, named after its title and the current time.
+func createRecordingDirectory(title string) (string, error) {
+	words := strings.FieldsFunc(title, func(char rune) bool {
+		return !unicode.IsLetter(char) && !unicode.IsDigit(char) && char != '-'
+	})
+
+	name := strings.Join(words, "_")
+	if name == "" {
+		name = "stream"
+	}
+
+	if err := os.MkdirAll(MEDIA_RECORDINGS, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	// Recordings of the same stream may be saved within the same second, for example by the DVR window and a recorder.
+	base := MEDIA_RECORDINGS + name + "_" + time.Now().Format("2006-01-02_15-04-05")
+	directory := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(directory, os.ModePerm)
+		if err == nil {
+			return directory + "/", nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		directory = base + "_" + toString(i)
+	}
+}
+
+// Links a file into the recording, copying it when hard links are not supported.
+func linkRecordingFile(source, destination string) error {
+	if err := os.Link(source, destination); err == nil {
+		return nil
+	}
+
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	_, err = io.Copy(output, input)
+	return err
+}
+
+// saveLiveRecording stores the ended live stream as a VOD playlist under MEDIA_RECORDINGS and adds it to history.
+// Segments, maps and keys of the playlist are expected to be stored in the source directory under their URLs.
+func (server *Server) saveLiveRecording(m3u *M3U, sourceDir string, title string, userId uint64) {
+	if len(m3u.segments) == 0 {
+		return
+	}
+
+	directory, err := createRecordingDirectory(title)
+	if err != nil {
+		LogError("Failed to create recording directory for %v: %v", title, err)
+		return
+	}
+
+	recording := m3u.copy()
+	linked := make(map[string]bool)
+	for _, segment := range recording.segments {
+		keyUri := ""
+		if segment.hasKey {
+			keyUri = segment.key.uri
+		}
+
+		for _, file := range []string{segment.url, segment.mapUri, keyUri} {
+			if file == "" || linked[file] || isAbsolute(file) {
+				continue
+			}
+			linked[file] = true
+
+			source, safe := safeJoin(sourceDir, file)
+			destination, safeDestination := safeJoin(directory, file)
+			if !safe || !safeDestination {
+				LogError("Recording file %v points outside of the stream directory", file)
+				os.RemoveAll(directory)
+				return
+			}
+
+			os.MkdirAll(path.Dir(destination), os.ModePerm)
+			if err := linkRecordingFile(source, destination); err != nil {
+				LogError("Failed to store recording file %v: %v", file, err)
+				os.RemoveAll(directory)
+				return
+			}
+		}
+	}
+
+	server.finishRecording(&recording, directory, title, userId)
+}
+
+// finishRecording writes the playlist of the recording stored in the directory as a VOD playlist and adds it to history.
+func (server *Server) finishRecording(recording *M3U, directory string, title string, userId uint64) {
+	recording.isLive = false
+	recording.clearLowLatency()
+	recording.setAttribute(EXT_X_PLAYLIST_TYPE, "VOD")
+
+	playlistPath := directory + RECORDING_M3U8
+	file, err := os.Create(playlistPath)
+	if err != nil {
+		LogError("Failed to create recording playlist %v: %v", playlistPath, err)
+		os.RemoveAll(directory)
+		return
+	}
+	err = recording.serializeTo(file)
+	file.Close()
+	if err != nil {
+		LogError("Failed to write recording playlist %v: %v", playlistPath, err)
+		os.RemoveAll(directory)
+		return
+	}
+
+	entry := Entry{
+		Url:       playlistPath,
+		UserId:    userId,
+		Title:     fmt.Sprintf("%v (recording)", title),
+		UseProxy:  false,
+		Subtitles: []Subtitle{},
+		CreatedAt: time.Now(),
+	}
+
+	server.state.mutex.Lock()
+	err = server.historyAdd(entry)
+	server.state.mutex.Unlock()
+	if err != nil {
+		LogError("Failed to add recording %v to history: %v", playlistPath, err)
+		return
+	}
+
+	LogInfo("Live stream '%v' was saved as %v.", title, playlistPath)
+	go server.libraryRescan()
+}
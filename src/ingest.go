@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Streams can also be pushed to the server as a continuous MPEG-TS stream, the way OBS and ffmpeg output to a URL, over
+// a chunked HTTP request or binary WebSocket messages. The pusher is authorized with the stream key of the user. The
+// server cuts the stream into segments at keyframes on its own and publishes them as a hosted stream, served under
+// STREAM_ROUTE like streams uploaded one segment at a time.
+
+const TS_PACKET_SIZE = 188
+const TS_SYNC_BYTE = 0x47
+const TS_PAT_PID = 0x0000
+const TS_CLOCK_RATE = 90000.0
+const TS_TIMESTAMP_WRAP = int64(1) << 33
+
+// Stream types of the program map table carrying video and audio elementary streams.
+var TS_VIDEO_STREAM_TYPES = []byte{0x01, 0x02, 0x10, 0x1B, 0x24}
+var TS_AUDIO_STREAM_TYPES = []byte{0x03, 0x04, 0x0F, 0x11, 0x81}
+
+// TsSegmenter cuts an MPEG-TS stream into segments starting at keyframes of its media stream, which is the first video
+// stream of the program, or the first audio stream when it has no video. Every segment begins with the most recent
+// program tables, so each one can be decoded on its own.
+type TsSegmenter struct {
+	target  float64 // seconds after which the segment is cut at the next keyframe
+	publish func(data []byte, sequence int, duration float64) error
+
+	pmtPid   int // -1 until the program association table is received
+	mediaPid int // -1 until the program map table is received
+	isVideo  bool
+	pat      []byte
+	pmt      []byte
+
+	segment       bytes.Buffer
+	started       bool  // the current segment begins at a keyframe
+	startTime     int64 // timestamp of the first frame of the segment, in 90kHz ticks without wrapping
+	lastTime      int64 // timestamp of the last frame of the stream, in 90kHz ticks without wrapping
+	frameDuration int64 // distance between the last two frames
+	sequence      int
+}
+
+func newTsSegmenter(target float64, publish func(data []byte, sequence int, duration float64) error) *TsSegmenter {
+	return &TsSegmenter{
+		target:   target,
+		publish:  publish,
+		pmtPid:   -1,
+		mediaPid: -1,
+	}
+}
+
+// Reads packets of the stream until it ends or publishing a segment fails, publishing the final segment at the end.
+func (segmenter *TsSegmenter) segmentFrom(reader io.Reader) error {
+	packet := make([]byte, TS_PACKET_SIZE)
+	skipped := 0
+	for {
+		dropped, err := readTsPacket(reader, packet)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return segmenter.flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if dropped > 0 && skipped == 0 {
+			LogWarn("Pushed stream is not aligned to MPEG-TS packets, skipping %v bytes to the next sync byte.", dropped)
+		}
+		skipped += dropped
+
+		if err := segmenter.handlePacket(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads the next packet into the buffer, skipping bytes until the sync byte. Returns the number of bytes skipped.
+func readTsPacket(reader io.Reader, packet []byte) (int, error) {
+	dropped := 0
+	filled := 0
+	for {
+		if _, err := io.ReadFull(reader, packet[filled:]); err != nil {
+			return dropped, err
+		}
+
+		if packet[0] == TS_SYNC_BYTE {
+			return dropped, nil
+		}
+
+		index := bytes.IndexByte(packet, TS_SYNC_BYTE)
+		if index == -1 {
+			index = len(packet)
+		}
+
+		dropped += index
+		filled = copy(packet, packet[index:])
+	}
+}
+
+func (segmenter *TsSegmenter) handlePacket(packet []byte) error {
+	pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+	payloadStart := packet[1]&0x40 != 0
+	payload, randomAccess := tsPacketPayload(packet)
+
+	switch {
+	case pid == TS_PAT_PID && payloadStart:
+		if pmtPid, found := parseTsPat(payload); found {
+			segmenter.pmtPid = pmtPid
+			segmenter.pat = slices.Clone(packet)
+		}
+
+	case pid == segmenter.pmtPid && payloadStart:
+		if mediaPid, isVideo, found := parseTsPmt(payload); found {
+			if segmenter.mediaPid != -1 && segmenter.mediaPid != mediaPid {
+				LogWarn("Media stream of the pushed stream changed from PID %v to %v.", segmenter.mediaPid, mediaPid)
+				if err := segmenter.cut(true); err != nil {
+					return err
+				}
+				segmenter.started = false
+			}
+			segmenter.mediaPid, segmenter.isVideo = mediaPid, isVideo
+			segmenter.pmt = slices.Clone(packet)
+		}
+
+	case pid == segmenter.mediaPid && payloadStart:
+		timestamp, found := parsePesTimestamp(payload)
+		if !found {
+			break
+		}
+
+		keyframe := randomAccess || !segmenter.isVideo
+		if err := segmenter.handleFrame(timestamp, keyframe); err != nil {
+			return err
+		}
+	}
+
+	if !segmenter.started {
+		return nil
+	}
+
+	// Encoders sending keyframes rarely are cut without one, rather than producing oversized segments.
+	if segmenter.segment.Len()+TS_PACKET_SIZE > MAX_STREAM_CHUNK_SIZE {
+		if err := segmenter.cut(false); err != nil {
+			return err
+		}
+		segmenter.startTime = segmenter.lastTime
+		segmenter.writeTables()
+	}
+
+	segmenter.segment.Write(packet)
+	return nil
+}
+
+func (segmenter *TsSegmenter) handleFrame(timestamp int64, keyframe bool) error {
+	if !segmenter.started {
+		if !keyframe || segmenter.pat == nil {
+			return nil
+		}
+
+		segmenter.started = true
+		segmenter.startTime = timestamp
+		segmenter.lastTime = timestamp
+		segmenter.frameDuration = 0
+		segmenter.writeTables()
+		return nil
+	}
+
+	// Timestamps wrap around every 2^33 ticks, the distance to the previous frame is taken modulo the wrap.
+	delta := (timestamp - segmenter.lastTime%TS_TIMESTAMP_WRAP + TS_TIMESTAMP_WRAP) % TS_TIMESTAMP_WRAP
+	if delta >= TS_TIMESTAMP_WRAP/2 || float64(delta)/TS_CLOCK_RATE > MAX_STREAM_SEGMENT_DURATION {
+		LogWarn("Timestamps of the pushed stream jumped by %.1fs, marking a discontinuity.", float64(delta)/TS_CLOCK_RATE)
+		if err := segmenter.cut(true); err != nil {
+			return err
+		}
+
+		// The next segment has to begin at a keyframe again.
+		segmenter.started = false
+		return segmenter.handleFrame(timestamp, keyframe)
+	}
+
+	if delta > 0 {
+		segmenter.frameDuration = delta
+	}
+	segmenter.lastTime += delta
+
+	elapsed := float64(segmenter.lastTime-segmenter.startTime) / TS_CLOCK_RATE
+	if (keyframe && elapsed >= segmenter.target) || elapsed >= 3*segmenter.target {
+		if err := segmenter.cut(false); err != nil {
+			return err
+		}
+		segmenter.startTime = segmenter.lastTime
+		segmenter.writeTables()
+	}
+
+	return nil
+}
+
+func (segmenter *TsSegmenter) writeTables() {
+	segmenter.segment.Write(segmenter.pat)
+	segmenter.segment.Write(segmenter.pmt)
+}
+
+// Publishes the current segment. With the discontinuity, the segment ends after its last frame, otherwise it ends where
+// the next segment begins. A discontinuity skips a sequence number, so the gap is marked in the served playlist.
+func (segmenter *TsSegmenter) cut(discontinuity bool) error {
+	defer segmenter.segment.Reset()
+
+	end := segmenter.lastTime
+	if discontinuity {
+		end += segmenter.frameDuration
+	}
+
+	duration := float64(end-segmenter.startTime) / TS_CLOCK_RATE
+	if !segmenter.started || duration <= 0 {
+		return nil
+	}
+
+	if err := segmenter.publish(segmenter.segment.Bytes(), segmenter.sequence, duration); err != nil {
+		return err
+	}
+
+	segmenter.sequence++
+	if discontinuity {
+		segmenter.sequence++
+	}
+	return nil
+}
+
+// Publishes the final segment of the stream.
+func (segmenter *TsSegmenter) flush() error {
+	err := segmenter.cut(true)
+	segmenter.started = false
+	return err
+}
+
+// Returns the payload of the packet and whether its adaptation field sets the random access indicator.
+func tsPacketPayload(packet []byte) ([]byte, bool) {
+	control := (packet[3] >> 4) & 0x3
+	offset := 4
+	randomAccess := false
+
+	if control&0x2 != 0 {
+		length := int(packet[4])
+		if length > 0 {
+			randomAccess = packet[5]&0x40 != 0
+		}
+		offset += 1 + length
+	}
+
+	if control&0x1 == 0 || offset >= len(packet) {
+		return nil, randomAccess
+	}
+
+	return packet[offset:], randomAccess
+}
+
+// Returns the section of the table starting in the payload, bounded by its length and without the checksum.
+func tsTableSection(payload []byte, tableId byte) ([]byte, bool) {
+	if len(payload) == 0 {
+		return nil, false
+	}
+
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, false
+	}
+
+	section := payload[1+pointer:]
+	if section[0] != tableId {
+		return nil, false
+	}
+
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + length - 4
+	if length < 9 || end > len(section) {
+		return nil, false
+	}
+
+	return section[:end], true
+}
+
+// Returns the PID of the program map table of the first program listed by the program association table.
+func parseTsPat(payload []byte) (int, bool) {
+	section, found := tsTableSection(payload, 0x00)
+	if !found {
+		return 0, false
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program == 0 {
+			// Program number 0 points to the network information table.
+			continue
+		}
+
+		return int(section[i+2]&0x1F)<<8 | int(section[i+3]), true
+	}
+
+	return 0, false
+}
+
+// Returns the PID of the first video stream listed by the program map table, or of the first audio stream when there
+// is no video.
+func parseTsPmt(payload []byte) (int, bool, bool) {
+	section, found := tsTableSection(payload, 0x02)
+	if !found || len(section) < 12 {
+		return 0, false, false
+	}
+
+	audioPid := -1
+	infoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + infoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1F)<<8 | int(section[i+2])
+		esInfoLength := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		i += 5 + esInfoLength
+
+		if slices.Contains(TS_VIDEO_STREAM_TYPES, streamType) {
+			return pid, true, true
+		}
+
+		if audioPid == -1 && slices.Contains(TS_AUDIO_STREAM_TYPES, streamType) {
+			audioPid = pid
+		}
+	}
+
+	if audioPid == -1 {
+		return 0, false, false
+	}
+
+	return audioPid, false, true
+}
+
+// Returns the decoding timestamp of the PES packet starting in the payload, or its presentation timestamp when the
+// decoding timestamp is not present.
+func parsePesTimestamp(payload []byte) (int64, bool) {
+	if len(payload) < 14 || payload[0] != 0x00 || payload[1] != 0x00 || payload[2] != 0x01 {
+		return 0, false
+	}
+
+	flags := payload[7] >> 6
+	switch flags {
+	case 0x2:
+		return parsePesClock(payload[9:14]), true
+	case 0x3:
+		if len(payload) < 19 {
+			return 0, false
+		}
+		return parsePesClock(payload[14:19]), true
+	}
+
+	return 0, false
+}
+
+func parsePesClock(field []byte) int64 {
+	clock := int64(field[0]>>1&0x07) << 30
+	clock |= int64(field[1]) << 22
+	clock |= int64(field[2]>>1) << 15
+	clock |= int64(field[3]) << 7
+	clock |= int64(field[4] >> 1)
+	return clock
+}
+
+// Returns the presentation timestamp of the first PES packet in the MPEG-TS data.
+func firstPesPresentationTimestamp(data []byte) (int64, bool) {
+	for offset := 0; offset+TS_PACKET_SIZE <= len(data); offset += TS_PACKET_SIZE {
+		packet := data[offset : offset+TS_PACKET_SIZE]
+		if packet[0] != TS_SYNC_BYTE || packet[1]&0x40 == 0 {
+			continue
+		}
+
+		payload, _ := tsPacketPayload(packet)
+		if len(payload) < 14 || payload[0] != 0x00 || payload[1] != 0x00 || payload[2] != 0x01 || payload[7]&0x80 == 0 {
+			continue
+		}
+
+		return parsePesClock(payload[9:14]), true
+	}
+
+	return 0, false
+}
+
+// Returns the stream key of the user, generating one when the user has none.
+func (server *Server) streamKeyGet(userId uint64) (StreamKey, error) {
+	server.state.streamKeyLock.Lock()
+	defer server.state.streamKeyLock.Unlock()
+
+	index := slices.IndexFunc(server.state.streamKeys, func(key StreamKey) bool {
+		return key.UserId == userId
+	})
+	if index != -1 {
+		return server.state.streamKeys[index], nil
+	}
+
+	return server.streamKeyGenerate(userId)
+}
+
+// Replaces the stream key of the user with a new one, so the previous key can no longer be used to push streams.
+func (server *Server) streamKeyReset(userId uint64) (StreamKey, error) {
+	server.state.streamKeyLock.Lock()
+	defer server.state.streamKeyLock.Unlock()
+
+	return server.streamKeyGenerate(userId)
+}
+
+// Expects the stream key lock to be held.
+func (server *Server) streamKeyGenerate(userId uint64) (StreamKey, error) {
+	key := StreamKey{
+		UserId:    userId,
+		Key:       generateToken(),
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	if key.Key == "" || !DatabaseStreamKeySet(server.db, key) {
+		return StreamKey{}, errors.New("Failed to generate a new stream key")
+	}
+
+	index := slices.IndexFunc(server.state.streamKeys, func(key StreamKey) bool {
+		return key.UserId == userId
+	})
+	if index == -1 {
+		server.state.streamKeys = append(server.state.streamKeys, key)
+	} else {
+		server.state.streamKeys[index] = key
+	}
+
+	return key, nil
+}
+
+// Returns the user the stream key belongs to, nil when the key is not valid.
+func (server *Server) findStreamKeyUser(key string) *User {
+	if key == "" {
+		return nil
+	}
+
+	server.state.streamKeyLock.Lock()
+	index := slices.IndexFunc(server.state.streamKeys, func(streamKey StreamKey) bool {
+		return streamKey.Key == key
+	})
+	userId := uint64(0)
+	if index != -1 {
+		userId = server.state.streamKeys[index].UserId
+	}
+	server.state.streamKeyLock.Unlock()
+
+	if index == -1 {
+		return nil
+	}
+
+	server.users.mutex.Lock()
+	defer server.users.mutex.Unlock()
+
+	user := server.findUserById(userId)
+	if user == nil {
+		return nil
+	}
+
+	found := *user
+	return &found
+}
+
+// ingestStream hosts the MPEG-TS stream read from the pusher until it ends, the pusher disconnects or the stream is
+// stopped or replaced by another one.
+func (server *Server) ingestStream(reader io.Reader, user *User) error {
+	stream := server.startHostedStream(user)
+	defer server.stopHostedStream(stream, user.Id)
+
+	segmenter := newTsSegmenter(STREAM_PUSH_SEGMENT_DURATION, func(data []byte, sequence int, duration float64) error {
+		file, err := os.CreateTemp(CONTENT_STREAM, "upload-*")
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(data)
+		file.Close()
+		if err != nil {
+			os.Remove(file.Name())
+			return err
+		}
+
+		filename := fmt.Sprintf("stream%v.ts", sequence)
+		return stream.acceptUpload(file.Name(), filename, sequence, duration, int64(len(data)))
+	})
+
+	err := segmenter.segmentFrom(reader)
+	if errors.Is(err, errStreamEnded) {
+		return nil
+	}
+	return err
+}
+
+// Reads the body of a pushed stream, failing once the pusher stops sending data for too long.
+type pushReader struct {
+	body       io.Reader
+	controller *http.ResponseController
+}
+
+func (reader *pushReader) Read(buffer []byte) (int, error) {
+	err := reader.controller.SetReadDeadline(time.Now().Add(STREAM_PUSH_READ_TIMEOUT))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+
+	return reader.body.Read(buffer)
+}
+
+// Reads the binary messages of a WebSocket connection as one continuous stream, ending once the connection is closed.
+type websocketReader struct {
+	conn    *websocket.Conn
+	message io.Reader
+}
+
+func (reader *websocketReader) Read(buffer []byte) (int, error) {
+	for {
+		if reader.message != nil {
+			n, err := reader.message.Read(buffer)
+			if err != io.EOF {
+				return n, err
+			}
+
+			reader.message = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		reader.conn.SetReadDeadline(time.Now().Add(STREAM_PUSH_READ_TIMEOUT))
+		messageType, message, err := reader.conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if messageType == websocket.BinaryMessage {
+			reader.message = message
+		}
+	}
+}
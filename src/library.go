@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MAX_LIBRARY_PAGE_SIZE = 200
+const DEFAULT_LIBRARY_PAGE_SIZE = 50
+
+// Index of media files stored on the server, rebuilt on startup, after uploads and on demand.
+type Library struct {
+	mutex sync.Mutex
+	files []LibraryFile
+
+	// Directories scanned recursively in addition to CONTENT_MEDIA, all of them within CONTENT_ROOT.
+	roots []string
+
+	scanning   atomic.Bool
+	rescanNext atomic.Bool
+	lastScan   time.Time
+}
+
+type LibraryFile struct {
+	// Relative path of the file, starting with CONTENT_ROOT, usable as an entry URL.
+	Path string `json:"path"`
+	Name string `json:"name"`
+
+	// One of: video, audio, subs, image, other. Derived from the file extension with getMediaType.
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+
+	// Duration in seconds, 0 when unknown or not applicable.
+	Duration float64 `json:"duration"`
+
+	// Unix time in milliseconds.
+	ModifiedAt int64 `json:"modified_at"`
+}
+
+type LibraryListRequest struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Count  int    `json:"count"`
+}
+
+type LibrarySearchRequest struct {
+	Query  string `json:"query"`
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Count  int    `json:"count"`
+}
+
+type LibraryPageResponse struct {
+	Files []LibraryFile `json:"files"`
+	Total int           `json:"total"`
+}
+
+func createLibrary(extraRoots []string) *Library {
+	roots := []string{CONTENT_MEDIA}
+
+	for _, root := range extraRoots {
+		root = filepath.ToSlash(filepath.Clean(root))
+		if !filepath.IsLocal(root) {
+			LogWarn("Library root '%v' is not a local relative path. Skipping.", root)
+			continue
+		}
+
+		// Only files within CONTENT_ROOT are served, files of other roots could not be played.
+		if !strings.HasPrefix(root+"/", CONTENT_ROOT) {
+			LogWarn("Library root '%v' is outside of '%v' and could not be served. Skipping.", root, CONTENT_ROOT)
+			continue
+		}
+
+		if slices.Contains(roots, root) {
+			continue
+		}
+
+		roots = append(roots, root)
+	}
+
+	return &Library{
+		files: make([]LibraryFile, 0),
+		roots: roots,
+	}
+}
+
+// Rescans all library roots. When a scan is already in progress, another one is performed right after it finishes.
+func (server *Server) libraryRescan() {
+	library := server.library
+	if !library.scanning.CompareAndSwap(false, true) {
+		library.rescanNext.Store(true)
+		return
+	}
+
+	for {
+		library.rescanNext.Store(false)
+		library.scan()
+
+		if !library.rescanNext.Load() {
+			break
+		}
+	}
+
+	library.scanning.Store(false)
+
+	library.mutex.Lock()
+	total := len(library.files)
+	library.mutex.Unlock()
+
+	server.writeEventToAllConnections("libraryupdate", total, SERVER_ID)
+}
+
+func (library *Library) scan() {
+	start := time.Now()
+
+	// Previously indexed files are reused to avoid probing unchanged files again.
+	library.mutex.Lock()
+	previous := make(map[string]LibraryFile, len(library.files))
+	for _, file := range library.files {
+		previous[file.Path] = file
+	}
+	library.mutex.Unlock()
+
+	files := make([]LibraryFile, 0, len(previous))
+	seen := make(map[string]bool)
+
+	for _, root := range library.roots {
+		err := WalkFiles(root, func(filePath string, entry os.DirEntry) {
+			if seen[filePath] || strings.HasPrefix(filePath, MEDIA_THUMB) || strings.HasPrefix(filePath, MEDIA_PARTIAL) {
+				return
+			}
+
+			// Recordings are listed by their playlists only, not by each of their segments.
+			if strings.HasPrefix(filePath, MEDIA_RECORDINGS) && !isPathM3U(filePath) {
+				return
+			}
+			seen[filePath] = true
+
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				return
+			}
+
+			file := LibraryFile{
+				Path:       filePath,
+				Name:       path.Base(filePath),
+				Type:       getMediaType(path.Ext(filePath)),
+				Size:       info.Size(),
+				ModifiedAt: info.ModTime().UnixMilli(),
+			}
+
+			old, exists := previous[filePath]
+			if exists && old.Size == file.Size && old.ModifiedAt == file.ModifiedAt {
+				file.Duration = old.Duration
+			} else if file.Type == "video" || file.Type == "audio" {
+				file.Duration = probeMediaDuration(filePath)
+			}
+
+			files = append(files, file)
+		})
+
+		if err != nil && !os.IsNotExist(err) {
+			LogWarn("Failed to scan library root '%v': %v", root, err)
+		}
+	}
+
+	slices.SortFunc(files, func(a, b LibraryFile) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+
+	library.mutex.Lock()
+	library.files = files
+	library.lastScan = time.Now()
+	library.mutex.Unlock()
+
+	LogInfo("Library scan indexed %v files in %v.", len(files), time.Since(start).Round(time.Millisecond))
+}
+
+func probeMediaDuration(filePath string) float64 {
+	probe, err := probeMediaFile(filePath)
+	if err != nil {
+		return 0
+	}
+
+	return probe.Duration
+}
+
+func (library *Library) list(request LibraryListRequest) LibraryPageResponse {
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+
+	filtered := filterLibraryFiles(library.files, "", request.Type)
+	return paginateLibraryFiles(filtered, request.Offset, request.Count)
+}
+
+func (library *Library) search(request LibrarySearchRequest) LibraryPageResponse {
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+
+	filtered := filterLibraryFiles(library.files, request.Query, request.Type)
+	return paginateLibraryFiles(filtered, request.Offset, request.Count)
+}
+
+// Returns files of the given media type (any type when empty) whose paths contain every word of the query, ignoring case.
+func filterLibraryFiles(files []LibraryFile, query string, mediaType string) []LibraryFile {
+	words := strings.Fields(strings.ToLower(query))
+	filtered := make([]LibraryFile, 0)
+
+	for _, file := range files {
+		if mediaType != "" && file.Type != mediaType {
+			continue
+		}
+
+		lowerPath := strings.ToLower(file.Path)
+		matches := true
+		for _, word := range words {
+			if !strings.Contains(lowerPath, word) {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			filtered = append(filtered, file)
+		}
+	}
+
+	return filtered
+}
+
+func paginateLibraryFiles(files []LibraryFile, offset int, count int) LibraryPageResponse {
+	if count <= 0 {
+		count = DEFAULT_LIBRARY_PAGE_SIZE
+	}
+	count = min(count, MAX_LIBRARY_PAGE_SIZE)
+
+	offset = max(offset, 0)
+	offset = min(offset, len(files))
+	end := min(offset+count, len(files))
+
+	page := make([]LibraryFile, end-offset)
+	copy(page, files[offset:end])
+
+	return LibraryPageResponse{
+		Files: page,
+		Total: len(files),
+	}
+}
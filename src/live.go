@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Starts the refresher of a live proxy. Expects the setup lock to be held.
+func (server *Server) startLiveRefresher(proxy *HlsProxy) {
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy.stopPrefetch = cancel
+	proxy.prefetchDone = make(chan struct{})
+
+	// The playlist is about to be requested by clients loading the new entry.
+	proxy.lastServed.Store(time.Now().UnixMilli())
+	go server.runLiveRefresher(ctx, proxy)
+}
+
+// runLiveRefresher polls the origin playlist at the cadence it advertises, so every client is served the same playlist
+// from memory and new segments are downloaded before clients request them. Polling pauses while no client requests the
+// stream and stops once the origin ends it. With the DVR window enabled every segment is downloaded and polling never
+// pauses, so the window has no gaps and the stream can be saved once it ends. The same applies while the stream is being
+// recorded, the recording is saved once the stream ends or the entry changes.
+func (server *Server) runLiveRefresher(ctx context.Context, proxy *HlsProxy) {
+	LogDebug("Starting live refresher for %v", proxy.liveUrl)
+	defer close(proxy.prefetchDone)
+	defer server.finishLiveRecording(proxy, true, SERVER_ID)
+
+	var downloads sync.WaitGroup
+	defer downloads.Wait()
+
+	semaphore := make(chan struct{}, HLS_PREFETCH_CONCURRENCY)
+	retain := proxy.dvr != nil
+	prefetch := retain || server.config.HlsPrefetchSeconds > 0
+	backoff := time.Duration(0)
+	resumed := true
+
+	for {
+		for !retain && proxy.activeRecording() == nil && time.Since(time.UnixMilli(proxy.lastServed.Load())) > LIVE_IDLE_TIMEOUT {
+			if !resumed {
+				LogDebug("Live stream %v is idle, pausing the refresher", proxy.liveUrl)
+				resumed = true
+			}
+
+			select {
+			case <-ctx.Done():
+				LogDebug("Terminating live refresher for %v", proxy.liveUrl)
+				return
+			case <-proxy.liveWake:
+			}
+		}
+
+		recording := proxy.activeRecording()
+		liveM3U, newSegments, changed, err := proxy.refreshLivePlaylist()
+		var wait time.Duration
+		if err != nil {
+			backoff = min(max(2*backoff, time.Second), HLS_PREFETCH_MAX_BACKOFF)
+			wait = backoff
+			LogWarn("Failed to refresh live playlist %v, retrying in %v: %v", proxy.liveUrl, backoff, err)
+		} else {
+			backoff = 0
+			wait = liveRefreshInterval(liveM3U, changed)
+
+			// Clients start playing close to the live edge, older segments are left for them to request.
+			if resumed && !retain && recording == nil {
+				newSegments = newSegments[max(0, len(newSegments)-LIVE_INITIAL_PREFETCH):]
+				resumed = false
+			}
+
+			if recording != nil {
+				recording.add(proxy, liveM3U, newSegments)
+			}
+
+			if prefetch || recording != nil {
+				proxy.prefetchLiveSegments(ctx, &downloads, semaphore, newSegments, recording)
+			}
+
+			if !liveM3U.isLive {
+				LogInfo("Live stream %v has ended, the playlist is no longer refreshed.", proxy.liveUrl)
+				downloads.Wait()
+				if retain {
+					server.saveProxiedLiveStream(ctx, proxy, liveM3U)
+				}
+				server.finishLiveRecording(proxy, true, SERVER_ID)
+				<-ctx.Done()
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			LogDebug("Terminating live refresher for %v", proxy.liveUrl)
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Returns how long to wait before polling the origin playlist again. As recommended by the HLS specification, the
+// playlist is reloaded after its target duration, or after half of it when it did not change. Low-latency playlists are
+// reloaded at their part target instead.
+func liveRefreshInterval(m3u *M3U, changed bool) time.Duration {
+	target, err := strconv.ParseFloat(m3u.getAttribute(EXT_X_TARGETDURATION), 64)
+	if err != nil || target <= 0 {
+		target = m3u.avgSegmentLength()
+	}
+
+	partInfo := parseParams(m3u.getAttribute(EXT_X_PART_INF))
+	partTarget, err := strconv.ParseFloat(getParamValue("PART-TARGET", partInfo), 64)
+	if err == nil && partTarget > 0 {
+		target = partTarget
+	}
+
+	interval := time.Duration(target * float64(time.Second))
+	if !changed {
+		interval /= 2
+	}
+
+	return min(max(interval, LIVE_MIN_REFRESH_INTERVAL), LIVE_MAX_REFRESH_INTERVAL)
+}
+
+// Records a client request of the live stream. Returns true and wakes the refresher up if the stream was idle.
+func (proxy *HlsProxy) markLiveServed() bool {
+	now := time.Now().UnixMilli()
+	lastServed := time.UnixMilli(proxy.lastServed.Swap(now))
+	if time.Since(lastServed) <= LIVE_IDLE_TIMEOUT {
+		return false
+	}
+
+	select {
+	case proxy.liveWake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Returns the playlist stored by the refresher. Clients of an idle stream, or of one which was not refreshed yet, wait
+// for the next refresh instead of receiving an outdated playlist.
+func (proxy *HlsProxy) awaitLivePlaylist(ctx context.Context, wasIdle bool) ([]byte, error) {
+	proxy.liveMutex.Lock()
+	playlist, err, ended, refreshed := proxy.livePlaylist, proxy.liveErr, proxy.liveEnded, proxy.liveRefreshed
+	proxy.liveMutex.Unlock()
+
+	if playlist != nil && (!wasIdle || ended) {
+		return playlist, nil
+	}
+
+	if playlist == nil && err != nil && !wasIdle {
+		return nil, err
+	}
+
+	select {
+	case <-refreshed:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(LIVE_REFRESH_TIMEOUT):
+	}
+
+	proxy.liveMutex.Lock()
+	playlist, err = proxy.livePlaylist, proxy.liveErr
+	proxy.liveMutex.Unlock()
+
+	if playlist == nil {
+		if err == nil {
+			err = errors.New("Live playlist is not available yet")
+		}
+		return nil, err
+	}
+
+	return playlist, nil
+}
+
+// refreshLivePlaylist downloads the origin playlist, rewrites it to point at the proxy and stores it for clients.
+// Returns the origin playlist along with names of segments which were not listed before and whether it changed.
+func (proxy *HlsProxy) refreshLivePlaylist() (*M3U, []string, bool, error) {
+	liveM3U, err := downloadM3U(proxy.liveUrl, proxy.referer)
+	if err == nil && len(liveM3U.segments) == 0 {
+		err = errors.New("No live segments received!")
+	}
+
+	if err != nil {
+		proxy.liveMutex.Lock()
+		proxy.liveErr = err
+		close(proxy.liveRefreshed)
+		proxy.liveRefreshed = make(chan struct{})
+		proxy.liveMutex.Unlock()
+		return nil, nil, false, err
+	}
+
+	newSegments := proxy.rewriteLivePlaylist(liveM3U)
+
+	var playlist bytes.Buffer
+	liveM3U.serializeTo(&playlist)
+
+	proxy.liveMutex.Lock()
+	changed := !bytes.Equal(playlist.Bytes(), proxy.livePlaylist)
+	proxy.livePlaylist = playlist.Bytes()
+	proxy.liveErr = nil
+	proxy.liveEnded = !liveM3U.isLive
+	close(proxy.liveRefreshed)
+	proxy.liveRefreshed = make(chan struct{})
+	proxy.liveMutex.Unlock()
+
+	return liveM3U, newSegments, changed, nil
+}
+
+// rewriteLivePlaylist registers segments, parts and maps of the origin playlist in the segment map and points the
+// playlist at them. Segments which fell out of the sliding window are evicted, unless they are still retained by the
+// DVR window, which also lists them in the playlist. Returns names of the new segments.
+func (proxy *HlsProxy) rewriteLivePlaylist(liveM3U *M3U) []string {
+	segmentMap := &proxy.liveSegments
+	id := 0
+	if mediaSequence := liveM3U.getAttribute(EXT_X_MEDIA_SEQUENCE); mediaSequence != "" {
+		if sequenceId, err := parseInt(mediaSequence); err == nil {
+			id = sequenceId
+		}
+	}
+
+	// Segments numbered before a restart of the stream would be served in place of the new ones.
+	if id < proxy.liveSequence {
+		LogInfo("Media sequence of live stream %v went back from %v to %v, evicting all segments.", proxy.liveUrl, proxy.liveSequence, id)
+		proxy.evictLiveSegments(math.MaxInt)
+		if proxy.dvr != nil {
+			proxy.dvr.clear()
+		}
+	}
+	proxy.liveSequence = id
+	minSequence := id - LIVE_SEGMENTS_BEHIND
+
+	liveM3U.prefixRelativeSegments()
+
+	newSegments := make([]string, 0)
+	segmentCount := len(liveM3U.segments)
+	var mapUri string
+	var mapRange *ByteRange
+	for i := range segmentCount {
+		segment := &liveM3U.segments[i]
+
+		realUrl := segment.url
+		segName := LIVE_PREFIX + toString(id)
+
+		// Maps are registered once per origin URI and range, so that the same map keeps its name while the window slides.
+		if segment.mapUri != "" {
+			mapUri, mapRange = segment.mapUri, segment.mapRange
+		}
+
+		mapName := ""
+		if mapUri != "" {
+			mapName = proxy.registerLiveResource(MIS_PREFIX, mapUri, mapRange, id)
+		}
+
+		if _, exists := segmentMap.Load(segName); !exists {
+			liveSegment := LiveSegment{realUrl: realUrl, mapName: mapName, sequence: id, created: time.Now()}
+			if segment.byteRange != nil {
+				liveSegment.realRange = segment.byteRange.toRange()
+			}
+			segmentMap.Store(segName, &liveSegment)
+			newSegments = append(newSegments, segName)
+		}
+
+		segment.url = segName
+		segment.byteRange = nil
+		if segment.hasKey && segment.key.uri != "" {
+			segment.key.uri = proxy.registerLiveResource(KEY_PREFIX, segment.key.uri, nil, id)
+		}
+		rewriteLiveParts(segmentMap, segment.parts, id)
+		id++
+	}
+
+	// The segment still being produced gets the next media sequence number
+	rewriteLiveParts(segmentMap, liveM3U.trailingParts, id)
+	liveM3U.preloadHints = rewriteLivePreloadHints(segmentMap, liveM3U.preloadHints, id, len(liveM3U.trailingParts))
+
+	// The proxy serves a single rendition and refreshes the playlist on its own schedule,
+	// blocking reloads and delta updates requested by clients are not supported.
+	liveM3U.renditionReports = nil
+	liveM3U.skip = nil
+	liveM3U.serverControl = slices.DeleteFunc(liveM3U.serverControl, func(param Param) bool {
+		return param.key == "CAN-BLOCK-RELOAD" || param.key == "CAN-SKIP-UNTIL" || param.key == "CAN-SKIP-DATERANGES"
+	})
+
+	if proxy.dvr != nil {
+		proxy.dvr.extend(liveM3U)
+		minSequence = min(minSequence, proxy.dvr.firstSequence)
+	}
+	proxy.evictLiveSegments(minSequence)
+	rewriteLiveMaps(segmentMap, liveM3U.segments)
+
+	return newSegments
+}
+
+// Lists the map of every segment whose map differs from the one of the previous segment. Segments which listed the
+// map in the origin playlist may already be evicted.
+func rewriteLiveMaps(segmentMap *sync.Map, segments []Segment) {
+	previous := ""
+	for i := range segments {
+		segment := &segments[i]
+		segment.mapUri = ""
+		segment.mapRange = nil
+
+		maybeSegment, found := segmentMap.Load(segment.url)
+		if !found {
+			continue
+		}
+
+		current := maybeSegment.(*LiveSegment).mapName
+		if current != "" && current != previous {
+			segment.mapUri = current
+		}
+		previous = current
+	}
+}
+
+// Removes segments and parts numbered below the media sequence from the segment map, along with keys and maps no
+// longer used by the remaining segments, and deletes their files.
+func (proxy *HlsProxy) evictLiveSegments(minSequence int) {
+	proxy.liveSegments.Range(func(key, value any) bool {
+		name := key.(string)
+		segment := value.(*LiveSegment)
+		if segment.sequence >= minSequence {
+			return true
+		}
+
+		segment.mutex.Lock()
+		segment.evicted = true
+		if segment.obtainedUrl {
+			os.Remove(CONTENT_PROXY + name)
+		}
+		segment.mutex.Unlock()
+
+		proxy.liveSegments.Delete(name)
+		return true
+	})
+
+	proxy.evictLiveResources(minSequence)
+}
+
+// Downloads the live segment unless it is already on disk. Returns false when the segment was evicted.
+func (proxy *HlsProxy) fetchLiveSegment(ctx context.Context, name string, segment *LiveSegment) (bool, error) {
+	segment.mutex.Lock()
+	defer segment.mutex.Unlock()
+
+	if segment.evicted {
+		return false, nil
+	}
+
+	if segment.obtainedUrl {
+		return true, nil
+	}
+
+	options := &DownloadOptions{
+		referer:   proxy.referer,
+		hasty:     false,
+		bodyLimit: MAX_CHUNK_SIZE,
+		byteRange: segment.realRange,
+		ctx:       ctx,
+	}
+
+	if err := downloadFile(segment.realUrl, CONTENT_PROXY+name, options); err != nil {
+		return true, err
+	}
+
+	segment.obtainedUrl = true
+	return true, nil
+}
+
+// Downloads every segment and map of the ended stream which clients did not request and saves the stream as a recording.
+func (server *Server) saveProxiedLiveStream(ctx context.Context, proxy *HlsProxy, liveM3U *M3U) {
+	for _, segment := range liveM3U.segments {
+		// The entry changed, the proxy directory is about to be removed.
+		if ctx.Err() != nil {
+			return
+		}
+
+		maybeSegment, found := proxy.liveSegments.Load(segment.url)
+		if !found {
+			LogWarn("Segment %v of the ended live stream is no longer available, the stream is not saved.", segment.url)
+			return
+		}
+
+		liveSegment := maybeSegment.(*LiveSegment)
+		_, err := proxy.fetchLiveSegment(ctx, segment.url, liveSegment)
+		if err == nil && segment.mapUri != "" {
+			_, err = proxy.fetchResource(ctx, segment.mapUri)
+		}
+		if err == nil && segment.hasKey && segment.key.uri != "" {
+			_, err = proxy.fetchResource(ctx, segment.key.uri)
+		}
+
+		if err != nil {
+			LogWarn("Failed to fetch segment %v of the ended live stream, the stream is not saved: %v", segment.url, err)
+			return
+		}
+	}
+
+	server.state.mutex.Lock()
+	title, userId := server.state.entry.Title, server.state.entry.UserId
+	server.state.mutex.Unlock()
+
+	// The entry changed in the meantime, the title belongs to a different entry.
+	if ctx.Err() != nil {
+		return
+	}
+
+	server.saveLiveRecording(liveM3U, CONTENT_PROXY, title, userId)
+}
+
+// Downloads the segments in the background, sharing the semaphore limiting concurrent downloads of the refresher.
+// Downloaded segments are stored in the recording, unless it is nil.
+func (proxy *HlsProxy) prefetchLiveSegments(ctx context.Context, downloads *sync.WaitGroup, semaphore chan struct{}, names []string, recording *LiveRecording) {
+	for _, name := range names {
+		maybeSegment, found := proxy.liveSegments.Load(name)
+		if !found {
+			continue
+		}
+
+		downloads.Add(1)
+		go func() {
+			defer downloads.Done()
+
+			select {
+			case <-ctx.Done():
+				return
+			case semaphore <- struct{}{}:
+			}
+			defer func() { <-semaphore }()
+
+			liveSegment := maybeSegment.(*LiveSegment)
+			if _, err := proxy.fetchLiveSegment(ctx, name, liveSegment); err != nil {
+				LogDebug("Failed to prefetch live segment %v: %v", name, err)
+				return
+			}
+
+			if recording != nil {
+				recording.store(name, liveSegment)
+			}
+		}()
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	net_url "net/url"
 	"os"
 	"slices"
@@ -27,6 +28,7 @@ const (
 	EXT_X_PROGRAM_DATE_TIME = "EXT-X-PROGRAM-DATE-TIME" // time YYYY-MM-DDThh:mm:ss.SSSZ
 	EXT_X_DATERANGE         = "EXT-X-DATERANGE"         // attribute-list keys: ID,CLASS,START-DATE,END-DATE,(5 more)
 	EXT_X_BITRATE           = "EXT-X-BITRATE"           // value in rate
+	EXT_X_GAP               = "EXT-X-GAP"               // standalone
 
 	// 4.3.3. [Media Playlist Tags]
 	EXT_X_TARGETDURATION         = "EXT-X-TARGETDURATION"         // <duration in seconds>
@@ -37,6 +39,14 @@ const (
 	EXT_X_PLAYLIST_TYPE = "EXT-X-PLAYLIST-TYPE" // value: EVENT/VOD
 	EXT_X_ALLOW_CACHE   = "EXT-X-ALLOW-CACHE"   // value: YES/NO
 
+	// 4.4.3.7-4.4.5.2 [Low-Latency HLS Tags] (rfc8216bis)
+	EXT_X_PART_INF         = "EXT-X-PART-INF"         // attribute-list keys: PART-TARGET
+	EXT_X_SERVER_CONTROL   = "EXT-X-SERVER-CONTROL"   // attribute-list keys: CAN-SKIP-UNTIL,CAN-SKIP-DATERANGES,HOLD-BACK,PART-HOLD-BACK,CAN-BLOCK-RELOAD
+	EXT_X_PART             = "EXT-X-PART"             // attribute-list keys: URI,DURATION,INDEPENDENT,BYTERANGE,GAP
+	EXT_X_SKIP             = "EXT-X-SKIP"             // attribute-list keys: SKIPPED-SEGMENTS,RECENTLY-REMOVED-DATERANGES
+	EXT_X_PRELOAD_HINT     = "EXT-X-PRELOAD-HINT"     // attribute-list keys: TYPE,URI,BYTERANGE-START,BYTERANGE-LENGTH
+	EXT_X_RENDITION_REPORT = "EXT-X-RENDITION-REPORT" // attribute-list keys: URI,LAST-MSN,LAST-PART
+
 	// 4.3.4. [Master Playlist Tags]
 	EXT_X_MEDIA        = "EXT-X-MEDIA"        // attribute-list keys: TYPE,URI,GROUP-ID,LANGUAGE,ASSOC-LANGUAGE,NAME,DEFAULT(...)
 	EXT_X_STREAM_INF   = "EXT-X-STREAM-INF"   // <attribute-list> <URI> keys: BANDWIDTH,AVERAGE-BANDWIDTH,CODECS,RESOLUTION,FRAME-RATE,AUDIO,VIDEO(...)
@@ -49,7 +59,7 @@ const (
 	EXT_X_PREFETCH             = "EXT-X-PREFETCH"             // apparently is followed by url?
 
 	//  4.4.6. [Multivariant Playlist Tags]
-	EXT_X_I_FRAME_STREAM_INF = "EXT-X-I-FRAME-STREAM-INF"
+	EXT_X_I_FRAME_STREAM_INF = "EXT-X-I-FRAME-STREAM-INF" // attribute-list keys: URI,BANDWIDTH,CODECS,RESOLUTION(...)
 )
 
 // GENERIC_TAGS are tags which are not directly handled in any case statement and appear in no particular order
@@ -60,15 +70,19 @@ var GENERIC_TAGS = []string{
 	EXT_X_DISCONTINUITY_SEQUENCE,
 	EXT_X_PLAYLIST_TYPE,
 	EXT_X_ALLOW_CACHE,
-
-	EXT_X_SESSION_DATA,
-	EXT_X_SESSION_KEY,
+	EXT_X_PART_INF,
 
 	EXT_X_INDEPENDENT_SEGMENTS,
 	EXT_X_START,
 	EXT_X_PREFETCH,
+}
 
-	EXT_X_I_FRAME_STREAM_INF,
+// Attributes whose values are quoted-strings, the remaining ones are enumerated strings or numbers written as-is.
+var QUOTED_ATTRIBUTES = []string{
+	"URI", "GROUP-ID", "LANGUAGE", "ASSOC-LANGUAGE", "NAME", "STABLE-RENDITION-ID", "INSTREAM-ID", "CHARACTERISTICS",
+	"CHANNELS", "CODECS", "SUPPLEMENTAL-CODECS", "AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS", "STABLE-VARIANT-ID",
+	"PATHWAY-ID", "KEYFORMAT", "KEYFORMATVERSIONS", "BYTERANGE", "DATA-ID", "VALUE", "ID", "CLASS", "START-DATE",
+	"END-DATE", "RECENTLY-REMOVED-DATERANGES",
 }
 
 func detectM3U(path string) (bool, error) {
@@ -78,11 +92,13 @@ func detectM3U(path string) (bool, error) {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	if scanner.Scan() && strings.HasPrefix(scanner.Text(), "#"+EXTM3U) {
-		return true, nil
-	}
-	return false, nil
+	return detectM3UFrom(file), nil
+}
+
+// detectM3UFrom reads the first line only
+func detectM3UFrom(reader io.Reader) bool {
+	scanner := bufio.NewScanner(reader)
+	return scanner.Scan() && strings.HasPrefix(scanner.Text(), "#"+EXTM3U)
 }
 
 type KeyValue struct {
@@ -99,7 +115,7 @@ func getKeyValue(line string) *KeyValue {
 	}
 	line = line[1:]
 	colon := strings.Index(line, ":")
-	if colon == -1 || colon == len(line)-1 {
+	if colon == -1 {
 		return &KeyValue{line, ""}
 	}
 	if colon < 6 {
@@ -117,8 +133,13 @@ func parseM3U(path string) (*M3U, error) {
 	}
 	defer file.Close()
 
+	return parseM3UFrom(file)
+}
+
+// parseM3UFrom parses a playlist from the reader, for example directly from the body of an HTTP response
+func parseM3UFrom(reader io.Reader) (*M3U, error) {
 	hasEnd := false
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(reader)
 
 	if scanner.Scan() && scanner.Text() != ("#"+EXTM3U) {
 		return nil, fmt.Errorf("not a valid M3U playlist, missing EXTM3U tag")
@@ -128,6 +149,7 @@ func parseM3U(path string) (*M3U, error) {
 	parsingSegment := false
 
 	segment := Segment{}
+	var pendingRange *ByteRange // EXT-X-BYTERANGE whose offset may depend on the previous segment
 	for scanner.Scan() {
 		line := scanner.Text()
 		if len(line) == 0 {
@@ -154,25 +176,63 @@ func parseM3U(path string) (*M3U, error) {
 				if len(params) == 0 {
 					continue
 				}
-				// BYTERANGE is rare so ignoring for now
 				segment.mapUri = getParamValue("URI", params)
+				if value := getParamValue("BYTERANGE", params); value != "" {
+					// The offset of a map byte range defaults to 0
+					byteRange, err := parseByteRange(value, 0)
+					if err != nil {
+						continue
+					}
+					segment.mapRange = &byteRange
+				}
 				parsingSegment = true
 			case EXT_X_KEY:
+				// METHOD is required, keys without it cannot be used or written back
 				params := parseParams(pair.value)
-				if len(params) == 0 {
+				if getParamValue("METHOD", params) == "" {
 					continue
 				}
-				// ignoring KEYFORMAT for now
 
-				key := &segment.key
-				key.uri = getParamValue("URI", params)
-				key.method = getParamValue("METHOD", params)
-				key.initVec = getParamValue("IV", params)
-				segment.hasKey = true
+				key := Key{
+					method:         getParamValue("METHOD", params),
+					uri:            getParamValue("URI", params),
+					initVec:        getParamValue("IV", params),
+					format:         getParamValue("KEYFORMAT", params),
+					formatVersions: getParamValue("KEYFORMATVERSIONS", params),
+				}
+
+				// Keys of other formats are obtained by the client from a DRM system and are only passed through.
+				if key.isIdentity() {
+					segment.key = key
+					segment.hasKey = true
+				} else {
+					segment.otherKeys = append(segment.otherKeys, key)
+				}
 				parsingSegment = true
-			case EXT_X_PROGRAM_DATE_TIME, EXT_X_BITRATE, EXT_X_DATERANGE, EXT_X_BYTERANGE, EXT_X_DISCONTINUITY:
+			case EXT_X_BYTERANGE:
+				byteRange, err := parseByteRange(pair.value, -1)
+				if err != nil {
+					continue
+				}
+				pendingRange = &byteRange
+				parsingSegment = true
+			case EXT_X_PROGRAM_DATE_TIME, EXT_X_BITRATE, EXT_X_DATERANGE, EXT_X_DISCONTINUITY, EXT_X_GAP:
 				segment.addPair(*pair)
 				parsingSegment = true
+			case EXT_X_PART:
+				part, err := parsePart(pair.value, segment.parts)
+				if err != nil {
+					continue
+				}
+				segment.parts = append(segment.parts, part)
+			case EXT_X_PRELOAD_HINT:
+				m3u.preloadHints = append(m3u.preloadHints, parseParams(pair.value))
+			case EXT_X_RENDITION_REPORT:
+				m3u.renditionReports = append(m3u.renditionReports, parseParams(pair.value))
+			case EXT_X_SERVER_CONTROL:
+				m3u.serverControl = parseParams(pair.value)
+			case EXT_X_SKIP:
+				m3u.skip = parseParams(pair.value)
 			case EXT_X_ENDLIST:
 				hasEnd = true
 				parsingSegment = false
@@ -191,9 +251,23 @@ func parseM3U(path string) (*M3U, error) {
 				params := parseParams(pair.value)
 				typeValue := getParamValue("TYPE", params)
 				// possible types: AUDIO, VIDEO, SUBTITLES, CLOSED-CAPTIONS
-				if typeValue == "AUDIO" {
+				switch typeValue {
+				case "AUDIO":
 					m3u.audioRenditions = append(m3u.audioRenditions, params)
+				case "SUBTITLES":
+					m3u.subtitleRenditions = append(m3u.subtitleRenditions, params)
+				case "CLOSED-CAPTIONS":
+					m3u.captionRenditions = append(m3u.captionRenditions, params)
 				}
+			case EXT_X_I_FRAME_STREAM_INF:
+				m3u.isMasterPlaylist = true
+				m3u.iframeTracks = append(m3u.iframeTracks, parseParams(pair.value))
+			case EXT_X_SESSION_DATA:
+				m3u.isMasterPlaylist = true
+				m3u.sessionData = append(m3u.sessionData, parseParams(pair.value))
+			case EXT_X_SESSION_KEY:
+				m3u.isMasterPlaylist = true
+				m3u.sessionKeys = append(m3u.sessionKeys, parseParams(pair.value))
 			default:
 				if slices.Contains(GENERIC_TAGS, pair.key) {
 					m3u.addPair(*pair)
@@ -202,12 +276,33 @@ func parseM3U(path string) (*M3U, error) {
 		} else if parsingSegment {
 			// This should copy the current segment
 			segment.url = line
+			if pendingRange != nil {
+				// Without an offset the sub-range starts where the previous segment's sub-range of the same resource ends
+				if pendingRange.offset == -1 {
+					pendingRange.offset = 0
+					if count := len(m3u.segments); count > 0 {
+						previous := &m3u.segments[count-1]
+						if previous.url == segment.url && previous.byteRange != nil {
+							pendingRange.offset = previous.byteRange.end()
+						}
+					}
+				}
+				segment.byteRange = pendingRange
+				pendingRange = nil
+			}
 			m3u.addSegment(segment)
 			parsingSegment = false
 			segment = Segment{}
 		} // else Probably garbage?
 	}
 
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Parts following the last segment belong to the segment which is still being produced
+	m3u.trailingParts = segment.parts
+
 	m3u.isLive = !hasEnd && !m3u.isMasterPlaylist
 	listType := m3u.getAttribute(EXT_X_PLAYLIST_TYPE)
 	if m3u.isLive && listType == "VOD" {
@@ -227,9 +322,138 @@ func parseFirstFloat(values string) (float64, error) {
 
 // Key - Media Segments MAY be encrypted
 type Key struct {
-	method  string // NONE, AES-128, and SAMPLE-AES, SAMPLE-AES-CTR
-	uri     string // URI where the key can be obtained
-	initVec string // hexadecimal-sequence that specifies a 128-bit Initialization Vector
+	method         string // NONE, AES-128, and SAMPLE-AES, SAMPLE-AES-CTR
+	uri            string // URI where the key can be obtained
+	initVec        string // hexadecimal-sequence that specifies a 128-bit Initialization Vector
+	format         string // [optional] how the key is represented, "identity" when empty
+	formatVersions string // [optional] slash separated versions of the key format
+}
+
+func (key *Key) isIdentity() bool {
+	return key.format == "" || key.format == "identity"
+}
+
+func (key *Key) String() string {
+	params := make([]Param, 0, 5)
+	if key.method != "" {
+		params = append(params, Param{"METHOD", key.method})
+	}
+	if key.uri != "" {
+		params = append(params, Param{"URI", key.uri})
+	}
+	if key.initVec != "" {
+		params = append(params, Param{"IV", key.initVec})
+	}
+	if key.format != "" {
+		params = append(params, Param{"KEYFORMAT", key.format})
+	}
+	if key.formatVersions != "" {
+		params = append(params, Param{"KEYFORMATVERSIONS", key.formatVersions})
+	}
+
+	output := strings.Builder{}
+	writeParams(&output, params)
+	return output.String()
+}
+
+// ByteRange - sub-range of the resource identified by a URI, written as <length>[@<offset>]
+type ByteRange struct {
+	length int64
+	offset int64
+}
+
+// parseByteRange parses <length>[@<offset>], a missing offset is replaced with defaultOffset
+func parseByteRange(value string, defaultOffset int64) (ByteRange, error) {
+	lengthValue, offsetValue, hasOffset := strings.Cut(value, "@")
+	length, err := strconv.ParseInt(lengthValue, 10, 64)
+	if err != nil || length < 0 {
+		return ByteRange{}, fmt.Errorf("invalid byte range length in %v", value)
+	}
+
+	offset := defaultOffset
+	if hasOffset {
+		offset, err = strconv.ParseInt(offsetValue, 10, 64)
+		if err != nil || offset < 0 {
+			return ByteRange{}, fmt.Errorf("invalid byte range offset in %v", value)
+		}
+	}
+
+	return ByteRange{length: length, offset: offset}, nil
+}
+
+// end returns the offset following the last byte of the range
+func (byteRange *ByteRange) end() int64 {
+	return byteRange.offset + byteRange.length
+}
+
+func (byteRange *ByteRange) toRange() *Range {
+	return &Range{byteRange.offset, byteRange.end() - 1}
+}
+
+func (byteRange *ByteRange) String() string {
+	return fmt.Sprintf("%v@%v", byteRange.length, byteRange.offset)
+}
+
+// Part - Partial Segment of Low-Latency HLS, a part of the segment which is still being produced or was recently
+type Part struct {
+	url       string
+	duration  float64
+	byteRange *ByteRange
+	params    []Param // remaining attributes such as INDEPENDENT and GAP
+}
+
+// parsePart parses the EXT-X-PART attributes, a byte range without an offset follows the previous part of the same URI
+func parsePart(value string, previousParts []Part) (Part, error) {
+	params := parseParams(value)
+	part := Part{}
+	for _, param := range params {
+		switch param.key {
+		case "URI":
+			part.url = param.value
+		case "DURATION":
+			duration, err := strconv.ParseFloat(param.value, 64)
+			if err != nil {
+				return part, fmt.Errorf("invalid part duration %v", param.value)
+			}
+			part.duration = duration
+		case "BYTERANGE":
+			byteRange, err := parseByteRange(param.value, -1)
+			if err != nil {
+				return part, err
+			}
+			part.byteRange = &byteRange
+		default:
+			part.params = append(part.params, param)
+		}
+	}
+
+	if part.url == "" {
+		return part, fmt.Errorf("part is missing the URI attribute")
+	}
+
+	if part.byteRange != nil && part.byteRange.offset == -1 {
+		part.byteRange.offset = 0
+		if count := len(previousParts); count > 0 {
+			previous := &previousParts[count-1]
+			if previous.url == part.url && previous.byteRange != nil {
+				part.byteRange.offset = previous.byteRange.end()
+			}
+		}
+	}
+
+	return part, nil
+}
+
+func (part *Part) String() string {
+	params := []Param{{"DURATION", strconv.FormatFloat(part.duration, 'f', -1, 64)}, {"URI", part.url}}
+	if part.byteRange != nil {
+		params = append(params, Param{"BYTERANGE", part.byteRange.String()})
+	}
+	params = append(params, part.params...)
+
+	output := strings.Builder{}
+	writeParams(&output, params)
+	return output.String()
 }
 
 func parseParams(line string) []Param {
@@ -247,9 +471,11 @@ func parseParams(line string) []Param {
 				value.WriteByte(',')
 				break
 			}
-			// comma acts as a pair separator here
-			pair := Param{key.String(), value.String()}
-			params = append(params, pair)
+			// comma acts as a pair separator here, keyless pairs are dropped
+			if key.Len() > 0 {
+				pair := Param{key.String(), value.String()}
+				params = append(params, pair)
+			}
 			key.Reset()
 			value.Reset()
 			onKey = true
@@ -271,7 +497,7 @@ func parseParams(line string) []Param {
 			}
 		}
 	}
-	if key.Len() > 0 || value.Len() > 0 {
+	if key.Len() > 0 {
 		pair := Param{key.String(), value.String()}
 		params = append(params, pair)
 	}
@@ -283,7 +509,26 @@ type Param struct {
 }
 
 func (param *Param) String() string {
-	return fmt.Sprintf("%v=\"%v\"", param.key, param.value)
+	if param.isQuoted() {
+		return fmt.Sprintf("%v=\"%v\"", param.key, param.value)
+	}
+	return param.key + "=" + param.value
+}
+
+func (param *Param) isQuoted() bool {
+	if strings.Contains(param.value, ",") {
+		// Only quoted-strings can contain commas
+		return true
+	}
+	if param.key == "CLOSED-CAPTIONS" && param.value == "NONE" {
+		return false
+	}
+	if strings.HasPrefix(param.key, "X-") {
+		// Client attributes can be quoted-strings, hexadecimal sequences or decimal floats
+		_, err := strconv.ParseFloat(param.value, 64)
+		return err != nil && !strings.HasPrefix(param.value, "0x") && !strings.HasPrefix(param.value, "0X")
+	}
+	return slices.Contains(QUOTED_ATTRIBUTES, param.key)
 }
 
 // Track - Variant Stream (represents a m3u8 entry along with its metadata in a master playlist)
@@ -331,21 +576,37 @@ func (m3u *M3U) removeAttributes(key string) {
 }
 
 type M3U struct {
-	url              string // the URL where the playlist was originally obtained
-	isMasterPlaylist bool
-	isLive           bool
-	tracks           []Track    // exclusive to master playlists
-	audioRenditions  [][]Param  // EXT-X-MEDIA only of TYPE=AUDIO
-	attributePairs   []KeyValue // key:value properties which describe the playlist
-	segments         []Segment  // Segment URLs appearing in an ordered sequence
+	url                string // the URL where the playlist was originally obtained
+	isMasterPlaylist   bool
+	isLive             bool
+	tracks             []Track    // exclusive to master playlists
+	audioRenditions    [][]Param  // EXT-X-MEDIA of TYPE=AUDIO
+	subtitleRenditions [][]Param  // EXT-X-MEDIA of TYPE=SUBTITLES
+	captionRenditions  [][]Param  // EXT-X-MEDIA of TYPE=CLOSED-CAPTIONS, these have no URI
+	iframeTracks       [][]Param  // EXT-X-I-FRAME-STREAM-INF, the URI is one of the attributes
+	sessionData        [][]Param  // EXT-X-SESSION-DATA
+	sessionKeys        [][]Param  // EXT-X-SESSION-KEY
+	attributePairs     []KeyValue // key:value properties which describe the playlist
+	segments           []Segment  // Segment URLs appearing in an ordered sequence
+
+	// Low-Latency HLS
+	serverControl    []Param   // EXT-X-SERVER-CONTROL
+	skip             []Param   // EXT-X-SKIP, present in playlist delta updates in place of the skipped segments
+	trailingParts    []Part    // parts of the segment which is still being produced
+	preloadHints     [][]Param // EXT-X-PRELOAD-HINT
+	renditionReports [][]Param // EXT-X-RENDITION-REPORT
 }
 
 type Segment struct {
 	url            string
 	length         float64
-	mapUri         string // [optional] Media Initialization Section
+	byteRange      *ByteRange // [optional] sub-range of the URL, the offset is always resolved
+	mapUri         string     // [optional] Media Initialization Section
+	mapRange       *ByteRange // [optional] sub-range of the map URI
 	hasKey         bool
-	key            Key
+	key            Key   // identity key used to decrypt the segment
+	otherKeys      []Key // keys of other KEYFORMATs, obtained by clients from their DRM systems
+	parts          []Part
 	attributePairs []KeyValue
 }
 
@@ -394,6 +655,18 @@ func (m3u *M3U) getAttribute(key string) string {
 	return ""
 }
 
+// Replaces the value of the first pair with the given key or adds a new pair if the key is missing
+func (m3u *M3U) setAttribute(key, value string) {
+	for i := range m3u.attributePairs {
+		pair := &m3u.attributePairs[i]
+		if pair.key == key {
+			pair.value = value
+			return
+		}
+	}
+	m3u.addPair(KeyValue{key, value})
+}
+
 func (m3u *M3U) addPair(pair KeyValue) {
 	m3u.attributePairs = append(m3u.attributePairs, pair)
 }
@@ -500,6 +773,36 @@ func (m3u *M3U) getTrackByVideoHeight(targetHeight int64) *Track {
 	return targetTrack
 }
 
+// Picks a track for each of the target heights with getTrackByVideoHeight, skipping duplicates.
+// Tracks rejected by the filter are ignored, unless none of them pass it.
+// this method should only be used if the m3u is a master playlist
+func (m3u *M3U) getTracksByVideoHeights(targetHeights []int64, filter func(track *Track) bool) []Track {
+	candidates := M3U{}
+	for i := range m3u.tracks {
+		if filter == nil || filter(&m3u.tracks[i]) {
+			candidates.addTrack(m3u.tracks[i])
+		}
+	}
+	if len(candidates.tracks) == 0 {
+		candidates.tracks = m3u.tracks
+	}
+
+	tracks := make([]Track, 0, len(targetHeights))
+	for _, height := range targetHeights {
+		track := candidates.getTrackByVideoHeight(height)
+		if track == nil {
+			continue
+		}
+		duplicate := slices.ContainsFunc(tracks, func(picked Track) bool {
+			return picked.url == track.url
+		})
+		if !duplicate {
+			tracks = append(tracks, *track)
+		}
+	}
+	return tracks
+}
+
 type Width = int64
 type Height = int64
 
@@ -526,8 +829,9 @@ func (m3u *M3U) prefixRelativeTracks() {
 	root := getRootDomain(urlStruct)
 	relativePath := stripLastSegment(urlStruct)
 
-	for i := range m3u.audioRenditions {
-		rendition := &m3u.audioRenditions[i]
+	renditions := slices.Concat(m3u.audioRenditions, m3u.subtitleRenditions, m3u.iframeTracks, m3u.sessionData, m3u.sessionKeys)
+	for i := range renditions {
+		rendition := &renditions[i]
 		uriParam := getParam("URI", *rendition)
 		if uriParam != nil && !isAbsolute(uriParam.value) {
 			if strings.HasPrefix(uriParam.value, "/") {
@@ -574,42 +878,65 @@ func (m3u *M3U) copy() M3U {
 	return *m3uCopy
 }
 
-// This will only prefix URLs which are not fully qualified, including map URI or key URI
+// This will only prefix URLs which are not fully qualified, including map, key, part, preload hint and rendition report URIs
 func (m3u *M3U) prefixRelativeSegments() {
 	urlStruct, _ := net_url.Parse(m3u.url)
 	root := getRootDomain(urlStruct)
 	relativePath := stripLastSegment(urlStruct)
 
+	prefix := func(url *string) {
+		if *url == "" || isAbsolute(*url) {
+			return
+		}
+		if strings.HasPrefix(*url, "/") {
+			*url = prefixUrl(root, *url)
+		} else {
+			*url = prefixUrl(relativePath, *url)
+		}
+	}
+
+	prefixParts := func(parts []Part) {
+		for i := range parts {
+			prefix(&parts[i].url)
+		}
+	}
+
 	// if a range loop is used the track url is effectively not reassigned
 	for i := range m3u.segments {
 		segment := &m3u.segments[i]
-		if !isAbsolute(segment.url) {
-			if strings.HasPrefix(segment.url, "/") {
-				segment.url = prefixUrl(root, segment.url)
-			} else {
-				segment.url = prefixUrl(relativePath, segment.url)
-			}
+		prefix(&segment.url)
+		prefix(&segment.mapUri)
+		if segment.hasKey {
+			prefix(&segment.key.uri)
 		}
-		mapUri := segment.mapUri
-		if mapUri != "" && !isAbsolute(mapUri) {
-			if strings.HasPrefix(mapUri, "/") {
-				segment.mapUri = prefixUrl(root, mapUri)
-			} else {
-				segment.mapUri = prefixUrl(relativePath, mapUri)
-			}
+		for j := range segment.otherKeys {
+			// Keys of DRM systems often use custom schemes (skd://), which are absolute.
+			prefix(&segment.otherKeys[j].uri)
 		}
+		prefixParts(segment.parts)
+	}
+	prefixParts(m3u.trailingParts)
 
-		keyUri := segment.key.uri
-		if segment.hasKey && !isAbsolute(keyUri) {
-			if strings.HasPrefix(keyUri, "/") {
-				segment.key.uri = prefixUrl(root, keyUri)
-			} else {
-				segment.key.uri = prefixUrl(relativePath, keyUri)
-			}
+	for _, params := range slices.Concat(m3u.preloadHints, m3u.renditionReports) {
+		if uriParam := getParam("URI", params); uriParam != nil {
+			prefix(&uriParam.value)
 		}
 	}
 }
 
+// clearLowLatency removes Low-Latency HLS parts, hints, reports and server control from the playlist
+func (m3u *M3U) clearLowLatency() {
+	for i := range m3u.segments {
+		m3u.segments[i].parts = nil
+	}
+	m3u.removeAttributes(EXT_X_PART_INF)
+	m3u.serverControl = nil
+	m3u.skip = nil
+	m3u.trailingParts = nil
+	m3u.preloadHints = nil
+	m3u.renditionReports = nil
+}
+
 func (m3u *M3U) serialize(path string) {
 	file, err := os.Create(path)
 	if err != nil {
@@ -617,14 +944,19 @@ func (m3u *M3U) serialize(path string) {
 	}
 	defer file.Close()
 
+	m3u.serializeTo(file)
+}
+
+// serializeTo writes the playlist to the writer, for example directly to an HTTP response
+func (m3u *M3U) serializeTo(writer io.Writer) error {
 	if m3u.isMasterPlaylist {
-		m3u.serializeMasterPlaylist(file)
+		return m3u.serializeMasterPlaylist(writer)
 	} else {
-		m3u.serializePlaylist(file)
+		return m3u.serializePlaylist(writer)
 	}
 }
 
-func (m3u *M3U) serializeMasterPlaylist(file *os.File) {
+func (m3u *M3U) serializeMasterPlaylist(writer io.Writer) error {
 	output := strings.Builder{}
 	output.WriteString("#EXTM3U\n")
 
@@ -635,18 +967,32 @@ func (m3u *M3U) serializeMasterPlaylist(file *os.File) {
 			output.WriteString("#" + pair.key + ":" + pair.value + "\n")
 		}
 	}
-	output.WriteByte('\n')
-	for i := range m3u.audioRenditions {
-		output.WriteString("#EXT-X-MEDIA:")
-		writeParams(&output, m3u.audioRenditions[i])
+	writeParamTags(&output, EXT_X_SESSION_DATA, m3u.sessionData)
+	writeParamTags(&output, EXT_X_SESSION_KEY, m3u.sessionKeys)
+
+	renditions := slices.Concat(m3u.audioRenditions, m3u.subtitleRenditions, m3u.captionRenditions)
+	// A master playlist left without any renditions or tracks is written the same way a media playlist would be
+	if len(renditions) > 0 || len(m3u.tracks) > 0 || len(m3u.iframeTracks) > 0 {
 		output.WriteByte('\n')
 	}
+	writeParamTags(&output, EXT_X_MEDIA, renditions)
 	for _, track := range m3u.tracks {
 		output.WriteString("#EXT-X-STREAM-INF:")
 		writeParams(&output, track.streamInfo)
 		output.WriteString("\n" + track.url + "\n")
 	}
-	file.WriteString(output.String())
+	writeParamTags(&output, EXT_X_I_FRAME_STREAM_INF, m3u.iframeTracks)
+	_, err := io.WriteString(writer, output.String())
+	return err
+}
+
+// writeParamTags writes a line with the tag and its attribute list for each of the param lists
+func writeParamTags(output *strings.Builder, tag string, paramLists [][]Param) {
+	for _, params := range paramLists {
+		output.WriteString("#" + tag + ":")
+		writeParams(output, params)
+		output.WriteByte('\n')
+	}
 }
 
 func writeParams(output *strings.Builder, params []Param) {
@@ -660,7 +1006,7 @@ func writeParams(output *strings.Builder, params []Param) {
 	}
 }
 
-func (m3u *M3U) serializePlaylist(file *os.File) {
+func (m3u *M3U) serializePlaylist(writer io.Writer) error {
 	output := strings.Builder{}
 	output.WriteString("#EXTM3U\n")
 
@@ -671,24 +1017,27 @@ func (m3u *M3U) serializePlaylist(file *os.File) {
 			output.WriteString("#" + pair.key + ":" + pair.value + "\n")
 		}
 	}
+	if len(m3u.serverControl) > 0 {
+		writeParamTags(&output, EXT_X_SERVER_CONTROL, [][]Param{m3u.serverControl})
+	}
+	if len(m3u.skip) > 0 {
+		writeParamTags(&output, EXT_X_SKIP, [][]Param{m3u.skip})
+	}
 
 	for _, seg := range m3u.segments {
 		if seg.mapUri != "" {
-			output.WriteString("#EXT-X-MAP:URI=\"" + seg.mapUri + "\"\n")
+			mapParams := []Param{{"URI", seg.mapUri}}
+			if seg.mapRange != nil {
+				mapParams = append(mapParams, Param{"BYTERANGE", seg.mapRange.String()})
+			}
+			writeParamTags(&output, EXT_X_MAP, [][]Param{mapParams})
 		}
 		// #EXT-X-KEY:METHOD=AES-128,URI="key4.json?f=1041&s=0&p=1822770&m=1506045858",IV=0x000000000000000000000000001BD032
 		if seg.hasKey {
-			output.WriteString("#EXT-X-KEY:")
-			if seg.key.method != "" {
-				output.WriteString("METHOD=" + seg.key.method + ",")
-			}
-			if seg.key.uri != "" {
-				output.WriteString("URI=" + seg.key.uri + ",")
-			}
-			if seg.key.initVec != "" {
-				output.WriteString("IV=" + seg.key.initVec + ",")
-			}
-			output.WriteString("\n")
+			output.WriteString("#EXT-X-KEY:" + seg.key.String() + "\n")
+		}
+		for _, key := range seg.otherKeys {
+			output.WriteString("#EXT-X-KEY:" + key.String() + "\n")
 		}
 		for _, segPair := range seg.attributePairs {
 			if segPair.value == "" {
@@ -697,24 +1046,40 @@ func (m3u *M3U) serializePlaylist(file *os.File) {
 				output.WriteString("#" + segPair.key + ":" + segPair.value + "\n")
 			}
 		}
-		extInf := fmt.Sprintf("#EXTINF:%v\n", seg.length)
+		for _, part := range seg.parts {
+			output.WriteString("#EXT-X-PART:" + part.String() + "\n")
+		}
+		extInf := fmt.Sprintf("#EXTINF:%v,\n", seg.length)
 		output.WriteString(extInf)
+		if seg.byteRange != nil {
+			output.WriteString("#EXT-X-BYTERANGE:" + seg.byteRange.String() + "\n")
+		}
 		output.WriteString(seg.url + "\n")
 	}
 
+	for _, part := range m3u.trailingParts {
+		output.WriteString("#EXT-X-PART:" + part.String() + "\n")
+	}
+	writeParamTags(&output, EXT_X_PRELOAD_HINT, m3u.preloadHints)
+	writeParamTags(&output, EXT_X_RENDITION_REPORT, m3u.renditionReports)
+
 	if !m3u.isLive {
 		output.WriteString("#EXT-X-ENDLIST\n")
 	}
-	file.WriteString(output.String())
+	_, err := io.WriteString(writer, output.String())
+	return err
 }
 
-func downloadM3U(url string, filename string, referer string) (*M3U, error) {
-	options := &DownloadOptions{referer: referer, hasty: true, bodyLimit: MAX_CHUNK_SIZE}
-	err := downloadFile(url, filename, options)
+// downloadM3U parses the playlist directly from the response, without storing it on disk
+func downloadM3U(url string, referer string) (*M3U, error) {
+	options := &DownloadOptions{method: "GET", referer: referer, hasty: true, bodyLimit: MAX_CHUNK_SIZE}
+	response, body, err := openDownload(url, options)
 	if err != nil {
 		return nil, err
 	}
-	m3u, err := parseM3U(filename)
+	defer response.Body.Close()
+
+	m3u, err := parseM3UFrom(body)
 	if err == nil {
 		m3u.url = url
 	}
@@ -1,6 +1,14 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
 
 func TestStringedParamWithCommas(t *testing.T) {
 	input := "CODECS=\"avc1.4d4028,mp4a.40.2,stpp.ttml.im1t\",RESOLUTION=1920x800"
@@ -85,3 +93,427 @@ func TestAddingPairsAttributeRetrievalAndRemoval(t *testing.T) {
 		return
 	}
 }
+
+func TestTracksByVideoHeights(t *testing.T) {
+	m3u := newM3U(0)
+	for _, resolution := range []string{"1920x1080", "1280x720", "640x360"} {
+		track := Track{url: resolution + ".m3u8", streamInfo: []Param{{"RESOLUTION", resolution}}}
+		m3u.addTrack(track)
+	}
+
+	tracks := m3u.getTracksByVideoHeights([]int64{1080, 720, 480, 1080}, nil)
+	urls := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		urls = append(urls, track.url)
+	}
+
+	expected := "1920x1080.m3u8,1280x720.m3u8,640x360.m3u8"
+	if strings.Join(urls, ",") != expected {
+		t.Errorf("Expected tracks %v, actual %v", expected, urls)
+	}
+
+	filter := func(track *Track) bool { return track.url != "1920x1080.m3u8" }
+	tracks = m3u.getTracksByVideoHeights([]int64{1080}, filter)
+	if len(tracks) != 1 || tracks[0].url != "1280x720.m3u8" {
+		t.Errorf("Filtered track should fall back to a lower resolution, actual %v", tracks)
+	}
+}
+
+func TestMasterPlaylistKeepsSubtitleAndCaptionRenditions(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="Deutsch",LANGUAGE="de",URI="audio/de.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subs/en.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=1280x720,AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+720p.m3u8
+`
+	input := filepath.Join(t.TempDir(), "master.m3u8")
+	if err := os.WriteFile(input, []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m3u, err := parseM3U(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m3u.audioRenditions) != 2 || len(m3u.subtitleRenditions) != 1 || len(m3u.captionRenditions) != 1 {
+		t.Fatalf("Expected 2 audio, 1 subtitle and 1 caption renditions, actual %v, %v, %v",
+			len(m3u.audioRenditions), len(m3u.subtitleRenditions), len(m3u.captionRenditions))
+	}
+
+	m3u.url = "https://example.com/stream/master.m3u8"
+	m3u.prefixRelativeTracks()
+	if uri := getParamValue("URI", m3u.subtitleRenditions[0]); uri != "https://example.com/stream/subs/en.m3u8" {
+		t.Errorf("Subtitle rendition URI was not prefixed, actual %v", uri)
+	}
+
+	output := filepath.Join(t.TempDir(), "proxy.m3u8")
+	m3u.serialize(output)
+	serialized, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"TYPE=SUBTITLES", "TYPE=CLOSED-CAPTIONS", `INSTREAM-ID="CC1"`, `LANGUAGE="de"`} {
+		if !strings.Contains(string(serialized), expected) {
+			t.Errorf("Serialized master playlist is missing %v:\n%s", expected, serialized)
+		}
+	}
+}
+
+func TestLowLatencyPlaylistRoundTrip(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-PART-INF:PART-TARGET=1.0
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.0
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@720
+media.mp4
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:2000
+media.mp4
+#EXT-X-PART:DURATION=1.0,URI="part.mp4",BYTERANGE="300@0",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.0,URI="part.mp4",BYTERANGE="400"
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part.mp4",BYTERANGE-START=700
+#EXT-X-RENDITION-REPORT:URI="../low/index.m3u8",LAST-MSN=2,LAST-PART=1
+`
+	input := filepath.Join(t.TempDir(), "live.m3u8")
+	if err := os.WriteFile(input, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m3u, err := parseM3U(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m3u.segments) != 2 {
+		t.Fatalf("Expected 2 segments, actual %v", len(m3u.segments))
+	}
+
+	first, second := m3u.segments[0], m3u.segments[1]
+	if first.mapRange == nil || first.mapRange.String() != "720@0" {
+		t.Errorf("Expected map byte range 720@0, actual %v", first.mapRange)
+	}
+	if second.byteRange == nil || second.byteRange.String() != "2000@1720" {
+		t.Errorf("Byte range without an offset should follow the previous segment, actual %v", second.byteRange)
+	}
+	if !first.hasKey || first.key.uri != "key.bin" || len(first.otherKeys) != 1 || first.otherKeys[0].format != "com.apple.streamingkeydelivery" {
+		t.Errorf("Expected an identity key and one DRM key, actual %v and %v", first.key, first.otherKeys)
+	}
+	if len(m3u.trailingParts) != 2 || m3u.trailingParts[1].byteRange.String() != "400@300" {
+		t.Errorf("Expected 2 trailing parts with resolved byte ranges, actual %v", m3u.trailingParts)
+	}
+	if getParamValue("CAN-BLOCK-RELOAD", m3u.serverControl) != "YES" || len(m3u.preloadHints) != 1 || len(m3u.renditionReports) != 1 {
+		t.Errorf("Low-Latency HLS tags were not parsed")
+	}
+
+	output := filepath.Join(t.TempDir(), "output.m3u8")
+	m3u.serialize(output)
+	reparsed, err := parseM3U(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialized, _ := os.ReadFile(output)
+	for _, expected := range []string{
+		`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`,
+		`KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"`,
+		"#EXT-X-BYTERANGE:2000@1720",
+		`#EXT-X-PART:DURATION=1,URI="part.mp4",BYTERANGE="300@0",INDEPENDENT=YES`,
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.0",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part.mp4",BYTERANGE-START=700`,
+		"#EXT-X-PART-INF:PART-TARGET=1.0",
+	} {
+		if !strings.Contains(string(serialized), expected) {
+			t.Errorf("Serialized playlist is missing %v:\n%s", expected, serialized)
+		}
+	}
+
+	if len(reparsed.segments) != 2 || len(reparsed.trailingParts) != 2 || reparsed.segments[1].byteRange.String() != "2000@1720" {
+		t.Errorf("Reparsed playlist differs from the original:\n%s", serialized)
+	}
+}
+
+func TestIFrameTrackUrisArePrefixed(t *testing.T) {
+	m3u := newM3U(0)
+	m3u.url = "https://example.com/hls/master.m3u8"
+	m3u.isMasterPlaylist = true
+	m3u.iframeTracks = [][]Param{{{"BANDWIDTH", "1000"}, {"URI", "iframes.m3u8"}}}
+	m3u.prefixRelativeTracks()
+
+	if uri := getParamValue("URI", m3u.iframeTracks[0]); uri != "https://example.com/hls/iframes.m3u8" {
+		t.Errorf("I-frame playlist URI was not prefixed, actual %v", uri)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the M3U8 round-trip tests")
+
+// serializeM3UFile parses the playlist file and returns it serialized along with the path it was serialized to
+func serializeM3UFile(t testing.TB, input string) (string, string) {
+	m3u, err := parseM3U(input)
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %v", input, err)
+	}
+
+	output := filepath.Join(t.TempDir(), "serialized.m3u8")
+	m3u.serialize(output)
+	serialized, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(serialized), output
+}
+
+func TestParseFromReaderMatchesFile(t *testing.T) {
+	data, err := os.ReadFile("testdata/m3u8/media_encrypted.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !detectM3UFrom(bytes.NewReader(data)) {
+		t.Errorf("Playlist was not detected as M3U")
+	}
+
+	if detectM3UFrom(strings.NewReader("<html></html>")) {
+		t.Errorf("HTML document was detected as M3U")
+	}
+
+	m3u, err := parseM3UFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	if err := m3u.serializeTo(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	serialized, _ := serializeM3UFile(t, "testdata/m3u8/media_encrypted.m3u8")
+	if output.String() != serialized {
+		t.Errorf("Playlist parsed from memory differs from the file:\n%v\n---\n%v", output.String(), serialized)
+	}
+
+	if _, err := parseM3UFrom(strings.NewReader("#EXTINF:4,\nsegment.ts\n")); err == nil {
+		t.Errorf("Expected an error for a playlist without the EXTM3U tag")
+	}
+}
+
+func TestPlaylistGoldenRoundTrip(t *testing.T) {
+	playlists, err := filepath.Glob("testdata/m3u8/*.m3u8")
+	if err != nil || len(playlists) == 0 {
+		t.Fatalf("No playlists found in testdata: %v", err)
+	}
+
+	for _, playlist := range playlists {
+		t.Run(filepath.Base(playlist), func(t *testing.T) {
+			serialized, output := serializeM3UFile(t, playlist)
+
+			golden := strings.TrimSuffix(playlist, ".m3u8") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(serialized), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Missing golden file, run the tests with -update to create it: %v", err)
+			}
+			if serialized != string(expected) {
+				t.Errorf("Serialized playlist differs from %v:\n%v", golden, serialized)
+			}
+
+			// Serialized playlists are normalized, parsing and serializing them again must not change anything
+			reserialized, _ := serializeM3UFile(t, output)
+			if reserialized != serialized {
+				t.Errorf("Playlist changed after a second round trip:\n%v\n---\n%v", serialized, reserialized)
+			}
+		})
+	}
+}
+
+func TestPlaylistCorpusModel(t *testing.T) {
+	master, err := parseM3U("testdata/m3u8/master_renditions.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !master.isMasterPlaylist || len(master.tracks) != 2 || len(master.iframeTracks) != 2 || len(master.sessionData) != 2 || len(master.sessionKeys) != 1 {
+		t.Errorf("Master playlist was not fully parsed: %v tracks, %v I-frame tracks, %v session data, %v session keys",
+			len(master.tracks), len(master.iframeTracks), len(master.sessionData), len(master.sessionKeys))
+	}
+	if name := getParamValue("NAME", master.subtitleRenditions[1]); name != "Français" {
+		t.Errorf("Expected UTF-8 rendition name to be preserved, actual %v", name)
+	}
+
+	vod, err := parseM3U("testdata/m3u8/media_fmp4_byterange.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vod.isLive || len(vod.segments) != 4 || vod.segments[2].byteRange.String() != "1443584@2839198" {
+		t.Errorf("Byte range offsets of the VOD playlist were not resolved")
+	}
+
+	encrypted, err := parseM3U("testdata/m3u8/media_encrypted.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := encrypted.segments[2]
+	if third.getAttribute(EXT_X_DISCONTINUITY) != "" || !slices.ContainsFunc(third.attributePairs, func(pair KeyValue) bool { return pair.key == EXT_X_DISCONTINUITY }) {
+		t.Errorf("Expected the third segment to follow a discontinuity")
+	}
+	if third.key.uri != "keys/key2.bin" || len(third.otherKeys) != 1 {
+		t.Errorf("Expected the identity key and a DRM key on the third segment, actual %v and %v", third.key, third.otherKeys)
+	}
+
+	live, err := parseM3U("testdata/m3u8/live_sliding.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !live.isLive || live.getAttribute(EXT_X_MEDIA_SEQUENCE) != "2680" {
+		t.Errorf("Expected a live playlist starting at media sequence 2680")
+	}
+
+	delta, err := parseM3U("testdata/m3u8/live_delta_update.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getParamValue("SKIPPED-SEGMENTS", delta.skip) != "3" || len(delta.segments) != 2 {
+		t.Errorf("Expected a delta update skipping 3 segments")
+	}
+}
+
+func TestPrefixRelativeSegments(t *testing.T) {
+	m3u, err := parseM3U("testdata/m3u8/live_llhls.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3u.url = "https://live.example.com/hls/720p/index.m3u8?session=1"
+	m3u.prefixRelativeSegments()
+
+	expected := map[string]string{
+		"segment":          "https://live.example.com/hls/720p/fileSequence266.mp4",
+		"map":              "https://live.example.com/hls/720p/init.mp4",
+		"part":             "https://live.example.com/hls/720p/filePart267.0.mp4",
+		"trailing part":    "https://live.example.com/hls/720p/filePart268.mp4",
+		"preload hint":     "https://live.example.com/hls/720p/filePart268.mp4",
+		"rendition report": "https://live.example.com/hls/720p/../1M/waitForMSN.php",
+	}
+	actual := map[string]string{
+		"segment":          m3u.segments[0].url,
+		"map":              m3u.segments[0].mapUri,
+		"part":             m3u.segments[1].parts[0].url,
+		"trailing part":    m3u.trailingParts[0].url,
+		"preload hint":     getParamValue("URI", m3u.preloadHints[0]),
+		"rendition report": getParamValue("URI", m3u.renditionReports[0]),
+	}
+	for name, url := range expected {
+		if actual[name] != url {
+			t.Errorf("Expected %v URL %v, actual %v", name, url, actual[name])
+		}
+	}
+
+	vod, err := parseM3U("testdata/m3u8/media_vod.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vod.url = "https://cdn.example.com/vod/index.m3u8"
+	vod.prefixRelativeSegments()
+
+	urls := make([]string, 0, len(vod.segments))
+	for _, segment := range vod.segments {
+		urls = append(urls, segment.url)
+	}
+	expectedUrls := []string{
+		"https://cdn.example.com/vod/segment0.ts",
+		"https://cdn.example.com/vod/segment1.ts",
+		"https://cdn.example.com/absolute/segment2.ts",
+		"https://cdn.example.com/vod/segment3.ts?sig=123&exp=456",
+		"https://cdn.example.com/vod/segment4.ts",
+	}
+	if !slices.Equal(urls, expectedUrls) {
+		t.Errorf("Expected segment URLs %v, actual %v", expectedUrls, urls)
+	}
+}
+
+func TestTrackByVideoHeight(t *testing.T) {
+	m3u, err := parseM3U("testdata/m3u8/master_variants.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[int64]string{
+		1080: "1080p/index.m3u8",
+		720:  "720p/index.m3u8",
+		600:  "/streams/480p/index.m3u8",
+		240:  "https://cdn.example.com/streams/240p/index.m3u8?token=abc",
+	}
+	for height, url := range cases {
+		track := m3u.getTrackByVideoHeight(height)
+		if track == nil || track.url != url {
+			t.Errorf("Expected track %v for height %v, actual %v", url, height, track)
+		}
+	}
+}
+
+func FuzzParseM3U(f *testing.F) {
+	playlists, _ := filepath.Glob("testdata/m3u8/*.m3u8")
+	for _, playlist := range playlists {
+		data, err := os.ReadFile(playlist)
+		if err == nil {
+			f.Add(data)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m3u, err := parseM3UFrom(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		var serialized bytes.Buffer
+		if err := m3u.serializeTo(&serialized); err != nil {
+			t.Fatal(err)
+		}
+
+		reparsed, err := parseM3UFrom(bytes.NewReader(serialized.Bytes()))
+		if err != nil {
+			t.Fatalf("Serialized playlist failed to parse: %v\n%s", err, serialized.Bytes())
+		}
+
+		var reserialized bytes.Buffer
+		reparsed.serializeTo(&reserialized)
+		if serialized.String() != reserialized.String() {
+			t.Errorf("Playlist changed after a second round trip:\n%s\n---\n%s", serialized.Bytes(), reserialized.Bytes())
+		}
+	})
+}
+
+func FuzzParseParams(f *testing.F) {
+	f.Add(`BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"`)
+	f.Add(`TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",URI="audio/de.m3u8"`)
+	f.Add(`METHOD=AES-128,URI="key.bin",IV=0x1F`)
+	f.Add(`X-CUSTOM="a=b,c",X-NUMBER=1.5,`)
+	f.Add(`=,,"`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		params := parseParams(line)
+
+		output := strings.Builder{}
+		writeParams(&output, params)
+		reparsed := parseParams(output.String())
+
+		output.Reset()
+		writeParams(&output, reparsed)
+		if !slices.Equal(parseParams(output.String()), reparsed) {
+			t.Errorf("Params changed after a second round trip: %v -> %v", reparsed, output.String())
+		}
+	})
+}
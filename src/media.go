@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	net_url "net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+type MediaFile struct {
+	LibraryFile
+
+	// ID of the user that uploaded the file, 0 for files not uploaded through the API.
+	UploadedBy uint64 `json:"uploaded_by"`
+
+	// Whether the requesting user is allowed to rename and delete the file.
+	CanManage bool `json:"can_manage"`
+}
+
+type MediaListResponse struct {
+	Files []MediaFile `json:"files"`
+	Total int         `json:"total"`
+}
+
+type MediaDeleteRequest struct {
+	Path string `json:"path"`
+}
+
+type MediaRenameRequest struct {
+	Path    string `json:"path"`
+	NewName string `json:"new_name"`
+}
+
+type MediaDeleteEvent struct {
+	Path string `json:"path"`
+
+	// Playlist and history entries which still point at the deleted file.
+	EntryIds []uint64 `json:"entry_ids"`
+}
+
+type MediaRenameEvent struct {
+	OldPath string `json:"old_path"`
+	NewPath string `json:"new_path"`
+}
+
+// Validates that the path points to an existing media file managed by the server and returns its cleaned form.
+func validateMediaPath(mediaPath string) (string, error) {
+	cleaned, isSafe := safeJoin(mediaPath)
+	if !isSafe || !strings.HasPrefix(cleaned, CONTENT_MEDIA) {
+		return "", fmt.Errorf("Path %v does not point to a media file", mediaPath)
+	}
+
+	if strings.HasPrefix(cleaned, MEDIA_THUMB) || strings.HasPrefix(cleaned, MEDIA_PARTIAL) {
+		return "", fmt.Errorf("Path %v cannot be managed", mediaPath)
+	}
+
+	if strings.HasPrefix(cleaned, MEDIA_RECORDINGS) && !isPathM3U(cleaned) {
+		return "", fmt.Errorf("Segments of recording %v cannot be managed", path.Dir(cleaned))
+	}
+
+	info, err := os.Stat(cleaned)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("Media file %v does not exist", mediaPath)
+	}
+
+	return cleaned, nil
+}
+
+func (server *Server) findUploadRecord(mediaPath string) (UploadRecord, bool) {
+	server.state.uploadLock.Lock()
+	defer server.state.uploadLock.Unlock()
+
+	index := slices.IndexFunc(server.state.uploads, func(record UploadRecord) bool {
+		return record.Path == mediaPath
+	})
+
+	if index == -1 {
+		return UploadRecord{}, false
+	}
+
+	return server.state.uploads[index], true
+}
+
+func (server *Server) canManageMedia(record UploadRecord, exists bool, userId uint64) bool {
+	if server.config.Uploads.AnyoneCanManage {
+		return true
+	}
+
+	return exists && record.UserId == userId
+}
+
+func (server *Server) mediaList(request LibraryListRequest, userId uint64) MediaListResponse {
+	server.library.mutex.Lock()
+	media := make([]LibraryFile, 0)
+	for _, file := range server.library.files {
+		if strings.HasPrefix(file.Path, CONTENT_MEDIA) {
+			media = append(media, file)
+		}
+	}
+	server.library.mutex.Unlock()
+
+	filtered := filterLibraryFiles(media, "", request.Type)
+	page := paginateLibraryFiles(filtered, request.Offset, request.Count)
+
+	files := make([]MediaFile, 0, len(page.Files))
+	for _, file := range page.Files {
+		record, exists := server.findUploadRecord(file.Path)
+		mediaFile := MediaFile{
+			LibraryFile: file,
+			UploadedBy:  record.UserId,
+			CanManage:   server.canManageMedia(record, exists, userId),
+		}
+
+		files = append(files, mediaFile)
+	}
+
+	return MediaListResponse{
+		Files: files,
+		Total: page.Total,
+	}
+}
+
+// Returns the path of the media file the entry URL points at, empty for remote URLs. Entry URLs of media files are stored
+// escaped by relativizeUrl, so they can't be compared with paths directly.
+func entryMediaPath(url string) string {
+	parsed, err := net_url.Parse(url)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" {
+		return ""
+	}
+
+	return parsed.Path
+}
+
+// Returns the entry URL of the media file, escaped the way relativizeUrl stores it.
+func mediaPathToUrl(mediaPath string) string {
+	url := net_url.URL{Path: mediaPath}
+	return url.String()
+}
+
+// Returns IDs of playlist and history entries pointing at the media file. Expects the state mutex to be held.
+func (server *Server) findEntriesWithUrl(mediaPath string) []uint64 {
+	ids := make([]uint64, 0)
+	for _, entry := range server.state.playlist {
+		if entryMediaPath(entry.Url) == mediaPath {
+			ids = append(ids, entry.Id)
+		}
+	}
+
+	for _, entry := range server.state.history {
+		if entryMediaPath(entry.Url) == mediaPath {
+			ids = append(ids, entry.Id)
+		}
+	}
+
+	return ids
+}
+
+// Checks permissions and whether the file is safe to modify. Expects the state mutex to be held.
+func (server *Server) checkMediaModifiable(mediaPath string, userId uint64) (UploadRecord, bool, error) {
+	record, exists := server.findUploadRecord(mediaPath)
+	if !server.canManageMedia(record, exists, userId) {
+		LogWarn("User id:%v tried to modify media file %v they did not upload", userId, mediaPath)
+		return record, exists, fmt.Errorf("You're not the uploader of this file")
+	}
+
+	if entryMediaPath(server.state.entry.Url) == mediaPath {
+		return record, exists, fmt.Errorf("Media file %v is currently playing", mediaPath)
+	}
+
+	return record, exists, nil
+}
+
+func (server *Server) mediaDelete(request MediaDeleteRequest, userId uint64) error {
+	mediaPath, err := validateMediaPath(request.Path)
+	if err != nil {
+		return err
+	}
+
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	if _, _, err := server.checkMediaModifiable(mediaPath, userId); err != nil {
+		return err
+	}
+
+	if err := os.Remove(mediaPath); err != nil {
+		LogError("Failed to delete media file %v: %v", mediaPath, err)
+		return fmt.Errorf("Failed to delete media file %v", mediaPath)
+	}
+
+	// Segments of a recording are deleted along with its playlist.
+	if recording := path.Dir(mediaPath) + "/"; strings.HasPrefix(recording, MEDIA_RECORDINGS) && recording != MEDIA_RECORDINGS {
+		os.RemoveAll(recording)
+	}
+
+	DatabaseUploadDelete(server.db, mediaPath)
+	server.state.uploadLock.Lock()
+	server.state.uploads = slices.DeleteFunc(server.state.uploads, func(record UploadRecord) bool {
+		return record.Path == mediaPath
+	})
+	server.state.uploadLock.Unlock()
+
+	// Thumbnails of the affected entries stay, since the entries are still listed. Once nothing references them,
+	// they are removed by the thumbnail cache eviction.
+	affected := server.findEntriesWithUrl(mediaPath)
+	if len(affected) > 0 {
+		LogWarn("Deleted media file %v is still referenced by entries %v", mediaPath, affected)
+	}
+
+	LogInfo("User id:%v deleted media file %v.", userId, mediaPath)
+	event := MediaDeleteEvent{
+		Path:     mediaPath,
+		EntryIds: affected,
+	}
+	server.writeEventToAllConnections("mediadelete", event, userId)
+
+	go server.libraryRescan()
+	return nil
+}
+
+func (server *Server) mediaRename(request MediaRenameRequest, userId uint64) (string, error) {
+	oldPath, err := validateMediaPath(request.Path)
+	if err != nil {
+		return "", err
+	}
+
+	newName := SanitizeUrlFileName(strings.TrimSpace(request.NewName))
+	if newName == "" || newName != path.Base(newName) || strings.HasPrefix(newName, ".") {
+		return "", fmt.Errorf("File name %v is not allowed", request.NewName)
+	}
+
+	oldCategory := getMediaType(path.Ext(oldPath))
+	newCategory := getMediaType(path.Ext(newName))
+	if oldCategory != newCategory {
+		return "", fmt.Errorf("Renaming %v to %v would change its media category", path.Base(oldPath), newName)
+	}
+
+	newPath, isSafe := safeJoin(path.Dir(oldPath), newName)
+	if !isSafe {
+		return "", fmt.Errorf("File name %v is not allowed", request.NewName)
+	}
+
+	if newPath == oldPath {
+		return newPath, nil
+	}
+
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	record, tracked, err := server.checkMediaModifiable(oldPath, userId)
+	if err != nil {
+		return "", err
+	}
+
+	// Hard link followed by removal of the old name fails instead of overwriting an existing file.
+	if err := os.Link(oldPath, newPath); err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("File %v already exists", newName)
+		}
+
+		LogError("Failed to rename media file %v to %v: %v", oldPath, newPath, err)
+		return "", fmt.Errorf("Failed to rename media file %v", path.Base(oldPath))
+	}
+	os.Remove(oldPath)
+
+	if tracked {
+		DatabaseUploadRename(server.db, record.Id, newPath)
+		server.state.uploadLock.Lock()
+		for i := range server.state.uploads {
+			if server.state.uploads[i].Id == record.Id {
+				server.state.uploads[i].Path = newPath
+			}
+		}
+		server.state.uploadLock.Unlock()
+	}
+
+	newUrl := mediaPathToUrl(newPath)
+	for i, entry := range server.state.playlist {
+		if entryMediaPath(entry.Url) != oldPath {
+			continue
+		}
+
+		entry.Url = newUrl
+		DatabaseEntryUpdateUrl(server.db, entry.Id, newUrl)
+		server.state.playlist[i] = entry
+
+		event := createPlaylistEvent("update", entry)
+		server.writeEventToAllConnections("playlist", event, userId)
+	}
+
+	historyChanged := false
+	for i, entry := range server.state.history {
+		if entryMediaPath(entry.Url) == oldPath {
+			server.state.history[i].Url = newUrl
+			DatabaseEntryUpdateUrl(server.db, entry.Id, newUrl)
+			historyChanged = true
+		}
+	}
+
+	if historyChanged {
+		server.writeEventToAllConnections("historyrestore", server.state.history, userId)
+	}
+
+	LogInfo("User id:%v renamed media file %v to %v.", userId, oldPath, newPath)
+	event := MediaRenameEvent{
+		OldPath: oldPath,
+		NewPath: newPath,
+	}
+	server.writeEventToAllConnections("mediarename", event, userId)
+
+	go server.libraryRescan()
+	return newPath, nil
+}
@@ -23,6 +23,50 @@ type ServerConfig struct {
 	Redirects           []RedirectConfig `json:"redirects"`
 	BlacklistedIpRanges [][]string       `json:"blacklisted_ip_ranges"`
 	ProfilerOutput      string           `json:"profiler_output"`
+	Uploads             UploadConfig     `json:"uploads"`
+
+	// Directories indexed by the library in addition to the media directory. They must be relative paths within the
+	// content directory, since only files served from there can be played.
+	LibraryRoots []string `json:"library_roots"`
+
+	// Command grabbing a video frame for thumbnails of videos without one, disabled when empty. Arguments may contain
+	// {input}, {output} and {referer} placeholders, for example: ["ffmpeg", "-ss", "5", "-i", "{input}", "-frames:v", "1", "{output}"]
+	ThumbnailCommand []string `json:"thumbnail_command"`
+
+	// Video heights of the HLS master playlist renditions kept by the proxy. Nearest lower renditions are used
+	// when an exact height is missing.
+	HlsRenditionHeights []int64 `json:"hls_rendition_heights"`
+
+	// Attach WebVTT subtitle renditions of proxied HLS master playlists to the entry as subtitles.
+	HlsAttachSubtitles bool `json:"hls_attach_subtitles"`
+
+	// Seconds of HLS segments downloaded ahead of the room playhead, before clients request them. 0 disables prefetching.
+	HlsPrefetchSeconds float64 `json:"hls_prefetch_seconds"`
+
+	// Disk budget for proxied HLS chunks, chunks furthest behind the room playhead are evicted first. 0 disables the limit.
+	HlsCacheSizeMB int64 `json:"hls_cache_size_mb"`
+
+	// Minutes of live stream segments kept on disk and listed in the served playlist, so the room can rewind proxied and
+	// hosted streams. Streams which end are saved to history as recordings. 0 disables the window.
+	LiveDvrMinutes float64 `json:"live_dvr_minutes"`
+
+	// Parallel connections downloading ranges of proxied files. Connections beyond the first are opened only while the
+	// origin is too slow to stay ahead of playback.
+	FileProxyWorkers int `json:"file_proxy_workers"`
+}
+
+type UploadConfig struct {
+	// Size limit of a single upload for each media category (video, audio, image, subs, other). 0 disables the limit.
+	CategoryLimitsMB map[string]int64 `json:"category_limits_mb"`
+
+	// Total size of files a single user is allowed to upload. 0 disables the limit.
+	UserLimitMB int64 `json:"user_limit_mb"`
+
+	// Total size of all files stored in the media directory. 0 disables the limit.
+	MediaQuotaMB int64 `json:"media_quota_mb"`
+
+	// Allows every user to rename and delete any media file, instead of only the files they uploaded.
+	AnyoneCanManage bool `json:"anyone_can_manage"`
 }
 
 type RedirectConfig struct {
@@ -77,6 +121,26 @@ func createDefaultConfig() Config {
 		Redirects:           []RedirectConfig{},
 		BlacklistedIpRanges: [][]string{},
 		ProfilerOutput:      "",
+		LibraryRoots:        []string{},
+		Uploads: UploadConfig{
+			CategoryLimitsMB: map[string]int64{
+				"video": 4096,
+				"audio": 512,
+				"image": 32,
+				"subs":  1,
+				"other": 256,
+			},
+			UserLimitMB:     16384,
+			MediaQuotaMB:    65536,
+			AnyoneCanManage: false,
+		},
+		ThumbnailCommand:    []string{},
+		HlsRenditionHeights: []int64{1080, 720, 480},
+		HlsAttachSubtitles:  false,
+		HlsPrefetchSeconds:  30,
+		HlsCacheSizeMB:      2048,
+		LiveDvrMinutes:      0,
+		FileProxyWorkers:    4,
 	}
 
 	logging := LoggingConfig{
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Starts a prefetcher for every VOD proxy of the current entry. Expects the setup lock to be held.
+func (server *Server) startHlsPrefetchers() {
+	if server.config.HlsPrefetchSeconds <= 0 {
+		return
+	}
+
+	for prefix, proxy := range server.state.hlsProxies {
+		ctx, cancel := context.WithCancel(context.Background())
+		proxy.stopPrefetch = cancel
+		proxy.prefetchDone = make(chan struct{})
+		go server.runHlsPrefetcher(ctx, proxy, prefix)
+	}
+}
+
+// Cancels prefetchers and cache eviction of the current entry and waits for prefetch downloads to finish, so they don't
+// touch the proxy directory of the next entry. Expects the setup lock to be held.
+func (server *Server) destructHlsProxies() {
+	for _, proxy := range server.state.hlsProxies {
+		if proxy.stopPrefetch != nil {
+			proxy.stopPrefetch()
+		}
+		if proxy.cache != nil {
+			proxy.cache.close()
+		}
+	}
+
+	for _, proxy := range server.state.hlsProxies {
+		if proxy.prefetchDone != nil {
+			<-proxy.prefetchDone
+		}
+	}
+}
+
+// runHlsPrefetcher keeps chunks covering the next HlsPrefetchSeconds of the room playhead downloaded, so clients are
+// served from disk instead of waiting on the origin. Renditions which clients stopped requesting (a different quality
+// or audio language) are left alone until they are requested again.
+func (server *Server) runHlsPrefetcher(ctx context.Context, proxy *HlsProxy, prefix string) {
+	LogDebug("Starting HLS prefetcher for rendition %v", prefix)
+	defer close(proxy.prefetchDone)
+	backoff := time.Duration(0)
+
+	for {
+		wait := time.Second
+		if backoff > 0 {
+			wait = backoff
+		}
+
+		select {
+		case <-ctx.Done():
+			LogDebug("Terminating HLS prefetcher for rendition %v", prefix)
+			return
+		case <-time.After(wait):
+		}
+
+		lastServed := time.UnixMilli(proxy.lastServed.Load())
+		if time.Since(lastServed) > HLS_PREFETCH_IDLE_TIMEOUT {
+			continue
+		}
+
+		timestamp := server.getCurrentTimestamp()
+		pending := proxy.chunksToPrefetch(timestamp, server.config.HlsPrefetchSeconds)
+		if len(pending) == 0 {
+			continue
+		}
+
+		failed := proxy.prefetchChunks(ctx, prefix, pending)
+		if failed {
+			backoff = min(max(2*backoff, time.Second), HLS_PREFETCH_MAX_BACKOFF)
+			LogWarn("HLS prefetcher for rendition %v failed to fetch chunks, retrying in %v", prefix, backoff)
+		} else {
+			backoff = 0
+		}
+	}
+}
+
+// Returns IDs of chunks which are not on disk yet and overlap the window of the given length starting at the timestamp.
+func (proxy *HlsProxy) chunksToPrefetch(timestamp, ahead float64) []int {
+	if len(proxy.chunkStarts) == 0 {
+		return nil
+	}
+
+	// Index of the chunk containing the timestamp, chunk 0 when the timestamp precedes it.
+	first, found := slices.BinarySearch(proxy.chunkStarts, timestamp)
+	if !found {
+		first = max(0, first-1)
+	}
+
+	pending := make([]int, 0)
+	for id := first; id < len(proxy.chunkStarts) && proxy.chunkStarts[id] < timestamp+ahead; id++ {
+		mutex := &proxy.chunkLocks[id]
+		if !mutex.TryLock() {
+			// Already being fetched by a client
+			continue
+		}
+		fetched := proxy.fetchedChunks[id]
+		mutex.Unlock()
+
+		if !fetched {
+			pending = append(pending, id)
+		}
+	}
+
+	return pending
+}
+
+// Fetches the chunks in order with at most HLS_PREFETCH_CONCURRENCY downloads at once. Returns true if any failed.
+func (proxy *HlsProxy) prefetchChunks(ctx context.Context, prefix string, chunkIds []int) bool {
+	semaphore := make(chan struct{}, HLS_PREFETCH_CONCURRENCY)
+	var group sync.WaitGroup
+	var failed bool
+	var failedMutex sync.Mutex
+
+	for _, id := range chunkIds {
+		select {
+		case <-ctx.Done():
+			group.Wait()
+			return false
+		case semaphore <- struct{}{}:
+		}
+
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			defer func() { <-semaphore }()
+
+			chunk := prefix + toString(id)
+			if err := proxy.fetchChunk(ctx, chunk, id); err != nil {
+				LogDebug("Failed to prefetch chunk %v: %v", chunk, err)
+				failedMutex.Lock()
+				failed = true
+				failedMutex.Unlock()
+			}
+		}()
+	}
+
+	group.Wait()
+	return failed
+}
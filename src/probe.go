@@ -0,0 +1,1367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const MAX_PROBE_ELEMENT_SIZE = 16 * MB
+const MAX_PROBE_HTTP_READS = 16
+const MP3_SYNC_SEARCH_SIZE = 64 * KB
+
+var errUnknownContainer = errors.New("unknown media container")
+
+type MediaTrack struct {
+	// One of: video, audio, subtitle.
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+}
+
+// Information extracted from the headers of a media container without decoding any of the streams.
+type MediaProbe struct {
+	Container string
+
+	// Duration in seconds.
+	Duration float64
+
+	// Overall bitrate in bits per second.
+	Bitrate int64
+
+	Tracks []MediaTrack
+
+	// Embedded tags with normalized lowercase keys, such as title, artist, album, date and track.
+	Tags map[string]string
+
+	// Embedded cover art image (ID3 APIC, FLAC PICTURE or MP4 covr), nil when absent or larger than MAX_THUMBNAIL_SIZE.
+	Cover []byte
+}
+
+func probeMediaFile(filePath string) (MediaProbe, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return MediaProbe{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return MediaProbe{}, err
+	}
+
+	return probeMedia(file, info.Size())
+}
+
+// Probes a remote file with a bounded number of HTTP range requests.
+func probeMediaUrl(url, referer string, size int64) (MediaProbe, error) {
+	reader := &httpRangeReader{url: url, referer: referer}
+	return probeMedia(reader, size)
+}
+
+func probeMedia(reader io.ReaderAt, size int64) (MediaProbe, error) {
+	header, err := readProbeBytes(reader, 0, 12)
+	if err != nil {
+		return MediaProbe{}, err
+	}
+
+	var probe MediaProbe
+	switch {
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		probe, err = probeMp4(reader, size)
+
+	case bytes.Equal(header[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		probe, err = probeMatroska(reader, size)
+
+	case bytes.Equal(header[:4], []byte("fLaC")):
+		probe, err = probeFlac(reader, size)
+
+	case bytes.Equal(header[:3], []byte("ID3")) || isMpegAudioHeader(header):
+		probe, err = probeMp3(reader, size)
+
+	default:
+		return MediaProbe{}, errUnknownContainer
+	}
+
+	if err != nil {
+		return MediaProbe{}, err
+	}
+
+	if probe.Bitrate == 0 && probe.Duration > 0 {
+		probe.Bitrate = int64(float64(size) * 8 / probe.Duration)
+	}
+
+	return probe, nil
+}
+
+// Copies probed duration, bitrate, tracks and tags into the metadata, without overwriting fields that are already set.
+func (probe *MediaProbe) fillMetadata(metadata *Metadata) {
+	if metadata.Duration == 0 {
+		metadata.Duration = int64(math.Round(probe.Duration))
+	}
+
+	if metadata.Bitrate == 0 {
+		metadata.Bitrate = probe.Bitrate
+	}
+
+	if metadata.Container == "" {
+		metadata.Container = probe.Container
+	}
+
+	if len(metadata.Tracks) == 0 {
+		metadata.Tracks = probe.Tracks
+	}
+
+	if metadata.ArtistName == "" {
+		metadata.ArtistName = probe.Tags["artist"]
+	}
+
+	if metadata.ArtistName == "" {
+		metadata.ArtistName = probe.Tags["albumartist"]
+	}
+
+	if metadata.AlbumName == "" {
+		metadata.AlbumName = probe.Tags["album"]
+	}
+
+	if metadata.ReleaseDate == "" {
+		metadata.ReleaseDate = probe.Tags["date"]
+	}
+
+	if metadata.TrackNumber == 0 {
+		// Track numbers are often stored as "3/12".
+		track, _, _ := strings.Cut(probe.Tags["track"], "/")
+		metadata.TrackNumber, _ = strconv.Atoi(strings.TrimSpace(track))
+	}
+}
+
+func readProbeBytes(reader io.ReaderAt, offset, count int64) ([]byte, error) {
+	if count < 0 || count > MAX_PROBE_ELEMENT_SIZE {
+		return nil, fmt.Errorf("probe read of %v bytes exceeds the limit", count)
+	}
+
+	buffer := make([]byte, count)
+	read, err := reader.ReadAt(buffer, offset)
+	if read == len(buffer) {
+		return buffer, nil
+	}
+
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return nil, err
+}
+
+// Reads up to count bytes, returning fewer when the end of the file is reached.
+func readProbeBytesAtMost(reader io.ReaderAt, offset, count, size int64) ([]byte, error) {
+	count = min(count, size-offset)
+	if count <= 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return readProbeBytes(reader, offset, count)
+}
+
+type httpRangeReader struct {
+	url     string
+	referer string
+	reads   int
+}
+
+func (reader *httpRangeReader) ReadAt(buffer []byte, offset int64) (int, error) {
+	if reader.reads >= MAX_PROBE_HTTP_READS {
+		return 0, errors.New("probe exceeded the maximum number of range requests")
+	}
+	reader.reads += 1
+
+	request, err := http.NewRequest("GET", reader.url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("User-Agent", userAgent)
+	if reader.referer != "" {
+		request.Header.Set("Referer", reader.referer)
+		request.Header.Set("Origin", inferOrigin(reader.referer))
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+int64(len(buffer))-1))
+
+	response, err := hastyClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		return 0, &DownloadError{Code: response.StatusCode, Message: "Range request for the probe failed."}
+	}
+
+	return io.ReadFull(response.Body, buffer)
+}
+
+//
+// ISO base media file format (MP4, M4A, MOV)
+//
+
+func probeMp4(reader io.ReaderAt, size int64) (MediaProbe, error) {
+	probe := MediaProbe{
+		Container: "mp4",
+		Tracks:    make([]MediaTrack, 0),
+		Tags:      make(map[string]string),
+	}
+
+	offset := int64(0)
+	for offset+8 <= size {
+		header, err := readProbeBytesAtMost(reader, offset, 16, size)
+		if err != nil || len(header) < 8 {
+			break
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		headerSize := int64(8)
+
+		if boxSize == 1 && len(header) >= 16 {
+			boxSize = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		} else if boxSize == 0 {
+			boxSize = size - offset
+		}
+
+		if boxSize < headerSize || offset+boxSize > size {
+			break
+		}
+
+		if kind == "ftyp" && len(header) >= 12 && string(header[8:12]) == "qt  " {
+			probe.Container = "mov"
+		}
+
+		if kind == "moov" {
+			moov, err := readProbeBytes(reader, offset+headerSize, boxSize-headerSize)
+			if err != nil {
+				return MediaProbe{}, err
+			}
+
+			parseMp4Moov(moov, &probe)
+			return probe, nil
+		}
+
+		offset += boxSize
+	}
+
+	return MediaProbe{}, errors.New("mp4 file is missing the moov box")
+}
+
+func iterateMp4Boxes(data []byte, fn func(kind string, payload []byte)) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		headerSize := uint64(8)
+
+		if size == 1 {
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			headerSize = 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return
+		}
+
+		fn(kind, data[headerSize:size])
+		data = data[size:]
+	}
+}
+
+func parseMp4Moov(moov []byte, probe *MediaProbe) {
+	iterateMp4Boxes(moov, func(kind string, payload []byte) {
+		switch kind {
+		case "mvhd":
+			var timescale, duration uint64
+			if len(payload) >= 32 && payload[0] == 1 {
+				timescale = uint64(binary.BigEndian.Uint32(payload[20:]))
+				duration = binary.BigEndian.Uint64(payload[24:])
+			} else if len(payload) >= 20 {
+				timescale = uint64(binary.BigEndian.Uint32(payload[12:]))
+				duration = uint64(binary.BigEndian.Uint32(payload[16:]))
+			}
+
+			if timescale > 0 {
+				probe.Duration = float64(duration) / float64(timescale)
+			}
+
+		case "trak":
+			if track, ok := parseMp4Track(payload); ok {
+				probe.Tracks = append(probe.Tracks, track)
+			}
+
+		case "udta":
+			iterateMp4Boxes(payload, func(kind string, payload []byte) {
+				if kind == "meta" {
+					parseMp4Meta(payload, probe)
+				}
+			})
+		}
+	})
+}
+
+func parseMp4Track(trak []byte) (MediaTrack, bool) {
+	var handler, fourcc, language string
+
+	iterateMp4Boxes(trak, func(kind string, mdia []byte) {
+		if kind != "mdia" {
+			return
+		}
+
+		iterateMp4Boxes(mdia, func(kind string, payload []byte) {
+			switch kind {
+			case "hdlr":
+				if len(payload) >= 12 {
+					handler = string(payload[8:12])
+				}
+
+			case "mdhd":
+				languageOffset := 20
+				if len(payload) > 0 && payload[0] == 1 {
+					languageOffset = 32
+				}
+
+				if len(payload) >= languageOffset+2 {
+					language = decodeMp4Language(binary.BigEndian.Uint16(payload[languageOffset:]))
+				}
+
+			case "minf":
+				iterateMp4Boxes(payload, func(kind string, stbl []byte) {
+					if kind != "stbl" {
+						return
+					}
+
+					iterateMp4Boxes(stbl, func(kind string, stsd []byte) {
+						if kind == "stsd" && len(stsd) >= 16 {
+							fourcc = string(stsd[12:16])
+						}
+					})
+				})
+			}
+		})
+	})
+
+	track := MediaTrack{
+		Codec:    mp4CodecName(fourcc),
+		Language: language,
+	}
+
+	switch handler {
+	case "vide":
+		track.Kind = "video"
+	case "soun":
+		track.Kind = "audio"
+	case "sbtl", "subt", "text", "clcp":
+		track.Kind = "subtitle"
+	default:
+		return MediaTrack{}, false
+	}
+
+	return track, true
+}
+
+// Language is packed as three 5-bit characters offset by 0x60.
+func decodeMp4Language(packed uint16) string {
+	if packed == 0 || packed == 0x7FFF {
+		return ""
+	}
+
+	language := string([]byte{
+		byte((packed>>10)&0x1F) + 0x60,
+		byte((packed>>5)&0x1F) + 0x60,
+		byte(packed&0x1F) + 0x60,
+	})
+
+	if language == "und" {
+		return ""
+	}
+
+	return language
+}
+
+func mp4CodecName(fourcc string) string {
+	switch fourcc {
+	case "avc1", "avc3":
+		return "h264"
+	case "hvc1", "hev1":
+		return "hevc"
+	case "av01":
+		return "av1"
+	case "vp09":
+		return "vp9"
+	case "mp4a":
+		return "aac"
+	case "ac-3":
+		return "ac3"
+	case "ec-3":
+		return "eac3"
+	case "Opus":
+		return "opus"
+	case "fLaC":
+		return "flac"
+	case "tx3g":
+		return "mov_text"
+	case "wvtt":
+		return "webvtt"
+	case "stpp":
+		return "ttml"
+	}
+
+	return strings.TrimSpace(fourcc)
+}
+
+func parseMp4Meta(meta []byte, probe *MediaProbe) {
+	tags := probe.Tags
+
+	// The MP4 meta box is a full box with 4 bytes of version and flags, while the QuickTime one is not.
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		meta = meta[4:]
+	}
+
+	iterateMp4Boxes(meta, func(kind string, ilst []byte) {
+		if kind != "ilst" {
+			return
+		}
+
+		iterateMp4Boxes(ilst, func(itemKind string, item []byte) {
+			var value []byte
+			iterateMp4Boxes(item, func(kind string, payload []byte) {
+				if kind == "data" && len(payload) >= 8 && value == nil {
+					value = payload[8:]
+				}
+			})
+
+			if value == nil {
+				return
+			}
+
+			switch itemKind {
+			case "\xa9nam":
+				tags["title"] = string(value)
+			case "\xa9ART":
+				tags["artist"] = string(value)
+			case "aART":
+				tags["albumartist"] = string(value)
+			case "\xa9alb":
+				tags["album"] = string(value)
+			case "\xa9day":
+				tags["date"] = string(value)
+			case "\xa9gen":
+				tags["genre"] = string(value)
+			case "trkn":
+				if len(value) >= 4 {
+					tags["track"] = strconv.Itoa(int(binary.BigEndian.Uint16(value[2:])))
+				}
+			case "covr":
+				if probe.Cover == nil && len(value) <= MAX_THUMBNAIL_SIZE {
+					probe.Cover = slices.Clone(value)
+				}
+			}
+		})
+	})
+}
+
+//
+// Matroska and WebM
+//
+
+const (
+	EBML_ID_HEADER   = 0x1A45DFA3
+	EBML_ID_DOCTYPE  = 0x4282
+	MKV_ID_SEGMENT   = 0x18538067
+	MKV_ID_SEEK_HEAD = 0x114D9B74
+	MKV_ID_SEEK      = 0x4DBB
+	MKV_ID_SEEK_ID   = 0x53AB
+	MKV_ID_SEEK_POS  = 0x53AC
+	MKV_ID_INFO      = 0x1549A966
+	MKV_ID_TIMESCALE = 0x2AD7B1
+	MKV_ID_DURATION  = 0x4489
+	MKV_ID_TITLE     = 0x7BA9
+	MKV_ID_TRACKS    = 0x1654AE6B
+	MKV_ID_TRACK     = 0xAE
+	MKV_ID_TYPE      = 0x83
+	MKV_ID_CODEC     = 0x86
+	MKV_ID_LANGUAGE  = 0x22B59C
+	MKV_ID_NAME      = 0x536E
+	MKV_ID_TAGS      = 0x1254C367
+	MKV_ID_TAG       = 0x7373
+	MKV_ID_SIMPLETAG = 0x67C8
+	MKV_ID_TAG_NAME  = 0x45A3
+	MKV_ID_TAG_VALUE = 0x4487
+	MKV_ID_CLUSTER   = 0x1F43B675
+)
+
+// Reads an EBML variable length integer. Element IDs keep their length marker bits, sizes do not.
+// Returns -1 as the value for sizes with all value bits set, which denote an unknown size.
+func readEbmlVint(data []byte, keepMarker bool) (int64, int, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length += 1
+	}
+
+	if len(data) < length {
+		return 0, 0, false
+	}
+
+	value := int64(data[0])
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+
+	allOnes := value == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | int64(data[i])
+		allOnes = allOnes && data[i] == 0xFF
+	}
+
+	if !keepMarker && allOnes {
+		return -1, length, true
+	}
+
+	return value, length, true
+}
+
+func readEbmlElementHeader(data []byte) (id int64, size int64, headerSize int, ok bool) {
+	id, idLength, ok := readEbmlVint(data, true)
+	if !ok {
+		return 0, 0, 0, false
+	}
+
+	size, sizeLength, ok := readEbmlVint(data[idLength:], false)
+	if !ok {
+		return 0, 0, 0, false
+	}
+
+	return id, size, idLength + sizeLength, true
+}
+
+func iterateEbmlElements(data []byte, fn func(id int64, payload []byte)) {
+	for len(data) > 0 {
+		id, size, headerSize, ok := readEbmlElementHeader(data)
+		if !ok {
+			return
+		}
+
+		data = data[headerSize:]
+		if size < 0 || size > int64(len(data)) {
+			size = int64(len(data))
+		}
+
+		fn(id, data[:size])
+		data = data[size:]
+	}
+}
+
+func readEbmlUint(payload []byte) uint64 {
+	var value uint64
+	for _, b := range payload {
+		value = value<<8 | uint64(b)
+	}
+
+	return value
+}
+
+func readEbmlFloat(payload []byte) float64 {
+	switch len(payload) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(payload))
+	}
+
+	return 0
+}
+
+func readEbmlString(payload []byte) string {
+	return strings.TrimRight(string(payload), "\x00")
+}
+
+func probeMatroska(reader io.ReaderAt, size int64) (MediaProbe, error) {
+	probe := MediaProbe{
+		Container: "matroska",
+		Tracks:    make([]MediaTrack, 0),
+		Tags:      make(map[string]string),
+	}
+
+	readHeader := func(offset int64) (int64, int64, int64, bool) {
+		header, err := readProbeBytesAtMost(reader, offset, 12, size)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+
+		id, elementSize, headerSize, ok := readEbmlElementHeader(header)
+		return id, elementSize, offset + int64(headerSize), ok
+	}
+
+	id, elementSize, dataOffset, ok := readHeader(0)
+	if !ok || id != EBML_ID_HEADER || elementSize < 0 {
+		return MediaProbe{}, errors.New("invalid EBML header")
+	}
+
+	ebml, err := readProbeBytes(reader, dataOffset, elementSize)
+	if err != nil {
+		return MediaProbe{}, err
+	}
+
+	iterateEbmlElements(ebml, func(id int64, payload []byte) {
+		if id == EBML_ID_DOCTYPE && readEbmlString(payload) == "webm" {
+			probe.Container = "webm"
+		}
+	})
+
+	id, elementSize, segmentStart, ok := readHeader(dataOffset + elementSize)
+	if !ok || id != MKV_ID_SEGMENT {
+		return MediaProbe{}, errors.New("matroska file is missing the segment element")
+	}
+
+	segmentEnd := size
+	if elementSize >= 0 {
+		segmentEnd = min(segmentStart+elementSize, size)
+	}
+
+	timescale := uint64(1_000_000)
+	var duration float64
+	seeks := make(map[int64]int64)
+	parsed := make(map[int64]bool)
+
+	handleElement := func(id int64, payload []byte) {
+		parsed[id] = true
+
+		switch id {
+		case MKV_ID_SEEK_HEAD:
+			iterateEbmlElements(payload, func(id int64, seek []byte) {
+				if id != MKV_ID_SEEK {
+					return
+				}
+
+				var seekId, seekPosition int64 = 0, -1
+				iterateEbmlElements(seek, func(id int64, payload []byte) {
+					switch id {
+					case MKV_ID_SEEK_ID:
+						seekId = int64(readEbmlUint(payload))
+					case MKV_ID_SEEK_POS:
+						seekPosition = int64(readEbmlUint(payload))
+					}
+				})
+
+				if seekId != 0 && seekPosition >= 0 {
+					seeks[seekId] = seekPosition
+				}
+			})
+
+		case MKV_ID_INFO:
+			iterateEbmlElements(payload, func(id int64, payload []byte) {
+				switch id {
+				case MKV_ID_TIMESCALE:
+					timescale = readEbmlUint(payload)
+				case MKV_ID_DURATION:
+					duration = readEbmlFloat(payload)
+				case MKV_ID_TITLE:
+					if _, exists := probe.Tags["title"]; !exists {
+						probe.Tags["title"] = readEbmlString(payload)
+					}
+				}
+			})
+
+		case MKV_ID_TRACKS:
+			iterateEbmlElements(payload, func(id int64, entry []byte) {
+				if id != MKV_ID_TRACK {
+					return
+				}
+
+				if track, ok := parseMatroskaTrack(entry); ok {
+					probe.Tracks = append(probe.Tracks, track)
+				}
+			})
+
+		case MKV_ID_TAGS:
+			parseMatroskaTags(payload, probe.Tags)
+		}
+	}
+
+	readElement := func(id int64, offset, elementSize int64) {
+		if elementSize < 0 || elementSize > MAX_PROBE_ELEMENT_SIZE {
+			return
+		}
+
+		payload, err := readProbeBytes(reader, offset, elementSize)
+		if err == nil {
+			handleElement(id, payload)
+		}
+	}
+
+	// Top level elements are scanned until the first cluster. Elements placed after the clusters are located through the seek head.
+	offset := segmentStart
+	for offset < segmentEnd {
+		id, elementSize, dataOffset, ok := readHeader(offset)
+		if !ok || id == MKV_ID_CLUSTER || elementSize < 0 {
+			break
+		}
+
+		switch id {
+		case MKV_ID_SEEK_HEAD, MKV_ID_INFO, MKV_ID_TRACKS, MKV_ID_TAGS:
+			readElement(id, dataOffset, elementSize)
+		}
+
+		offset = dataOffset + elementSize
+	}
+
+	for _, id := range []int64{MKV_ID_INFO, MKV_ID_TRACKS, MKV_ID_TAGS} {
+		position, exists := seeks[id]
+		if parsed[id] || !exists {
+			continue
+		}
+
+		seekedId, elementSize, dataOffset, ok := readHeader(segmentStart + position)
+		if ok && seekedId == id {
+			readElement(id, dataOffset, elementSize)
+		}
+	}
+
+	if !parsed[MKV_ID_INFO] {
+		return MediaProbe{}, errors.New("matroska file is missing the info element")
+	}
+
+	probe.Duration = duration * float64(timescale) / 1e9
+	return probe, nil
+}
+
+func parseMatroskaTrack(entry []byte) (MediaTrack, bool) {
+	var track MediaTrack
+	var trackType uint64
+	var codecId string
+
+	iterateEbmlElements(entry, func(id int64, payload []byte) {
+		switch id {
+		case MKV_ID_TYPE:
+			trackType = readEbmlUint(payload)
+		case MKV_ID_CODEC:
+			codecId = readEbmlString(payload)
+		case MKV_ID_LANGUAGE:
+			track.Language = readEbmlString(payload)
+		case MKV_ID_NAME:
+			track.Name = readEbmlString(payload)
+		}
+	})
+
+	switch trackType {
+	case 1:
+		track.Kind = "video"
+	case 2:
+		track.Kind = "audio"
+	case 17:
+		track.Kind = "subtitle"
+	default:
+		return MediaTrack{}, false
+	}
+
+	if track.Language == "und" {
+		track.Language = ""
+	}
+
+	track.Codec = matroskaCodecName(codecId)
+	return track, true
+}
+
+func matroskaCodecName(codecId string) string {
+	switch {
+	case codecId == "V_MPEG4/ISO/AVC":
+		return "h264"
+	case codecId == "V_MPEGH/ISO/HEVC":
+		return "hevc"
+	case strings.HasPrefix(codecId, "A_AAC"):
+		return "aac"
+	case codecId == "A_MPEG/L3":
+		return "mp3"
+	case codecId == "S_TEXT/UTF8":
+		return "subrip"
+	case codecId == "S_TEXT/ASS", codecId == "S_TEXT/SSA":
+		return "ass"
+	case codecId == "S_HDMV/PGS":
+		return "hdmv_pgs_subtitle"
+	case codecId == "S_VOBSUB":
+		return "dvd_subtitle"
+	}
+
+	// Remaining codec IDs map directly, for example V_VP9, V_AV1, A_OPUS, A_VORBIS, A_FLAC, A_EAC3 and S_TEXT/WEBVTT.
+	name := codecId
+	if len(name) > 2 && name[1] == '_' {
+		name = name[2:]
+	}
+	name = strings.TrimPrefix(name, "TEXT/")
+
+	return strings.ToLower(name)
+}
+
+func parseMatroskaTags(payload []byte, tags map[string]string) {
+	iterateEbmlElements(payload, func(id int64, tag []byte) {
+		if id != MKV_ID_TAG {
+			return
+		}
+
+		iterateEbmlElements(tag, func(id int64, simpleTag []byte) {
+			if id != MKV_ID_SIMPLETAG {
+				return
+			}
+
+			var name, value string
+			iterateEbmlElements(simpleTag, func(id int64, payload []byte) {
+				switch id {
+				case MKV_ID_TAG_NAME:
+					name = readEbmlString(payload)
+				case MKV_ID_TAG_VALUE:
+					value = readEbmlString(payload)
+				}
+			})
+
+			setNormalizedTag(tags, name, value)
+		})
+	})
+}
+
+// Stores a tag under its normalized key. The first value of a tag wins.
+func setNormalizedTag(tags map[string]string, name, value string) {
+	value = strings.TrimSpace(value)
+	if name == "" || value == "" {
+		return
+	}
+
+	key := strings.ToLower(name)
+	switch key {
+	case "album_artist", "album artist":
+		key = "albumartist"
+	case "tracknumber", "part_number":
+		key = "track"
+	case "year", "date_released", "date_recorded":
+		key = "date"
+	}
+
+	if _, exists := tags[key]; !exists {
+		tags[key] = value
+	}
+}
+
+//
+// FLAC
+//
+
+const (
+	FLAC_BLOCK_STREAMINFO     = 0
+	FLAC_BLOCK_VORBIS_COMMENT = 4
+	FLAC_BLOCK_PICTURE        = 6
+)
+
+func probeFlac(reader io.ReaderAt, size int64) (MediaProbe, error) {
+	probe := MediaProbe{
+		Container: "flac",
+		Tracks:    []MediaTrack{{Kind: "audio", Codec: "flac"}},
+		Tags:      make(map[string]string),
+	}
+
+	var sampleRate, totalSamples uint64
+	offset := int64(4)
+
+	for {
+		header, err := readProbeBytes(reader, offset, 4)
+		if err != nil {
+			return MediaProbe{}, err
+		}
+
+		isLast := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+
+		switch blockType {
+		case FLAC_BLOCK_STREAMINFO:
+			block, err := readProbeBytes(reader, offset, length)
+			if err != nil || len(block) < 18 {
+				return MediaProbe{}, errors.New("invalid flac stream info")
+			}
+
+			sampleRate = uint64(binary.BigEndian.Uint32(block[10:])) >> 12
+			totalSamples = uint64(block[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(block[14:]))
+
+		case FLAC_BLOCK_VORBIS_COMMENT:
+			block, err := readProbeBytes(reader, offset, length)
+			if err == nil {
+				parseVorbisComments(block, probe.Tags)
+			}
+
+		case FLAC_BLOCK_PICTURE:
+			if probe.Cover != nil || length > MAX_THUMBNAIL_SIZE+MAX_FLAC_PICTURE_HEADER {
+				break
+			}
+
+			block, err := readProbeBytes(reader, offset, length)
+			if err == nil {
+				probe.Cover = parseFlacPicture(block)
+			}
+		}
+
+		offset += length
+		if isLast {
+			break
+		}
+	}
+
+	if sampleRate == 0 {
+		return MediaProbe{}, errors.New("flac file is missing the stream info")
+	}
+
+	probe.Duration = float64(totalSamples) / float64(sampleRate)
+	if probe.Duration > 0 {
+		probe.Bitrate = int64(float64(size-offset) * 8 / probe.Duration)
+	}
+
+	return probe, nil
+}
+
+// Upper bound of the FLAC picture block fields preceding the image data (type, MIME type, description and dimensions).
+const MAX_FLAC_PICTURE_HEADER = 64 * KB
+
+// Returns the image data stored in a FLAC picture block.
+func parseFlacPicture(block []byte) []byte {
+	reader := bytes.NewReader(block)
+
+	var pictureType, mimeLength uint32
+	binary.Read(reader, binary.BigEndian, &pictureType)
+	if binary.Read(reader, binary.BigEndian, &mimeLength) != nil || reader.Len() < int(mimeLength) {
+		return nil
+	}
+	reader.Seek(int64(mimeLength), io.SeekCurrent)
+
+	var descriptionLength uint32
+	if binary.Read(reader, binary.BigEndian, &descriptionLength) != nil || reader.Len() < int(descriptionLength) {
+		return nil
+	}
+
+	// Description is followed by width, height, color depth and indexed color count.
+	reader.Seek(int64(descriptionLength)+16, io.SeekCurrent)
+
+	var dataLength uint32
+	if binary.Read(reader, binary.BigEndian, &dataLength) != nil || reader.Len() < int(dataLength) || dataLength > MAX_THUMBNAIL_SIZE {
+		return nil
+	}
+
+	data := make([]byte, dataLength)
+	reader.Read(data)
+	return data
+}
+
+func parseVorbisComments(block []byte, tags map[string]string) {
+	if len(block) < 4 {
+		return
+	}
+
+	vendorLength := int(binary.LittleEndian.Uint32(block))
+	block = block[min(4+vendorLength, len(block)):]
+	if len(block) < 4 {
+		return
+	}
+
+	count := int(binary.LittleEndian.Uint32(block))
+	block = block[4:]
+
+	for i := 0; i < count && len(block) >= 4; i++ {
+		length := int(binary.LittleEndian.Uint32(block))
+		block = block[4:]
+		if length > len(block) {
+			return
+		}
+
+		name, value, found := strings.Cut(string(block[:length]), "=")
+		if found {
+			setNormalizedTag(tags, name, value)
+		}
+
+		block = block[length:]
+	}
+}
+
+//
+// MPEG audio (MP3)
+//
+
+var mpegBitrates = [2][3][16]int64{
+	// MPEG 1: Layer I, Layer II, Layer III
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	// MPEG 2 and 2.5: Layer I, Layer II, Layer III
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mpegSampleRates = [3]int64{44100, 48000, 32000}
+
+type mpegAudioHeader struct {
+	// 1 for MPEG 1, 2 for MPEG 2 and 3 for MPEG 2.5.
+	version    int
+	layer      int
+	bitrate    int64 // bits per second
+	sampleRate int64
+	mono       bool
+}
+
+func isMpegAudioHeader(data []byte) bool {
+	_, ok := parseMpegAudioHeader(data)
+	return ok
+}
+
+func parseMpegAudioHeader(data []byte) (mpegAudioHeader, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return mpegAudioHeader{}, false
+	}
+
+	var header mpegAudioHeader
+
+	switch (data[1] >> 3) & 0x03 {
+	case 0:
+		header.version = 3
+	case 2:
+		header.version = 2
+	case 3:
+		header.version = 1
+	default:
+		return mpegAudioHeader{}, false
+	}
+
+	layerBits := (data[1] >> 1) & 0x03
+	if layerBits == 0 {
+		return mpegAudioHeader{}, false
+	}
+	header.layer = 4 - int(layerBits)
+
+	bitrateIndex := data[2] >> 4
+	sampleRateIndex := (data[2] >> 2) & 0x03
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mpegAudioHeader{}, false
+	}
+
+	table := min(header.version-1, 1)
+	header.bitrate = mpegBitrates[table][header.layer-1][bitrateIndex] * 1000
+	header.sampleRate = mpegSampleRates[sampleRateIndex] >> (header.version - 1)
+	header.mono = (data[3]>>6)&0x03 == 3
+
+	return header, true
+}
+
+func (header *mpegAudioHeader) samplesPerFrame() int64 {
+	switch {
+	case header.layer == 1:
+		return 384
+	case header.layer == 3 && header.version != 1:
+		return 576
+	}
+
+	return 1152
+}
+
+func probeMp3(reader io.ReaderAt, size int64) (MediaProbe, error) {
+	probe := MediaProbe{
+		Container: "mp3",
+		Tags:      make(map[string]string),
+	}
+
+	audioStart := int64(0)
+	id3, err := readProbeBytes(reader, 0, 10)
+	if err == nil && bytes.Equal(id3[:3], []byte("ID3")) {
+		tagSize := int64(decodeSyncsafe(id3[6:10]))
+		if id3[5]&0x10 != 0 {
+			// Footer present.
+			tagSize += 10
+		}
+
+		tag, err := readProbeBytes(reader, 10, tagSize)
+		if err == nil {
+			parseId3v2Frames(tag, id3[3], probe.Tags)
+			probe.Cover = parseId3v2Picture(tag, id3[3])
+		}
+
+		audioStart = 10 + tagSize
+	}
+
+	audioEnd := size
+	if size >= 128 {
+		trailer, err := readProbeBytes(reader, size-128, 128)
+		if err == nil && bytes.Equal(trailer[:3], []byte("TAG")) {
+			parseId3v1(trailer, probe.Tags)
+			audioEnd -= 128
+		}
+	}
+
+	// Frame sync is searched for, since some encoders pad the ID3 tag or insert junk before the first frame.
+	search, err := readProbeBytesAtMost(reader, audioStart, MP3_SYNC_SEARCH_SIZE, size)
+	if err != nil {
+		return MediaProbe{}, err
+	}
+
+	frameOffset := -1
+	var header mpegAudioHeader
+	for i := 0; i+4 <= len(search); i++ {
+		if parsed, ok := parseMpegAudioHeader(search[i:]); ok {
+			header = parsed
+			frameOffset = i
+			break
+		}
+	}
+
+	if frameOffset == -1 {
+		return MediaProbe{}, errors.New("mp3 frame sync not found")
+	}
+
+	frame := search[frameOffset:]
+	audioStart += int64(frameOffset)
+
+	codec := fmt.Sprintf("mp%v", header.layer)
+	probe.Tracks = []MediaTrack{{Kind: "audio", Codec: codec}}
+
+	// Variable bitrate files carry the total frame count in a Xing (or Info) or VBRI header inside the first frame.
+	sideInfoSize := 32
+	if header.version != 1 && header.mono {
+		sideInfoSize = 9
+	} else if header.version != 1 || header.mono {
+		sideInfoSize = 17
+	}
+
+	frameCount := int64(0)
+	xing := 4 + sideInfoSize
+	if len(frame) >= xing+12 && (bytes.Equal(frame[xing:xing+4], []byte("Xing")) || bytes.Equal(frame[xing:xing+4], []byte("Info"))) {
+		flags := binary.BigEndian.Uint32(frame[xing+4:])
+		if flags&0x01 != 0 {
+			frameCount = int64(binary.BigEndian.Uint32(frame[xing+8:]))
+		}
+	} else if len(frame) >= 36+18 && bytes.Equal(frame[36:40], []byte("VBRI")) {
+		frameCount = int64(binary.BigEndian.Uint32(frame[36+14:]))
+	}
+
+	audioSize := audioEnd - audioStart
+	if frameCount > 0 {
+		probe.Duration = float64(frameCount*header.samplesPerFrame()) / float64(header.sampleRate)
+	} else if header.bitrate > 0 {
+		probe.Duration = float64(audioSize*8) / float64(header.bitrate)
+	}
+
+	if probe.Duration > 0 {
+		probe.Bitrate = int64(float64(audioSize*8) / probe.Duration)
+	}
+
+	return probe, nil
+}
+
+func decodeSyncsafe(data []byte) uint32 {
+	var value uint32
+	for _, b := range data {
+		value = value<<7 | uint32(b&0x7F)
+	}
+
+	return value
+}
+
+// Calls fn for every frame of an ID3v2 tag body. Supports ID3v2.2, ID3v2.3 and ID3v2.4 frame headers.
+func iterateId3v2Frames(tag []byte, majorVersion byte, fn func(id string, payload []byte)) {
+	idLength, headerLength := 4, 10
+	if majorVersion == 2 {
+		idLength, headerLength = 3, 6
+	}
+
+	for len(tag) >= headerLength && tag[0] != 0 {
+		id := string(tag[:idLength])
+
+		var frameSize int
+		switch majorVersion {
+		case 2:
+			frameSize = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[4:]))
+		default:
+			frameSize = int(decodeSyncsafe(tag[4:8]))
+		}
+
+		tag = tag[headerLength:]
+		if frameSize < 0 || frameSize > len(tag) {
+			return
+		}
+
+		fn(id, tag[:frameSize])
+		tag = tag[frameSize:]
+	}
+}
+
+func parseId3v2Frames(tag []byte, majorVersion byte, tags map[string]string) {
+	iterateId3v2Frames(tag, majorVersion, func(id string, payload []byte) {
+		var name string
+		switch id {
+		case "TIT2", "TT2":
+			name = "title"
+		case "TPE1", "TP1":
+			name = "artist"
+		case "TPE2", "TP2":
+			name = "albumartist"
+		case "TALB", "TAL":
+			name = "album"
+		case "TRCK", "TRK":
+			name = "track"
+		case "TYER", "TYE", "TDRC":
+			name = "date"
+		case "TCON", "TCO":
+			name = "genre"
+		default:
+			return
+		}
+
+		setNormalizedTag(tags, name, decodeId3Text(payload))
+	})
+}
+
+const ID3_PICTURE_FRONT_COVER = 3
+
+// Returns the image data of the front cover APIC (or PIC in ID3v2.2) frame, falling back to the first picture found.
+func parseId3v2Picture(tag []byte, majorVersion byte) []byte {
+	var cover []byte
+	iterateId3v2Frames(tag, majorVersion, func(id string, payload []byte) {
+		if (id != "APIC" && id != "PIC") || len(payload) < 2 {
+			return
+		}
+
+		encoding, rest := payload[0], payload[1:]
+
+		// ID3v2.2 stores a three character image format, later versions a null terminated MIME type.
+		if id == "PIC" {
+			if len(rest) < 3 {
+				return
+			}
+			rest = rest[3:]
+		} else {
+			end := bytes.IndexByte(rest, 0)
+			if end == -1 {
+				return
+			}
+			rest = rest[end+1:]
+		}
+
+		if len(rest) < 1 {
+			return
+		}
+		pictureType, rest := rest[0], rest[1:]
+
+		// Description terminator is two bytes wide for UTF-16 encodings.
+		terminator := []byte{0}
+		if encoding == 1 || encoding == 2 {
+			terminator = []byte{0, 0}
+		}
+
+		end := -1
+		for i := 0; i+len(terminator) <= len(rest); i += len(terminator) {
+			if bytes.Equal(rest[i:i+len(terminator)], terminator) {
+				end = i
+				break
+			}
+		}
+
+		if end == -1 {
+			return
+		}
+
+		data := rest[end+len(terminator):]
+		if len(data) == 0 || len(data) > MAX_THUMBNAIL_SIZE {
+			return
+		}
+
+		if cover == nil || pictureType == ID3_PICTURE_FRONT_COVER {
+			cover = slices.Clone(data)
+		}
+	})
+
+	return cover
+}
+
+func parseId3v1(trailer []byte, tags map[string]string) {
+	field := func(from, to int) string {
+		return strings.TrimRight(string(trailer[from:to]), "\x00 ")
+	}
+
+	setNormalizedTag(tags, "title", field(3, 33))
+	setNormalizedTag(tags, "artist", field(33, 63))
+	setNormalizedTag(tags, "album", field(63, 93))
+	setNormalizedTag(tags, "date", field(93, 97))
+
+	// ID3v1.1 stores the track number in the last byte of the comment.
+	if trailer[125] == 0 && trailer[126] != 0 {
+		setNormalizedTag(tags, "track", strconv.Itoa(int(trailer[126])))
+	}
+}
+
+// Decodes an ID3v2 text frame prefixed with its text encoding byte.
+func decodeId3Text(payload []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+
+	encoding, text := payload[0], payload[1:]
+
+	var decoded string
+	switch encoding {
+	case 0:
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		decoded = string(runes)
+
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(text) >= 2 && text[0] == 0xFE && text[1] == 0xFF {
+			bigEndian, text = true, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xFF && text[1] == 0xFE {
+			bigEndian, text = false, text[2:]
+		}
+
+		units := make([]uint16, len(text)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(text[i*2:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(text[i*2:])
+			}
+		}
+		decoded = string(utf16.Decode(units))
+
+	default:
+		decoded = string(text)
+	}
+
+	// Multiple values are separated with null characters, only the first one is kept.
+	decoded, _, _ = strings.Cut(decoded, "\x00")
+	return strings.TrimSpace(decoded)
+}
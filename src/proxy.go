@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
 	net_url "net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +26,9 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 	start := time.Now()
 	_ = os.RemoveAll(CONTENT_PROXY)
 	_ = os.MkdirAll(CONTENT_PROXY, os.ModePerm)
+	server.destructHlsProxies()
+	server.state.hlsProxies = make(map[string]*HlsProxy)
+	server.state.subtitleRenditions = nil
 	var m3u *M3U
 	var err error
 	if strings.HasPrefix(url, CONTENT_MEDIA) {
@@ -32,7 +39,7 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 		}
 		m3u.url = url
 	} else {
-		m3u, err = downloadM3U(url, CONTENT_PROXY+ORIGINAL_M3U8, referer)
+		m3u, err = downloadM3U(url, referer)
 	}
 
 	if err != nil {
@@ -41,18 +48,23 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 	}
 
 	if m3u.isMasterPlaylist {
+		renditions, success := setupRenditionProxies(m3u, referer, server.config.HlsRenditionHeights)
+		if success {
+			server.state.isHls = true
+			server.state.isLive = false
+			server.state.proxy = renditions.video
+			server.state.hlsProxies = renditions.proxies
+			server.state.subtitleRenditions = renditions.subtitles
+			server.setupHlsCache()
+			server.startHlsPrefetchers()
+			duration := time.Since(start)
+			LogDebug("Time taken to setup proxy: %v", duration)
+			return true
+		}
 		if len(m3u.audioRenditions) > 0 {
-			success, videoProxy, audioProxy := setupDualTrackProxy(m3u, referer)
-			if success {
-				server.state.isHls = true
-				server.state.isLive = false
-				server.state.proxy = videoProxy
-				server.state.audioProxy = audioProxy
-				duration := time.Since(start)
-				LogDebug("Time taken to setup proxy: %v", duration)
-			}
-			return success
+			return false
 		}
+		LogInfo("Falling back to a single rendition of the master playlist.")
 		if m3u = prepareMediaPlaylistFromMasterPlaylist(m3u, referer, 0); m3u == nil {
 			return false
 		}
@@ -86,12 +98,8 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 		return false
 	}
 
-	// Check encryption map uri
-	if err = setupMapUri(&m3u.segments[0], referer, MEDIA_INIT_SECTION); err != nil {
-		return false
-	}
-	// Check decryption key
-	if err = setupKeyUri(&m3u.segments[0], referer, MEDIA_DECRYPTION_KEY); err != nil {
+	// Check the map and the decryption key of the first segment, every map and key is proxied once requested
+	if err = validateSegmentResources(&m3u.segments[0], referer); err != nil {
 		return false
 	}
 
@@ -101,8 +109,14 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 	var newProxy *HlsProxy
 	if m3u.isLive {
 		newProxy = setupLiveProxy(m3u.url, referer)
+		newProxy.dvr = newDvrWindow(server.config.LiveDvrMinutes)
+		server.state.hlsProxies[LIVE_PREFIX] = newProxy
+		server.startLiveRefresher(newProxy)
 	} else {
 		newProxy = setupVodProxy(m3u, CONTENT_PROXY+PROXY_M3U8, referer, VIDEO_PREFIX)
+		server.state.hlsProxies[VIDEO_PREFIX] = newProxy
+		server.setupHlsCache()
+		server.startHlsPrefetchers()
 	}
 	server.state.proxy = newProxy
 	setupDuration := time.Since(start)
@@ -110,115 +124,337 @@ func (server *Server) setupHlsProxy(url string, referer string) bool {
 	return true
 }
 
-// setupDualTrackProxy for the time being will handle only 0-depth master playlists.
-// returns (success, video proxy, audio proxy)
-func setupDualTrackProxy(originalM3U *M3U, referer string) (bool, *HlsProxy, *HlsProxy) {
+// setupRenditionProxies will handle only 0-depth master playlists. It proxies the video renditions closest to the
+// target heights along with every audio and subtitle rendition they reference, each with its own VOD proxy and chunk
+// prefix. The proxied master playlist lists all of them, so clients can switch quality, language and subtitles.
+func setupRenditionProxies(originalM3U *M3U, referer string, targetHeights []int64) (HlsRenditions, bool) {
 	originalM3U.prefixRelativeTracks()
-	bestTrack := originalM3U.getTrackByVideoHeight(1080)
-	if bestTrack == nil {
-		return false, nil, nil
+	if len(targetHeights) == 0 {
+		targetHeights = []int64{1080}
 	}
-	audioId := getParamValue("AUDIO", bestTrack.streamInfo)
-	if audioId == "" {
-		LogError("Best track's AUDIO param is empty, unable to match to audio.")
-		return false, nil, nil
+
+	var filter func(track *Track) bool
+	masterUrl, err := net_url.Parse(originalM3U.url)
+	if err == nil && masterUrl.Host == "manifest.googlevideo.com" {
+		filter = ytAudioFilter
 	}
 
-	matchedAudio := false
-	audioUrl := ""
-	var audioRendition []Param
-	for i := range originalM3U.audioRenditions {
-		rendition := originalM3U.audioRenditions[i]
-		groupId := getParamValue("GROUP-ID", rendition)
-		if groupId != audioId {
+	renditions := HlsRenditions{proxies: make(map[string]*HlsProxy)}
+	candidates := originalM3U.getTracksByVideoHeights(targetHeights, filter)
+	candidates = candidates[:min(len(candidates), MAX_HLS_RENDITIONS)]
+
+	setups := make([]RenditionSetup, len(candidates))
+	for i, track := range candidates {
+		LogInfo("Video rendition %v URL: %v", getParamValue("RESOLUTION", track.streamInfo), track.url)
+		setups[i] = RenditionSetup{url: track.url, prefix: renditionPrefix(RENDITION_VIDEO_PREFIX, i)}
+	}
+	setupRenditionProxiesConcurrently(setups, referer)
+
+	videoTracks := make([]Track, 0)
+	for i, track := range candidates {
+		setup := &setups[i]
+		if setup.err != nil {
+			LogWarn("Skipping video rendition %v: %v", getParamValue("RESOLUTION", track.streamInfo), setup.err)
 			continue
 		}
-		matchedAudio = true
-		audioUrl = getParamValue("URI", rendition)
-		audioRendition = rendition
+		if renditions.video == nil {
+			renditions.video = setup.proxy
+		}
+		renditions.proxies[setup.prefix] = setup.proxy
+		track.url = setup.prefix + RENDITION_M3U8
+		videoTracks = append(videoTracks, track)
+	}
 
-		audioDefault := getParamValue("DEFAULT", rendition)
-		if audioDefault == "YES" {
-			break
+	if len(videoTracks) == 0 {
+		LogError("None of the master playlist renditions could be proxied.")
+		return renditions, false
+	}
+
+	audioRenditions, emptyAudioGroups := proxyMediaGroups(originalM3U.audioRenditions, videoTracks, "AUDIO", RENDITION_AUDIO_PREFIX, referer, renditions.proxies, nil)
+	if len(emptyAudioGroups) > 0 {
+		LogError("No corresponding audio track could be proxied for audio ids: %v", emptyAudioGroups)
+		return renditions, false
+	}
+
+	subtitleRenditions, emptySubtitleGroups := proxyMediaGroups(originalM3U.subtitleRenditions, videoTracks, "SUBTITLES", RENDITION_SUBTITLE_PREFIX, referer, renditions.proxies, isWebVttProxy)
+	for i := range videoTracks {
+		track := &videoTracks[i]
+		if slices.Contains(emptySubtitleGroups, getParamValue("SUBTITLES", track.streamInfo)) {
+			track.streamInfo = slices.DeleteFunc(track.streamInfo, func(param Param) bool {
+				return param.key == "SUBTITLES"
+			})
 		}
-		// YT hack: Look for original in audio track name
-		audioName := getParamValue("NAME", rendition)
-		if strings.Contains(audioName, "original") {
-			break
+	}
+
+	for _, rendition := range subtitleRenditions {
+		prefix := strings.TrimSuffix(getParamValue("URI", rendition), RENDITION_M3U8)
+		subtitle := SubtitleRendition{
+			name:     getParamValue("NAME", rendition),
+			language: getParamValue("LANGUAGE", rendition),
+			proxy:    renditions.proxies[prefix],
 		}
+		renditions.subtitles = append(renditions.subtitles, subtitle)
 	}
 
-	if !matchedAudio {
-		LogError("No corresponding audio track found for audio id: %v", audioId)
-		return false, nil, nil
+	// Closed captions are carried inside the video segments, so they only need to be listed
+	captionRenditions := make([][]Param, 0)
+	for _, rendition := range originalM3U.captionRenditions {
+		groupId := getParamValue("GROUP-ID", rendition)
+		referenced := slices.ContainsFunc(videoTracks, func(track Track) bool {
+			return getParamValue("CLOSED-CAPTIONS", track.streamInfo) == groupId
+		})
+		if referenced {
+			captionRenditions = append(captionRenditions, rendition)
+		}
 	}
 
-	LogInfo("Video URL: %v", bestTrack.url)
-	LogInfo("Audio URL: %v", audioUrl)
+	// Craft proxied master playlist for the client
+	originalM3U.tracks = videoTracks
+	originalM3U.audioRenditions = audioRenditions
+	originalM3U.subtitleRenditions = subtitleRenditions
+	originalM3U.captionRenditions = captionRenditions
+	// I-frame playlists are not proxied, clients only use them for trick play
+	originalM3U.iframeTracks = nil
+	originalM3U.serialize(CONTENT_PROXY + PROXY_M3U8)
+	return renditions, true
+}
 
-	videoM3U, err := downloadM3U(bestTrack.url, CONTENT_PROXY+VIDEO_M3U8, referer)
-	if err != nil {
-		LogError("Failed to download m3u8 video track: %v", err.Error())
-		return false, nil, nil
+func renditionPrefix(kind string, index int) string {
+	return kind + strconv.FormatInt(int64(index), 36) + "-"
+}
+
+// Sets up proxies of the rendition playlists with at most HLS_RENDITION_SETUP_CONCURRENCY downloads at once, storing
+// the proxy or the error in each setup. Failed renditions leave gaps in the prefixes.
+func setupRenditionProxiesConcurrently(setups []RenditionSetup, referer string) {
+	semaphore := make(chan struct{}, HLS_RENDITION_SETUP_CONCURRENCY)
+	var group sync.WaitGroup
+	for i := range setups {
+		setup := &setups[i]
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			setup.proxy, setup.err = setupRenditionProxy(setup.url, referer, setup.prefix)
+		}()
+	}
+	group.Wait()
+}
+
+// proxyMediaGroups proxies every EXT-X-MEDIA rendition belonging to the groups which video tracks reference with
+// the given attribute (AUDIO or SUBTITLES). Renditions that fail to proxy or are rejected by the filter are skipped.
+// returns (proxied renditions with rewritten URIs, referenced groups left without any rendition)
+func proxyMediaGroups(renditions [][]Param, videoTracks []Track, attribute, kind, referer string, proxies map[string]*HlsProxy, filter func(proxy *HlsProxy) bool) ([][]Param, []string) {
+	groups := make([]string, 0)
+	for _, track := range videoTracks {
+		groupId := getParamValue(attribute, track.streamInfo)
+		if groupId != "" && !slices.Contains(groups, groupId) {
+			groups = append(groups, groupId)
+		}
 	}
-	videoM3U.prefixRelativeSegments()
-	if !validatePlaylist(videoM3U, referer) {
-		LogError("Chunk 0 was not available in video m3u!")
-		return false, nil, nil
+
+	// Renditions of the referenced groups, each with the index of its setup or -1 when muxed into the video renditions.
+	type candidate struct {
+		groupId   string
+		rendition []Param
+		setup     int
 	}
-	if videoM3U.removeTrailingSegment(MIN_SEGMENT_LENGTH) {
-		LogDebug("Removed trailing playlist segment in video track.")
+
+	candidates := make([]candidate, 0)
+	setups := make([]RenditionSetup, 0)
+	for _, groupId := range groups {
+		for _, rendition := range renditions {
+			if getParamValue("GROUP-ID", rendition) != groupId {
+				continue
+			}
+
+			uriParam := getParam("URI", rendition)
+			if uriParam == nil {
+				candidates = append(candidates, candidate{groupId, slices.Clone(rendition), -1})
+				continue
+			}
+			if len(setups) == MAX_HLS_RENDITIONS {
+				continue
+			}
+
+			LogInfo("%v rendition %v (%v) URL: %v", attribute, getParamValue("NAME", rendition), groupId, uriParam.value)
+			setup := RenditionSetup{url: uriParam.value, prefix: renditionPrefix(kind, len(setups))}
+			candidates = append(candidates, candidate{groupId, slices.Clone(rendition), len(setups)})
+			setups = append(setups, setup)
+		}
+	}
+	setupRenditionProxiesConcurrently(setups, referer)
+
+	proxied := make([][]Param, 0)
+	groupSizes := make(map[string]int)
+	for _, candidate := range candidates {
+		rendition := candidate.rendition
+		if candidate.setup >= 0 {
+			setup := &setups[candidate.setup]
+			name := getParamValue("NAME", rendition)
+			if setup.err != nil {
+				LogWarn("Skipping %v rendition %v: %v", attribute, name, setup.err)
+				continue
+			}
+			if filter != nil && !filter(setup.proxy) {
+				LogInfo("Skipping %v rendition %v: unsupported format", attribute, name)
+				continue
+			}
+			proxies[setup.prefix] = setup.proxy
+			getParam("URI", rendition).value = setup.prefix + RENDITION_M3U8
+		}
+		proxied = append(proxied, rendition)
+		groupSizes[candidate.groupId]++
+	}
+
+	emptyGroups := make([]string, 0)
+	for _, groupId := range groups {
+		if groupSizes[groupId] == 0 {
+			emptyGroups = append(emptyGroups, groupId)
+		}
+	}
+
+	return proxied, emptyGroups
+}
+
+// Returns the MPEG-TS timestamp the first chunk of the proxied video starts at, which the player maps to the start of
+// the media timeline. Returns -1 when it can't be read, for example from fragmented MP4 or encrypted chunks.
+func firstVideoTimestamp(proxy *HlsProxy) int64 {
+	if proxy == nil || len(proxy.originalChunks) == 0 {
+		return -1
 	}
 
-	audioM3U, err := downloadM3U(audioUrl, CONTENT_PROXY+AUDIO_M3U8, referer)
+	probeRange := &Range{0, SUBTITLE_PTS_PROBE_SIZE - 1}
+	if len(proxy.chunkRanges) > 0 && proxy.chunkRanges[0] != nil {
+		chunkRange := proxy.chunkRanges[0]
+		probeRange = &Range{chunkRange.start, min(chunkRange.end, chunkRange.start+SUBTITLE_PTS_PROBE_SIZE-1)}
+	}
+
+	data, err := downloadFileChunk(proxy.originalChunks[0], probeRange, proxy.referer)
 	if err != nil {
-		LogError("Failed to download m3u8 audio track: %v", err.Error())
-		return false, nil, nil
+		LogDebug("Failed to download the first video chunk to align subtitles: %v", err)
+		return -1
 	}
-	audioM3U.prefixRelativeSegments()
-	if audioM3U.removeTrailingSegment(MIN_SEGMENT_LENGTH) {
-		LogDebug("Removed trailing playlist segment in audio track.")
+
+	if timestamp, found := firstPesPresentationTimestamp(data); found {
+		return timestamp
 	}
 
-	if videoM3U.isMasterPlaylist || audioM3U.isMasterPlaylist {
-		LogWarn("Unimplemented: Either video or audio is a master playlist")
-		return false, nil, nil
+	return -1
+}
+
+// Downloads WebVTT subtitle renditions of the proxied master playlist and attaches them to the entry as subtitles.
+func (server *Server) attachHlsSubtitles(entryId uint64) {
+	server.state.setupLock.Lock()
+	renditions := server.state.subtitleRenditions
+	video := server.state.proxy
+	server.state.setupLock.Unlock()
+
+	basePts := int64(-1)
+	if len(renditions) > 0 {
+		basePts = firstVideoTimestamp(video)
+	}
+
+	for _, rendition := range renditions {
+		segments := make([][]byte, 0, len(rendition.proxy.originalChunks))
+		totalSize := 0
+		var err error
+		for _, chunkUrl := range rendition.proxy.originalChunks {
+			var segment []byte
+			segment, err = downloadFileChunk(chunkUrl, &Range{0, SUBTITLE_SIZE_LIMIT - 1}, rendition.proxy.referer)
+			if err != nil {
+				break
+			}
+
+			totalSize += len(segment)
+			if totalSize > SUBTITLE_SIZE_LIMIT {
+				err = fmt.Errorf("subtitle exceeds the size limit")
+				break
+			}
+			segments = append(segments, segment)
+		}
+
+		if err != nil {
+			LogWarn("Failed to download subtitle rendition %v: %v", rendition.name, err)
+			continue
+		}
+
+		name := rendition.name
+		if rendition.language != "" && !strings.Contains(name, rendition.language) {
+			name = fmt.Sprintf("%v (%v)", name, rendition.language)
+		}
+
+		subtitle := createSubtitle(name, ".vtt")
+		if err := os.WriteFile(subtitle.Url, mergeWebVttSegments(segments, basePts), 0644); err != nil {
+			LogError("Failed to save subtitle rendition %v: %v", rendition.name, err)
+			continue
+		}
+
+		server.state.mutex.Lock()
+		if server.state.entry.Id != entryId {
+			server.state.mutex.Unlock()
+			os.Remove(subtitle.Url)
+			return
+		}
+
+		if err := DatabaseSubtitleAdd(server.db, entryId, &subtitle); err != nil {
+			LogError("Failed to attach subtitle rendition %v: %v", rendition.name, err)
+		} else {
+			server.state.entry.Subtitles = append(server.state.entry.Subtitles, subtitle)
+			server.writeEventToAllConnections("subtitleattach", subtitle, SERVER_ID)
+		}
+		server.state.mutex.Unlock()
 	}
+}
 
-	if len(videoM3U.segments) == 0 || len(audioM3U.segments) == 0 {
-		LogWarn("One of the playlists contains 0 segments")
-		return false, nil, nil
+// Only WebVTT subtitle segments are proxied, since that's the only subtitle format supported by the clients.
+func isWebVttProxy(proxy *HlsProxy) bool {
+	if len(proxy.originalChunks) == 0 {
+		return false
 	}
+	urlStruct, err := net_url.Parse(proxy.originalChunks[0])
+	if err != nil {
+		return false
+	}
+	extension := strings.ToLower(path.Ext(urlStruct.Path))
+	return extension == ".vtt" || extension == ".webvtt"
+}
 
-	// Check video & audio encryption map uri
-	if err = setupMapUri(&videoM3U.segments[0], referer, MEDIA_INIT_SECTION); err != nil {
-		return false, nil, nil
+// setupRenditionProxy downloads the media playlist of a master playlist rendition and prepares a VOD proxy for it,
+// serving the playlist, chunks, map and key under the given chunk prefix.
+func setupRenditionProxy(url, referer, prefix string) (*HlsProxy, error) {
+	playlistPath := CONTENT_PROXY + prefix + RENDITION_M3U8
+	m3u, err := downloadM3U(url, referer)
+	if err != nil {
+		return nil, err
+	}
+	if m3u.isMasterPlaylist {
+		return nil, errors.New("rendition is a master playlist")
+	}
+	if m3u.isLive {
+		return nil, errors.New("live renditions are not supported")
 	}
-	// Don't fail on audio alone
-	err = setupMapUri(&audioM3U.segments[0], referer, MEDIA_INIT_SECTION_AUDIO)
 
-	// Check video decryption key
-	if err = setupKeyUri(&videoM3U.segments[0], referer, MEDIA_DECRYPTION_KEY); err != nil {
-		return false, nil, nil
+	m3u.prefixRelativeSegments()
+	if m3u.removeTrailingSegment(MIN_SEGMENT_LENGTH) {
+		LogDebug("Removed trailing playlist segment in rendition %v.", prefix)
 	}
-	// Check audio decryption key
-	if err = setupKeyUri(&audioM3U.segments[0], referer, MEDIA_DECRYPTION_KEY_AUDIO); err != nil {
-		return false, nil, nil
+	if len(m3u.segments) == 0 {
+		return nil, errors.New("rendition contains 0 segments")
+	}
+	if m3u.totalDuration() > MAX_PLAYLIST_DURATION_SECONDS {
+		return nil, errors.New("rendition exceeds max duration")
+	}
+	if !validatePlaylist(m3u, referer) {
+		return nil, errors.New("chunk 0 was not available")
 	}
 
-	vidProxy := setupVodProxy(videoM3U, CONTENT_PROXY+VIDEO_M3U8, referer, VIDEO_PREFIX)
-	audioProxy := setupVodProxy(audioM3U, CONTENT_PROXY+AUDIO_M3U8, referer, AUDIO_PREFIX)
-	// Craft proxied master playlist for the client
-	originalM3U.tracks = originalM3U.tracks[:0]
-	originalM3U.audioRenditions = originalM3U.audioRenditions[:0]
-	uriParam := getParam("URI", audioRendition)
-	uriParam.value = AUDIO_M3U8
-	bestTrack.url = VIDEO_M3U8
-	originalM3U.tracks = append(originalM3U.tracks, *bestTrack)
-	originalM3U.audioRenditions = append(originalM3U.audioRenditions, audioRendition)
+	if err = validateSegmentResources(&m3u.segments[0], referer); err != nil {
+		return nil, err
+	}
 
-	originalM3U.serialize(CONTENT_PROXY + PROXY_M3U8)
-	return true, vidProxy, audioProxy
+	return setupVodProxy(m3u, playlistPath, referer, prefix), nil
 }
 
 func ytAudioFilter(track *Track) bool {
@@ -250,7 +486,7 @@ func prepareMediaPlaylistFromMasterPlaylist(m3u *M3U, referer string, depth int)
 	bestUrl := bestTrack.url
 
 	var err error = nil
-	m3u, err = downloadM3U(bestUrl, CONTENT_PROXY+ORIGINAL_M3U8, referer)
+	m3u, err = downloadM3U(bestUrl, referer)
 
 	if isErrorStatus(err, 404) {
 		LogError("Best url returned 404. %v", err.Error())
@@ -273,30 +509,164 @@ func prepareMediaPlaylistFromMasterPlaylist(m3u *M3U, referer string, depth int)
 	return m3u
 }
 
-func setupMapUri(segment *Segment, referer, fileName string) error {
+// validateSegmentResources checks whether the map and the decryption key of the segment can be downloaded.
+func validateSegmentResources(segment *Segment, referer string) error {
 	if segment.mapUri != "" {
-		err := downloadFile(segment.mapUri, CONTENT_PROXY+fileName, &DownloadOptions{referer: referer, hasty: true})
-		if err != nil {
+		options := &DownloadOptions{referer: referer, hasty: true, bodyLimit: MAX_CHUNK_SIZE}
+		if segment.mapRange != nil {
+			options.byteRange = segment.mapRange.toRange()
+		}
+		if err := discardDownload(segment.mapUri, options); err != nil {
 			LogWarn("Failed to obtain map uri key from %v\n: %v", segment.mapUri, err.Error())
 			return err
 		}
-		segment.mapUri = fileName
 	}
+
+	if segment.hasKey && segment.key.uri != "" {
+		options := &DownloadOptions{referer: referer, hasty: true, bodyLimit: MAX_CHUNK_SIZE}
+		if err := discardDownload(segment.key.uri, options); err != nil {
+			LogWarn("Failed to obtain decryption key from %v\n: %v", segment.key.uri, err.Error())
+			return err
+		}
+	}
+
 	return nil
 }
 
-func setupKeyUri(segment *Segment, referer, fileName string) error {
-	if !segment.hasKey {
-		return nil
-	}
-	keyUri := segment.key.uri
-	err := downloadFile(keyUri, CONTENT_PROXY+fileName, &DownloadOptions{referer: referer, hasty: true})
+func discardDownload(url string, options *DownloadOptions) error {
+	response, body, err := openDownload(url, options)
 	if err != nil {
-		LogWarn("Failed to obtain decryption key from %v\n: %v", keyUri, err.Error())
 		return err
 	}
-	segment.key.uri = fileName
-	return nil
+	defer response.Body.Close()
+
+	_, err = io.Copy(io.Discard, body)
+	return err
+}
+
+// registerResource assigns the key or map to a name starting with the prefix, under which the proxy serves it. The
+// same resource is always served under the same name. Returns the name.
+func (proxy *HlsProxy) registerResource(prefix, uri string, byteRange *ByteRange) string {
+	identity := uri
+	var resourceRange *Range
+	if byteRange != nil {
+		resourceRange = byteRange.toRange()
+		identity += "@" + int64ToString(resourceRange.start) + "-" + int64ToString(resourceRange.end)
+	}
+
+	proxy.resourceMutex.Lock()
+	defer proxy.resourceMutex.Unlock()
+
+	if proxy.resources == nil {
+		proxy.resources = make(map[string]*HlsResource)
+		proxy.resourceNames = make(map[string]string)
+	}
+
+	if name, found := proxy.resourceNames[identity]; found {
+		return name
+	}
+
+	name := prefix + toString(proxy.resourceCount)
+	proxy.resourceCount++
+	proxy.resources[name] = &HlsResource{uri: uri, identity: identity, byteRange: resourceRange}
+	proxy.resourceNames[identity] = name
+	return name
+}
+
+// registerLiveResource registers the key or map used by the live segment with the sequence number. The resource is
+// evicted along with the last segment using it. Returns the name.
+func (proxy *HlsProxy) registerLiveResource(prefix, uri string, byteRange *ByteRange, sequence int) string {
+	name := proxy.registerResource(prefix, uri, byteRange)
+
+	proxy.resourceMutex.Lock()
+	resource := proxy.resources[name]
+	resource.lastSequence = max(resource.lastSequence, sequence)
+	proxy.resourceMutex.Unlock()
+
+	return name
+}
+
+// Removes live resources which are no longer used by any segment numbered from the media sequence on and deletes their files.
+func (proxy *HlsProxy) evictLiveResources(minSequence int) {
+	evicted := make(map[string]*HlsResource)
+
+	proxy.resourceMutex.Lock()
+	for name, resource := range proxy.resources {
+		if resource.lastSequence < minSequence {
+			evicted[name] = resource
+			delete(proxy.resources, name)
+			delete(proxy.resourceNames, resource.identity)
+		}
+	}
+	proxy.resourceMutex.Unlock()
+
+	for name, resource := range evicted {
+		resource.mutex.Lock()
+		resource.evicted = true
+		if resource.obtained {
+			os.Remove(CONTENT_PROXY + name)
+		}
+		resource.mutex.Unlock()
+	}
+}
+
+// Downloads the key or map served under the name unless it is already on disk. Returns false when the proxy serves no
+// resource under the name or when it was evicted.
+func (proxy *HlsProxy) fetchResource(ctx context.Context, name string) (bool, error) {
+	proxy.resourceMutex.Lock()
+	resource := proxy.resources[name]
+	proxy.resourceMutex.Unlock()
+
+	if resource == nil {
+		return false, nil
+	}
+
+	resource.mutex.Lock()
+	defer resource.mutex.Unlock()
+
+	if resource.evicted {
+		return false, nil
+	}
+
+	if resource.obtained {
+		return true, nil
+	}
+
+	options := &DownloadOptions{
+		referer:   proxy.referer,
+		hasty:     true,
+		bodyLimit: MAX_CHUNK_SIZE,
+		byteRange: resource.byteRange,
+		ctx:       ctx,
+	}
+
+	if err := downloadFile(resource.uri, CONTENT_PROXY+name, options); err != nil {
+		return true, err
+	}
+
+	resource.obtained = true
+	return true, nil
+}
+
+func serveHlsResource(writer http.ResponseWriter, request *http.Request, proxy *HlsProxy, name string) {
+	available, fetchErr := proxy.fetchResource(context.Background(), name)
+	if !available {
+		http.Error(writer, "Not found", 404)
+		return
+	}
+
+	if fetchErr != nil {
+		LogError("Failed to fetch %v: %v", name, fetchErr)
+		code := 500
+		if isTimeoutError(fetchErr) {
+			code = 504
+		}
+		http.Error(writer, "Failed to fetch "+name, code)
+		return
+	}
+
+	LogDebug("Serving %v", name)
+	http.ServeFile(writer, request, CONTENT_PROXY+name)
 }
 
 func setupLiveProxy(liveUrl string, referer string) *HlsProxy {
@@ -304,6 +674,8 @@ func setupLiveProxy(liveUrl string, referer string) *HlsProxy {
 	proxy.referer = referer
 	proxy.liveUrl = liveUrl
 	proxy.liveSegments.Clear()
+	proxy.liveRefreshed = make(chan struct{})
+	proxy.liveWake = make(chan struct{}, 1)
 	return &proxy
 }
 
@@ -315,13 +687,37 @@ func setupVodProxy(m3u *M3U, osPath, referer, chunkPrefix string) *HlsProxy {
 	proxy.chunkLocks = make([]sync.Mutex, segmentCount)
 	proxy.fetchedChunks = make([]bool, segmentCount)
 	proxy.originalChunks = make([]string, segmentCount)
+	proxy.chunkStarts = make([]float64, segmentCount)
+	proxy.chunkSizes = make([]int64, segmentCount)
+	proxy.chunkPins = make([]atomic.Int32, segmentCount)
+	proxy.chunkRanges = make([]*Range, segmentCount)
+	start := 0.0
 	for i := range segmentCount {
 		segment := &m3u.segments[i]
 		proxy.originalChunks[i] = segment.url
+		proxy.chunkStarts[i] = start
+		start += segment.length
+
+		// Chunks are stored as whole files, so byte ranges are fetched by the proxy and removed from the playlist
+		if segment.byteRange != nil {
+			proxy.chunkRanges[i] = segment.byteRange.toRange()
+			segment.byteRange = nil
+		}
 
 		chunkName := chunkPrefix + toString(i)
 		segment.url = chunkName
+
+		// Playlists may rotate keys and switch maps mid-stream, each one is served under its own name.
+		if segment.mapUri != "" {
+			segment.mapUri = proxy.registerResource(chunkPrefix+MIS_PREFIX, segment.mapUri, segment.mapRange)
+			segment.mapRange = nil
+		}
+		if segment.hasKey && segment.key.uri != "" {
+			segment.key.uri = proxy.registerResource(chunkPrefix+KEY_PREFIX, segment.key.uri, nil)
+		}
 	}
+	proxy.duration = start
+	m3u.clearLowLatency()
 
 	m3u.serialize(osPath)
 	LogDebug("Prepared VOD proxy file.")
@@ -384,6 +780,7 @@ func (server *Server) setupFileProxy(proxy *FileProxy, url, referer, baseFilenam
 	defer server.state.setupLock.Unlock()
 	server.state.isHls = false
 	server.state.isLive = false
+	server.state.subtitleRenditions = nil
 
 	proxy.referer = referer
 	proxy.url = url
@@ -413,6 +810,16 @@ func (server *Server) setupFileProxy(proxy *FileProxy, url, referer, baseFilenam
 
 	proxy.file = proxyFile
 	proxy.diskRanges = make([]Range, 0)
+	proxy.bitrate = HEURISTIC_BITRATE_MB_S
+
+	probe, err := probeMediaUrl(url, referer, size)
+	proxy.probe = probe
+	if err == nil && probe.Bitrate > 0 {
+		proxy.bitrate = float64(probe.Bitrate) / 8
+		LogInfo("Probed %v file proxy bitrate: %v kbps, duration: %.1fs", probe.Container, probe.Bitrate/1000, probe.Duration)
+	} else {
+		LogDebug("Falling back to heuristic bitrate for the file proxy: %v", err)
+	}
 
 	if size > TRAILING_PULL_SIZE {
 		// Preload the end of the file
@@ -422,106 +829,149 @@ func (server *Server) setupFileProxy(proxy *FileProxy, url, referer, baseFilenam
 		}
 	}
 
-	proxy.downloader = &GenericDownloader{
-		mutex:    sync.Mutex{},
-		download: nil,
-		offset:   0,
-		preload:  0,
-		speed:    NewDefaultSpeedTest(),
-		sleeper:  NewSleeper(),
-		destroy:  make(chan bool),
-	}
-	proxy.downloader.mutex.Lock()
-	proxy.replaceDownload(0)
-	proxy.downloader.mutex.Unlock()
-	go server.startDownloadLoop(proxy)
+	proxy.downloader = newGenericDownloader(server.config.FileProxyWorkers)
+	proxy.startDownloadWorkers()
 	LogInfo("Successfully setup proxy for file of size %v MB", formatMegabytes(size, 2))
 	return true
 }
 
-var loopIdSeed atomic.Int64
+func newGenericDownloader(workers int) *GenericDownloader {
+	ctx, stop := context.WithCancel(context.Background())
+	return &GenericDownloader{
+		workers: max(1, workers),
+		speed:   NewDefaultSpeedTest(),
+		sleeper: NewSleeper(),
+		ctx:     ctx,
+		stop:    stop,
+	}
+}
 
-func (server *Server) startDownloadLoop(proxy *FileProxy) {
-	lastTimestamp := server.getCurrentTimestamp()
+func (proxy *FileProxy) startDownloadWorkers() {
+	downloader := proxy.downloader
+	for index := range downloader.workers {
+		downloader.done.Add(1)
+		go proxy.downloadWorker(index)
+	}
+}
 
+func (proxy *FileProxy) downloadWorker(index int) {
 	downloader := proxy.downloader
-	loopId := loopIdSeed.Add(1)
-	for {
-		select {
-		case <-downloader.destroy:
-			downloader.closed = true
-			LogInfo("Terminating download loop#%v", loopId)
-			// cleanup and exit loop
-			downloader.closeDownload()
-			return
-		default:
-			// If a download enters disk range:
-			// a. Determine if the range is worth terminating the currently active download
-			// b. Cover state where there's no active download
-
-			downloader.mutex.Lock()
-			offset := downloader.offset
-			count := int64(HEURISTIC_BITRATE_MB_S)
-			if offset+count >= proxy.contentLength {
-				count = proxy.contentLength - offset
-			}
+	defer downloader.done.Done()
 
-			currentRange := newRange(offset, offset+count-1)
-			if count == 0 || proxy.isRangeAvailableOnDisk(currentRange) {
-				// The downloader should keep looping even on disk because clients are waiting in cycles
-				downloader.closeDownload()
-				downloader.sleeper.WakeAll()
-			}
-			// If no active download
-			if downloader.download == nil {
-				// Best solution: wait on another download indefinitely
-				downloader.mutex.Unlock()
-				time.Sleep(time.Second)
-				continue
-			}
+	for downloader.ctx.Err() == nil {
+		downloader.mutex.Lock()
+		claim, claimed := Range{}, false
+		if index < downloader.allowedWorkers(proxy.bitrate) {
+			claim, claimed = proxy.claimRange()
+		}
+		downloader.mutex.Unlock()
 
-			// Bitrate/length could be obtained from ffprobe
-			currentTimestamp := server.getCurrentTimestamp()
-			consumedPreload := (currentTimestamp - lastTimestamp) * HEURISTIC_BITRATE_MB_S
-			if consumedPreload > 0 {
-				downloader.preload -= int64(consumedPreload)
-				downloader.preload = max(0, downloader.preload)
-			}
-			lastTimestamp = currentTimestamp
+		if !claimed {
+			// Woken once the playhead moves or other workers store bytes.
+			downloader.sleeper.Sleep(time.Second)
+			continue
+		}
 
-			// It could monitor download speed and detect disk range
-			if downloader.preload > MAX_PRELOAD_SIZE {
-				LogInfo("[Download loop#%v] exceeding max preload", loopId)
-				downloader.mutex.Unlock()
-				time.Sleep(time.Second)
-				continue
-			}
+		err := proxy.downloadRange(claim)
 
-			nextOffset, err := proxy.pullAndStoreBytes(downloader.download, downloader.offset, count)
-			if err != nil {
-				LogWarn("[Download loop#%v] error while pulling from source %v - replacing download", loopId, err)
-				// Why does it timeout?
-				proxy.replaceDownload(downloader.offset)
-				downloader.mutex.Unlock()
-				time.Sleep(time.Second)
-				continue
+		downloader.mutex.Lock()
+		downloader.claimed = slices.DeleteFunc(downloader.claimed, func(r Range) bool {
+			return r == claim
+		})
+		downloader.mutex.Unlock()
+
+		if err != nil && downloader.ctx.Err() == nil {
+			LogWarn("[Download worker#%v] Failed to download range %v: %v", index, claim.StringMB(), err)
+			select {
+			case <-downloader.ctx.Done():
+			case <-time.After(time.Second):
 			}
-			downloader.preload += count
-			downloader.offset = nextOffset
-			offsetMB, preloadMB := formatMegabytes(downloader.offset, 2), formatMegabytes(downloader.preload, 2)
-			LogDebug("[Download loop#%v] Offset=%vMB Preload=%vMB", loopId, offsetMB, preloadMB)
-			downloader.sleeper.WakeAll()
-			downloader.mutex.Unlock()
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
 }
 
-func (downloader *GenericDownloader) closeDownload() {
-	if downloader.download != nil {
-		_ = downloader.download.Body.Close()
-		downloader.download = nil
+// Returns how many workers are allowed to download. Workers beyond the first are only needed while the measured speed
+// is too slow to stay ahead of playback. Expects the downloader mutex to be held.
+func (downloader *GenericDownloader) allowedWorkers(bitrate float64) int {
+	if downloader.speedMBps <= 0 || len(downloader.claimed) == 0 {
+		return downloader.workers
 	}
+
+	workerSpeed := downloader.speedMBps * MB / float64(len(downloader.claimed))
+	needed := int(math.Ceil(FILE_PROXY_TARGET_SPEEDUP * bitrate / workerSpeed))
+	return min(max(1, needed), downloader.workers)
+}
+
+// claimRange claims the first missing bytes following the playhead, which are neither on disk nor claimed by another
+// worker, up to FILE_PROXY_RANGE_SIZE bytes. Nothing is claimed further than MAX_PRELOAD_SIZE past the playhead.
+// Expects the downloader mutex to be held.
+func (proxy *FileProxy) claimRange() (Range, bool) {
+	downloader := proxy.downloader
+	limit := min(downloader.offset+MAX_PRELOAD_SIZE, proxy.contentLength) - 1
+
+	proxy.rangeMutex.Lock()
+	occupied := slices.Concat(proxy.diskRanges, downloader.claimed)
+	proxy.rangeMutex.Unlock()
+
+	slices.SortFunc(occupied, func(a, b Range) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	start, end := downloader.offset, limit
+	for _, r := range occupied {
+		if r.end < start {
+			continue
+		}
+		if r.start <= start {
+			start = r.end + 1
+			continue
+		}
+		end = r.start - 1
+		break
+	}
+
+	if start > limit {
+		return Range{}, false
+	}
+
+	claim := *newRange(start, min(end, limit, start+FILE_PROXY_RANGE_SIZE-1))
+	downloader.claimed = append(downloader.claimed, claim)
+	return claim, true
+}
+
+// downloadRange stores the claimed range on disk, stopping early once the playhead moves away from it.
+func (proxy *FileProxy) downloadRange(claim Range) error {
+	downloader := proxy.downloader
+	options := &DownloadOptions{referer: proxy.referer, byteRange: &claim, ctx: downloader.ctx}
+	response, body, err := openDownload(proxy.url, options)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	offset := claim.start
+	for offset <= claim.end {
+		count := min(FILE_PROXY_PULL_SIZE, claim.end-offset+1)
+		next, err := proxy.pullAndStoreBytes(body, offset, count)
+		if err != nil {
+			return err
+		}
+
+		downloader.mutex.Lock()
+		downloader.downloaded += next - offset
+		downloader.speedMBps = max(0, downloader.speed.TestMBps(downloader.downloaded))
+		playhead := downloader.offset
+		downloader.mutex.Unlock()
+		downloader.sleeper.WakeAll()
+
+		offset = next
+		if offset <= claim.end && (offset < playhead || offset > playhead+MAX_PRELOAD_SIZE) {
+			LogDebug("Abandoned download of range %v, the playhead moved to %vMB", claim.StringMB(), formatMegabytes(playhead, 2))
+			return nil
+		}
+	}
+
+	return nil
 }
 
 func (proxy *FileProxy) getPrefetchStart(start int64) int64 {
@@ -567,31 +1017,6 @@ func (proxy *FileProxy) getRangeOverlapWithDisk(r *Range) (Overlap, Range) {
 	return NONE, NO_RANGE
 }
 
-// replaceDownload replaces the current download synchronously
-func (proxy *FileProxy) replaceDownload(from int64) {
-	downloader := proxy.downloader
-	if downloader == nil {
-		LogError("Unable to replace download because downloader is nil")
-		return
-	}
-
-	if downloader.download != nil {
-		downloader.download.Body.Close()
-	}
-	newDownload, err := openFileDownload(proxy.url, from, proxy.referer)
-	if err != nil {
-		LogWarn("Failed to reopen response %v", err)
-		return
-	}
-	if from < downloader.offset {
-		downloader.preload = 0
-	}
-	downloader.offset = from
-	downloader.download = newDownload
-	downloader.sleeper.WakeAll()
-	LogInfo("Download was replaced, new offset = %vMB", formatMegabytes(from, 2))
-}
-
 func (proxy *FileProxy) logDiskRanges() {
 	view := strings.Builder{}
 	proxy.rangeMutex.Lock()
@@ -623,19 +1048,23 @@ func (proxy *FileProxy) serveRangeFromDisk(writer http.ResponseWriter, request *
 	return true
 }
 
-// pullAndStoreBytes pulls the specified number of bytes from the response and returns the next readable offset
-func (proxy *FileProxy) pullAndStoreBytes(response *http.Response, offset, count int64) (int64, error) {
+// pullAndStoreBytes pulls the specified number of bytes from the body and returns the next readable offset
+func (proxy *FileProxy) pullAndStoreBytes(body io.Reader, offset, count int64) (int64, error) {
 	if count < 0 {
 		return offset, errors.New("the count of bytes to pull is negative")
 	}
 	if count == 0 {
 		return offset, nil
 	}
-	chunkBytes, err := pullBytesFromResponse(response, int(count))
-	if err != nil {
+	chunkBytes := make([]byte, count)
+	pulled, err := io.ReadFull(body, chunkBytes)
+	if pulled == 0 {
 		LogWarn("Failed to pull bytes from response at %v count=%v due to %v", offset, count, err)
 		return offset, err
 	}
+	// Only the bytes actually received are marked as available.
+	chunkBytes = chunkBytes[:pulled]
+	count = int64(pulled)
 	proxy.fileMutex.Lock()
 	_, err = writeAtOffset(proxy.file, offset, chunkBytes)
 	if err != nil {
@@ -656,8 +1085,11 @@ func (proxy *FileProxy) destruct() {
 	if proxy == nil {
 		return
 	}
-	if proxy.downloader != nil && !proxy.downloader.closed {
-		proxy.downloader.destroy <- true
+	if proxy.downloader != nil {
+		// Workers have to stop writing before the file is closed.
+		proxy.downloader.stop()
+		proxy.downloader.sleeper.WakeAll()
+		proxy.downloader.done.Wait()
 	}
 	if proxy.file != nil {
 		proxy.fileMutex.Lock()
@@ -670,13 +1102,31 @@ func (server *Server) serveHlsVod(writer http.ResponseWriter, request *http.Requ
 	writer.Header().Add("Cache-Control", "no-cache")
 
 	switch chunk {
-	case PROXY_M3U8, VIDEO_M3U8, AUDIO_M3U8:
+	case PROXY_M3U8:
 		LogDebug("Serving %v", chunk)
 		writer.Header().Add("content-type", M3U8_CONTENT_TYPE)
 		http.ServeFile(writer, request, CONTENT_PROXY+chunk)
 		return
-	case MEDIA_INIT_SECTION, MEDIA_INIT_SECTION_AUDIO, MEDIA_DECRYPTION_KEY, MEDIA_DECRYPTION_KEY_AUDIO:
+	}
+
+	if len(chunk) > MAX_CHUNK_NAME_LENGTH || len(chunk) <= HLS_PREFIX_LENGTH {
+		http.Error(writer, "Not found", 404)
+		return
+	}
+
+	prefix, name := chunk[:HLS_PREFIX_LENGTH], chunk[HLS_PREFIX_LENGTH:]
+	server.state.setupLock.Lock()
+	proxy := server.state.hlsProxies[prefix]
+	server.state.setupLock.Unlock()
+	if proxy == nil {
+		http.Error(writer, "Not found", 404)
+		return
+	}
+
+	switch name {
+	case RENDITION_M3U8:
 		LogDebug("Serving %v", chunk)
+		writer.Header().Add("content-type", M3U8_CONTENT_TYPE)
 		http.ServeFile(writer, request, CONTENT_PROXY+chunk)
 		return
 	}
@@ -685,28 +1135,18 @@ func (server *Server) serveHlsVod(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
-	if len(chunk) > MAX_CHUNK_NAME_LENGTH || len(chunk) < len(VIDEO_PREFIX) {
-		http.Error(writer, "Not found", 404)
+	if strings.HasPrefix(name, MIS_PREFIX) || strings.HasPrefix(name, KEY_PREFIX) {
+		serveHlsResource(writer, request, proxy, chunk)
 		return
 	}
 
-	chunkId, err := strconv.Atoi(chunk[3:])
+	chunkId, err := strconv.Atoi(name)
 	if err != nil {
 		http.Error(writer, "Chunk ID is not a number", 404)
 		return
 	}
 
-	var proxy *HlsProxy
-	server.state.setupLock.Lock()
-	if strings.HasPrefix(chunk, VIDEO_PREFIX) {
-		proxy = server.state.proxy
-	} else if strings.HasPrefix(chunk, AUDIO_PREFIX) {
-		proxy = server.state.audioProxy
-	}
-	server.state.setupLock.Unlock()
-	if proxy != nil {
-		serveHlsChunk(writer, request, proxy, chunk, chunkId)
-	}
+	serveHlsChunk(writer, request, proxy, chunk, chunkId)
 }
 
 var chunkLogsite = Logsite{}
@@ -717,26 +1157,17 @@ func serveHlsChunk(writer http.ResponseWriter, request *http.Request, proxy *Hls
 		return
 	}
 
-	mutex := &proxy.chunkLocks[chunkId]
-	mutex.Lock()
+	proxy.lastServed.Store(time.Now().UnixMilli())
 
-	if proxy.fetchedChunks[chunkId] {
-		mutex.Unlock()
-		http.ServeFile(writer, request, CONTENT_PROXY+chunk)
-		return
-	}
+	// Pinned until the file is served, otherwise the cache could evict it between the fetch and the response.
+	pin := &proxy.chunkPins[chunkId]
+	pin.Add(1)
+	defer pin.Add(-1)
 
-	destinationUrl := proxy.originalChunks[chunkId]
-	options := &DownloadOptions{
-		referer:   proxy.referer,
-		hasty:     false,
-		bodyLimit: MAX_CHUNK_SIZE,
-	}
-	fetchErr := downloadFile(destinationUrl, CONTENT_PROXY+chunk, options)
+	fetchErr := proxy.fetchChunk(context.Background(), chunk, chunkId)
 	if fetchErr != nil {
-		mutex.Unlock()
 		if chunkLogsite.atMostEvery(time.Second) {
-			LogError("Failed to fetch chunk #%v due to %v from %v", chunkId, fetchErr, destinationUrl)
+			LogError("Failed to fetch chunk #%v due to %v from %v", chunkId, fetchErr, proxy.originalChunks[chunkId])
 		}
 
 		code := 500
@@ -750,12 +1181,46 @@ func serveHlsChunk(writer http.ResponseWriter, request *http.Request, proxy *Hls
 		http.Error(writer, "Failed to fetch vod chunk", code)
 		return
 	}
-	proxy.fetchedChunks[chunkId] = true
-	mutex.Unlock()
 
 	http.ServeFile(writer, request, CONTENT_PROXY+chunk)
 }
 
+// fetchChunk downloads the chunk to disk unless it's already there. Concurrent fetches of the same chunk,
+// for example by a client and the prefetcher, wait for each other instead of downloading it twice. Cancelling the context
+// abandons the download, leaving the chunk to the next fetch.
+func (proxy *HlsProxy) fetchChunk(ctx context.Context, chunk string, chunkId int) error {
+	mutex := &proxy.chunkLocks[chunkId]
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if proxy.fetchedChunks[chunkId] {
+		return nil
+	}
+
+	options := &DownloadOptions{
+		referer:   proxy.referer,
+		hasty:     false,
+		bodyLimit: MAX_CHUNK_SIZE,
+		byteRange: proxy.chunkRanges[chunkId],
+		ctx:       ctx,
+	}
+	err := downloadFile(proxy.originalChunks[chunkId], CONTENT_PROXY+chunk, options)
+	if err != nil {
+		return err
+	}
+
+	proxy.fetchedChunks[chunkId] = true
+	if info, err := os.Stat(CONTENT_PROXY + chunk); err == nil {
+		proxy.chunkSizes[chunkId] = info.Size()
+	}
+
+	// The chunk lock is still held, so the cache cannot evict the chunk that was just fetched.
+	if proxy.cache != nil {
+		proxy.cache.add(proxy.chunkSizes[chunkId])
+	}
+	return nil
+}
+
 func (server *Server) serveFileProxyNaive(writer http.ResponseWriter, request *http.Request, filename string) {
 	proxy := &server.state.fileProxy
 	if filename != proxy.filename {
@@ -856,9 +1321,8 @@ func (server *Server) serveFileProxy(writer http.ResponseWriter, request *http.R
 			currentRange.end = proxy.contentLength - 1
 		}
 
-		// Bitrate/length could be obtained from ffprobe
 		currentTimestamp := server.getCurrentTimestamp()
-		consumedPreload := (currentTimestamp - lastTimestamp) * HEURISTIC_BITRATE_MB_S
+		consumedPreload := (currentTimestamp - lastTimestamp) * proxy.bitrate
 		if consumedPreload > 0 {
 			preload -= int64(math.Abs(consumedPreload))
 			preload = max(0, preload)
@@ -884,6 +1348,11 @@ func (server *Server) serveFileProxy(writer http.ResponseWriter, request *http.R
 		// Handle multiple possible states:
 		// sync.Mutex is not FIFO so clients are not guaranteed to be served (use sync.Cond?)
 		downloader.mutex.Lock()
+		// The playhead follows clients reading sequentially, jumps are handled at step 3
+		if downloader.offset <= currentRange.start && currentRange.start <= downloader.offset+MAX_PRELOAD_SIZE {
+			downloader.offset = currentRange.start
+		}
+
 		// 1. Next chunk is fully available from disk
 		available := proxy.isRangeAvailableOnDisk(&currentRange)
 		if available {
@@ -913,28 +1382,24 @@ func (server *Server) serveFileProxy(writer http.ResponseWriter, request *http.R
 			return
 		}
 
-		// 3. Next chunk can be supplied from an existing in-progress download
-
-		// The forward offset causing clients to reopen their active connection is unknown therefore upon changing
-		// the current download it's necessary to terminate connections with other clients
-		isDownloadActive := downloader.download != nil
-		offset := downloader.offset
-		forwardOffset := offset + 2*HEURISTIC_BITRATE_MB_S
-		if isDownloadActive && (offset <= currentRange.start && currentRange.start < forwardOffset) {
-			downloader.mutex.Unlock()
-			// Always wait one cycle
-			if !downloader.sleeper.Sleep(2 * time.Second) {
-				LogWarn("Connection %v is delayed because the next chunk wasn't available at %v = %v", getIp(request), &currentRange, currentRange.StringMB())
-				// If connection was to be terminated here with no bytes served the browser would decide it's EOF
-			}
-			// Serve client from disk (at step 1)
-			continue
+		// 3. Next chunk is downloaded by the workers, unless a worker is already downloading it the playhead is moved
+		// to it, so the workers download it first
+		claimed := slices.ContainsFunc(downloader.claimed, func(r Range) bool {
+			return r.start <= currentRange.start && currentRange.start <= r.end
+		})
+		if !claimed && downloader.offset != currentRange.start {
+			downloader.offset = proxy.getPrefetchStart(currentRange.start)
+			LogInfo("Download playhead moved to %vMB", formatMegabytes(downloader.offset, 2))
+			downloader.sleeper.WakeAll()
 		}
-
-		// 4. Next chunk requires new connection to be opened (serve at step 3)
-		start := proxy.getPrefetchStart(currentRange.start)
-		proxy.replaceDownload(start)
 		downloader.mutex.Unlock()
+
+		// Always wait one cycle
+		if !downloader.sleeper.Sleep(2 * time.Second) {
+			LogWarn("Connection %v is delayed because the next chunk wasn't available at %v = %v", getIp(request), &currentRange, currentRange.StringMB())
+			// If connection was to be terminated here with no bytes served the browser would decide it's EOF
+		}
+		// Serve client from disk (at step 1)
 	}
 }
 
@@ -945,21 +1410,10 @@ func (server *Server) serveHlsLive(writer http.ResponseWriter, request *http.Req
 	server.state.setupLock.Unlock()
 
 	segmentMap := &proxy.liveSegments
-	lastRefresh := &proxy.lastRefresh
+	wasIdle := proxy.markLiveServed()
 
-	now := time.Now()
 	if chunk == PROXY_M3U8 {
-		cleanupSegmentMap(segmentMap)
-		refreshedAgo := now.Sub(*lastRefresh)
-		// Optimized to refresh at most once every 1.5 seconds
-		if refreshedAgo.Seconds() < 1.5 {
-			LogDebug("Serving unmodified %v", PROXY_M3U8)
-			writer.Header().Add("content-type", M3U8_CONTENT_TYPE)
-			http.ServeFile(writer, request, CONTENT_PROXY+PROXY_M3U8)
-			return
-		}
-
-		liveM3U, err := downloadM3U(proxy.liveUrl, CONTENT_PROXY+ORIGINAL_M3U8, proxy.referer)
+		playlist, err := proxy.awaitLivePlaylist(request.Context(), wasIdle)
 		var downloadErr *DownloadError
 		if errors.As(err, &downloadErr) {
 			LogError("Download error of the live url [%v] %v", proxy.liveUrl, err.Error())
@@ -971,42 +1425,8 @@ func (server *Server) serveHlsLive(writer http.ResponseWriter, request *http.Req
 			return
 		}
 
-		if len(liveM3U.segments) == 0 {
-			respondInternalError(writer, "No live segments received!")
-			return
-		}
-
-		id := 0
-		if mediaSequence := liveM3U.getAttribute(EXT_X_MEDIA_SEQUENCE); mediaSequence != "" {
-			if sequenceId, err := parseInt(mediaSequence); err == nil {
-				id = sequenceId
-			}
-		}
-
-		liveM3U.prefixRelativeSegments()
-
-		segmentCount := len(liveM3U.segments)
-		for i := range segmentCount {
-			segment := &liveM3U.segments[i]
-
-			realUrl := segment.url
-			segName := LIVE_PREFIX + toString(id)
-
-			if _, exists := segmentMap.Load(segName); !exists {
-				liveSegment := LiveSegment{realUrl: realUrl, realMapUri: segment.mapUri, created: time.Now()}
-				segmentMap.Store(segName, &liveSegment)
-				if segment.mapUri != "" {
-					segment.mapUri = MIS_PREFIX + toString(id)
-				}
-			}
-
-			segment.url = segName
-			id++
-		}
-
-		liveM3U.serialize(CONTENT_PROXY + PROXY_M3U8)
 		writer.Header().Add("content-type", M3U8_CONTENT_TYPE)
-		http.ServeFile(writer, request, CONTENT_PROXY+PROXY_M3U8)
+		writer.Write(playlist)
 		return
 	}
 
@@ -1019,8 +1439,8 @@ func (server *Server) serveHlsLive(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
-	if strings.HasPrefix(chunk, MIS_PREFIX) {
-		fetchOrServeMediaInitSection(writer, request, chunk, segmentMap, proxy.referer)
+	if strings.HasPrefix(chunk, MIS_PREFIX) || strings.HasPrefix(chunk, KEY_PREFIX) {
+		serveHlsResource(writer, request, proxy, chunk)
 		return
 	}
 
@@ -1030,23 +1450,13 @@ func (server *Server) serveHlsLive(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
-	fetchedChunk := maybeChunk.(*LiveSegment)
-	mutex := &fetchedChunk.mutex
-	mutex.Lock()
-	if fetchedChunk.obtainedUrl {
-		mutex.Unlock()
-		http.ServeFile(writer, request, CONTENT_PROXY+chunk)
+	available, fetchErr := proxy.fetchLiveSegment(context.Background(), chunk, maybeChunk.(*LiveSegment))
+	if !available {
+		http.Error(writer, "Not found", 404)
 		return
 	}
 
-	options := &DownloadOptions{
-		referer:   proxy.referer,
-		hasty:     false,
-		bodyLimit: MAX_CHUNK_SIZE,
-	}
-	fetchErr := downloadFile(fetchedChunk.realUrl, CONTENT_PROXY+chunk, options)
 	if fetchErr != nil {
-		mutex.Unlock()
 		LogError("Failed to fetch live chunk %v", fetchErr)
 
 		code := 500
@@ -1058,77 +1468,52 @@ func (server *Server) serveHlsLive(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
-	fetchedChunk.obtainedUrl = true
-	mutex.Unlock()
 	http.ServeFile(writer, request, CONTENT_PROXY+chunk)
 }
 
-func fetchOrServeMediaInitSection(writer http.ResponseWriter, request *http.Request, init string, segmentMap *sync.Map, referer string) {
-	_, after, ok := strings.Cut(init, "-")
-	if !ok || after == "" {
-		http.Error(writer, "Bad media section", http.StatusBadRequest)
-		return
-	}
-	id, err := parseInt64(after)
-	if err != nil {
-		http.Error(writer, "Bad media section", http.StatusBadRequest)
-		return
-	}
-	segName := LIVE_PREFIX + int64ToString(id)
-	maybeChunk, found := segmentMap.Load(segName)
-	if !found {
-		http.Error(writer, "Corresponding live segment not found", http.StatusNotFound)
-		return
-	}
-	liveSegment := maybeChunk.(*LiveSegment)
-	mutex := &liveSegment.mutex
-	mutex.Lock()
-	initKeyPath := CONTENT_PROXY + init
-	if liveSegment.obtainedMapUri {
-		mutex.Unlock()
-		http.ServeFile(writer, request, initKeyPath)
-		return
-	}
-	options := &DownloadOptions{
-		referer:   referer,
-		hasty:     true,
-		bodyLimit: MAX_CHUNK_SIZE,
-	}
-	fetchErr := downloadFile(liveSegment.realMapUri, initKeyPath, options)
-	if fetchErr != nil {
-		mutex.Unlock()
-		LogError("Failed to fetch media init section %v", fetchErr)
-		code := 500
-		if isTimeoutError(fetchErr) {
-			code = 504
+// Parts are named after their segment, for example live-120.0, live-120.1
+func rewriteLiveParts(segmentMap *sync.Map, parts []Part, sequence int) {
+	segName := LIVE_PREFIX + toString(sequence)
+	for i := range parts {
+		part := &parts[i]
+		partName := segName + "." + toString(i)
+		if _, exists := segmentMap.Load(partName); !exists {
+			liveSegment := LiveSegment{realUrl: part.url, sequence: sequence, created: time.Now()}
+			if part.byteRange != nil {
+				liveSegment.realRange = part.byteRange.toRange()
+			}
+			segmentMap.Store(partName, &liveSegment)
 		}
-		http.Error(writer, "Failed to fetch media init section", code)
-		return
+		part.url = partName
+		part.byteRange = nil
 	}
-	liveSegment.obtainedMapUri = true
-	mutex.Unlock()
-
-	http.ServeFile(writer, request, initKeyPath)
 }
 
-func cleanupSegmentMap(segmentMap *sync.Map) {
-	// Cleanup map - remove old entries to avoid memory leaks
-	var keysToRemove []string
-	now := time.Now()
-	size := 0
-	segmentMap.Range(func(key, value any) bool {
-		fSegment := value.(*LiveSegment)
-		age := now.Sub(fSegment.created)
-		if age.Seconds() > 30 {
-			keysToRemove = append(keysToRemove, key.(string))
+// Part hints are rewritten to the name of the upcoming part, map hints are dropped since maps are proxied per segment.
+func rewriteLivePreloadHints(segmentMap *sync.Map, hints [][]Param, sequence int, partIndex int) [][]Param {
+	segName := LIVE_PREFIX + toString(sequence)
+	rewritten := make([][]Param, 0, len(hints))
+	for _, hint := range hints {
+		if getParamValue("TYPE", hint) != "PART" {
+			continue
+		}
+
+		partName := segName + "." + toString(partIndex)
+		if _, exists := segmentMap.Load(partName); !exists {
+			liveSegment := LiveSegment{realUrl: getParamValue("URI", hint), sequence: sequence, created: time.Now()}
+			start, err := parseInt64(getParamValue("BYTERANGE-START", hint))
+			if err == nil {
+				// Without a length the part extends to the end of the resource
+				end := int64(math.MaxInt64 - 1)
+				if length, err := parseInt64(getParamValue("BYTERANGE-LENGTH", hint)); err == nil {
+					end = start + length - 1
+				}
+				liveSegment.realRange = &Range{start, end}
+			}
+			segmentMap.Store(partName, &liveSegment)
 		}
-		size++
-		// true continues iteration
-		return true
-	})
 
-	// Remove the collected keys
-	for _, key := range keysToRemove {
-		segmentMap.Delete(key)
+		rewritten = append(rewritten, []Param{{"TYPE", "PART"}, {"URI", partName}})
 	}
+	return rewritten
 }
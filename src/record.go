@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// LiveRecording stores segments of a proxied live stream in a directory under MEDIA_RECORDINGS as the live refresher
+// downloads them. Once the recording is stopped, or the stream ends, the stored segments are listed in a VOD playlist.
+type LiveRecording struct {
+	title     string
+	userId    uint64
+	directory string
+
+	mutex    sync.Mutex
+	stopped  bool
+	source   *M3U                 // attributes of the recorded playlist, nil until the first segment is recorded
+	segments []RecordedSegment    // every recorded segment in the order of the stream
+	pending  map[*LiveSegment]int // index of segments which are not stored yet
+	maps     map[string]string    // file names of stored maps, keyed by the names the proxy serves them under
+	keys     map[string]string    // file names of stored keys, keyed by the names the proxy serves them under
+	sequence int                  // media sequence of the segment expected next, -1 before the first one
+}
+
+type RecordedSegment struct {
+	segment Segment // URL of the segment is relative to the recording directory
+	mapName string  // file name of the map of the segment, empty when it has none
+	stored  bool
+}
+
+// Starts recording the live stream of the current entry.
+func (server *Server) startLiveRecording(userId uint64) error {
+	server.state.setupLock.Lock()
+	defer server.state.setupLock.Unlock()
+
+	proxy := server.state.hlsProxies[LIVE_PREFIX]
+	if proxy == nil {
+		return errors.New("Only proxied live streams can be recorded")
+	}
+
+	server.state.mutex.Lock()
+	title := server.state.entry.Title
+	server.state.mutex.Unlock()
+
+	proxy.liveMutex.Lock()
+	defer proxy.liveMutex.Unlock()
+
+	if proxy.recordingClosed {
+		return errors.New("The live stream is no longer proxied")
+	}
+
+	if proxy.recording != nil {
+		return nil
+	}
+
+	directory, err := createRecordingDirectory(title)
+	if err != nil {
+		return fmt.Errorf("Failed to create the recording directory: %v", err)
+	}
+
+	proxy.recording = &LiveRecording{
+		title:     title,
+		userId:    userId,
+		directory: directory,
+		pending:   make(map[*LiveSegment]int),
+		maps:      make(map[string]string),
+		keys:      make(map[string]string),
+		sequence:  -1,
+	}
+
+	// Segments are recorded by the refresher, which may be paused while no client requests the stream.
+	select {
+	case proxy.liveWake <- struct{}{}:
+	default:
+	}
+
+	LogInfo("Recording of live stream %v was started by user %v.", proxy.liveUrl, userId)
+	server.writeEventToAllConnections("playerrecord", true, userId)
+	return nil
+}
+
+// Stops recording the live stream of the current entry, if it is being recorded, and saves the recording.
+func (server *Server) stopLiveRecording(userId uint64) {
+	server.state.setupLock.Lock()
+	proxy := server.state.hlsProxies[LIVE_PREFIX]
+	server.state.setupLock.Unlock()
+
+	if proxy != nil {
+		server.finishLiveRecording(proxy, false, userId)
+	}
+}
+
+// Returns whether the live stream of the current entry is being recorded.
+func (server *Server) isLiveRecording() bool {
+	server.state.setupLock.Lock()
+	proxy := server.state.hlsProxies[LIVE_PREFIX]
+	server.state.setupLock.Unlock()
+
+	return proxy.activeRecording() != nil
+}
+
+// Returns the recording of the live proxy, or nil when it is not being recorded.
+func (proxy *HlsProxy) activeRecording() *LiveRecording {
+	if proxy == nil {
+		return nil
+	}
+
+	proxy.liveMutex.Lock()
+	defer proxy.liveMutex.Unlock()
+	return proxy.recording
+}
+
+// Detaches the recording from the live proxy and saves it. Once closed, no new recording of the proxy can be started.
+func (server *Server) finishLiveRecording(proxy *HlsProxy, close bool, userId uint64) {
+	proxy.liveMutex.Lock()
+	recording := proxy.recording
+	proxy.recording = nil
+	if close {
+		proxy.recordingClosed = true
+	}
+	proxy.liveMutex.Unlock()
+
+	if recording == nil {
+		return
+	}
+
+	server.writeEventToAllConnections("playerrecord", false, userId)
+
+	m3u := recording.finish()
+	if m3u == nil {
+		LogInfo("Recording of live stream '%v' was stopped before any segment was stored.", recording.title)
+		os.RemoveAll(recording.directory)
+		return
+	}
+
+	server.finishRecording(m3u, recording.directory, recording.title, recording.userId)
+}
+
+// add appends the new segments of the rewritten live playlist to the recording and stores the maps they use. Segments
+// are stored once the refresher downloads them. Expects to be called by the refresher only.
+func (recording *LiveRecording) add(proxy *HlsProxy, liveM3U *M3U, names []string) {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+
+	if recording.stopped {
+		return
+	}
+
+	if recording.source == nil {
+		source := liveM3U.copy()
+		source.segments = nil
+		source.removeAttributes(EXT_X_MEDIA_SEQUENCE)
+		source.removeAttributes(EXT_X_DISCONTINUITY_SEQUENCE)
+		source.removeAttributes(EXT_X_PLAYLIST_TYPE)
+		recording.source = &source
+	}
+
+	// New segments may not list the key in effect, it was listed by a segment preceding them.
+	var key Key
+	hasKey := false
+	keys := make(map[string]Key, len(names))
+	for _, segment := range liveM3U.segments {
+		if segment.hasKey {
+			key, hasKey = segment.key, true
+		}
+		if hasKey {
+			keys[segment.url] = key
+		}
+	}
+
+	for _, name := range names {
+		maybeSegment, found := proxy.liveSegments.Load(name)
+		if !found {
+			continue
+		}
+		liveSegment := maybeSegment.(*LiveSegment)
+
+		index := slices.IndexFunc(liveM3U.segments, func(segment Segment) bool {
+			return segment.url == name
+		})
+		if index == -1 {
+			continue
+		}
+
+		mapName, err := recording.storeMap(proxy, liveSegment)
+		if err != nil {
+			LogWarn("Failed to record the map of live segment %v: %v", name, err)
+			continue
+		}
+
+		segment := liveM3U.segments[index]
+		segment.url = fmt.Sprintf("segment-%v", len(recording.segments))
+		segment.parts = nil
+		segment.mapUri, segment.mapRange = "", nil
+		segment.key, segment.hasKey = keys[name]
+
+		if segment.hasKey && segment.key.uri != "" {
+			keyName, err := recording.storeKey(proxy, segment.key.uri)
+			if err != nil {
+				LogWarn("Failed to record the key of live segment %v: %v", name, err)
+				continue
+			}
+			segment.key.uri = keyName
+		}
+
+		// Segments in between were missed, or the stream restarted.
+		if recording.sequence >= 0 && liveSegment.sequence != recording.sequence && !hasDiscontinuity(&segment) {
+			segment.addPair(KeyValue{EXT_X_DISCONTINUITY, ""})
+		}
+		recording.sequence = liveSegment.sequence + 1
+
+		// The implicit IV of AES-128 is the media sequence number, which changes in the recorded playlist.
+		if segment.hasKey && segment.key.method == "AES-128" && segment.key.initVec == "" {
+			segment.key.initVec = fmt.Sprintf("0x%032X", liveSegment.sequence)
+		}
+
+		recording.pending[liveSegment] = len(recording.segments)
+		recording.segments = append(recording.segments, RecordedSegment{segment: segment, mapName: mapName})
+	}
+}
+
+// Stores the map of the live segment in the recording unless it is already stored. Returns its file name, empty when
+// the segment has no map.
+func (recording *LiveRecording) storeMap(proxy *HlsProxy, liveSegment *LiveSegment) (string, error) {
+	name := liveSegment.mapName
+	if name == "" {
+		return "", nil
+	}
+
+	if mapName, stored := recording.maps[name]; stored {
+		return mapName, nil
+	}
+
+	if _, err := proxy.fetchResource(context.Background(), name); err != nil {
+		return "", err
+	}
+
+	mapName := fmt.Sprintf("init-%v", len(recording.maps))
+	if err := linkRecordingFile(CONTENT_PROXY+name, recording.directory+mapName); err != nil {
+		return "", err
+	}
+
+	recording.maps[name] = mapName
+	return mapName, nil
+}
+
+// Stores the key served by the proxy under the name in the recording unless it is already stored. Returns its file name.
+func (recording *LiveRecording) storeKey(proxy *HlsProxy, name string) (string, error) {
+	if keyName, stored := recording.keys[name]; stored {
+		return keyName, nil
+	}
+
+	if _, err := proxy.fetchResource(context.Background(), name); err != nil {
+		return "", err
+	}
+
+	keyName := fmt.Sprintf("key-%v", len(recording.keys))
+	if err := linkRecordingFile(CONTENT_PROXY+name, recording.directory+keyName); err != nil {
+		return "", err
+	}
+
+	recording.keys[name] = keyName
+	return keyName, nil
+}
+
+// Stores the downloaded live segment in the recording, if it was added to it.
+func (recording *LiveRecording) store(name string, liveSegment *LiveSegment) {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+
+	index, found := recording.pending[liveSegment]
+	if recording.stopped || !found {
+		return
+	}
+	delete(recording.pending, liveSegment)
+
+	recorded := &recording.segments[index]
+	if err := linkLiveFile(liveSegment, CONTENT_PROXY+name, recording.directory+recorded.segment.url); err != nil {
+		LogWarn("Failed to record live segment %v: %v", name, err)
+		return
+	}
+	recorded.stored = true
+}
+
+// Stops the recording and returns the playlist of the stored segments, or nil when none were stored. Segments which
+// were not stored are left out and replaced with a discontinuity.
+func (recording *LiveRecording) finish() *M3U {
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+
+	recording.stopped = true
+	if recording.source == nil {
+		return nil
+	}
+
+	m3u := recording.source.copy()
+	discontinuity := false
+	previousMap := ""
+	for _, recorded := range recording.segments {
+		if !recorded.stored {
+			discontinuity = true
+			continue
+		}
+
+		segment := recorded.segment
+		if discontinuity && len(m3u.segments) > 0 && !hasDiscontinuity(&segment) {
+			segment.addPair(KeyValue{EXT_X_DISCONTINUITY, ""})
+		}
+		discontinuity = false
+
+		if recorded.mapName != previousMap {
+			segment.mapUri = recorded.mapName
+			previousMap = recorded.mapName
+		}
+
+		m3u.segments = append(m3u.segments, segment)
+	}
+	removeRepeatedKeys(m3u.segments)
+
+	if len(m3u.segments) == 0 {
+		return nil
+	}
+
+	return &m3u
+}
+
+// Links a downloaded file of the live segment into a recording, unless the segment was evicted along with its files.
+func linkLiveFile(liveSegment *LiveSegment, source, destination string) error {
+	liveSegment.mutex.Lock()
+	defer liveSegment.mutex.Unlock()
+
+	if liveSegment.evicted {
+		return errors.New("Live segment was evicted before it was recorded")
+	}
+
+	return linkRecordingFile(source, destination)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	cryptorand "crypto/rand"
 	"database/sql"
 	"encoding/base64"
@@ -8,8 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
-	rand2 "math/rand/v2"
 	"net"
 	"net/http"
 	net_url "net/url"
@@ -206,6 +207,9 @@ func StartServer(config ServerConfig, db *sql.DB) {
 	history, _ := DatabaseHistoryGet(db)
 	playlist, _ := DatabasePlaylistGet(db)
 	messages, _ := DatabaseMessageGet(db, 10000, 0)
+	schedules, _ := DatabaseScheduleGet(db)
+	uploads, _ := DatabaseUploadGet(db)
+	streamKeys, _ := DatabaseStreamKeyGet(db)
 
 	autoplay := DatabaseGetAutoplay(db)
 	looping := DatabaseGetLooping(db)
@@ -224,11 +228,17 @@ func StartServer(config ServerConfig, db *sql.DB) {
 			},
 			actions:   make([]Action, 0, 4),
 			resources: make(map[string]SharedResource),
+			schedules: schedules,
+			uploads:   uploads,
+
+			resumableUploads: make(map[string]*ResumableUpload),
+			streamKeys:       streamKeys,
 		},
 
-		users: users,
-		conns: makeConnections(),
-		db:    db,
+		users:   users,
+		conns:   makeConnections(),
+		library: createLibrary(config.LibraryRoots),
+		db:      db,
 	}
 
 	configureRoutes()
@@ -252,9 +262,15 @@ func StartServer(config ServerConfig, db *sql.DB) {
 		LogError("Failed to find either SSL certificate or the private key.")
 	}
 
+	// Resumable upload sessions are not persisted, so their partial files are discarded on startup.
+	os.RemoveAll(MEDIA_PARTIAL)
+
 	go server.periodicResync()
 	go server.periodicInactiveUserCleanup()
 	go server.periodicCacheCleanup()
+	go server.periodicScheduler()
+	go server.libraryRescan()
+	go server.evictThumbnails()
 
 	internalLogger := CreateInternalLoggerForHttpServer()
 
@@ -473,6 +489,11 @@ func registerEndpoints(server *Server) *http.ServeMux {
 	server.handleEndpoint(mux, "/api/uptime", server.apiUptime, "GET")
 	server.handleEndpoint(mux, "/api/login", server.apiLogin, "GET")
 	server.handleEndpointAuthorized(mux, "/api/uploadmedia", server.apiUploadMedia, "POST")
+	server.handleEndpointAuthorized(mux, "/api/upload/init", server.apiUploadInit, "POST")
+	server.handleEndpointAuthorized(mux, "/api/upload/chunk/{id}", server.apiUploadChunk, "POST")
+	server.handleEndpointAuthorized(mux, "/api/upload/offset/{id}", server.apiUploadOffset, "GET")
+	server.handleEndpointAuthorized(mux, "/api/upload/finalize/{id}", server.apiUploadFinalize, "POST")
+	server.handleEndpointAuthorized(mux, "/api/upload/abort/{id}", server.apiUploadAbort, "POST")
 	server.handleEndpointAuthorized(mux, "/api/invite/create", server.apiInviteCreate, "GET")
 	server.handleEndpointAuthorized(mux, "/api/share", server.apiShare, "POST")
 
@@ -493,6 +514,7 @@ func registerEndpoints(server *Server) *http.ServeMux {
 	server.handleEndpointAuthorized(mux, "/api/player/seek", server.apiPlayerSeek, "POST")
 	server.handleEndpointAuthorized(mux, "/api/player/autoplay", server.apiPlayerAutoplay, "POST")
 	server.handleEndpointAuthorized(mux, "/api/player/looping", server.apiPlayerLooping, "POST")
+	server.handleEndpointAuthorized(mux, "/api/player/record", server.apiPlayerRecord, "POST")
 	server.handleEndpointAuthorized(mux, "/api/player/updatetitle", server.apiPlayerUpdateTitle, "POST")
 
 	// Subtitle API calls.
@@ -514,6 +536,7 @@ func registerEndpoints(server *Server) *http.ServeMux {
 	server.handleEndpointAuthorized(mux, "/api/playlist/shuffle", server.apiPlaylistShuffle, "POST")
 	server.handleEndpointAuthorized(mux, "/api/playlist/move", server.apiPlaylistMove, "POST")
 	server.handleEndpointAuthorized(mux, "/api/playlist/update", server.apiPlaylistUpdate, "POST")
+	server.handleEndpointAuthorized(mux, "/api/playlist/undo", server.apiPlaylistUndo, "POST")
 
 	// API calls that change state of the history.
 	server.handleEndpointAuthorized(mux, "/api/history/get", server.apiHistoryGet, "GET")
@@ -522,6 +545,18 @@ func registerEndpoints(server *Server) *http.ServeMux {
 	server.handleEndpointAuthorized(mux, "/api/history/delete", server.apiHistoryDelete, "POST")
 	server.handleEndpointAuthorized(mux, "/api/history/playlistadd", server.apiHistoryPlaylistAdd, "POST")
 
+	server.handleEndpointAuthorized(mux, "/api/media/list", server.apiMediaList, "POST")
+	server.handleEndpointAuthorized(mux, "/api/media/delete", server.apiMediaDelete, "POST")
+	server.handleEndpointAuthorized(mux, "/api/media/rename", server.apiMediaRename, "POST")
+
+	server.handleEndpointAuthorized(mux, "/api/library/list", server.apiLibraryList, "POST")
+	server.handleEndpointAuthorized(mux, "/api/library/search", server.apiLibrarySearch, "POST")
+	server.handleEndpointAuthorized(mux, "/api/library/rescan", server.apiLibraryRescan, "POST")
+
+	server.handleEndpointAuthorized(mux, "/api/schedule/list", server.apiScheduleList, "GET")
+	server.handleEndpointAuthorized(mux, "/api/schedule/add", server.apiScheduleAdd, "POST")
+	server.handleEndpointAuthorized(mux, "/api/schedule/cancel", server.apiScheduleCancel, "POST")
+
 	server.handleEndpointAuthorized(mux, "/api/chat/send", server.apiChatSend, "POST")
 	server.handleEndpointAuthorized(mux, "/api/chat/edit", server.apiChatEdit, "POST")
 	server.handleEndpointAuthorized(mux, "/api/chat/get", server.apiChatGet, "POST")
@@ -529,6 +564,11 @@ func registerEndpoints(server *Server) *http.ServeMux {
 
 	server.handleEndpointAuthorized(mux, "/api/stream/start", server.apiStreamStart, "POST")
 	server.handleEndpointAuthorized(mux, "/api/stream/upload/{filename}", server.apiStreamUpload, "POST")
+	server.handleEndpointAuthorized(mux, "/api/stream/stop", server.apiStreamStop, "POST")
+	server.handleEndpointAuthorized(mux, "/api/stream/key/get", server.apiStreamKeyGet, "GET")
+	server.handleEndpointAuthorized(mux, "/api/stream/key/reset", server.apiStreamKeyReset, "POST")
+	server.handleEndpoint(mux, "/api/stream/push/{key}", server.apiStreamPush, "POST")
+	server.handleEndpoint(mux, "/api/stream/ws/{key}", server.apiStreamPushWebsocket, "GET")
 	// Server events and proxy.
 	server.handleEndpoint(mux, "/api/events", server.apiEvents, "GET")
 
@@ -735,9 +775,92 @@ func (server *Server) periodicCacheCleanup() {
 			delete(resources, k)
 		}
 		server.state.resourceLock.Unlock()
+
+		server.cleanupStaleUploads()
+	}
+}
+
+func (server *Server) periodicScheduler() {
+	// Countdown mark last broadcast for each pending schedule.
+	broadcastMarks := make(map[uint64]int64)
+
+	for {
+		time.Sleep(SCHEDULE_CHECK_INTERVAL)
+
+		now := time.Now()
+		due := make([]Schedule, 0)
+		countdowns := make([]ScheduleCountdownEvent, 0)
+		marks := make(map[uint64]int64)
+
+		server.state.mutex.Lock()
+		pending := make([]Schedule, 0, len(server.state.schedules))
+		for _, schedule := range server.state.schedules {
+			remaining := time.UnixMilli(schedule.StartAt).Sub(now)
+
+			if remaining > 0 {
+				pending = append(pending, schedule)
+
+				mark, inCountdown := countdownMark(remaining)
+				if !inCountdown {
+					continue
+				}
+
+				if lastMark, broadcast := broadcastMarks[schedule.Id]; !broadcast || lastMark != mark {
+					countdown := ScheduleCountdownEvent{
+						ScheduleId:  schedule.Id,
+						Title:       schedule.Entry.Title,
+						StartAt:     schedule.StartAt,
+						SecondsLeft: int64(math.Ceil(remaining.Seconds())),
+					}
+					countdowns = append(countdowns, countdown)
+				}
+
+				marks[schedule.Id] = mark
+				continue
+			}
+
+			DatabaseScheduleDelete(server.db, schedule.Id)
+
+			// Schedules missed while the server was down are dropped instead of starting long after their premiere.
+			if -remaining > SCHEDULE_MISSED_TOLERANCE {
+				LogWarn("Dropping schedule id:%v, it was due %v ago.", schedule.Id, -remaining.Round(time.Second))
+				server.writeEventToAllConnections("scheduledelete", schedule.Id, SERVER_ID)
+				continue
+			}
+
+			due = append(due, schedule)
+		}
+		server.state.schedules = pending
+		server.state.mutex.Unlock()
+		broadcastMarks = marks
+
+		for _, countdown := range countdowns {
+			server.writeEventToAllConnections("schedulecountdown", countdown, SERVER_ID)
+		}
+
+		// Setting an entry may take a while (yt-dlp, proxy setup), which must not hold up countdowns and other schedules.
+		for _, schedule := range due {
+			go server.scheduleStart(schedule)
+		}
 	}
 }
 
+// Countdown is broadcast every 10 seconds within the countdown period and every second during the last 10 seconds.
+// Returns the mark the remaining time falls under, which is broadcast once, so that a late or early check of the
+// scheduler neither skips nor repeats a mark. Returns false outside of the countdown period.
+func countdownMark(remaining time.Duration) (int64, bool) {
+	if remaining > SCHEDULE_COUNTDOWN_PERIOD {
+		return 0, false
+	}
+
+	seconds := int64(math.Ceil(remaining.Seconds()))
+	if seconds <= 10 {
+		return seconds, true
+	}
+
+	return (seconds + 9) / 10 * 10, true
+}
+
 func (server *Server) detectYtdlpSource(url string) QuerySource {
 	if url == "" {
 		return ENTRY_SOURCE_NONE
@@ -783,7 +906,7 @@ func (server *Server) loadYtdlpSource(newEntry *Entry, source QuerySource) error
 		LogError("Unsupported ytdlp source host detected: %v", source)
 	}
 
-	newEntry.cacheThumbnail()
+	server.cacheThumbnail(newEntry)
 	if err != nil {
 		server.writeEventToAllConnections("playererror", err.Error(), SERVER_ID)
 		return err
@@ -792,7 +915,9 @@ func (server *Server) loadYtdlpSource(newEntry *Entry, source QuerySource) error
 	return nil
 }
 
-func (server *Server) setNewEntry(newEntry Entry, setById uint64) {
+// Sets the new entry as the current one. Returns an error when the entry failed to load, in which case the current
+// entry is kept.
+func (server *Server) setNewEntry(newEntry Entry, setById uint64) error {
 	server.state.isLoadingEntry.Store(true)
 	defer server.state.isLoadingEntry.Store(false)
 
@@ -802,11 +927,13 @@ func (server *Server) setNewEntry(newEntry Entry, setById uint64) {
 		server.loadYtdlpSource(&newEntry, source)
 	}
 
+	server.probeLocalEntry(&newEntry)
+
 	err := server.setupProxy(&newEntry)
 	if err != nil {
 		LogWarn("%v", err)
 		server.writeEventToAllConnections("playererror", err.Error(), SERVER_ID)
-		return
+		return err
 	}
 
 	server.state.mutex.Lock()
@@ -832,8 +959,30 @@ func (server *Server) setNewEntry(newEntry Entry, setById uint64) {
 
 	LogInfo("New entry URL is now: '%s'.", newEntry.Url)
 	server.writeEventToAllConnections("playerset", newEntry, SERVER_ID)
+	server.generateThumbnailsInBackground([]Entry{newEntry})
+
+	if server.config.HlsAttachSubtitles && newEntry.UseProxy {
+		go server.attachHlsSubtitles(newEntry.Id)
+	}
 
 	go server.preloadYoutubeSourceOnNextEntry()
+	return nil
+}
+
+// Fills metadata of entries pointing to media files stored on the server.
+func (server *Server) probeLocalEntry(entry *Entry) {
+	parsedUrl, err := net_url.Parse(entry.Url)
+	if err != nil || parsedUrl.Scheme != "" || !strings.HasPrefix(parsedUrl.Path, CONTENT_MEDIA) {
+		return
+	}
+
+	probe, err := probeMediaFile(parsedUrl.Path)
+	if err != nil {
+		LogDebug("Failed to probe local media file %v: %v", parsedUrl.Path, err)
+		return
+	}
+
+	probe.fillMetadata(&entry.Metadata)
 }
 
 func isPathM3U(p string) bool {
@@ -1059,6 +1208,7 @@ func (server *Server) setupProxy(entry *Entry) error {
 	server.state.setupLock.Lock()
 	server.state.fileProxy.destruct()
 	server.state.audioFileProxy.destruct()
+	server.destructHlsProxies()
 	server.state.setupLock.Unlock()
 
 	urlStruct, err := net_url.Parse(entry.Url)
@@ -1180,8 +1330,18 @@ func (server *Server) serveStream(writer http.ResponseWriter, request *http.Requ
 	writer.Header().Add("Cache-Control", "no-cache")
 
 	if chunk == STREAM_M3U8 {
+		server.state.setupLock.Lock()
+		liveStream := server.state.liveStream
+		server.state.setupLock.Unlock()
+
+		playlist := liveStream.servedPlaylist()
+		if playlist == nil {
+			http.Error(writer, "No stream was started", 404)
+			return
+		}
+
 		writer.Header().Add("content-type", M3U8_CONTENT_TYPE)
-		http.ServeFile(writer, request, CONTENT_STREAM+STREAM_M3U8)
+		writer.Write(playlist)
 		return
 	}
 
@@ -1389,6 +1549,8 @@ func (server *Server) cleanupDummyUsers() []User {
 }
 
 func (server *Server) playerGet() PlayerGetResponse {
+	recording := server.isLiveRecording()
+
 	server.state.mutex.Lock()
 	defer server.state.mutex.Unlock()
 
@@ -1401,9 +1563,10 @@ func (server *Server) playerGet() PlayerGetResponse {
 	copy(actions, server.state.actions)
 
 	data := PlayerGetResponse{
-		Player:  player,
-		Entry:   entry,
-		Actions: actions,
+		Player:    player,
+		Entry:     entry,
+		Actions:   actions,
+		Recording: recording,
 	}
 
 	return data
@@ -1435,7 +1598,9 @@ func (server *Server) playerSet(requested RequestEntry, userId uint64) error {
 	}
 
 	entry.Title = constructTitleWhenMissing(&entry)
-	server.setNewEntry(entry, userId)
+	if err := server.setNewEntry(entry, userId); err != nil {
+		return err
+	}
 
 	if requested.LyricsFetch {
 		server.fetchLyricsForCurrentEntry(userId)
@@ -1631,7 +1796,7 @@ func (server *Server) playlistAddOne(entry Entry, toTop bool) error {
 		return nil
 	}
 
-	if err := DatabasePlaylistAdd(server.db, &entry); err != nil {
+	if err := DatabasePlaylistAdd(server.db, &entry, toTop); err != nil {
 		return err
 	}
 
@@ -1647,6 +1812,7 @@ func (server *Server) playlistAddOne(entry Entry, toTop bool) error {
 	}
 
 	server.writeEventToAllConnections("playlist", event, entry.UserId)
+	server.generateThumbnailsInBackground([]Entry{entry})
 	return nil
 }
 
@@ -1657,7 +1823,7 @@ func (server *Server) playlistAddMany(entries []Entry, toTop bool) {
 
 	var event PlaylistEvent
 
-	DatabasePlaylistAddMany(server.db, entries)
+	DatabasePlaylistAddMany(server.db, entries, toTop)
 
 	if toTop {
 		server.state.playlist = append(entries, server.state.playlist...)
@@ -1668,6 +1834,7 @@ func (server *Server) playlistAddMany(entries []Entry, toTop bool) {
 	}
 
 	server.writeEventToAllConnections("playlist", event, 0)
+	server.generateThumbnailsInBackground(entries)
 }
 
 func (server *Server) playlistPlay(entryId uint64, userId uint64) error {
@@ -1699,6 +1866,7 @@ func (server *Server) playlistMove(data PlaylistMoveRequest, userId uint64) erro
 	}
 
 	entry := server.state.playlist[index]
+	order := getEntryIds(server.state.playlist)
 
 	// Remove element from the slice:
 	server.state.playlist = slices.Delete(server.state.playlist, index, index+1)
@@ -1710,7 +1878,15 @@ func (server *Server) playlistMove(data PlaylistMoveRequest, userId uint64) erro
 	list = append(list, entry)
 	list = append(list, server.state.playlist[data.DestIndex:]...)
 
+	server.pushUndoAction(UndoAction{
+		Type:   UNDO_PLAYLIST_ORDER,
+		UserId: userId,
+		Order:  order,
+	})
+
 	server.state.playlist = list
+	prevId, nextId := getNeighbourIds(server.state.playlist, data.DestIndex)
+	DatabasePlaylistMove(server.db, entry.Id, prevId, nextId)
 
 	eventData := PlaylistMoveEvent{
 		EntryId:   data.EntryId,
@@ -1732,7 +1908,14 @@ func (server *Server) playlistDelete(entryId uint64, userId uint64) error {
 		return fmt.Errorf("Failed to remove playlist element. Entry with ID %v is not in the playlist.", entryId)
 	}
 
-	server.playlistDeleteAt(index)
+	entry := server.playlistDeleteAt(index)
+	server.pushUndoAction(UndoAction{
+		Type:    UNDO_PLAYLIST_DELETE,
+		UserId:  userId,
+		Entries: []Entry{entry},
+		Index:   index,
+	})
+
 	go server.preloadYoutubeSourceOnNextEntry()
 	return nil
 }
@@ -1748,26 +1931,47 @@ func (server *Server) playlistDeleteAt(index int) Entry {
 	return entry
 }
 
-func (server *Server) playlistClear() {
+func (server *Server) playlistClear(userId uint64) {
 	server.state.mutex.Lock()
+	if len(server.state.playlist) > 0 {
+		removed := make([]Entry, len(server.state.playlist))
+		copy(removed, server.state.playlist)
+
+		server.pushUndoAction(UndoAction{
+			Type:    UNDO_PLAYLIST_CLEAR,
+			UserId:  userId,
+			Entries: removed,
+		})
+	}
+
 	server.state.playlist = server.state.playlist[:0]
 	DatabasePlaylistClear(server.db)
 	server.state.mutex.Unlock()
 
 	event := createPlaylistEvent("clear", nil)
-	server.writeEventToAllConnections("playlist", event, 0)
+	server.writeEventToAllConnections("playlist", event, userId)
 }
 
-func (server *Server) playlistShuffle() {
+func (server *Server) playlistShuffle(userId uint64) {
 	server.state.mutex.Lock()
+	if len(server.state.playlist) > 0 {
+		server.pushUndoAction(UndoAction{
+			Type:   UNDO_PLAYLIST_ORDER,
+			UserId: userId,
+			Order:  getEntryIds(server.state.playlist),
+		})
+	}
+
 	for i := range server.state.playlist {
 		j := rand.Intn(i + 1)
 		server.state.playlist[i], server.state.playlist[j] = server.state.playlist[j], server.state.playlist[i]
 	}
-	server.state.mutex.Unlock()
+	DatabasePlaylistReorder(server.db, server.state.playlist)
 
 	event := createPlaylistEvent("shuffle", server.state.playlist)
-	server.writeEventToAllConnections("playlist", event, 0)
+	server.writeEventToAllConnections("playlist", event, userId)
+	server.state.mutex.Unlock()
+
 	go server.preloadYoutubeSourceOnNextEntry()
 }
 
@@ -1791,6 +1995,222 @@ func (server *Server) playlistUpdate(entry Entry, userId uint64) error {
 	return nil
 }
 
+func (server *Server) scheduleAdd(data ScheduleAddRequest, userId uint64) (Schedule, error) {
+	if data.Entry.Url == "" && data.Entry.Query == "" {
+		return Schedule{}, fmt.Errorf("Scheduled entry is missing both the URL and the query.")
+	}
+
+	now := time.Now()
+	if !time.UnixMilli(data.StartAt).After(now) {
+		return Schedule{}, fmt.Errorf("Schedule start time must be in the future.")
+	}
+
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	if len(server.state.schedules) >= MAX_SCHEDULE_COUNT {
+		return Schedule{}, fmt.Errorf("Too many pending schedules, the limit is %v.", MAX_SCHEDULE_COUNT)
+	}
+
+	schedule := Schedule{
+		UserId:    userId,
+		StartAt:   data.StartAt,
+		CreatedAt: now.UnixMilli(),
+		Entry:     data.Entry,
+		Playlist:  data.Playlist,
+	}
+
+	if schedule.Playlist == nil {
+		schedule.Playlist = make([]RequestEntry, 0)
+	}
+
+	if err := DatabaseScheduleAdd(server.db, &schedule); err != nil {
+		return Schedule{}, err
+	}
+
+	index, _ := slices.BinarySearchFunc(server.state.schedules, schedule.StartAt, func(s Schedule, startAt int64) int {
+		return cmp.Compare(s.StartAt, startAt)
+	})
+	server.state.schedules = slices.Insert(server.state.schedules, index, schedule)
+
+	LogInfo("User id:%v scheduled '%v' at %v.", userId, schedule.Entry.Url, time.UnixMilli(schedule.StartAt).UTC())
+	server.writeEventToAllConnections("scheduleadd", schedule, userId)
+	return schedule, nil
+}
+
+func (server *Server) scheduleCancel(scheduleId uint64, userId uint64) error {
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	index := slices.IndexFunc(server.state.schedules, func(s Schedule) bool {
+		return s.Id == scheduleId
+	})
+
+	if index == -1 {
+		return fmt.Errorf("Schedule with id:%v does not exist.", scheduleId)
+	}
+
+	server.state.schedules = slices.Delete(server.state.schedules, index, index+1)
+	DatabaseScheduleDelete(server.db, scheduleId)
+
+	server.writeEventToAllConnections("scheduledelete", scheduleId, userId)
+	return nil
+}
+
+// Sets the scheduled entry, queues the scheduled playlist after it and starts the playback regardless of autoplay.
+func (server *Server) scheduleStart(schedule Schedule) {
+	LogInfo("Starting schedule id:%v with url '%v'.", schedule.Id, schedule.Entry.Url)
+	server.writeEventToAllConnections("schedulestart", schedule, SERVER_ID)
+
+	// The playback is not forced when the scheduled entry failed to load.
+	if err := server.playerSet(schedule.Entry, schedule.UserId); err != nil {
+		LogError("Failed to start schedule id:%v: %v", schedule.Id, err)
+		return
+	}
+
+	for i := len(schedule.Playlist) - 1; i >= 0; i-- {
+		requested := schedule.Playlist[i]
+		requested.PlaylistToTop = true
+
+		if err := server.playlistAdd(requested, schedule.UserId); err != nil {
+			LogWarn("Failed to add scheduled playlist entry '%v': %v", requested.Url, err)
+		}
+	}
+
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	if server.state.player.Playing {
+		return
+	}
+
+	sync := PlayerSyncRequest{
+		Timestamp:      0.0,
+		Programmatic:   true,
+		CurrentEntryId: server.state.entry.Id,
+	}
+	server.playerUpdateState(PLAYER_SYNC_PLAY, sync, SERVER_ID)
+}
+
+func getEntryIds(entries []Entry) []uint64 {
+	ids := make([]uint64, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+
+	return ids
+}
+
+// Returns IDs of entries surrounding the entry at a given index, 0 when there is no neighbour on that side.
+func getNeighbourIds(entries []Entry, index int) (uint64, uint64) {
+	var prevId, nextId uint64
+	if index > 0 {
+		prevId = entries[index-1].Id
+	}
+
+	if index+1 < len(entries) {
+		nextId = entries[index+1].Id
+	}
+
+	return prevId, nextId
+}
+
+// Records a reversible mutation, discarding the oldest one when the undo stack is full. Expects the state mutex to be held.
+func (server *Server) pushUndoAction(action UndoAction) {
+	if len(server.state.undoStack) >= MAX_UNDO_SIZE {
+		server.state.undoStack = slices.Delete(server.state.undoStack, 0, 1)
+	}
+
+	server.state.undoStack = append(server.state.undoStack, action)
+}
+
+func (server *Server) playlistUndo(userId uint64) error {
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	length := len(server.state.undoStack)
+	if length == 0 {
+		return fmt.Errorf("Nothing to undo.")
+	}
+
+	action := server.state.undoStack[length-1]
+	server.state.undoStack = server.state.undoStack[:length-1]
+
+	switch action.Type {
+	case UNDO_PLAYLIST_CLEAR:
+		restored := action.Entries
+		if err := DatabasePlaylistRestore(server.db, restored, true); err != nil {
+			return err
+		}
+
+		server.state.playlist = append(restored, server.state.playlist...)
+
+	case UNDO_PLAYLIST_DELETE:
+		entry := action.Entries[0]
+		if err := DatabasePlaylistRestore(server.db, action.Entries, false); err != nil {
+			return err
+		}
+
+		index := min(action.Index, len(server.state.playlist))
+		server.state.playlist = slices.Insert(server.state.playlist, index, entry)
+		prevId, nextId := getNeighbourIds(server.state.playlist, index)
+		DatabasePlaylistMove(server.db, entry.Id, prevId, nextId)
+
+	case UNDO_PLAYLIST_ORDER:
+		server.state.playlist = restoreEntryOrder(server.state.playlist, action.Order)
+		DatabasePlaylistReorder(server.db, server.state.playlist)
+
+	case UNDO_HISTORY_CLEAR:
+		// Oldest cleared entries are dropped when the history filled up again in the meantime.
+		restored := action.Entries
+		if overflow := len(restored) + len(server.state.history) - MAX_HISTORY_SIZE; overflow > 0 {
+			restored = restored[min(overflow, len(restored)):]
+		}
+
+		if err := DatabaseHistoryRestore(server.db, restored); err != nil {
+			return err
+		}
+
+		server.state.history = append(slices.Clone(restored), server.state.history...)
+		server.addRecentAction("undo", userId, "history clear")
+		server.writeEventToAllConnections("historyrestore", server.state.history, userId)
+		return nil
+
+	default:
+		return fmt.Errorf("Unexpected main.UndoType: %#v", action.Type)
+	}
+
+	server.addRecentAction("undo", userId, "playlist")
+	event := createPlaylistEvent("restore", server.state.playlist)
+	server.writeEventToAllConnections("playlist", event, userId)
+	go server.preloadYoutubeSourceOnNextEntry()
+	return nil
+}
+
+// Sorts entries to match the provided order of entry IDs. Entries missing from the order keep their relative position at the end.
+func restoreEntryOrder(entries []Entry, order []uint64) []Entry {
+	restored := make([]Entry, 0, len(entries))
+	used := make([]bool, len(entries))
+
+	for _, id := range order {
+		index := FindEntryIndex(entries, id)
+		if index == -1 || used[index] {
+			continue
+		}
+
+		restored = append(restored, entries[index])
+		used[index] = true
+	}
+
+	for i, entry := range entries {
+		if !used[i] {
+			restored = append(restored, entry)
+		}
+	}
+
+	return restored
+}
+
 func compareEntries(entry1 Entry, entry2 Entry) bool {
 	if entry1.Url != entry2.Url {
 		return false
@@ -1847,9 +2267,30 @@ func (server *Server) historyAdd(entry Entry) error {
 	}
 
 	server.writeEventToAllConnections("historyadd", entry, 0)
+	server.generateThumbnailsInBackground([]Entry{entry})
 	return nil
 }
 
+func (server *Server) historyClear(userId uint64) {
+	server.state.mutex.Lock()
+	if len(server.state.history) > 0 {
+		removed := make([]Entry, len(server.state.history))
+		copy(removed, server.state.history)
+
+		server.pushUndoAction(UndoAction{
+			Type:    UNDO_HISTORY_CLEAR,
+			UserId:  userId,
+			Entries: removed,
+		})
+	}
+
+	server.state.history = server.state.history[:0]
+	server.state.mutex.Unlock()
+
+	DatabaseHistoryClear(server.db)
+	server.writeEventToAllConnections("historyclear", nil, userId)
+}
+
 func (server *Server) historyDelete(index int) Entry {
 	entry := server.state.history[index]
 
@@ -2044,31 +2485,6 @@ func (server *Server) relativizeUrl(url string) (string, error) {
 	return urlStruct.String(), nil
 }
 
-func (entry *Entry) cacheThumbnail() {
-	if entry.Thumbnail == "" || !isAbsolute(entry.Thumbnail) {
-		return
-	}
-	options := &DownloadOptions{
-		referer:   entry.RefererUrl,
-		hasty:     false,
-		bodyLimit: MAX_THUMBNAIL_SIZE,
-	}
-
-	// This mkdir should be done on server startup?
-	os.MkdirAll(MEDIA_THUMB, os.ModePerm)
-	thumbnailPath := MEDIA_THUMB + uint64ToString(rand2.Uint64())
-	fetchErr := downloadFile(entry.Thumbnail, thumbnailPath, options)
-	if fetchErr != nil {
-		LogError("Thumbnail could not be downloaded: %v", fetchErr)
-		return
-	}
-	entry.Thumbnail = thumbnailPath
-	err := KeepLatestFiles(MEDIA_THUMB, MAX_THUMBNAIL_COUNT)
-	if err != nil {
-		LogError("Thumbnail directory could not be culled: %v", err)
-	}
-}
-
 func (server *Server) loadYoutubePlaylist(url string, skipCount uint, maxSize uint, addToTop bool, userId uint64) error {
 	query := url
 	parsedUrl, err := net_url.Parse(query)
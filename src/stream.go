@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Streams hosted on the server are uploaded by the streamer one segment at a time, named stream<sequence number> with
+// the extension of the segment container. The server validates every upload and maintains the sliding window playlist
+// served to clients on its own. Segments are published once their duration is known, either given with the upload or
+// listed by the playlist of the streamer, which is what encoders such as ffmpeg upload along with the segments.
+
+var STREAM_SEGMENT_EXTENSIONS = []string{".ts", ".m4s", ".mp4", ".aac"}
+
+var errStreamEnded = errors.New("The stream has ended")
+
+func newLiveStream(userId uint64, title string, dvr *DvrWindow) *LiveStream {
+	stream := &LiveStream{
+		userId:        userId,
+		title:         title,
+		lastUploaded:  -1,
+		lastPublished: -1,
+		pending:       make(map[int]string),
+		files:         make(map[int]string),
+		dvr:           dvr,
+	}
+
+	stream.updatePlaylist()
+	return stream
+}
+
+// Starts a new hosted stream of the user and sets it as the current entry. The previous stream is stopped first.
+func (server *Server) startHostedStream(user *User) *LiveStream {
+	server.state.setupLock.Lock()
+	defer server.state.setupLock.Unlock()
+
+	// The previous stream is saved before its segments are removed.
+	if previous := server.state.liveStream; previous != nil {
+		server.stopHostedStream(previous, previous.userId)
+	}
+
+	_ = os.RemoveAll(CONTENT_STREAM)
+	_ = os.MkdirAll(CONTENT_STREAM, os.ModePerm)
+
+	entry := Entry{
+		Url:       STREAM_ROUTE + STREAM_M3U8,
+		UserId:    user.Id,
+		Title:     user.Username + "'s stream",
+		UseProxy:  false,
+		Subtitles: []Subtitle{},
+		CreatedAt: time.Now(),
+	}
+
+	stream := newLiveStream(user.Id, entry.Title, newDvrWindow(server.config.LiveDvrMinutes))
+	server.state.liveStream = stream
+	server.writeEventToAllConnections("streamstart", stream.stats(), user.Id)
+
+	go server.setNewEntry(entry, user.Id)
+	return stream
+}
+
+// Returns the sequence number of the uploaded segment, or -1 for the media initialization section.
+func parseStreamFilename(filename string) (int, error) {
+	if filename == STREAM_INIT {
+		return -1, nil
+	}
+
+	extension := path.Ext(filename)
+	if !slices.Contains(STREAM_SEGMENT_EXTENSIONS, extension) {
+		return 0, fmt.Errorf("Unsupported stream segment %v", filename)
+	}
+
+	number, found := strings.CutPrefix(strings.TrimSuffix(filename, extension), "stream")
+	if !found || number == "" || strings.ContainsFunc(number, func(char rune) bool { return char < '0' || char > '9' }) {
+		return 0, fmt.Errorf("Stream segment %v is not named stream<sequence number>%v", filename, extension)
+	}
+
+	return parseInt(number)
+}
+
+// Returns the playlist served to clients, nil when no stream was started.
+func (stream *LiveStream) servedPlaylist() []byte {
+	if stream == nil {
+		return nil
+	}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.playlist
+}
+
+// Checks whether a segment with the sequence number can be uploaded, before its upload is received.
+func (stream *LiveStream) validateUpload(sequence int) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.checkSequence(sequence)
+}
+
+func (stream *LiveStream) checkSequence(sequence int) error {
+	if stream.ended {
+		return errStreamEnded
+	}
+
+	if sequence >= 0 && sequence <= stream.lastUploaded {
+		return fmt.Errorf("Segment %v is out of order, segment %v was already uploaded", sequence, stream.lastUploaded)
+	}
+
+	return nil
+}
+
+// acceptUpload moves the received file in place of the segment and publishes it, unless its duration is not known yet.
+// In that case the segment waits for the playlist of the streamer which lists it. Removes the file when the segment is
+// rejected.
+func (stream *LiveStream) acceptUpload(received, filename string, sequence int, duration float64, size int64) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if err := stream.checkSequence(sequence); err != nil {
+		os.Remove(received)
+		return err
+	}
+
+	if err := os.Rename(received, CONTENT_STREAM+filename); err != nil {
+		os.Remove(received)
+		return err
+	}
+
+	stream.dataTransferred += size
+	if sequence < 0 {
+		stream.hasInit = true
+		return nil
+	}
+
+	stream.lastUploaded = sequence
+	if duration == 0 {
+		stream.pending[sequence] = filename
+		return nil
+	}
+
+	stream.publish(sequence, filename, duration)
+	stream.updatePlaylist()
+	stream.collectGarbage()
+	return nil
+}
+
+// receiveStreamPlaylist publishes the pending segments listed by the playlist uploaded by the streamer, with the
+// durations it lists. The stream is stopped once the playlist ends.
+func (server *Server) receiveStreamPlaylist(stream *LiveStream, m3u *M3U) {
+	stream.mutex.Lock()
+	published := false
+	for _, segment := range m3u.segments {
+		sequence, err := parseStreamFilename(path.Base(segment.url))
+		if err != nil || sequence < 0 {
+			continue
+		}
+
+		filename, pending := stream.pending[sequence]
+		if !pending {
+			continue
+		}
+		delete(stream.pending, sequence)
+
+		if segment.length <= 0 || segment.length > MAX_STREAM_SEGMENT_DURATION {
+			LogWarn("Dropping stream segment %v with invalid duration of %vs.", filename, segment.length)
+			os.Remove(CONTENT_STREAM + filename)
+			continue
+		}
+
+		stream.publish(sequence, filename, segment.length)
+		published = true
+	}
+
+	if published {
+		stream.updatePlaylist()
+		stream.collectGarbage()
+	}
+	ended := !m3u.isLive && !stream.ended
+	stream.mutex.Unlock()
+
+	if ended {
+		server.stopHostedStream(stream, stream.userId)
+	}
+}
+
+// Appends the segment to the window and slides it. Pending segments preceding the segment are dropped, since they can no
+// longer be published in order.
+func (stream *LiveStream) publish(sequence int, filename string, duration float64) {
+	for pendingSequence, pendingFile := range stream.pending {
+		if pendingSequence < sequence {
+			os.Remove(CONTENT_STREAM + pendingFile)
+			delete(stream.pending, pendingSequence)
+		}
+	}
+
+	segment := Segment{url: filename, length: duration}
+	if stream.hasInit {
+		segment.mapUri = STREAM_INIT
+	}
+
+	if stream.lastPublished >= 0 && sequence != stream.lastPublished+1 {
+		LogWarn("Stream segment %v does not follow segment %v, marking a discontinuity.", sequence, stream.lastPublished)
+		segment.addPair(KeyValue{EXT_X_DISCONTINUITY, ""})
+	}
+
+	stream.lastPublished = sequence
+	stream.published += duration
+	stream.targetDuration = max(stream.targetDuration, int(math.Ceil(duration)))
+	stream.files[stream.mediaSequence+len(stream.window)] = filename
+	stream.window = append(stream.window, segment)
+
+	for len(stream.window) > STREAM_WINDOW_SEGMENTS {
+		// Removing a discontinuity tag advances the discontinuity sequence.
+		if hasDiscontinuity(&stream.window[0]) {
+			stream.discontinuitySequence++
+		}
+		stream.window = slices.Delete(stream.window, 0, 1)
+		stream.mediaSequence++
+	}
+}
+
+// Serializes the window, merged with the DVR window, as the playlist served to clients. Returns the served playlist.
+func (stream *LiveStream) updatePlaylist() *M3U {
+	m3u := newM3U(uint32(len(stream.window)))
+	m3u.url = STREAM_ROUTE + STREAM_M3U8
+	m3u.isLive = !stream.ended
+
+	version := "3"
+	if stream.hasInit {
+		version = "6"
+	}
+
+	targetDuration := stream.targetDuration
+	if targetDuration == 0 {
+		targetDuration = STREAM_INITIAL_TARGET_DURATION
+	}
+
+	m3u.addPair(KeyValue{EXT_X_VERSION, version})
+	m3u.addPair(KeyValue{EXT_X_TARGETDURATION, toString(targetDuration)})
+	m3u.addPair(KeyValue{EXT_X_MEDIA_SEQUENCE, toString(stream.mediaSequence)})
+	if stream.discontinuitySequence > 0 {
+		m3u.addPair(KeyValue{EXT_X_DISCONTINUITY_SEQUENCE, toString(stream.discontinuitySequence)})
+	}
+	m3u.segments = append(m3u.segments, stream.window...)
+
+	if stream.dvr != nil {
+		stream.dvr.extend(m3u)
+	} else {
+		removeRepeatedMaps(m3u.segments)
+	}
+
+	var playlist bytes.Buffer
+	m3u.serializeTo(&playlist)
+	stream.playlist = playlist.Bytes()
+	return m3u
+}
+
+// Deletes segments which clients are no longer expected to request, keeping the ones retained by the DVR window.
+func (stream *LiveStream) collectGarbage() {
+	minSequence := stream.mediaSequence - LIVE_SEGMENTS_BEHIND
+	if stream.dvr != nil {
+		minSequence = min(minSequence, stream.dvr.firstSequence)
+	}
+
+	for sequence, filename := range stream.files {
+		if sequence < minSequence {
+			os.Remove(CONTENT_STREAM + filename)
+			delete(stream.files, sequence)
+		}
+	}
+}
+
+func (stream *LiveStream) stats() StreamStats {
+	bitrate := 0.0
+	if stream.published > 0 {
+		bitrate = float64(stream.dataTransferred*8) / stream.published
+	}
+
+	return StreamStats{
+		UserId:          stream.userId,
+		Title:           stream.title,
+		DataTransferred: stream.dataTransferred,
+		Duration:        stream.published,
+		Bitrate:         bitrate,
+	}
+}
+
+// Ends the hosted stream, so the playlist served to clients ends too. With the DVR window enabled, the stream is saved
+// as a recording.
+func (server *Server) stopHostedStream(stream *LiveStream, userId uint64) {
+	stream.mutex.Lock()
+	if stream.ended {
+		stream.mutex.Unlock()
+		return
+	}
+
+	stream.ended = true
+	for sequence, filename := range stream.pending {
+		os.Remove(CONTENT_STREAM + filename)
+		delete(stream.pending, sequence)
+	}
+
+	m3u := stream.updatePlaylist()
+	stats := stream.stats()
+	stream.mutex.Unlock()
+
+	LogInfo("Stream '%v' has ended after %.1fs, receiving %v bytes at %.0f kbps.", stats.Title, stats.Duration, stats.DataTransferred, stats.Bitrate/1000)
+	server.writeEventToAllConnections("streamstop", stats, userId)
+
+	if stream.dvr != nil {
+		server.saveLiveRecording(m3u, CONTENT_STREAM, stream.title, stream.userId)
+	}
+}
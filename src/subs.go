@@ -243,6 +243,164 @@ func parseTimestamps(timestamps string) (Timecode, Timecode, error) {
 	return start, end, nil
 }
 
+// Merges WebVTT segments of an HLS subtitle rendition into a single file. Header blocks (WEBVTT, X-TIMESTAMP-MAP)
+// of the segments are dropped and cues repeated across segment boundaries are written only once.
+// Cue times of segments with X-TIMESTAMP-MAP are moved to the media timeline, which starts at the MPEG-TS timestamp
+// basePts. When basePts is negative, the timeline starts at the MPEG-TS timestamp mapped by the first segment.
+func mergeWebVttSegments(segments [][]byte, basePts int64) []byte {
+	var output strings.Builder
+	output.WriteString("WEBVTT\n\n")
+
+	written := make(map[string]bool)
+	for _, segment := range segments {
+		text := strings.ReplaceAll(string(segment), "\r\n", "\n")
+		blocks := strings.Split(text, "\n\n")
+
+		offset := int64(0)
+		if local, mpegts, found := parseWebVttTimestampMap(blocks[0]); found {
+			if basePts < 0 {
+				basePts = mpegts
+			}
+			offset = mpegtsToMilliseconds(mpegts-basePts) - local
+		}
+
+		for _, block := range blocks {
+			block = strings.Trim(block, "\n")
+			if block == "" || strings.HasPrefix(block, "WEBVTT") || !strings.Contains(block, "-->") {
+				continue
+			}
+
+			block, visible := shiftWebVttCue(block, offset)
+			if !visible || written[block] {
+				continue
+			}
+			written[block] = true
+
+			output.WriteString(block)
+			output.WriteString("\n\n")
+		}
+	}
+
+	return []byte(output.String())
+}
+
+// Returns the LOCAL cue time in milliseconds and the MPEGTS timestamp mapped by X-TIMESTAMP-MAP of the WebVTT header.
+func parseWebVttTimestampMap(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "WEBVTT") {
+		return 0, 0, false
+	}
+
+	for _, line := range strings.Split(header, "\n") {
+		mapping, found := strings.CutPrefix(strings.TrimSpace(line), "X-TIMESTAMP-MAP=")
+		if !found {
+			continue
+		}
+
+		var local, mpegts int64
+		var hasLocal, hasMpegts bool
+		for _, pair := range strings.Split(mapping, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), ":")
+			switch key {
+			case "LOCAL":
+				timestamp, err := parseVttTimestamp(value)
+				local, hasLocal = timestamp, err == nil
+			case "MPEGTS":
+				timestamp, err := strconv.ParseInt(value, 10, 64)
+				mpegts, hasMpegts = timestamp, err == nil
+			}
+		}
+
+		return local, mpegts, hasLocal && hasMpegts
+	}
+
+	return 0, 0, false
+}
+
+// Converts a difference of 90kHz MPEG-TS timestamps to milliseconds, accounting for the 33 bit rollover.
+func mpegtsToMilliseconds(difference int64) int64 {
+	if difference < -TS_TIMESTAMP_WRAP/2 {
+		difference += TS_TIMESTAMP_WRAP
+	} else if difference > TS_TIMESTAMP_WRAP/2 {
+		difference -= TS_TIMESTAMP_WRAP
+	}
+
+	return difference / 90
+}
+
+// Shifts the timing of the WebVTT cue block by the offset in milliseconds. Returns false when the cue ends before zero.
+func shiftWebVttCue(block string, offset int64) (string, bool) {
+	lines := strings.Split(block, "\n")
+	for i, line := range lines {
+		startStamp, rest, found := strings.Cut(line, "-->")
+		if !found {
+			continue
+		}
+
+		endStamp, settings, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		start, startErr := parseVttTimestamp(strings.TrimSpace(startStamp))
+		end, endErr := parseVttTimestamp(endStamp)
+		if startErr != nil || endErr != nil {
+			return block, true
+		}
+
+		if offset == 0 {
+			return block, true
+		}
+
+		start, end = max(start+offset, 0), end+offset
+		if end < 0 {
+			return block, false
+		}
+
+		lines[i] = formatVttTimestamp(start) + " --> " + formatVttTimestamp(end)
+		if settings != "" {
+			lines[i] += " " + settings
+		}
+		return strings.Join(lines, "\n"), true
+	}
+
+	return block, true
+}
+
+// Parses a WebVTT timestamp in the ([hh:]mm:ss.ttt) format into milliseconds.
+func parseVttTimestamp(timestamp string) (int64, error) {
+	clock, fraction, found := strings.Cut(timestamp, ".")
+	if !found || len(fraction) != 3 {
+		return 0, fmt.Errorf("invalid WebVTT timestamp %q", timestamp)
+	}
+
+	milliseconds, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	units := strings.Split(clock, ":")
+	if len(units) != 2 && len(units) != 3 {
+		return 0, fmt.Errorf("invalid WebVTT timestamp %q", timestamp)
+	}
+
+	seconds := int64(0)
+	for _, unit := range units {
+		value, err := strconv.ParseInt(unit, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + value
+	}
+
+	return seconds*1000 + milliseconds, nil
+}
+
+func formatVttTimestamp(milliseconds int64) string {
+	timecode := Timecode{
+		Hours:        int(milliseconds / 3600000),
+		Minutes:      int(milliseconds / 60000 % 60),
+		Seconds:      int(milliseconds / 1000 % 60),
+		Milliseconds: int(milliseconds % 1000),
+	}
+	return timecode.toVtt()
+}
+
 func serializeToVTT(subtitles []SubtitleCue, path string) error {
 	file, err := os.Create(path)
 	if err != nil {
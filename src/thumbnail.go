@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	net_url "net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const THUMBNAIL_COMMAND_TIMEOUT = 20 * time.Second
+
+var thumbnailSemaphore = make(chan struct{}, THUMBNAIL_CONCURRENCY)
+
+type ThumbnailFile struct {
+	path       string
+	size       int64
+	accessedAt time.Time
+}
+
+// Thumbnails are content-addressed, named after a hash of their source (URL, media file or image data), so the same
+// thumbnail is stored only once and reused by every entry pointing at it.
+func thumbnailPathFor(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return MEDIA_THUMB + hex.EncodeToString(hash[:16])
+}
+
+// Returns true when the thumbnail is already cached, marking it as recently used.
+func touchThumbnail(thumbnailPath string) bool {
+	info, err := os.Stat(thumbnailPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	now := time.Now()
+	os.Chtimes(thumbnailPath, now, now)
+	return true
+}
+
+// Same as touchThumbnail, synchronized with eviction.
+func (server *Server) isThumbnailCached(thumbnailPath string) bool {
+	server.state.thumbnailLock.Lock()
+	defer server.state.thumbnailLock.Unlock()
+	return touchThumbnail(thumbnailPath)
+}
+
+// Creates a directory for a thumbnail being downloaded or grabbed. The thumbnail lock is not held meanwhile, so every
+// producer gets a directory of its own and a failed attempt never leaves a partial file under the cached name.
+// Eviction skips directories.
+func createThumbnailWorkDir() (string, error) {
+	// This mkdir should be done on server startup?
+	os.MkdirAll(MEDIA_THUMB, os.ModePerm)
+	return os.MkdirTemp(MEDIA_THUMB, "partial-")
+}
+
+// Moves the produced thumbnail into the cache, unless the same thumbnail was stored in the meantime.
+func (server *Server) storeThumbnail(producedPath, thumbnailPath string) error {
+	server.state.thumbnailLock.Lock()
+	defer server.state.thumbnailLock.Unlock()
+
+	if touchThumbnail(thumbnailPath) {
+		return nil
+	}
+
+	if err := os.Rename(producedPath, thumbnailPath); err != nil {
+		return err
+	}
+
+	go server.evictThumbnails()
+	return nil
+}
+
+// Downloads a remote thumbnail supplied by yt-dlp into the thumbnail cache, unless it is already cached.
+func (server *Server) cacheThumbnail(entry *Entry) {
+	if entry.Thumbnail == "" || !isAbsolute(entry.Thumbnail) {
+		return
+	}
+
+	thumbnailPath := thumbnailPathFor(entry.Thumbnail)
+	if server.isThumbnailCached(thumbnailPath) {
+		entry.Thumbnail = thumbnailPath
+		return
+	}
+
+	workDir, err := createThumbnailWorkDir()
+	if err != nil {
+		LogError("Thumbnail could not be downloaded: %v", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	options := &DownloadOptions{
+		referer:   entry.RefererUrl,
+		hasty:     false,
+		bodyLimit: MAX_THUMBNAIL_SIZE,
+	}
+
+	downloadPath := workDir + "/thumbnail"
+	fetchErr := downloadFile(entry.Thumbnail, downloadPath, options)
+	if fetchErr != nil {
+		LogError("Thumbnail could not be downloaded: %v", fetchErr)
+		return
+	}
+
+	if err := server.storeThumbnail(downloadPath, thumbnailPath); err != nil {
+		LogError("Thumbnail could not be stored: %v", err)
+		return
+	}
+
+	entry.Thumbnail = thumbnailPath
+}
+
+// Generates thumbnails of the entries without one in the background, one entry after another. Once generated, the
+// thumbnail is assigned to every entry pointing at the same media.
+func (server *Server) generateThumbnailsInBackground(entries []Entry) {
+	pending := slices.DeleteFunc(slices.Clone(entries), func(entry Entry) bool {
+		return entry.Thumbnail != ""
+	})
+
+	if len(pending) == 0 {
+		return
+	}
+
+	go func() {
+		for _, entry := range pending {
+			thumbnailSemaphore <- struct{}{}
+			thumbnail := server.generateThumbnail(entry)
+			<-thumbnailSemaphore
+
+			if thumbnail != "" {
+				server.assignThumbnail(entry.Url, thumbnail)
+			}
+		}
+	}()
+}
+
+// Returns the thumbnail generated for an entry pointing directly at a media file, local or remote, empty when none
+// could be generated.
+func (server *Server) generateThumbnail(entry Entry) string {
+	parsedUrl, err := net_url.Parse(entry.Url)
+	if err != nil {
+		return ""
+	}
+
+	if parsedUrl.Scheme == "" {
+		if !strings.HasPrefix(parsedUrl.Path, CONTENT_MEDIA) {
+			return ""
+		}
+
+		probe, err := probeMediaFile(parsedUrl.Path)
+		if err != nil {
+			LogDebug("Failed to probe local media file %v: %v", parsedUrl.Path, err)
+		}
+
+		return server.generateMediaThumbnail(probe, parsedUrl.Path, "")
+	}
+
+	return server.probeLinkedMedia(entry.Url, parsedUrl, entry.RefererUrl)
+}
+
+// Assigns the thumbnail to the current entry, playlist and history entries pointing at the URL which have none yet.
+func (server *Server) assignThumbnail(url, thumbnail string) {
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	for i := range server.state.playlist {
+		entry := &server.state.playlist[i]
+		if entry.Url != url || entry.Thumbnail != "" {
+			continue
+		}
+
+		entry.Thumbnail = thumbnail
+		DatabaseEntryUpdateThumbnail(server.db, entry.Id, thumbnail)
+
+		event := createPlaylistEvent("update", *entry)
+		server.writeEventToAllConnections("playlist", event, SERVER_ID)
+	}
+
+	historyChanged := false
+	for i := range server.state.history {
+		entry := &server.state.history[i]
+		if entry.Url == url && entry.Thumbnail == "" {
+			entry.Thumbnail = thumbnail
+			DatabaseEntryUpdateThumbnail(server.db, entry.Id, thumbnail)
+			historyChanged = true
+		}
+	}
+
+	if historyChanged {
+		server.writeEventToAllConnections("historyrestore", server.state.history, SERVER_ID)
+	}
+
+	entry := &server.state.entry
+	if entry.Url == url && entry.Thumbnail == "" {
+		entry.Thumbnail = thumbnail
+		DatabaseEntryUpdateThumbnail(server.db, entry.Id, thumbnail)
+		server.writeEventToAllConnections("playerthumbnail", thumbnail, SERVER_ID)
+	}
+}
+
+// Generates a thumbnail for a media file, local or remote, whose source did not provide one. Audio files use their
+// embedded cover art, videos a frame grabbed by the configured thumbnail command. Returns empty when none was generated.
+func (server *Server) generateMediaThumbnail(probe MediaProbe, input, referer string) string {
+	if probe.Cover != nil {
+		thumbnailPath, err := server.saveThumbnail(probe.Cover)
+		if err != nil {
+			LogWarn("Failed to save embedded cover art of %v: %v", input, err)
+			return ""
+		}
+
+		return thumbnailPath
+	}
+
+	isVideo := slices.ContainsFunc(probe.Tracks, func(track MediaTrack) bool {
+		return track.Kind == "video"
+	})
+
+	parsedUrl, err := net_url.Parse(input)
+	if err == nil && getMediaType(path.Ext(parsedUrl.Path)) == "video" {
+		isVideo = true
+	}
+
+	if !isVideo || len(server.config.ThumbnailCommand) == 0 {
+		return ""
+	}
+
+	// Local files are keyed by their size and modification time as well, so a replaced file gets a new frame.
+	key := input
+	if info, err := os.Stat(input); err == nil {
+		key = fmt.Sprintf("%v:%v:%v", input, info.Size(), info.ModTime().UnixNano())
+	}
+
+	thumbnailPath, err := server.grabVideoFrame(key, input, referer)
+	if err != nil {
+		LogWarn("Thumbnail command failed for %v: %v", input, err)
+		return ""
+	}
+
+	return thumbnailPath
+}
+
+// Probes a remote media file linked directly, proxied or not, to provide it with a thumbnail.
+func (server *Server) probeLinkedMedia(url string, parsedUrl *net_url.URL, referer string) string {
+	mediaType := getMediaType(path.Ext(parsedUrl.Path))
+	if mediaType != "video" && mediaType != "audio" {
+		return ""
+	}
+
+	size, err := getContentLength(url, referer)
+	if err != nil {
+		LogDebug("Failed to get content length of linked media %v: %v", url, err)
+		return ""
+	}
+
+	probe, err := probeMediaUrl(url, referer, size)
+	if err != nil {
+		LogDebug("Failed to probe linked media %v: %v", url, err)
+	}
+
+	return server.generateMediaThumbnail(probe, url, referer)
+}
+
+// Stores image data in the thumbnail cache and returns its path.
+func (server *Server) saveThumbnail(data []byte) (string, error) {
+	if len(data) > MAX_THUMBNAIL_SIZE {
+		return "", errors.New("image exceeds the thumbnail size limit")
+	}
+
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return "", errors.New("data is not an image")
+	}
+
+	thumbnailPath := thumbnailPathFor(string(data))
+
+	server.state.thumbnailLock.Lock()
+	defer server.state.thumbnailLock.Unlock()
+
+	if touchThumbnail(thumbnailPath) {
+		return thumbnailPath, nil
+	}
+
+	os.MkdirAll(MEDIA_THUMB, os.ModePerm)
+	if err := os.WriteFile(thumbnailPath, data, 0644); err != nil {
+		os.Remove(thumbnailPath)
+		return "", err
+	}
+
+	go server.evictThumbnails()
+	return thumbnailPath, nil
+}
+
+// Runs the thumbnail command with {input}, {output} and {referer} placeholders substituted in its arguments.
+func (server *Server) grabVideoFrame(key, input, referer string) (string, error) {
+	thumbnailPath := thumbnailPathFor(key)
+	if server.isThumbnailCached(thumbnailPath) {
+		return thumbnailPath, nil
+	}
+
+	workDir, err := createThumbnailWorkDir()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	// Most frame grabbers pick the output format from the file extension.
+	outputPath := workDir + "/frame.jpg"
+
+	command := server.config.ThumbnailCommand
+	replacer := strings.NewReplacer("{input}", input, "{output}", outputPath, "{referer}", referer)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), THUMBNAIL_COMMAND_TIMEOUT)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return "", errors.Join(err, errors.New(strings.TrimSpace(string(output))))
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size() == 0 || info.Size() > MAX_THUMBNAIL_SIZE {
+		return "", errors.New("thumbnail command produced an empty or oversized image")
+	}
+
+	if err := server.storeThumbnail(outputPath, thumbnailPath); err != nil {
+		return "", err
+	}
+
+	return thumbnailPath, nil
+}
+
+// Returns thumbnails used by the current entry, the playlist, the history and the entries that can still be restored by an undo.
+func (server *Server) referencedThumbnails() map[string]bool {
+	server.state.mutex.Lock()
+	defer server.state.mutex.Unlock()
+
+	referenced := make(map[string]bool)
+	referenced[server.state.entry.Thumbnail] = true
+
+	for _, entry := range server.state.playlist {
+		referenced[entry.Thumbnail] = true
+	}
+
+	for _, entry := range server.state.history {
+		referenced[entry.Thumbnail] = true
+	}
+
+	for _, action := range server.state.undoStack {
+		for _, entry := range action.Entries {
+			referenced[entry.Thumbnail] = true
+		}
+	}
+
+	return referenced
+}
+
+// Removes least recently used thumbnails until the cache fits in MAX_THUMBNAIL_CACHE_SIZE. Thumbnails referenced by
+// live entries are never removed, even if that keeps the cache above the limit.
+func (server *Server) evictThumbnails() {
+	// Referenced thumbnails are collected first, the state mutex must not be acquired while holding the thumbnail lock.
+	referenced := server.referencedThumbnails()
+
+	server.state.thumbnailLock.Lock()
+	defer server.state.thumbnailLock.Unlock()
+
+	dirEntries, err := os.ReadDir(MEDIA_THUMB)
+	if err != nil {
+		LogError("Thumbnail directory could not be read: %v", err)
+		return
+	}
+
+	files := make([]ThumbnailFile, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		file := ThumbnailFile{
+			path:       MEDIA_THUMB + dirEntry.Name(),
+			size:       info.Size(),
+			accessedAt: info.ModTime(),
+		}
+
+		files = append(files, file)
+	}
+
+	for _, thumbnailPath := range selectThumbnailEvictions(files, referenced, MAX_THUMBNAIL_CACHE_SIZE) {
+		if err := os.Remove(thumbnailPath); err != nil {
+			LogWarn("Failed to evict thumbnail %v: %v", thumbnailPath, err)
+		}
+	}
+}
+
+// Returns paths of unreferenced thumbnails to remove, least recently used first, so that the total size fits the limit.
+func selectThumbnailEvictions(files []ThumbnailFile, referenced map[string]bool, limit int64) []string {
+	total := int64(0)
+	for _, file := range files {
+		total += file.size
+	}
+
+	sorted := slices.Clone(files)
+	slices.SortFunc(sorted, func(a, b ThumbnailFile) int {
+		return a.accessedAt.Compare(b.accessedAt)
+	})
+
+	evicted := make([]string, 0)
+	for _, file := range sorted {
+		if total <= limit {
+			break
+		}
+
+		if referenced[file.path] {
+			continue
+		}
+
+		evicted = append(evicted, file.path)
+		total -= file.size
+	}
+
+	return evicted
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SNIFF_LENGTH = 512
+const MAX_UNIQUE_NAME_ATTEMPTS = 1000
+const MAX_RESUMABLE_UPLOADS_PER_USER = 4
+const RESUMABLE_UPLOAD_EXPIRY = 24 * time.Hour
+const UPLOAD_FORM_OVERHEAD = 64 * KB // multipart boundaries and headers surrounding the uploaded file
+
+// Media categories returned by getMediaType.
+var UPLOAD_CATEGORIES = []string{"video", "audio", "image", "subs", "other"}
+
+var errUploadTooLarge = errors.New("upload exceeds the size limit")
+var errUploadOffsetMismatch = errors.New("upload offset does not match the current offset")
+
+// A media file uploaded by a user, tracked to enforce per-user upload quotas.
+type UploadRecord struct {
+	Id     uint64 `json:"id"`
+	UserId uint64 `json:"user_id"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+
+	// Unix time in milliseconds.
+	CreatedAt int64 `json:"created_at"`
+}
+
+// Returns media categories the leading bytes of a file could belong to, based on well known magic numbers.
+// Containers which can hold either audio or video (for example MP4, Matroska and Ogg) report both categories.
+func sniffMediaCategories(head []byte) []string {
+	hasPrefix := func(offset int, magic string) bool {
+		return len(head) >= offset+len(magic) && string(head[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case hasPrefix(4, "ftyp"):
+		if hasPrefix(8, "M4A ") || hasPrefix(8, "M4B ") || hasPrefix(8, "M4P ") {
+			return []string{"audio"}
+		}
+		return []string{"video", "audio"}
+
+	case hasPrefix(0, "\x1A\x45\xDF\xA3"), hasPrefix(0, "OggS"), hasPrefix(0, "\x30\x26\xB2\x75\x8E\x66\xCF\x11"):
+		return []string{"video", "audio"}
+
+	case hasPrefix(0, "RIFF") && hasPrefix(8, "AVI "), hasPrefix(0, "FLV"), hasPrefix(0, "\x00\x00\x01\xBA"), hasPrefix(0, ".RMF"):
+		return []string{"video"}
+
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		// MPEG transport stream packets.
+		return []string{"video"}
+
+	case hasPrefix(0, "ID3"), hasPrefix(0, "fLaC"), hasPrefix(0, "RIFF") && hasPrefix(8, "WAVE"), hasPrefix(0, "FORM") && hasPrefix(8, "AIFF"),
+		hasPrefix(0, "MAC "), hasPrefix(0, "wvpk"), hasPrefix(0, "#!AMR"), isMpegAudioHeader(head):
+		return []string{"audio"}
+	}
+
+	contentType := http.DetectContentType(head)
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return []string{"image"}
+
+	case strings.HasPrefix(contentType, "text/xml") && bytes.Contains(head, []byte("<svg")):
+		return []string{"image"}
+
+	case strings.HasPrefix(contentType, "text/plain"):
+		return []string{"subs"}
+	}
+
+	return []string{}
+}
+
+// Verifies that the leading bytes of a file match the category derived from its extension. Files of the "other" category are not verified.
+func validateUploadContent(head []byte, category string) error {
+	if category == "other" {
+		return nil
+	}
+
+	sniffed := sniffMediaCategories(head)
+	if slices.Contains(sniffed, category) {
+		return nil
+	}
+
+	if len(sniffed) == 0 {
+		return fmt.Errorf("Content of the uploaded file was not recognized as %v", category)
+	}
+
+	return fmt.Errorf("Content of the uploaded file looks like %v, but its extension indicates %v", strings.Join(sniffed, " or "), category)
+}
+
+// Returns the size limit in bytes for a single upload of the given category, 0 when unlimited.
+func (server *Server) uploadCategoryLimit(category string) int64 {
+	return server.config.Uploads.CategoryLimitsMB[category] * MB
+}
+
+// Returns the size limit in bytes of an upload whose category is not known yet, 0 when unlimited. Considers the limit of
+// every category and the remaining budget of the user.
+func (server *Server) uploadBodyLimit(budget int64) int64 {
+	limit := int64(0)
+	for _, category := range UPLOAD_CATEGORIES {
+		categoryLimit := server.uploadCategoryLimit(category)
+		if categoryLimit == 0 {
+			limit = 0
+			break
+		}
+		limit = max(limit, categoryLimit)
+	}
+
+	if budget >= 0 && (limit == 0 || budget < limit) {
+		limit = budget
+	}
+	return limit
+}
+
+// Returns the number of bytes stored by the user. Expects the upload lock to be held.
+func (server *Server) uploadedByUser(userId uint64) int64 {
+	var total int64
+	for _, record := range server.state.uploads {
+		if record.UserId == userId {
+			total += record.Size
+		}
+	}
+
+	return total
+}
+
+// Returns the number of bytes reserved by unfinished resumable uploads of the user and of all users. Expects the upload
+// lock to be held.
+func (server *Server) reservedByUploads(userId uint64) (int64, int64) {
+	var reservedByUser, reserved int64
+	for _, upload := range server.state.resumableUploads {
+		if upload.userId == userId {
+			reservedByUser += upload.size
+		}
+		reserved += upload.size
+	}
+
+	return reservedByUser, reserved
+}
+
+// Returns the number of bytes the user is still allowed to upload, considering the per-user limit and the total media quota.
+// A negative value means there is no limit.
+func (server *Server) uploadBudget(userId uint64) int64 {
+	server.state.uploadLock.Lock()
+	defer server.state.uploadLock.Unlock()
+
+	return server.uploadBudgetLocked(userId)
+}
+
+// Same as uploadBudget, with the full size of unfinished resumable uploads counted as used. Expects the upload lock to be held.
+func (server *Server) uploadBudgetLocked(userId uint64) int64 {
+	budget := int64(-1)
+	config := server.config.Uploads
+	reservedByUser, reserved := server.reservedByUploads(userId)
+
+	if config.UserLimitMB > 0 {
+		budget = max(config.UserLimitMB*MB-server.uploadedByUser(userId)-reservedByUser, 0)
+	}
+
+	if config.MediaQuotaMB > 0 {
+		used, err := directorySize(CONTENT_MEDIA)
+		if err != nil && !os.IsNotExist(err) {
+			LogWarn("Failed to compute size of the media directory: %v", err)
+		}
+
+		// Partial files are already accounted for by the reservations of their uploads.
+		partial, _ := directorySize(MEDIA_PARTIAL)
+
+		remaining := max(config.MediaQuotaMB*MB-(used-partial)-reserved, 0)
+		if budget < 0 || remaining < budget {
+			budget = remaining
+		}
+	}
+
+	return budget
+}
+
+func (server *Server) recordUpload(userId uint64, filePath string, size int64) {
+	record := UploadRecord{
+		UserId:    userId,
+		Path:      filePath,
+		Size:      size,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	if err := DatabaseUploadAdd(server.db, &record); err != nil {
+		return
+	}
+
+	server.state.uploadLock.Lock()
+	server.state.uploads = append(server.state.uploads, record)
+	server.state.uploadLock.Unlock()
+}
+
+// Creates a new file in the directory without overwriting existing ones, appending a counter to the name on collision.
+func createUniqueFile(directory, filename string) (*os.File, string, error) {
+	extension := path.Ext(filename)
+	base := strings.TrimSuffix(filename, extension)
+
+	for i := range MAX_UNIQUE_NAME_ATTEMPTS {
+		candidate := filename
+		if i > 0 {
+			candidate = fmt.Sprintf("%v (%v)%v", base, i, extension)
+		}
+
+		outputPath, isSafe := safeJoin(directory, candidate)
+		if !isSafe {
+			return nil, "", fmt.Errorf("Filename %v is not allowed", candidate)
+		}
+
+		file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return file, candidate, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, "", err
+		}
+	}
+
+	return nil, "", fmt.Errorf("Failed to find a free name for %v", filename)
+}
+
+// Copies at most limit bytes (unlimited when negative), failing with errUploadTooLarge when the source is longer.
+func copyWithLimit(output io.Writer, input io.Reader, limit int64) (int64, error) {
+	if limit < 0 {
+		return io.Copy(output, input)
+	}
+
+	written, err := io.Copy(output, io.LimitReader(input, limit+1))
+	if err != nil {
+		return written, err
+	}
+
+	if written > limit {
+		return written, errUploadTooLarge
+	}
+
+	return written, nil
+}
+
+// Response for uploads completed either in a single request or through the resumable upload protocol.
+func (server *Server) createUploadResponse(outputPath, filename, directory string) MediaUploadResponse {
+	extension := path.Ext(filename)
+	trimmed := strings.TrimSuffix(filename, extension)
+	name := cleanupResourceName(trimmed)
+
+	response := MediaUploadResponse{
+		Url:      outputPath,
+		Name:     name,
+		Filename: filename,
+		Format:   extension,
+		Category: directory,
+	}
+
+	if directory == "video" || directory == "audio" {
+		probe, err := probeMediaFile(outputPath)
+		if err != nil {
+			LogWarn("Failed to probe uploaded media file %v: %v", outputPath, err)
+		} else {
+			probe.fillMetadata(&response.Metadata)
+		}
+	}
+
+	go server.libraryRescan()
+	return response
+}
+
+// Upload split into chunks sent with explicit offsets, which can be resumed after a dropped connection.
+// Follows the semantics of the tus protocol: init (creation), chunk (PATCH), offset (HEAD), finalize and abort (termination).
+type ResumableUpload struct {
+	mutex sync.Mutex
+
+	id       string
+	userId   uint64
+	filename string
+	category string
+	size     int64
+	offset   int64
+
+	// Expected hex encoded SHA-256 of the whole file, verified on finalize when provided.
+	checksum string
+
+	// Path of the partial file stored in MEDIA_PARTIAL.
+	path         string
+	lastActivity time.Time
+	closed       bool
+}
+
+type UploadInitRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+type UploadStatusResponse struct {
+	UploadId     string `json:"upload_id"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	MaxChunkSize int64  `json:"max_chunk_size"`
+}
+
+func (server *Server) uploadInit(data UploadInitRequest, userId uint64) (*ResumableUpload, error) {
+	filename := SanitizeUrlFileName(path.Base(data.Filename))
+	if filename == "" || filename == "." || filename == "/" {
+		return nil, fmt.Errorf("Filename of the upload is missing")
+	}
+
+	if data.Size <= 0 {
+		return nil, fmt.Errorf("Size of the upload must be greater than 0")
+	}
+
+	checksum := strings.ToLower(data.Checksum)
+	if checksum != "" {
+		decoded, err := hex.DecodeString(checksum)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("Checksum must be a hex encoded SHA-256 digest")
+		}
+	}
+
+	category := getMediaType(path.Ext(filename))
+	limit := server.uploadCategoryLimit(category)
+	if limit > 0 && data.Size > limit {
+		return nil, fmt.Errorf("%w: %v of size %vMB exceeds the %v limit of %vMB", errUploadTooLarge, filename, formatMegabytes(data.Size, 2), category, formatMegabytes(limit, 2))
+	}
+
+	// The budget is checked under the same lock the upload is registered with, so that concurrent uploads of the user
+	// can't all claim the same remaining quota.
+	server.state.uploadLock.Lock()
+	defer server.state.uploadLock.Unlock()
+
+	budget := server.uploadBudgetLocked(userId)
+	if budget >= 0 && data.Size > budget {
+		return nil, fmt.Errorf("%w: %v of size %vMB exceeds the remaining upload quota of %vMB", errUploadTooLarge, filename, formatMegabytes(data.Size, 2), formatMegabytes(budget, 2))
+	}
+
+	active := 0
+	for _, upload := range server.state.resumableUploads {
+		if upload.userId == userId {
+			active += 1
+		}
+	}
+
+	if active >= MAX_RESUMABLE_UPLOADS_PER_USER {
+		return nil, fmt.Errorf("Too many unfinished uploads, the limit is %v", MAX_RESUMABLE_UPLOADS_PER_USER)
+	}
+
+	if err := os.MkdirAll(MEDIA_PARTIAL, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	id := randomBase64(18)
+	partialPath := MEDIA_PARTIAL + id + ".part"
+
+	file, err := os.Create(partialPath)
+	if err != nil {
+		LogError("Failed to create partial upload file %v: %v", partialPath, err)
+		return nil, fmt.Errorf("Failed to create the upload file")
+	}
+	file.Close()
+
+	upload := &ResumableUpload{
+		id:           id,
+		userId:       userId,
+		filename:     filename,
+		category:     category,
+		size:         data.Size,
+		checksum:     checksum,
+		path:         partialPath,
+		lastActivity: time.Now(),
+	}
+
+	server.state.resumableUploads[id] = upload
+	LogInfo("User id:%v started resumable upload %v of %v (%vMB).", userId, id, filename, formatMegabytes(data.Size, 2))
+	return upload, nil
+}
+
+// Finds a resumable upload owned by the user, responding with an error when it is missing or owned by someone else.
+func (server *Server) findResumableUpload(w http.ResponseWriter, id string, userId uint64) *ResumableUpload {
+	server.state.uploadLock.Lock()
+	upload, exists := server.state.resumableUploads[id]
+	server.state.uploadLock.Unlock()
+
+	if !exists {
+		LogWarn("Resumable upload %v does not exist", id)
+		http.Error(w, "Upload does not exist or has expired", http.StatusNotFound)
+		return nil
+	}
+
+	if upload.userId != userId {
+		LogWarn("User id:%v attempted to access upload %v owned by user id:%v", userId, id, upload.userId)
+		http.Error(w, "You're not the owner of this upload", http.StatusUnauthorized)
+		return nil
+	}
+
+	return upload
+}
+
+func (upload *ResumableUpload) status() UploadStatusResponse {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	return UploadStatusResponse{
+		UploadId:     upload.id,
+		Offset:       upload.offset,
+		Size:         upload.size,
+		MaxChunkSize: MAX_CHUNK_SIZE,
+	}
+}
+
+// Appends a chunk at the given offset, which must match the current offset of the upload. Returns the new offset.
+// Bytes received before a dropped connection are kept, so the client can resume from the offset reported afterwards.
+func (upload *ResumableUpload) writeChunk(body io.Reader, offset int64) (int64, error) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	if upload.closed {
+		return upload.offset, fmt.Errorf("Upload is no longer active")
+	}
+
+	if offset != upload.offset {
+		return upload.offset, errUploadOffsetMismatch
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return upload.offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return upload.offset, err
+	}
+
+	written, err := copyWithLimit(file, body, upload.size-offset)
+	upload.lastActivity = time.Now()
+
+	if errors.Is(err, errUploadTooLarge) {
+		file.Truncate(upload.offset)
+		return upload.offset, fmt.Errorf("Chunk exceeds the declared size of the upload")
+	}
+
+	upload.offset += written
+	return upload.offset, err
+}
+
+func (server *Server) uploadFinalize(upload *ResumableUpload) (MediaUploadResponse, error) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	if upload.closed {
+		return MediaUploadResponse{}, fmt.Errorf("Upload is no longer active")
+	}
+
+	if upload.offset != upload.size {
+		return MediaUploadResponse{}, fmt.Errorf("Upload is incomplete, received %v out of %v bytes", upload.offset, upload.size)
+	}
+
+	if upload.checksum != "" {
+		checksum, err := fileSha256(upload.path)
+		if err != nil {
+			return MediaUploadResponse{}, err
+		}
+
+		if checksum != upload.checksum {
+			upload.closed = true
+			server.removeResumableUpload(upload)
+			return MediaUploadResponse{}, fmt.Errorf("Checksum mismatch, expected %v but the uploaded file has %v", upload.checksum, checksum)
+		}
+	}
+
+	head, err := readFileHead(upload.path, SNIFF_LENGTH)
+	if err != nil {
+		return MediaUploadResponse{}, err
+	}
+
+	if err := validateUploadContent(head, upload.category); err != nil {
+		upload.closed = true
+		server.removeResumableUpload(upload)
+		return MediaUploadResponse{}, err
+	}
+
+	directory := CONTENT_MEDIA + upload.category
+	os.MkdirAll(directory, os.ModePerm)
+
+	placeholder, filename, err := createUniqueFile(directory, upload.filename)
+	if err != nil {
+		return MediaUploadResponse{}, err
+	}
+	outputPath := placeholder.Name()
+	placeholder.Close()
+
+	if err := os.Rename(upload.path, outputPath); err != nil {
+		os.Remove(outputPath)
+		LogError("Failed to move finished upload %v to %v: %v", upload.id, outputPath, err)
+		return MediaUploadResponse{}, fmt.Errorf("Failed to store the uploaded file")
+	}
+
+	// The upload is recorded before its reservation is released, so that the quota never appears free in between.
+	upload.closed = true
+	server.recordUpload(upload.userId, outputPath, upload.size)
+	server.removeResumableUpload(upload)
+
+	LogInfo("Resumable upload %v finished and was saved to: %v.", upload.id, outputPath)
+	return server.createUploadResponse(outputPath, filename, upload.category), nil
+}
+
+// Unregisters the upload and deletes its partial file, if it still exists.
+func (server *Server) removeResumableUpload(upload *ResumableUpload) {
+	server.state.uploadLock.Lock()
+	delete(server.state.resumableUploads, upload.id)
+	server.state.uploadLock.Unlock()
+
+	os.Remove(upload.path)
+}
+
+func (server *Server) cleanupStaleUploads() {
+	server.state.uploadLock.Lock()
+	uploads := make([]*ResumableUpload, 0, len(server.state.resumableUploads))
+	for _, upload := range server.state.resumableUploads {
+		uploads = append(uploads, upload)
+	}
+	server.state.uploadLock.Unlock()
+
+	for _, upload := range uploads {
+		upload.mutex.Lock()
+		stale := !upload.closed && time.Since(upload.lastActivity) > RESUMABLE_UPLOAD_EXPIRY
+		if stale {
+			upload.closed = true
+		}
+		upload.mutex.Unlock()
+
+		if stale {
+			LogInfo("Removing resumable upload %v of user id:%v due to inactivity.", upload.id, upload.userId)
+			server.removeResumableUpload(upload)
+		}
+	}
+}
+
+func fileSha256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readFileHead(filePath string, length int) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, length)
+	read, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return head[:read], nil
+}
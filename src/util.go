@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -561,6 +562,8 @@ type DownloadOptions struct {
 	bodyLimit int64
 	referer   string
 	hasty     bool
+	byteRange *Range          // [optional] downloads only the range of the resource
+	ctx       context.Context // [optional] cancels the download, including reading of the body
 }
 
 const DEFAULT_BODY_LIMIT = 32 * GB
@@ -573,6 +576,28 @@ func NewDefaultDownloadOptions() DownloadOptions {
 }
 
 func downloadFile(url string, path string, options *DownloadOptions) error {
+	response, body, err := openDownload(url, options)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, body)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// openDownload sends the request and checks the response status. Returns the response, which must be closed by the
+// caller, and its body limited to the requested byte range and body limit.
+func openDownload(url string, options *DownloadOptions) (*http.Response, io.Reader, error) {
 	if options == nil {
 		defaults := NewDefaultDownloadOptions()
 		options = &defaults
@@ -580,13 +605,20 @@ func downloadFile(url string, path string, options *DownloadOptions) error {
 	if options.bodyLimit <= 0 {
 		options.bodyLimit = DEFAULT_BODY_LIMIT
 	}
+	ctx := options.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	request, _ := http.NewRequest(options.method, url, nil)
+	request, _ := http.NewRequestWithContext(ctx, options.method, url, nil)
 	request.Header.Set("User-Agent", userAgent)
 	if options.referer != "" {
 		request.Header.Set("Referer", options.referer)
 		request.Header.Set("Origin", inferOrigin(options.referer))
 	}
+	if options.byteRange != nil {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", options.byteRange.start, options.byteRange.end))
+	}
 
 	client := defaultClient
 	if options.hasty {
@@ -594,38 +626,39 @@ func downloadFile(url string, path string, options *DownloadOptions) error {
 	}
 	response, err := client.Do(request)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer response.Body.Close()
 
-	if response.ContentLength > options.bodyLimit {
-		return fmt.Errorf("file is too large")
+	body := io.Reader(response.Body)
+	if options.byteRange != nil {
+		// Servers ignoring the Range header respond with the whole resource
+		if response.StatusCode == 200 {
+			if _, err := io.CopyN(io.Discard, body, options.byteRange.start); err != nil {
+				response.Body.Close()
+				return nil, nil, err
+			}
+		}
+		body = io.LimitReader(body, options.byteRange.length())
+	} else if response.ContentLength > options.bodyLimit {
+		response.Body.Close()
+		return nil, nil, fmt.Errorf("file is too large")
 	}
-	limitedBody := io.LimitReader(response.Body, options.bodyLimit)
+	limitedBody := io.LimitReader(body, options.bodyLimit)
 
 	if response.StatusCode != 200 && response.StatusCode != 206 {
+		defer response.Body.Close()
 		errBody, err := io.ReadAll(limitedBody)
 		var bodyError = ""
 		if err == nil {
 			bodyError = string(errBody)
 		}
-		return &DownloadError{
+		return nil, nil, &DownloadError{
 			Code:    response.StatusCode,
 			Message: "Failed to download file. " + bodyError,
 		}
 	}
 
-	out, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, limitedBody)
-	if err != nil {
-		return err
-	}
-	return nil
+	return response, limitedBody, nil
 }
 
 func pathExists(aPath string) bool {
@@ -1023,6 +1056,12 @@ func respondInternalError(writer http.ResponseWriter, format string, args ...any
 	http.Error(writer, output, http.StatusInternalServerError)
 }
 
+func respondTooLarge(writer http.ResponseWriter, format string, args ...any) {
+	output := fmt.Sprintf(format, args...)
+	LogWarnUp(1, "%v", output)
+	http.Error(writer, output, http.StatusRequestEntityTooLarge)
+}
+
 func respondTooManyRequests(writer http.ResponseWriter, ip string, retryAfter int) {
 	output := fmt.Sprintf("Too many requests triggered by %v, retry-after: %v", ip, retryAfter)
 	LogWarnUp(1, "%v", output)
@@ -1827,6 +1866,19 @@ func WalkFiles(root string, fn func(filePath string, entry os.DirEntry)) error {
 	return nil
 }
 
+// Returns the total size of all files under the directory.
+func directorySize(root string) (int64, error) {
+	var total int64
+	err := WalkFiles(root, func(filePath string, entry os.DirEntry) {
+		info, err := entry.Info()
+		if err == nil {
+			total += info.Size()
+		}
+	})
+
+	return total, err
+}
+
 func SanitizeUrlFileName(name string) string {
 	replacer := strings.NewReplacer("#", "", "?", "")
 	return replacer.Replace(name)
@@ -2,9 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
 	"net"
+	"os"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -885,3 +895,1115 @@ func TestSpeedTest(t *testing.T) {
 		t.Errorf("The speed should be %v but actual is %v", expected, speed)
 	}
 }
+
+func TestRestoreEntryOrder(t *testing.T) {
+	entries := []Entry{{Id: 3}, {Id: 1}, {Id: 4}, {Id: 2}}
+	order := []uint64{1, 2, 5, 3}
+
+	restored := restoreEntryOrder(entries, order)
+	actual := getEntryIds(restored)
+	expected := []uint64{1, 2, 3, 4}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("Restored order should be %v but actual is %v", expected, actual)
+	}
+}
+
+func TestGetNeighbourIds(t *testing.T) {
+	entries := []Entry{{Id: 7}, {Id: 8}, {Id: 9}}
+
+	cases := []struct{ index, prev, next int }{{0, 0, 8}, {1, 7, 9}, {2, 8, 0}}
+	for _, c := range cases {
+		prevId, nextId := getNeighbourIds(entries, c.index)
+		if prevId != uint64(c.prev) || nextId != uint64(c.next) {
+			t.Errorf("Neighbours of index %v should be (%v, %v) but actual are (%v, %v)", c.index, c.prev, c.next, prevId, nextId)
+		}
+	}
+}
+
+func TestMergeWebVttSegments(t *testing.T) {
+	segments := [][]byte{
+		[]byte("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:03.500 align:start\nFirst\n"),
+		[]byte("WEBVTT\nX-TIMESTAMP-MAP=LOCAL:00:00:00.000,MPEGTS:1440000\n\n00:00:00.000 --> 00:00:02.000\nSecond\n"),
+		[]byte("WEBVTT\n\n00:01:00.000 --> 00:01:01.000\nUnmapped\n"),
+	}
+
+	// Video starts 1 second after the MPEG-TS timestamp mapped by the first segment.
+	merged := string(mergeWebVttSegments(segments, 990000))
+	expected := "WEBVTT\n\n00:00.000 --> 00:02.500 align:start\nFirst\n\n00:05.000 --> 00:07.000\nSecond\n\n00:01:00.000 --> 00:01:01.000\nUnmapped\n\n"
+	if merged != expected {
+		t.Errorf("Expected cues moved to the media timeline:\n%q\nactual:\n%q", expected, merged)
+	}
+
+	// Without the start of the video, the timeline starts at the first mapped timestamp.
+	merged = string(mergeWebVttSegments(segments[:2], -1))
+	if !strings.Contains(merged, "00:00:01.000 --> 00:00:03.500") || !strings.Contains(merged, "00:06.000 --> 00:08.000") {
+		t.Errorf("Expected cues relative to the first segment, actual:\n%v", merged)
+	}
+}
+
+func TestCountdownMark(t *testing.T) {
+	if _, inCountdown := countdownMark(SCHEDULE_COUNTDOWN_PERIOD + time.Second); inCountdown {
+		t.Errorf("Countdown should not start before the countdown period")
+	}
+
+	// Checks of a drifting scheduler, a mark is broadcast whenever it differs from the previous one.
+	checks := []time.Duration{
+		31*time.Second + 100*time.Millisecond, 29*time.Second + 900*time.Millisecond, 28*time.Second + 900*time.Millisecond,
+		10*time.Second + 50*time.Millisecond, 9*time.Second + 20*time.Millisecond, 8*time.Second + 990*time.Millisecond,
+	}
+
+	broadcast := make([]int64, 0)
+	last := int64(-1)
+	for _, remaining := range checks {
+		mark, inCountdown := countdownMark(remaining)
+		if inCountdown && mark != last {
+			broadcast = append(broadcast, mark)
+		}
+		last = mark
+	}
+
+	expected := []int64{40, 30, 20, 10, 9}
+	if !slices.Equal(broadcast, expected) {
+		t.Errorf("Expected countdown marks %v to be broadcast, actual %v", expected, broadcast)
+	}
+}
+
+func TestCreateLibraryRoots(t *testing.T) {
+	library := createLibrary([]string{"content/shows", "content/shows/", "../movies", "/mnt/movies", "videos", "content"})
+	expected := []string{CONTENT_MEDIA, "content/shows", "content"}
+	if !slices.Equal(library.roots, expected) {
+		t.Errorf("Expected library roots %v, actual %v", expected, library.roots)
+	}
+}
+
+func TestLibraryFilterAndPaginate(t *testing.T) {
+	files := []LibraryFile{
+		{Path: "content/media/audio/Some Song.mp3", Type: "audio"},
+		{Path: "content/media/video/movie part 1.mp4", Type: "video"},
+		{Path: "content/media/video/Movie Part 2.mkv", Type: "video"},
+		{Path: "content/media/subs/movie.vtt", Type: "subs"},
+	}
+
+	filtered := filterLibraryFiles(files, "MOVIE part", "video")
+	if len(filtered) != 2 {
+		t.Fatalf("Expected 2 matching files but got %v", len(filtered))
+	}
+
+	page := paginateLibraryFiles(filtered, 1, 10)
+	if page.Total != 2 || len(page.Files) != 1 || page.Files[0].Path != files[2].Path {
+		t.Errorf("Unexpected page contents: %+v", page)
+	}
+
+	page = paginateLibraryFiles(files, 10, 0)
+	if page.Total != 4 || len(page.Files) != 0 {
+		t.Errorf("Page past the end should be empty but got %+v", page)
+	}
+}
+
+func TestProbeFlac(t *testing.T) {
+	var data bytes.Buffer
+	data.WriteString("fLaC")
+
+	// STREAMINFO: 44100 Hz, 2 channels, 16 bits per sample, 441000 samples (10 seconds).
+	streamInfo := make([]byte, 34)
+	binary.BigEndian.PutUint32(streamInfo[10:], 44100<<12|1<<9|15<<4)
+	binary.BigEndian.PutUint32(streamInfo[14:], 441000)
+	data.Write([]byte{FLAC_BLOCK_STREAMINFO, 0, 0, 34})
+	data.Write(streamInfo)
+
+	var comments bytes.Buffer
+	binary.Write(&comments, binary.LittleEndian, uint32(0))
+	binary.Write(&comments, binary.LittleEndian, uint32(2))
+	for _, comment := range []string{"ARTIST=Someone", "TRACKNUMBER=3/12"} {
+		binary.Write(&comments, binary.LittleEndian, uint32(len(comment)))
+		comments.WriteString(comment)
+	}
+	data.Write([]byte{0x80 | FLAC_BLOCK_VORBIS_COMMENT, 0, 0, byte(comments.Len())})
+	data.Write(comments.Bytes())
+	data.Write(make([]byte, 1000))
+
+	probe, err := probeMedia(bytes.NewReader(data.Bytes()), int64(data.Len()))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+
+	if probe.Container != "flac" || probe.Duration != 10 || probe.Bitrate != 800 {
+		t.Errorf("Unexpected probe result: %+v", probe)
+	}
+
+	var metadata Metadata
+	probe.fillMetadata(&metadata)
+	if metadata.ArtistName != "Someone" || metadata.TrackNumber != 3 || metadata.Duration != 10 {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+}
+
+func makeMp4Box(kind string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], kind)
+	return append(box, body...)
+}
+
+func TestProbeMp4(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 90500)
+
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], "soun")
+
+	mdhd := make([]byte, 24)
+	// "eng" packed as three 5-bit characters.
+	binary.BigEndian.PutUint16(mdhd[20:], ('e'-0x60)<<10|('n'-0x60)<<5|('g'-0x60))
+
+	stsd := make([]byte, 16)
+	copy(stsd[12:], "mp4a")
+
+	stbl := makeMp4Box("stbl", makeMp4Box("stsd", stsd))
+	mdia := makeMp4Box("mdia", makeMp4Box("hdlr", hdlr), makeMp4Box("mdhd", mdhd), makeMp4Box("minf", stbl))
+	title := makeMp4Box("\xa9nam", makeMp4Box("data", make([]byte, 8), []byte("Some title")))
+	meta := makeMp4Box("meta", make([]byte, 4), makeMp4Box("ilst", title))
+	moov := makeMp4Box("moov", makeMp4Box("mvhd", mvhd), makeMp4Box("trak", mdia), makeMp4Box("udta", meta))
+
+	file := bytes.Join([][]byte{makeMp4Box("ftyp", []byte("isom")), makeMp4Box("mdat", make([]byte, 5000)), moov}, nil)
+
+	probe, err := probeMedia(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+
+	if probe.Duration != 90.5 || probe.Tags["title"] != "Some title" {
+		t.Errorf("Unexpected probe result: %+v", probe)
+	}
+
+	expected := MediaTrack{Kind: "audio", Codec: "aac", Language: "eng"}
+	if len(probe.Tracks) != 1 || probe.Tracks[0] != expected {
+		t.Errorf("Expected tracks [%+v] but got %+v", expected, probe.Tracks)
+	}
+}
+
+func TestProbeMp3(t *testing.T) {
+	// MPEG 1 Layer III, 128 kbps, 44100 Hz, stereo.
+	header := []byte{0xFF, 0xFB, 0x90, 0x00}
+	frameSize := 144 * 128000 / 44100
+
+	var data bytes.Buffer
+	for range 100 {
+		data.Write(header)
+		data.Write(make([]byte, frameSize-4))
+	}
+
+	probe, err := probeMedia(bytes.NewReader(data.Bytes()), int64(data.Len()))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+
+	expected := float64(data.Len()*8) / 128000
+	if probe.Container != "mp3" || probe.Duration != expected || probe.Tracks[0].Codec != "mp3" {
+		t.Errorf("Unexpected probe result: %+v", probe)
+	}
+}
+
+func TestParseId3v2Picture(t *testing.T) {
+	makeFrame := func(pictureType byte, data string) []byte {
+		payload := []byte{0}
+		payload = append(payload, "image/png\x00"...)
+		payload = append(payload, pictureType)
+		payload = append(payload, "description\x00"...)
+		payload = append(payload, data...)
+
+		header := make([]byte, 10)
+		copy(header, "APIC")
+		binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+		return append(header, payload...)
+	}
+
+	tag := append(makeFrame(0, "other"), makeFrame(ID3_PICTURE_FRONT_COVER, "front")...)
+	cover := parseId3v2Picture(tag, 3)
+	if string(cover) != "front" {
+		t.Errorf("Expected the front cover to be preferred but got %q", cover)
+	}
+
+	cover = parseId3v2Picture(makeFrame(0, "other"), 3)
+	if string(cover) != "other" {
+		t.Errorf("Expected the only picture to be used but got %q", cover)
+	}
+}
+
+func TestValidateUploadContent(t *testing.T) {
+	mp4 := append([]byte{0, 0, 0, 20}, []byte("ftypisom")...)
+	flac := []byte("fLaC\x00\x00\x00\x22")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	subs := []byte("1\n00:00:01,000 --> 00:00:02,000\nHello\n")
+
+	cases := []struct {
+		head     []byte
+		category string
+		valid    bool
+	}{
+		{mp4, "video", true},
+		{mp4, "audio", true},
+		{flac, "audio", true},
+		{flac, "video", false},
+		{png, "image", true},
+		{png, "video", false},
+		{subs, "subs", true},
+		{subs, "audio", false},
+		{png, "other", true},
+	}
+
+	for i, c := range cases {
+		err := validateUploadContent(c.head, c.category)
+		if (err == nil) != c.valid {
+			t.Errorf("Case %v: expected valid=%v for category %v, got error: %v", i, c.valid, c.category, err)
+		}
+	}
+}
+
+func TestCreateUniqueFile(t *testing.T) {
+	directory := t.TempDir()
+
+	expected := []string{"clip.mp4", "clip (1).mp4", "clip (2).mp4"}
+	for _, name := range expected {
+		file, actual, err := createUniqueFile(directory, "clip.mp4")
+		if err != nil {
+			t.Fatalf("Failed to create unique file: %v", err)
+		}
+		file.Close()
+
+		if actual != name {
+			t.Errorf("Expected file name %v but got %v", name, actual)
+		}
+	}
+}
+
+func TestCopyWithLimit(t *testing.T) {
+	var output bytes.Buffer
+	_, err := copyWithLimit(&output, strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Errorf("Copy within the limit should succeed but failed with: %v", err)
+	}
+
+	_, err = copyWithLimit(&output, strings.NewReader("0123456789"), 9)
+	if !errors.Is(err, errUploadTooLarge) {
+		t.Errorf("Copy exceeding the limit should fail with errUploadTooLarge but got: %v", err)
+	}
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	server := &Server{}
+	server.config.Uploads.CategoryLimitsMB = map[string]int64{"video": 64, "audio": 8, "image": 2, "subs": 1, "other": 4}
+
+	if limit := server.uploadBodyLimit(-1); limit != 64*MB {
+		t.Errorf("Expected the largest category limit, actual %v", limit)
+	}
+	if limit := server.uploadBodyLimit(3 * MB); limit != 3*MB {
+		t.Errorf("Expected the remaining budget to bound the limit, actual %v", limit)
+	}
+
+	delete(server.config.Uploads.CategoryLimitsMB, "other")
+	if limit := server.uploadBodyLimit(-1); limit != 0 {
+		t.Errorf("Expected no limit when a category is unlimited, actual %v", limit)
+	}
+}
+
+func TestUploadBudgetReservations(t *testing.T) {
+	server := &Server{}
+	server.config.Uploads.UserLimitMB = 10
+	server.state.uploads = []UploadRecord{{UserId: 1, Size: 2 * MB}}
+	server.state.resumableUploads = map[string]*ResumableUpload{
+		"a": {userId: 1, size: 3 * MB},
+		"b": {userId: 1, size: 3 * MB},
+		"c": {userId: 2, size: 5 * MB},
+	}
+
+	if budget := server.uploadBudget(1); budget != 2*MB {
+		t.Errorf("Expected unfinished uploads of the user to be reserved, actual budget %v", budget)
+	}
+
+	_, err := server.uploadInit(UploadInitRequest{Filename: "video.mp4", Size: 3 * MB}, 1)
+	if !errors.Is(err, errUploadTooLarge) {
+		t.Errorf("Upload exceeding the budget left by unfinished uploads should be rejected, got: %v", err)
+	}
+}
+
+func TestResumableUploadWriteChunk(t *testing.T) {
+	upload := &ResumableUpload{
+		id:   "test",
+		size: 10,
+		path: t.TempDir() + "/upload.part",
+	}
+
+	file, err := os.Create(upload.path)
+	if err != nil {
+		t.Fatalf("Failed to create partial file: %v", err)
+	}
+	file.Close()
+
+	offset, err := upload.writeChunk(strings.NewReader("01234"), 0)
+	if err != nil || offset != 5 {
+		t.Fatalf("First chunk should end at offset 5, got %v (err: %v)", offset, err)
+	}
+
+	offset, err = upload.writeChunk(strings.NewReader("56789"), 3)
+	if !errors.Is(err, errUploadOffsetMismatch) || offset != 5 {
+		t.Errorf("Chunk with a stale offset should be rejected, got offset %v (err: %v)", offset, err)
+	}
+
+	offset, err = upload.writeChunk(strings.NewReader("567890"), 5)
+	if err == nil || offset != 5 {
+		t.Errorf("Chunk exceeding the declared size should be rejected, got offset %v (err: %v)", offset, err)
+	}
+
+	offset, err = upload.writeChunk(strings.NewReader("56789"), 5)
+	if err != nil || offset != 10 {
+		t.Errorf("Last chunk should end at offset 10, got %v (err: %v)", offset, err)
+	}
+
+	content, _ := os.ReadFile(upload.path)
+	if string(content) != "0123456789" {
+		t.Errorf("Unexpected upload content: %q", content)
+	}
+}
+
+func TestValidateMediaPathRejectsUnmanagedPaths(t *testing.T) {
+	paths := []string{
+		"content/media/../../server.go",
+		"content/proxy/video.mp4",
+		"content/media/thumb/cover.jpg",
+		"content/media/partial/upload.part",
+		"content/media/does-not-exist.mp4",
+	}
+
+	for _, mediaPath := range paths {
+		if _, err := validateMediaPath(mediaPath); err == nil {
+			t.Errorf("Path %v should be rejected", mediaPath)
+		}
+	}
+}
+
+func TestMediaEntriesWithEscapedUrls(t *testing.T) {
+	server := &Server{}
+	server.config.Uploads.AnyoneCanManage = true
+
+	mediaPath := CONTENT_MEDIA + "video/clip (1).mp4"
+	url, err := server.relativizeUrl(mediaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url == mediaPath {
+		t.Fatalf("Expected the entry URL to be escaped, actual %v", url)
+	}
+
+	server.state.playlist = []Entry{{Id: 1, Url: url}, {Id: 2, Url: CONTENT_MEDIA + "video/other.mp4"}}
+	server.state.history = []Entry{{Id: 3, Url: url}}
+
+	if ids := server.findEntriesWithUrl(mediaPath); !slices.Equal(ids, []uint64{1, 3}) {
+		t.Errorf("Expected entries [1 3] to point at %v, actual %v", mediaPath, ids)
+	}
+
+	server.state.entry = Entry{Id: 4, Url: url}
+	if _, _, err := server.checkMediaModifiable(mediaPath, 1); err == nil {
+		t.Errorf("Expected the playing media file to be unmodifiable")
+	}
+
+	if restored := entryMediaPath(mediaPathToUrl(mediaPath)); restored != mediaPath {
+		t.Errorf("Expected the escaped URL to point at %v, actual %v", mediaPath, restored)
+	}
+}
+
+func TestAssignThumbnail(t *testing.T) {
+	server := &Server{conns: &Connections{}}
+	url := CONTENT_MEDIA + "audio/song.mp3"
+	server.state.playlist = []Entry{{Id: 1, Url: url}, {Id: 2, Url: url, Thumbnail: "custom.jpg"}, {Id: 3, Url: "other.mp3"}}
+	server.state.history = []Entry{{Id: 4, Url: url}}
+	server.state.entry = Entry{Id: 5, Url: url}
+
+	server.assignThumbnail(url, MEDIA_THUMB+"cover")
+
+	thumbnails := []string{
+		server.state.playlist[0].Thumbnail,
+		server.state.playlist[1].Thumbnail,
+		server.state.playlist[2].Thumbnail,
+		server.state.history[0].Thumbnail,
+		server.state.entry.Thumbnail,
+	}
+	expected := []string{MEDIA_THUMB + "cover", "custom.jpg", "", MEDIA_THUMB + "cover", MEDIA_THUMB + "cover"}
+	if !slices.Equal(thumbnails, expected) {
+		t.Errorf("Expected thumbnails %v, actual %v", expected, thumbnails)
+	}
+}
+
+func TestSelectThumbnailEvictions(t *testing.T) {
+	now := time.Now()
+	files := []ThumbnailFile{
+		{path: "newest", size: 10, accessedAt: now},
+		{path: "oldest", size: 10, accessedAt: now.Add(-3 * time.Hour)},
+		{path: "referenced", size: 10, accessedAt: now.Add(-2 * time.Hour)},
+		{path: "older", size: 10, accessedAt: now.Add(-time.Hour)},
+	}
+
+	referenced := map[string]bool{"referenced": true}
+
+	evicted := selectThumbnailEvictions(files, referenced, 20)
+	if !slices.Equal(evicted, []string{"oldest", "older"}) {
+		t.Errorf("Expected oldest unreferenced thumbnails to be evicted but got %v", evicted)
+	}
+
+	evicted = selectThumbnailEvictions(files, referenced, 40)
+	if len(evicted) != 0 {
+		t.Errorf("Nothing should be evicted within the limit but got %v", evicted)
+	}
+
+	evicted = selectThumbnailEvictions(files, referenced, 0)
+	if slices.Contains(evicted, "referenced") || len(evicted) != 3 {
+		t.Errorf("Referenced thumbnails must never be evicted, got %v", evicted)
+	}
+}
+
+func TestProcessAvatar(t *testing.T) {
+	encodePng := func(width, height int) []byte {
+		var output bytes.Buffer
+		png.Encode(&output, image.NewGray(image.Rect(0, 0, width, height)))
+		return output.Bytes()
+	}
+
+	encoded, err := processAvatar(encodePng(300, 200))
+	if err != nil {
+		t.Fatalf("Processing a valid avatar failed: %v", err)
+	}
+
+	expected := map[int]int{256: 200, 64: 64}
+	for size, side := range expected {
+		config, err := png.DecodeConfig(bytes.NewReader(encoded.sizes[size]))
+		if err != nil || config.Width != side || config.Height != side {
+			t.Errorf("Avatar of size %v should be %vx%v but got %vx%v (err: %v)", size, side, side, config.Width, config.Height, err)
+		}
+	}
+
+	if _, err := processAvatar(encodePng(MAX_AVATAR_DIMENSION+1, 1)); err == nil {
+		t.Errorf("Avatar exceeding the maximum dimension should be rejected")
+	}
+
+	avif := []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00")
+	if _, err := processAvatar(avif); !errors.Is(err, errAvatarAvif) {
+		t.Errorf("AVIF avatar should be rejected with errAvatarAvif but got: %v", err)
+	}
+
+	// Lossless WebP header of a 300x200 image.
+	webp := []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x2b\xc1\x31\x00\x00\x00\x00\x00\x00")
+	encoded, err = processAvatar(webp)
+	if err != nil || encoded.extension != "webp" || !bytes.Equal(encoded.sizes[64], webp) {
+		t.Errorf("WebP avatar should be stored unchanged but got extension %q (err: %v)", encoded.extension, err)
+	}
+
+	palette := color.Palette{color.Black, color.White}
+	anim := gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 120, 80), palette),
+			image.NewPaletted(image.Rect(10, 10, 40, 40), palette),
+		},
+		Delay:    []int{10, 20},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground},
+	}
+
+	var animated bytes.Buffer
+	gif.EncodeAll(&animated, &anim)
+
+	encoded, err = processAvatar(animated.Bytes())
+	if err != nil || encoded.extension != "gif" {
+		t.Fatalf("Processing an animated avatar failed with extension %q (err: %v)", encoded.extension, err)
+	}
+
+	decoded, err := gif.DecodeAll(bytes.NewReader(encoded.sizes[64]))
+	if err != nil || len(decoded.Image) != 2 || decoded.Config.Width != 64 || decoded.Config.Height != 64 || !slices.Equal(decoded.Delay, []int{10, 20}) {
+		t.Errorf("Animated avatar should keep its 2 frames at 64x64 (err: %v)", err)
+	}
+}
+
+func TestChunksToPrefetch(t *testing.T) {
+	proxy := HlsProxy{
+		chunkLocks:    make([]sync.Mutex, 5),
+		fetchedChunks: []bool{true, false, true, false, false},
+		chunkStarts:   []float64{0, 4, 8, 12, 16},
+	}
+
+	pending := proxy.chunksToPrefetch(5, 10)
+	if !slices.Equal(pending, []int{1, 3}) {
+		t.Errorf("Expected chunks [1 3] to be prefetched, actual %v", pending)
+	}
+
+	pending = proxy.chunksToPrefetch(16, 30)
+	if !slices.Equal(pending, []int{4}) {
+		t.Errorf("Expected only the last chunk to be prefetched, actual %v", pending)
+	}
+
+	proxy.chunkLocks[1].Lock()
+	pending = proxy.chunksToPrefetch(0, 8)
+	proxy.chunkLocks[1].Unlock()
+	if len(pending) != 0 {
+		t.Errorf("Chunks being fetched should be skipped, actual %v", pending)
+	}
+}
+
+func TestSelectChunkEvictions(t *testing.T) {
+	chunks := make([]CachedChunk, 0)
+	for id := range 30 {
+		start := float64(id * 10)
+		chunk := CachedChunk{id: id, start: start, end: start + 10, size: 100}
+		chunks = append(chunks, chunk)
+	}
+
+	// Playhead at 150s keeps chunks overlapping 120s-180s
+	evicted := selectChunkEvictions(chunks, 150, 30, 250)
+	ids := make([]int, 0, len(evicted))
+	for _, chunk := range evicted {
+		ids = append(ids, chunk.id)
+	}
+	if !slices.Equal(ids, []int{0, 1, 2}) {
+		t.Errorf("Expected chunks furthest behind the playhead to be evicted first, actual %v", ids)
+	}
+
+	evicted = selectChunkEvictions(chunks, 150, 30, 100*30)
+	ids = ids[:0]
+	for _, chunk := range evicted {
+		ids = append(ids, chunk.id)
+	}
+	expected := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18}
+	if !slices.Equal(ids, expected) {
+		t.Errorf("Expected chunks near the playhead to be kept, actual %v", ids)
+	}
+}
+
+func TestHlsCacheSkipsPinnedChunks(t *testing.T) {
+	proxy := &HlsProxy{
+		chunkLocks:    make([]sync.Mutex, 2),
+		fetchedChunks: []bool{true, true},
+		chunkStarts:   []float64{0, 10},
+		chunkSizes:    []int64{100, 100},
+		chunkPins:     make([]atomic.Int32, 2),
+		duration:      20,
+	}
+	cache := &HlsCache{
+		limit:    0,
+		proxies:  map[string]*HlsProxy{"pinned-test-": proxy},
+		playhead: func() float64 { return 1000 },
+	}
+
+	proxy.chunkPins[1].Add(1)
+	cache.add(200)
+
+	if proxy.fetchedChunks[0] || !proxy.fetchedChunks[1] {
+		t.Errorf("Only the unpinned chunk should be evicted, fetched chunks are %v", proxy.fetchedChunks)
+	}
+	if cache.size != 100 {
+		t.Errorf("Expected the cache to account the pinned chunk only, actual size %v", cache.size)
+	}
+}
+
+func TestLiveRefreshInterval(t *testing.T) {
+	m3u := &M3U{}
+	m3u.addPair(KeyValue{EXT_X_TARGETDURATION, "6"})
+
+	if interval := liveRefreshInterval(m3u, true); interval != 6*time.Second {
+		t.Errorf("Expected the target duration to be waited out after a change, actual %v", interval)
+	}
+
+	if interval := liveRefreshInterval(m3u, false); interval != 3*time.Second {
+		t.Errorf("Expected half of the target duration when the playlist did not change, actual %v", interval)
+	}
+
+	m3u.addPair(KeyValue{EXT_X_PART_INF, "PART-TARGET=0.2"})
+	if interval := liveRefreshInterval(m3u, true); interval != LIVE_MIN_REFRESH_INTERVAL {
+		t.Errorf("Expected part target to be clamped to the minimum interval, actual %v", interval)
+	}
+}
+
+func liveTestPlaylist(t *testing.T, sequence int) *M3U {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:" + toString(sequence) + "\n"
+	for i := range 3 {
+		playlist += "#EXTINF:4.0,\nsegment" + toString(sequence+i) + ".ts\n"
+	}
+
+	m3u, err := parseM3UFrom(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3u.url = "https://example.com/live/index.m3u8"
+	return m3u
+}
+
+func TestRewriteLivePlaylistSlidingWindow(t *testing.T) {
+	proxy := HlsProxy{}
+
+	newSegments := proxy.rewriteLivePlaylist(liveTestPlaylist(t, 10))
+	if !slices.Equal(newSegments, []string{"live-10", "live-11", "live-12"}) {
+		t.Errorf("Expected every segment of the first playlist to be new, actual %v", newSegments)
+	}
+
+	m3u := liveTestPlaylist(t, 11)
+	newSegments = proxy.rewriteLivePlaylist(m3u)
+	if !slices.Equal(newSegments, []string{"live-13"}) {
+		t.Errorf("Expected only the appended segment to be new, actual %v", newSegments)
+	}
+
+	if m3u.segments[0].url != "live-11" {
+		t.Errorf("Expected segments to be renamed after their media sequence, actual %v", m3u.segments[0].url)
+	}
+
+	maybeSegment, _ := proxy.liveSegments.Load("live-13")
+	if segment := maybeSegment.(*LiveSegment); segment.realUrl != "https://example.com/live/segment13.ts" {
+		t.Errorf("Expected segment to point at the origin, actual %v", segment.realUrl)
+	}
+
+	proxy.rewriteLivePlaylist(liveTestPlaylist(t, 15))
+	if _, found := proxy.liveSegments.Load("live-11"); found {
+		t.Errorf("Segments behind the sliding window should be evicted")
+	}
+	if _, found := proxy.liveSegments.Load("live-12"); !found {
+		t.Errorf("Segments which recently left the playlist should be kept for lagging clients")
+	}
+
+	proxy.rewriteLivePlaylist(liveTestPlaylist(t, 0))
+	if _, found := proxy.liveSegments.Load("live-15"); found {
+		t.Errorf("Segments numbered before a restart of the stream should be evicted")
+	}
+}
+
+func TestRewriteLivePlaylistMaps(t *testing.T) {
+	livePlaylist := func(sequence int) *M3U {
+		playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:" + toString(sequence) + "\n#EXT-X-MAP:URI=\"init.mp4\"\n"
+		for i := range 3 {
+			playlist += "#EXTINF:4.0,\nsegment" + toString(sequence+i) + ".m4s\n"
+		}
+
+		m3u, err := parseM3UFrom(strings.NewReader(playlist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m3u.url = "https://example.com/live/index.m3u8"
+		return m3u
+	}
+
+	proxy := HlsProxy{}
+	for sequence := 10; sequence < 20; sequence++ {
+		m3u := livePlaylist(sequence)
+		proxy.rewriteLivePlaylist(m3u)
+
+		// The same map keeps its name while the window slides, so that clients do not fetch it again.
+		if m3u.segments[0].mapUri != "mis-0" || m3u.segments[1].mapUri != "" || m3u.segments[2].mapUri != "" {
+			t.Fatalf("Expected only the first segment to list the map mis-0, actual %v", m3u.segments[0].mapUri)
+		}
+	}
+
+	if len(proxy.resources) != 1 {
+		t.Errorf("Expected the map to be registered once, actual %v", proxy.resources)
+	}
+}
+
+func TestDvrWindowExtend(t *testing.T) {
+	dvr := newDvrWindow(0.2)
+	if newDvrWindow(0) != nil {
+		t.Errorf("DVR window should be disabled without a length")
+	}
+
+	// The window of 12 seconds is filled by the 3 segments of 4 seconds listed by the playlist
+	dvr.extend(liveTestPlaylist(t, 10))
+	for sequence := 11; sequence <= 13; sequence++ {
+		m3u := liveTestPlaylist(t, sequence)
+		removed := dvr.extend(m3u)
+		if len(removed) != 1 || removed[0].url != "segment"+toString(sequence-1)+".ts" {
+			t.Errorf("Expected only the oldest segment to be removed, removed %v", removed)
+		}
+
+		if m3u.getAttribute(EXT_X_MEDIA_SEQUENCE) != toString(sequence) || len(m3u.segments) != 3 {
+			t.Errorf("Window kept beyond its length, sequence %v with %v segments", m3u.getAttribute(EXT_X_MEDIA_SEQUENCE), len(m3u.segments))
+		}
+	}
+
+	dvr = newDvrWindow(1)
+	dvr.extend(liveTestPlaylist(t, 10))
+	m3u := liveTestPlaylist(t, 12)
+	dvr.extend(m3u)
+	if m3u.getAttribute(EXT_X_MEDIA_SEQUENCE) != "10" || len(m3u.segments) != 5 {
+		t.Fatalf("Expected segments which left the playlist to be retained, sequence %v with %v segments", m3u.getAttribute(EXT_X_MEDIA_SEQUENCE), len(m3u.segments))
+	}
+
+	urls := make([]string, 0, len(m3u.segments))
+	for _, segment := range m3u.segments {
+		urls = append(urls, segment.url)
+	}
+	expected := []string{"segment10.ts", "segment11.ts", "segment12.ts", "segment13.ts", "segment14.ts"}
+	if !slices.Equal(urls, expected) {
+		t.Errorf("Expected segments %v, actual %v", expected, urls)
+	}
+
+	m3u = liveTestPlaylist(t, 40)
+	removed := dvr.extend(m3u)
+	if len(removed) != 5 || len(m3u.segments) != 3 {
+		t.Errorf("Expected the window to be cleared after a gap, removed %v, kept %v", len(removed), len(m3u.segments))
+	}
+}
+
+func TestLiveRecordingFinish(t *testing.T) {
+	recording := LiveRecording{}
+	if recording.finish() != nil {
+		t.Errorf("Recording without segments should not produce a playlist")
+	}
+
+	source := liveTestPlaylist(t, 10)
+	source.segments = nil
+	recording = LiveRecording{source: source}
+	for i, stored := range []bool{true, true, false, true, true} {
+		segment := Segment{url: "segment-" + toString(i), length: 4}
+		mapName := "init-0"
+		if i == 4 {
+			mapName = "init-1"
+		}
+		recording.segments = append(recording.segments, RecordedSegment{segment: segment, mapName: mapName, stored: stored})
+	}
+
+	m3u := recording.finish()
+	if !recording.stopped || m3u == nil || len(m3u.segments) != 4 {
+		t.Fatalf("Expected the 4 stored segments to be listed, got %v", m3u)
+	}
+
+	for i, expected := range []struct {
+		url           string
+		mapUri        string
+		discontinuity bool
+	}{
+		{"segment-0", "init-0", false},
+		{"segment-1", "", false},
+		{"segment-3", "", true},
+		{"segment-4", "init-1", false},
+	} {
+		segment := &m3u.segments[i]
+		if segment.url != expected.url || segment.mapUri != expected.mapUri || hasDiscontinuity(segment) != expected.discontinuity {
+			t.Errorf("Segment %v: expected %v, actual %v with map %v, discontinuity %v", i, expected, segment.url, segment.mapUri, hasDiscontinuity(segment))
+		}
+	}
+}
+
+func TestParseStreamFilename(t *testing.T) {
+	valid := map[string]int{"stream0.ts": 0, "stream17.m4s": 17, "stream003.aac": 3, STREAM_INIT: -1}
+	for filename, expected := range valid {
+		sequence, err := parseStreamFilename(filename)
+		if err != nil || sequence != expected {
+			t.Errorf("Expected %v to be segment %v, got %v (%v)", filename, expected, sequence, err)
+		}
+	}
+
+	for _, filename := range []string{"stream.ts", "stream-1.ts", "stream1.m3u8", "segment1.ts", "stream1a.ts", "stream+1.ts", STREAM_M3U8} {
+		if _, err := parseStreamFilename(filename); err == nil {
+			t.Errorf("Expected %v to be rejected", filename)
+		}
+	}
+}
+
+func TestLiveStreamPublish(t *testing.T) {
+	stream := newLiveStream(1, "stream", nil)
+	if !strings.Contains(string(stream.servedPlaylist()), "#EXT-X-TARGETDURATION:"+toString(STREAM_INITIAL_TARGET_DURATION)) {
+		t.Errorf("Expected an empty live playlist, got %s", stream.servedPlaylist())
+	}
+
+	if err := stream.checkSequence(0); err != nil {
+		t.Fatalf("First segment was rejected: %v", err)
+	}
+
+	// Segment 4 is missing, every segment lasts 2 seconds except the last one
+	for _, sequence := range []int{0, 1, 2, 3, 5, 6, 7, 8} {
+		duration := 2.0
+		if sequence == 8 {
+			duration = 4.5
+		}
+		stream.lastUploaded = sequence
+		stream.publish(sequence, "stream"+toString(sequence)+".ts", duration)
+	}
+	m3u := stream.updatePlaylist()
+
+	if err := stream.checkSequence(8); err == nil {
+		t.Errorf("Expected a segment uploaded out of order to be rejected")
+	}
+
+	if len(m3u.segments) != STREAM_WINDOW_SEGMENTS || m3u.getAttribute(EXT_X_MEDIA_SEQUENCE) != "2" {
+		t.Fatalf("Expected the window to slide to media sequence 2, got %v with %v segments", m3u.getAttribute(EXT_X_MEDIA_SEQUENCE), len(m3u.segments))
+	}
+
+	if m3u.segments[0].url != "stream2.ts" || !hasDiscontinuity(&m3u.segments[2]) || hasDiscontinuity(&m3u.segments[3]) {
+		t.Errorf("Expected a discontinuity only before segment 5")
+	}
+
+	if m3u.getAttribute(EXT_X_TARGETDURATION) != "5" {
+		t.Errorf("Expected the target duration to be rounded up to 5, got %v", m3u.getAttribute(EXT_X_TARGETDURATION))
+	}
+
+	for sequence := 9; sequence <= 12; sequence++ {
+		stream.publish(sequence, "stream"+toString(sequence)+".ts", 2)
+	}
+	m3u = stream.updatePlaylist()
+	if m3u.getAttribute(EXT_X_DISCONTINUITY_SEQUENCE) != "1" {
+		t.Errorf("Expected the discontinuity sequence to advance once the discontinuity left the window")
+	}
+
+	stream.collectGarbage()
+	if _, kept := stream.files[2]; kept || len(stream.files) != STREAM_WINDOW_SEGMENTS+LIVE_SEGMENTS_BEHIND {
+		t.Errorf("Expected segments behind media sequence %v to be collected, kept %v", 6-LIVE_SEGMENTS_BEHIND, stream.files)
+	}
+
+	stats := stream.stats()
+	if stats.Duration != 26.5 {
+		t.Errorf("Expected 26.5 seconds to be published, got %v", stats.Duration)
+	}
+}
+
+func makeTsPacket(pid int, payloadStart bool, randomAccess bool, payload []byte) []byte {
+	packet := []byte{TS_SYNC_BYTE, byte(pid>>8) & 0x1F, byte(pid), 0x30}
+	if payloadStart {
+		packet[1] |= 0x40
+	}
+
+	// The adaptation field pads the packet.
+	adaptation := make([]byte, TS_PACKET_SIZE-5-len(payload))
+	for i := range adaptation {
+		adaptation[i] = 0xFF
+	}
+	adaptation[0] = 0x00
+	if randomAccess {
+		adaptation[0] = 0x40
+	}
+
+	packet = append(packet, byte(len(adaptation)))
+	packet = append(packet, adaptation...)
+	return append(packet, payload...)
+}
+
+func makePesHeader(streamId byte, timestamp int64) []byte {
+	return []byte{
+		0x00, 0x00, 0x01, streamId, 0x00, 0x00, 0x80, 0x80, 0x05,
+		0x21 | byte(timestamp>>29)&0x0E,
+		byte(timestamp >> 22),
+		byte(timestamp>>14) | 0x01,
+		byte(timestamp >> 7),
+		byte(timestamp<<1) | 0x01,
+	}
+}
+
+func TestTsSegmenter(t *testing.T) {
+	const pmtPid, videoPid, audioPid = 0x1000, 0x100, 0x101
+
+	patSection := []byte{0x00, 0x00, 0xB0, 13, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xE0 | pmtPid>>8, pmtPid & 0xFF, 0, 0, 0, 0}
+	pmtSection := []byte{
+		0x00, 0x02, 0xB0, 23, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00,
+		0x0F, 0xE0 | audioPid>>8, audioPid & 0xFF, 0xF0, 0x00,
+		0x1B, 0xE0 | videoPid>>8, videoPid & 0xFF, 0xF0, 0x00,
+		0, 0, 0, 0,
+	}
+	pat := makeTsPacket(TS_PAT_PID, true, false, patSection)
+
+	// Misaligned bytes and a frame preceding the program tables are skipped.
+	var stream bytes.Buffer
+	stream.Write([]byte{0x00, 0x47, 0x12})
+	stream.Write(makeTsPacket(videoPid, true, true, makePesHeader(0xE0, 0)))
+
+	// Timestamps wrap around 2 seconds in, then jump 100 seconds ahead after 10 seconds. Keyframes are 2 seconds apart.
+	start := TS_TIMESTAMP_WRAP - 2*90000
+	for frame := 0; frame < 360; frame++ {
+		timestamp := (start + int64(frame)*3000) % TS_TIMESTAMP_WRAP
+		if frame >= 300 {
+			timestamp += 100 * 90000
+		}
+
+		if frame%60 == 0 {
+			stream.Write(pat)
+			stream.Write(makeTsPacket(pmtPid, true, false, pmtSection))
+		}
+		stream.Write(makeTsPacket(videoPid, true, frame%60 == 0, makePesHeader(0xE0, timestamp)))
+		stream.Write(makeTsPacket(videoPid, false, false, []byte{0x01, 0x02, 0x03}))
+		stream.Write(makeTsPacket(audioPid, true, false, makePesHeader(0xC0, timestamp)))
+	}
+
+	type published struct {
+		sequence int
+		duration float64
+	}
+	segments := make([]published, 0)
+	segmenter := newTsSegmenter(4, func(data []byte, sequence int, duration float64) error {
+		if len(data)%TS_PACKET_SIZE != 0 || !bytes.Equal(data[:TS_PACKET_SIZE], pat) {
+			t.Errorf("Segment %v does not begin with the program tables", sequence)
+		}
+		segments = append(segments, published{sequence, duration})
+		return nil
+	})
+
+	if err := segmenter.segmentFrom(&stream); err != nil {
+		t.Fatalf("Segmenting failed: %v", err)
+	}
+
+	expected := []published{{0, 4}, {1, 4}, {2, 2}, {4, 2}}
+	if !slices.Equal(segments, expected) {
+		t.Errorf("Expected segments %v, got %v", expected, segments)
+	}
+}
+
+func TestVodProxyRotatingKeys(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:4.0,
+segment0.m4s
+#EXTINF:4.0,
+segment1.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin",IV=0x01
+#EXTINF:4.0,
+segment2.m4s
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@0"
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:4.0,
+segment3.m4s
+#EXT-X-ENDLIST
+`
+	m3u, err := parseM3UFrom(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3u.url = "https://example.com/vod/index.m3u8"
+	m3u.prefixRelativeSegments()
+
+	proxy := setupVodProxy(m3u, t.TempDir()+"/"+PROXY_M3U8, "", VIDEO_PREFIX)
+
+	expected := []struct{ mapUri, keyUri string }{
+		{"vi-mis-0", "vi-key-1"},
+		{"", ""},
+		{"", "vi-key-2"},
+		{"vi-mis-3", "vi-key-1"},
+	}
+	for i, segment := range m3u.segments {
+		keyUri := ""
+		if segment.hasKey {
+			keyUri = segment.key.uri
+		}
+		if segment.mapUri != expected[i].mapUri || keyUri != expected[i].keyUri || segment.mapRange != nil {
+			t.Errorf("Segment %v: expected %v, actual map %v and key %v", i, expected[i], segment.mapUri, keyUri)
+		}
+	}
+
+	resource := proxy.resources["vi-key-2"]
+	if resource == nil || resource.uri != "https://example.com/vod/key2.bin" {
+		t.Errorf("Expected the second key to point at the origin, actual %v", resource)
+	}
+
+	resource = proxy.resources["vi-mis-3"]
+	if resource == nil || resource.byteRange == nil || resource.byteRange.end != 99 {
+		t.Errorf("Expected the map sub-range to be proxied separately, actual %v", resource)
+	}
+
+	if available, _ := proxy.fetchResource(context.Background(), "vi-key-9"); available {
+		t.Errorf("Unregistered resources should not be available")
+	}
+}
+
+func TestLiveProxyRotatingKeys(t *testing.T) {
+	livePlaylist := func(sequence int) *M3U {
+		playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:" + toString(sequence) + "\n"
+		for i := range 3 {
+			if i == 0 || (sequence+i)%4 == 0 {
+				playlist += "#EXT-X-KEY:METHOD=AES-128,URI=\"key" + toString((sequence+i)/4) + ".bin\"\n"
+			}
+			playlist += "#EXTINF:4.0,\nsegment" + toString(sequence+i) + ".ts\n"
+		}
+
+		m3u, err := parseM3UFrom(strings.NewReader(playlist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m3u.url = "https://example.com/live/index.m3u8"
+		return m3u
+	}
+
+	proxy := HlsProxy{dvr: newDvrWindow(1)}
+	proxy.rewriteLivePlaylist(livePlaylist(2))
+	m3u := livePlaylist(5)
+	proxy.rewriteLivePlaylist(m3u)
+
+	// Segments 2 to 7, the retained segment 2 lists the first key since the segment listing it left the playlist.
+	keys := make([]string, 0)
+	for _, segment := range m3u.segments {
+		if segment.hasKey {
+			keys = append(keys, segment.url+"="+segment.key.uri)
+		}
+	}
+
+	expected := []string{"live-2=key-0", "live-4=key-1"}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("Expected keys %v, actual %v", expected, keys)
+	}
+
+	if resource := proxy.resources["key-1"]; resource == nil || resource.uri != "https://example.com/live/key1.bin" {
+		t.Errorf("Expected the rotated key to point at the origin, actual %v", resource)
+	}
+
+	// Keys used only by evicted segments are evicted with them, and new keys get names which were never served before.
+	proxy = HlsProxy{}
+	proxy.rewriteLivePlaylist(livePlaylist(2))
+	m3u = livePlaylist(20)
+	proxy.rewriteLivePlaylist(m3u)
+
+	if len(proxy.resources) != 1 || len(proxy.resourceNames) != 1 || proxy.resources["key-2"] == nil {
+		t.Errorf("Expected only the key of the current segments to be kept, actual %v", proxy.resources)
+	}
+}
+
+func TestFileProxyClaimRange(t *testing.T) {
+	proxy := FileProxy{
+		contentLength: 100 * MB,
+		diskRanges:    []Range{*newRange(0, MB-1), *newRange(3*MB, 4*MB-1)},
+		downloader:    newGenericDownloader(4),
+	}
+	downloader := proxy.downloader
+	downloader.offset = 512 * KB
+
+	expected := []Range{*newRange(MB, 3*MB-1), *newRange(4*MB, 6*MB-1), *newRange(6*MB, 8*MB-1)}
+	for _, expectedClaim := range expected {
+		claim, claimed := proxy.claimRange()
+		if !claimed || claim != expectedClaim {
+			t.Errorf("Expected claim %v, actual %v", expectedClaim.StringMB(), claim.StringMB())
+		}
+	}
+
+	// Nothing is claimed past the preload limit.
+	downloader.offset = 90 * MB
+	downloader.claimed = []Range{*newRange(90*MB, 100*MB-1)}
+	if claim, claimed := proxy.claimRange(); claimed {
+		t.Errorf("Expected nothing to be claimed, actual %v", claim.StringMB())
+	}
+
+	downloader.offset = 50 * MB
+	downloader.claimed = []Range{*newRange(50*MB, 70*MB-3)}
+	claim, claimed := proxy.claimRange()
+	if !claimed || claim != *newRange(70*MB-2, 70*MB-1) {
+		t.Errorf("Expected the claim to end at the preload limit, actual %v", claim.StringMB())
+	}
+}
+
+func TestFileProxyAllowedWorkers(t *testing.T) {
+	downloader := newGenericDownloader(4)
+	if allowed := downloader.allowedWorkers(MB); allowed != 4 {
+		t.Errorf("Every worker should be allowed before the speed is measured, actual %v", allowed)
+	}
+
+	// Each of the 2 workers downloads at 1MB/s, 3MB/s are needed to stay ahead of playback.
+	downloader.speedMBps = 2
+	downloader.claimed = []Range{{0, MB - 1}, {MB, 2*MB - 1}}
+	if allowed := downloader.allowedWorkers(MB); allowed != 3 {
+		t.Errorf("Expected 3 workers to be allowed, actual %v", allowed)
+	}
+
+	downloader.speedMBps = 100
+	if allowed := downloader.allowedWorkers(MB); allowed != 1 {
+		t.Errorf("Expected a single worker on a fast origin, actual %v", allowed)
+	}
+}
@@ -34,6 +34,7 @@ export const EVENT_PLAYLIST_CLEAR   = id++;
 export const EVENT_PLAYLIST_DELETE  = id++;
 export const EVENT_PLAYLIST_UPDATE  = id++;
 export const EVENT_PLAYLIST_SHUFFLE = id++;
+export const EVENT_PLAYLIST_UNDO    = id++;
 
 export const ENTRY_SOURCE_NONE     = 0
 export const ENTRY_SOURCE_YOUTUBE  = 1
@@ -65,6 +66,7 @@ function getEventName(type) {
         case EVENT_PLAYLIST_DELETE:  return "playlist delete";
         case EVENT_PLAYLIST_UPDATE:  return "playlist update";
         case EVENT_PLAYLIST_SHUFFLE: return "playlist shuffle";
+        case EVENT_PLAYLIST_UNDO:    return "playlist undo";
 
         default: return "<unknown type:" + type + ">";
     }
@@ -191,6 +193,34 @@ async function httpPostFileWithProgress(endpoint, file, onprogress) {
     });
 }
 
+// Sends a raw chunk of a resumable upload starting at the given offset.
+async function httpPostChunk(endpoint, chunk, offset) {
+    endpoint = API_PATH + endpoint;
+
+    const headers = new Headers();
+    headers.set("Content-Type", "application/offset+octet-stream");
+    headers.set("Upload-Offset", offset);
+    headers.set("Authorization", token);
+
+    const options = {
+        method:  "POST",
+        body:    chunk,
+        headers: headers,
+    };
+
+    try {
+        const response = await fetch(endpoint, options);
+        if (!response.ok) {
+            let errorText = await response.text();
+            return JsonResponse.fromPostError(response.status, errorText, endpoint);
+        }
+
+        return JsonResponse.fromPost(response.status, await response.json(), endpoint);
+    } catch (error) {
+        return JsonResponse.fromPostException(error, endpoint);
+    }
+}
+
 // It sends a JSON body and receives a JSON body, on error receives error as text (http.Error in go)
 // Unfortunately there does not seem to be an option to disable the ugly response status console log
 async function httpPost(endpoint, data) {
@@ -286,6 +316,55 @@ export async function uploadMediaWithProgress(file, onprogress) {
     return await httpPostFileWithProgress("uploadmedia", file, onprogress);
 }
 
+const MAX_UPLOAD_RETRIES = 5;
+
+// Uploads a file in chunks. On a failed chunk the current offset is queried from the server and the upload resumes from there.
+export async function uploadMediaResumable(file, onprogress) {
+    let init = await httpPost("upload/init", { filename: file.name, size: file.size });
+    if (init.checkError()) {
+        return init;
+    }
+
+    let uploadId  = init.json.upload_id;
+    let chunkSize = init.json.max_chunk_size;
+    let offset    = 0;
+    let retries   = 0;
+
+    while (offset < file.size) {
+        let chunk = file.slice(offset, offset + chunkSize);
+        let response = await httpPostChunk("upload/chunk/" + uploadId, chunk, offset);
+
+        if (response.ok) {
+            offset  = response.json.offset;
+            retries = 0;
+            if (onprogress) {
+                onprogress({ loaded: offset, total: file.size });
+            }
+            continue;
+        }
+
+        retries += 1;
+        if (retries > MAX_UPLOAD_RETRIES) {
+            response.logError();
+            return response;
+        }
+
+        let status = await httpGet("upload/offset/" + uploadId);
+        if (!status) {
+            await new Promise(resolve => setTimeout(resolve, 1000 * retries));
+            continue;
+        }
+
+        offset = status.offset;
+    }
+
+    return await httpPost("upload/finalize/" + uploadId, null);
+}
+
+export async function uploadAbort(uploadId) {
+    return await httpPost("upload/abort/" + uploadId, null);
+}
+
 export async function inviteCreate() {
     return await httpGet("invite/create");
 }
@@ -373,6 +452,10 @@ export async function playerLooping(state) {
     return await httpPost("player/looping", state);
 }
 
+export async function playerRecord(state) {
+    return await httpPost("player/record", state);
+}
+
 export async function playerUpdateTitle(title) {
     return await httpPost("player/updatetitle", title);
 }
@@ -462,6 +545,76 @@ export async function playlistUpdate(entry) {
     return await httpPost("playlist/update", entry);
 }
 
+export async function playlistUndo() {
+    return await httpPost("playlist/undo", null);
+}
+
+export async function mediaList(type, offset, count) {
+    const payload = {
+        type:   type,
+        offset: offset,
+        count:  count,
+    };
+
+    return await httpPost("media/list", payload);
+}
+
+export async function mediaDelete(path) {
+    return await httpPost("media/delete", { path: path });
+}
+
+export async function mediaRename(path, newName) {
+    const payload = {
+        path:     path,
+        new_name: newName,
+    };
+
+    return await httpPost("media/rename", payload);
+}
+
+export async function libraryList(type, offset, count) {
+    const payload = {
+        type:   type,
+        offset: offset,
+        count:  count,
+    };
+
+    return await httpPost("library/list", payload);
+}
+
+export async function librarySearch(query, type, offset, count) {
+    const payload = {
+        query:  query,
+        type:   type,
+        offset: offset,
+        count:  count,
+    };
+
+    return await httpPost("library/search", payload);
+}
+
+export async function libraryRescan() {
+    return await httpPost("library/rescan", null);
+}
+
+export async function scheduleList() {
+    return await httpGet("schedule/list");
+}
+
+export async function scheduleAdd(startAt, entry, playlist) {
+    const payload = {
+        start_at: startAt,
+        entry:    entry,
+        playlist: playlist,
+    };
+
+    return await httpPost("schedule/add", payload);
+}
+
+export async function scheduleCancel(scheduleId) {
+    return await httpPost("schedule/cancel", scheduleId);
+}
+
 export async function historyGet() {
     return await httpGet("history/get");
 }
@@ -508,6 +661,18 @@ export async function chatDelete(messageId) {
     return await httpPost("/chat/delete", messageId);
 }
 
+export async function streamKeyGet() {
+    return await httpGet("stream/key/get");
+}
+
+export async function streamKeyReset() {
+    return await httpPost("stream/key/reset");
+}
+
+export function streamPushUrl(key) {
+    return window.location.origin + API_PATH + "stream/push/" + key;
+}
+
 export function getWebSocket() {
     return websocket;
 }
@@ -638,6 +803,10 @@ export function wsPlaylistPlay(entryId) {
     wsSendEvent(EVENT_PLAYLIST_PLAY, entryId);
 }
 
+export function wsPlaylistUndo() {
+    wsSendEvent(EVENT_PLAYLIST_UNDO, null);
+}
+
 export function wsPlaylistShuffle() {
     wsSendEvent(EVENT_PLAYLIST_SHUFFLE, null);
 }
@@ -331,7 +331,7 @@ class Chat {
     createMessage(message, user) {
         let root      = div("chat_message");
         let avatar    = div("chat_message_avatar");
-        let avatarImg = img(user.avatar);
+        let avatarImg = img(common.smallAvatar(user.avatar));
         let right     = div("chat_message_right");
         let info      = div("chat_message_info");
         let username  = div("chat_message_username");
@@ -4,6 +4,11 @@ import * as api from "./api.js";
 const DROPDOWN_EXPAND_TIME = getCssNumber("--dropdown_expand_time", "ms")
 const DOMAIN_URL = window.location.protocol + "//" + window.location.host;
 
+// Uploaded avatars are stored in a large and a small size, other avatars are returned unchanged.
+export function smallAvatar(avatarUrl) {
+    return avatarUrl.replace(/_256\.(png|gif|webp)$/, "_64.$1");
+}
+
 export function toggleEntryDropdown(self, htmlEntry, entry, user) {
     if (self.expandedEntry !== htmlEntry) {
         expandEntry(self, htmlEntry, entry, user);
@@ -80,7 +85,7 @@ export function createEntryDropdown(entry, user) {
 
     let createdAt      = new Date(entry.created_at);
     let lastSetAt      = new Date(entry.last_set_at);
-    let userAvatarImg  = img(user.avatar);
+    let userAvatarImg  = img(smallAvatar(user.avatar));
 
     let infoContentTop = div("entry_dropdown_info_content");
     let userAvatar     = div("entry_dropdown_user_avatar");
@@ -100,6 +100,16 @@ class Player {
         return this.internals.getResolution();
     }
 
+    // Returns HLS renditions as objects with height and bitrate fields, ordered as hls.js levels.
+    getQualityLevels() {
+        return this.internals.getQualityLevels();
+    }
+
+    // Selects HLS rendition at the given index, -1 enables automatic quality selection.
+    setQualityLevel(index) {
+        this.internals.setQualityLevel(index);
+    }
+
     setSubtitle(url, name, shift = 0.0) {
         let info = FileInfo.fromUrl(url);
         if (name) {
@@ -907,6 +917,53 @@ class Internals {
         }
     }
 
+    getQualityLevels() {
+        if (!this.playingHls) {
+            return [];
+        }
+
+        return this.hls.levels.map(level => ({ height: level.height, bitrate: level.bitrate }));
+    }
+
+    setQualityLevel(index) {
+        if (!this.playingHls) {
+            return;
+        }
+
+        this.hls.currentLevel = index;
+    }
+
+    // Lists HLS renditions in the quality picker of the settings menu, which is only shown when there is a choice.
+    updateQualityPicker() {
+        let levels = this.getQualityLevels();
+        let select = this.htmlQualitySelect;
+        select.replaceChildren();
+
+        if (levels.length <= 1) {
+            hide(this.htmlQualityRoot);
+            return;
+        }
+
+        let auto = newElement("option");
+        auto.value = -1;
+        auto.textContent = "Auto";
+        select.append(auto);
+
+        for (let i = 0; i < levels.length; i++) {
+            let level  = levels[i];
+            let option = newElement("option");
+            option.value = i;
+            option.textContent = level.height ? level.height + "p" : "Level " + (i + 1);
+            if (level.bitrate) {
+                option.textContent += " (" + (level.bitrate / 1000000).toFixed(1) + " Mbps)";
+            }
+            select.append(option);
+        }
+
+        select.value = this.hls.autoLevelEnabled ? -1 : this.hls.currentLevel;
+        show(this.htmlQualityRoot);
+    }
+
     setVolume(volume) {
         if (volume < 0.0) {
             volume = 0.0;
@@ -1118,6 +1175,7 @@ class Internals {
                 this.hls.detachMedia();
                 this.playingHls = false;
                 this.isLive = false;
+                this.updateQualityPicker();
             }
             mediaElement.src = url;
             await mediaElement.load();
@@ -1147,6 +1205,8 @@ class Internals {
                 if (this.isLive) {
                     show(this.htmlControls.buttons.liveIndicator);
                 }
+
+                this.updateQualityPicker();
             });
         }
 
@@ -1162,6 +1222,7 @@ class Internals {
             this.hls.stopLoad();
             this.playingHls = false;
             this.isLive = false;
+            this.updateQualityPicker();
         }
 
         if (this.hasAudioTrack) {
@@ -2328,8 +2389,15 @@ class Internals {
         let fitToScreen     = this.fitToScreen;
         let stretchToScreen = this.stretchToScreen;
         let disableVideo    = new Switcher("Disable video");
+        let qualityRoot     = newDiv(null, "player_toggle_root");
+        let qualityText     = newDiv(null, "player_toggle_text");
+        let qualitySelect   = newElement("select", null, "player_quality_select");
+
+        this.htmlQualityRoot   = qualityRoot;
+        this.htmlQualitySelect = qualitySelect;
 
         hide(menuRoot);
+        hide(qualityRoot);
         hide(generalView);
         hide(appearanceView)
 
@@ -2353,6 +2421,7 @@ class Internals {
 
         generalTab.textContent    = "General";
         appearanceTab.textContent = "Appearance";
+        qualityText.textContent   = "Quality";
 
         menuRoot.onclick = stopPropagation;
 
@@ -2400,6 +2469,8 @@ class Internals {
             this.fireSettingsChange(Options.SHOW_CONTROLS_ON_PAUSE, state);
         };
 
+        qualitySelect.onchange = _ => this.setQualityLevel(Number(qualitySelect.value));
+
         playbackSpeed.onInput = value => {
             this.setSpeed(value);
             this.fireSettingsChange(Options.PLAYBACK_SPEED, value);
@@ -2474,6 +2545,10 @@ class Internals {
         menuRoot.append(menuSeparator);
         menuRoot.append(menuViews); {
             menuViews.append(generalView); {
+                generalView.append(qualityRoot); {
+                    qualityRoot.append(qualityText);
+                    qualityRoot.append(qualitySelect);
+                }
                 generalView.append(playbackSpeed.root);
                 generalView.append(crossOrigin.root);
                 generalView.append(preservePitch.root);
@@ -111,6 +111,9 @@ class Room {
             tokenSetButton:  getById("settings_token_set_button"),
             tokenSetInput:   getById("settings_token_set_input"),
 
+            streamKeyCopyButton:  getById("settings_stream_key_copy_button"),
+            streamKeyResetButton: getById("settings_stream_key_reset_button"),
+
             animatedAvatarsToggle:   getById("animated_avatars_toggle"),
             newMessageSoundToggle:   getById("new_message_sound_toggle"),
             theaterModeToggle:       getById("theater_mode_toggle"),
@@ -189,6 +192,8 @@ class Room {
             copyEntryButton:    getById("room_copy_entry_button"),
             openSettingsButton: getById("room_open_settings_button"),
             fetchLyricsButton:  getById("room_fetch_lyrics_button"),
+            recordButton:       getById("room_record_button"),
+            recordLabel:        getById("room_record_label"),
 
             titleInput:         getById("room_entry_title_input"),
             titleUpdateButton:  getById("room_title_update_button"),
@@ -244,6 +249,9 @@ class Room {
 
         this.roomSelectedSubId = -1;
 
+        // Whether the live stream of the current entry is being recorded on the server.
+        this.isRecording = false;
+
         // Self user id. Server User structure.
         this.currentUserId = -1;
 
@@ -1047,6 +1055,7 @@ class Room {
 
         room.openSettingsButton.onclick = _ => this.showSettingsMenu();
         room.fetchLyricsButton.onclick  = _ => api.subtitleFetch();
+        room.recordButton.onclick       = _ => api.playerRecord(!this.isRecording);
     }
 
     attachRightPanelEvents() {
@@ -1205,6 +1214,29 @@ class Room {
             await this.setNewToken();
         };
 
+        menu.streamKeyCopyButton.onclick = async _ => {
+            let streamKey = await api.streamKeyGet();
+            if (!streamKey) {
+                return;
+            }
+
+            let url = api.streamPushUrl(streamKey.key);
+            if (navigator.clipboard) {
+                await navigator.clipboard.writeText(url);
+            } else {
+                menu.tokenSetInput.value = url;
+            }
+        };
+
+        menu.streamKeyResetButton.onclick = async _ => {
+            let response = await api.streamKeyReset();
+            if (response.checkError()) {
+                return;
+            }
+
+            this.player.setToast("Stream key was reset, copy the new stream URL.");
+        };
+
         menu.animatedAvatarsToggle.onclick = _ => {
             this.pageRoot.classList.toggle("disable_image_animations");
             let isToggled = menu.animatedAvatarsToggle.classList.toggle("active");
@@ -1448,6 +1480,11 @@ class Room {
         window.location.href = "/";
     }
 
+    setRecording(recording) {
+        this.isRecording = recording;
+        this.roomContent.recordLabel.textContent = recording ? "Stop recording" : "Record";
+    }
+
     async loadPlayerData(state) {
         if (!state) {
             return;
@@ -1455,6 +1492,7 @@ class Room {
 
         this.playlist.setAutoplay(state.player.autoplay);
         this.playlist.setLooping(state.player.looping);
+        this.setRecording(state.recording);
 
         this.setNewEntry(state.entry);
         if (state.entry.url) {
@@ -2062,6 +2100,22 @@ class Room {
                 this.playlist.setLooping(looping)
             } break;
 
+            case "streamstart": {
+                let stream = wsData;
+                this.player.setToast(stream.title + " has started");
+            } break;
+
+            case "streamstop": {
+                let stream = wsData;
+                this.player.setToast(stream.title + " has ended");
+            } break;
+
+            case "playerrecord": {
+                let recording = wsData;
+                this.setRecording(recording);
+                this.player.setToast(recording ? "Recording of the live stream started" : "Recording of the live stream stopped");
+            } break;
+
             case "playerautoplay": {
                 let autoplay = wsData;
                 this.playlist.setAutoplay(autoplay);
@@ -2076,6 +2130,12 @@ class Room {
                 this.addRecentAction(wsUserId, "updated current title.");
             } break;
 
+            case "playerthumbnail": {
+                let thumbnail = wsData;
+                this.currentEntry.thumbnail = thumbnail;
+                this.player.setPoster(thumbnail);
+            } break;
+
             case "playerwaiting": {
                 let message = wsData;
                 console.info("INFO: Received player waiting event: ", message);
@@ -2178,11 +2238,57 @@ class Room {
                 this.chat.delete(messageId, this.allUsers);
             } break;
 
+            case "mediadelete": {
+                let event = wsData;
+                console.info("INFO: Received media delete event: ", event);
+                if (event.entry_ids.length > 0) {
+                    console.warn("WARN: Deleted media file", event.path, "is still used by entries:", event.entry_ids);
+                }
+            } break;
+
+            case "mediarename": {
+                let event = wsData;
+                console.info("INFO: Received media rename event: ", event);
+            } break;
+
+            case "libraryupdate": {
+                let total = wsData;
+                console.info("INFO: Received library update event, indexed files: ", total);
+            } break;
+
+            case "scheduleadd": {
+                let schedule = wsData;
+                console.info("INFO: Received schedule add event: ", schedule);
+            } break;
+
+            case "scheduledelete": {
+                let scheduleId = wsData;
+                console.info("INFO: Received schedule delete event: ", scheduleId);
+            } break;
+
+            case "schedulecountdown": {
+                let countdown = wsData;
+                let title = countdown.title ? countdown.title : "Scheduled entry";
+                this.player.setToast(title + " starts in " + countdown.seconds_left + "s");
+            } break;
+
+            case "schedulestart": {
+                let schedule = wsData;
+                console.info("INFO: Received schedule start event: ", schedule);
+            } break;
+
             case "historyclear": {
                 console.info("INFO: Received history clear event");
                 this.history.clear();
             } break;
 
+            case "historyrestore": {
+                let entries = wsData;
+                console.info("INFO: Received history restore event: ", entries);
+                this.history.clear();
+                this.history.load(entries, this.allUsers);
+            } break;
+
             case "historyadd": {
                 let entry = wsData;
                 console.info("INFO: Received history add event: ", entry);
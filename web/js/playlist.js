@@ -25,6 +25,7 @@ class Playlist {
         this.controlsLoopingButton  = getById("playlist_controls_looping");
         this.controlsShuffleButton  = getById("playlist_controls_shuffle");
         this.controlsClearButton    = getById("playlist_controls_clear");
+        this.controlsUndoButton     = getById("playlist_controls_undo");
         this.controlsSettingsButton = getById("playlist_controls_settings");
 
         this.autoplayEnabled = false;
@@ -121,6 +122,7 @@ class Playlist {
 
         this.controlsShuffleButton.onclick  = _ => api.wsPlaylistShuffle();
         this.controlsClearButton.onclick    = _ => api.wsPlaylistClear();
+        this.controlsUndoButton.onclick     = _ => api.wsPlaylistUndo();
         this.controlsSettingsButton.onclick = _ => this.onSettingsClick();
 
         document.addEventListener("click", _ => this.hideContextMenu());
@@ -980,7 +982,8 @@ class Playlist {
                 this.delete(data)
             } break;
 
-            case "shuffle": {
+            case "shuffle":
+            case "restore": {
                 this.clear();
                 this.loadEntries(data, users);
             } break;